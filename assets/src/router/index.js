@@ -143,6 +143,14 @@ router.beforeEach((to, from, next) => {
           }
         }
 
+        // The users who must change their password or enroll a second
+        // factor can't go anywhere else before.
+        let user = store.state.user
+        if ((user.mustChangePassword || user.needsEnrollment) && to.path !== '/settings/profile') {
+          next({ path: '/settings/profile' })
+          return
+        }
+
         next()
       })
       .catch(e => {
@@ -18,9 +18,11 @@ const state = {
     return css
   })(),
   recaptcha: document.querySelector('meta[name="recaptcha"]').getAttribute('content'),
+  captcha: document.querySelector('meta[name="captcha"]').getAttribute('content'),
   staticGen: document.querySelector('meta[name="staticgen"]').getAttribute('content'),
   baseURL: document.querySelector('meta[name="base"]').getAttribute('content'),
   noAuth: (document.querySelector('meta[name="noauth"]').getAttribute('content') === 'true'),
+  oidc: (document.querySelector('meta[name="oidc"]').getAttribute('content') === 'true'),
   version: document.querySelector('meta[name="version"]').getAttribute('content'),
   jwt: '',
   progress: 0,
@@ -187,11 +187,14 @@ export function command (url, command, onmessage, onclose) {
   conn.onclose = onclose
 }
 
-export function search (url, search, onmessage, onclose) {
+export function search (url, search, content, onmessage, onclose) {
   let protocol = (ssl ? 'wss:' : 'ws:')
   url = removePrefix(url)
   url = `${protocol}//${window.location.host}${store.state.baseURL}/api/search${url}`
 
+  // The searches inside the files use the full-text index.
+  if (content) url += '?content=true'
+
   let conn = new window.WebSocket(url)
   conn.onopen = () => conn.send(search)
   conn.onmessage = onmessage
@@ -222,6 +225,12 @@ export function download (format, ...files) {
   window.open(url)
 }
 
+// thumbnail returns the URL of the thumbnail of an image or a video, in
+// one of the sizes of the server: small, medium or large.
+export function thumbnail (url, size) {
+  return `${store.state.baseURL}/api/thumbnail${removePrefix(url)}?size=${size}`
+}
+
 export function getSettings () {
   return new Promise((resolve, reject) => {
     let request = new window.XMLHttpRequest()
@@ -366,6 +375,33 @@ export function updateUser (user, which) {
   })
 }
 
+// changePassword changes the password of the current user and returns
+// the new token of its session.
+export function changePassword (password) {
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open('PUT', `${store.state.baseURL}/api/users/${store.state.user.ID}`, true)
+    if (!store.state.noAuth) request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      switch (request.status) {
+        case 200:
+          resolve(request.responseText)
+          break
+        default:
+          reject(request.responseText)
+          break
+      }
+    }
+    request.onerror = (error) => reject(error)
+    request.send(JSON.stringify({
+      what: 'user',
+      which: 'password',
+      data: {ID: store.state.user.ID, password: password}
+    }))
+  })
+}
+
 export function deleteUser (id) {
   return new Promise((resolve, reject) => {
     let request = new window.XMLHttpRequest()
@@ -429,7 +465,7 @@ export function deleteShare (hash) {
   })
 }
 
-export function share (url, expires = '', unit = 'hours') {
+export function share (url, expires = '', unit = 'hours', options = null) {
   url = removePrefix(url)
   url = `${store.state.baseURL}/api/share${url}`
   if (expires !== '') {
@@ -445,7 +481,89 @@ export function share (url, expires = '', unit = 'hours') {
       if (request.status === 200) {
         resolve(JSON.parse(request.responseText))
       } else {
-        reject(request.responseStatus)
+        reject(request.responseText)
+      }
+    }
+
+    request.onerror = (error) => reject(error)
+    request.send(options ? JSON.stringify(options) : null)
+  })
+}
+
+export function getShares () {
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open('GET', `${store.state.baseURL}/api/shares/`, true)
+    if (!store.state.noAuth) request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      switch (request.status) {
+        case 200:
+          resolve(JSON.parse(request.responseText))
+          break
+        default:
+          reject(request.responseText)
+          break
+      }
+    }
+    request.onerror = (error) => reject(error)
+    request.send()
+  })
+}
+
+// GRANTS
+
+export function getGrants (received = false) {
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open('GET', `${store.state.baseURL}/api/grants/${received ? '?received' : ''}`, true)
+    if (!store.state.noAuth) request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      if (request.status === 200) {
+        resolve(JSON.parse(request.responseText))
+      } else {
+        reject(request.status)
+      }
+    }
+
+    request.onerror = (error) => reject(error)
+    request.send()
+  })
+}
+
+export function grant (url, options) {
+  url = removePrefix(url)
+
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open('POST', `${store.state.baseURL}/api/grants${url}`, true)
+    if (!store.state.noAuth) request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      if (request.status === 200) {
+        resolve(JSON.parse(request.responseText))
+      } else {
+        reject(request.responseText)
+      }
+    }
+
+    request.onerror = (error) => reject(error)
+    request.send(JSON.stringify(options))
+  })
+}
+
+export function revokeGrant (id) {
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open('DELETE', `${store.state.baseURL}/api/grants/${id}`, true)
+    if (!store.state.noAuth) request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      if (request.status === 200) {
+        resolve()
+      } else {
+        reject(request.responseText)
       }
     }
 
@@ -453,3 +571,151 @@ export function share (url, expires = '', unit = 'hours') {
     request.send()
   })
 }
+
+// WEBHOOKS
+
+export function getWebhookDeliveries () {
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open('GET', `${store.state.baseURL}/api/webhooks/`, true)
+    if (!store.state.noAuth) request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      if (request.status === 200) {
+        resolve(JSON.parse(request.responseText))
+      } else {
+        reject(request.status)
+      }
+    }
+
+    request.onerror = (error) => reject(error)
+    request.send()
+  })
+}
+
+export function redeliverWebhook (id) {
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open('POST', `${store.state.baseURL}/api/webhooks/${id}`, true)
+    if (!store.state.noAuth) request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      if (request.status === 200) {
+        resolve(JSON.parse(request.responseText))
+      } else {
+        reject(request.responseText)
+      }
+    }
+
+    request.onerror = (error) => reject(error)
+    request.send()
+  })
+}
+
+// HOOKS
+
+export function getHookLog () {
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open('GET', `${store.state.baseURL}/api/hooks/`, true)
+    if (!store.state.noAuth) request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      if (request.status === 200) {
+        resolve(JSON.parse(request.responseText))
+      } else {
+        reject(request.status)
+      }
+    }
+
+    request.onerror = (error) => reject(error)
+    request.send()
+  })
+}
+
+// LOCKOUTS
+
+export function getLockouts () {
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open('GET', `${store.state.baseURL}/api/lockouts/`, true)
+    if (!store.state.noAuth) request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      switch (request.status) {
+        case 200:
+          resolve(JSON.parse(request.responseText))
+          break
+        default:
+          reject(request.responseText)
+          break
+      }
+    }
+    request.onerror = (error) => reject(error)
+    request.send()
+  })
+}
+
+export function unlock (key) {
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open('DELETE', `${store.state.baseURL}/api/lockouts/${encodeURIComponent(key)}`, true)
+    if (!store.state.noAuth) request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      switch (request.status) {
+        case 200:
+          resolve()
+          break
+        default:
+          reject(request.responseText)
+          break
+      }
+    }
+    request.onerror = (error) => reject(error)
+    request.send()
+  })
+}
+
+// TWO-FACTOR AUTHENTICATION
+
+function totp (method, path = '', code = null) {
+  return new Promise((resolve, reject) => {
+    let request = new window.XMLHttpRequest()
+    request.open(method, `${store.state.baseURL}/api/totp/${path}`, true)
+    request.setRequestHeader('Authorization', `Bearer ${store.state.jwt}`)
+
+    request.onload = () => {
+      switch (request.status) {
+        case 200:
+          resolve(request.responseText === '' ? null : JSON.parse(request.responseText))
+          break
+        default:
+          reject(request.responseText)
+          break
+      }
+    }
+    request.onerror = (error) => reject(error)
+    request.send(code === null ? null : JSON.stringify({code: code}))
+  })
+}
+
+export function getTOTP () {
+  return totp('GET')
+}
+
+export function enrollTOTP () {
+  return totp('POST')
+}
+
+export function verifyTOTP (code) {
+  return totp('POST', 'verify', code)
+}
+
+export function newRecoveryCodes (code) {
+  return totp('POST', 'recovery', code)
+}
+
+export function disableTOTP (code) {
+  return totp('DELETE', '', code)
+}
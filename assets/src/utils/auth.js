@@ -31,8 +31,8 @@ function loggedIn () {
   })
 }
 
-function login (user, password, captcha) {
-  let data = {username: user, password: password, recaptcha: captcha}
+function login (user, password, captcha, otp = '') {
+  let data = {username: user, password: password, recaptcha: captcha, otp: otp}
   return new Promise((resolve, reject) => {
     let request = new window.XMLHttpRequest()
     request.open('POST', `${store.state.baseURL}/api/auth/get`, true)
@@ -42,7 +42,7 @@ function login (user, password, captcha) {
         parseToken(request.responseText)
         resolve()
       } else {
-        reject(request.responseText)
+        reject(request.status)
       }
     }
     request.onerror = () => reject(new Error('Could not finish the request'))
@@ -58,6 +58,7 @@ function logout () {
 }
 
 export default {
+  parseToken: parseToken,
   loggedIn: loggedIn,
   login: login,
   logout: logout
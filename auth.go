@@ -0,0 +1,45 @@
+package filemanager
+
+// AuthProvider checks the passwords of the users against another source
+// than File Manager, like a directory. It returns ErrNotExist for the
+// users it doesn't know and ErrOtherSource for the users it doesn't
+// manage, whose password is then checked by File Manager.
+type AuthProvider interface {
+	Authenticate(m *FileManager, username, password string) (*User, error)
+}
+
+// Authenticate checks the username and the password of a user with the
+// providers, then with the password File Manager keeps.
+func (m *FileManager) Authenticate(username, password string) (*User, error) {
+	for _, p := range m.AuthProviders {
+		u, err := p.Authenticate(m, username, password)
+		if err == ErrNotExist || err == ErrOtherSource {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if u.Disabled {
+			return nil, ErrInvalidCredentials
+		}
+
+		return u, nil
+	}
+
+	u, err := m.Store.Users.GetByUsername(username, m.NewFS)
+	if err == ErrNotExist {
+		return nil, ErrInvalidCredentials
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Disabled || !CheckPasswordHash(password, u.Password) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return u, nil
+}
@@ -0,0 +1,48 @@
+package bolt
+
+import (
+	"github.com/asdine/storm"
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// AccessKeyStore is an S3 access keys store.
+type AccessKeyStore struct {
+	DB *storm.DB
+}
+
+// Get gets an access key from its ID.
+func (s AccessKeyStore) Get(id string) (*fm.AccessKey, error) {
+	var v fm.AccessKey
+	err := s.DB.One("ID", id, &v)
+	if err == storm.ErrNotFound {
+		return nil, fm.ErrNotExist
+	}
+
+	return &v, err
+}
+
+// GetByUser gets the access keys of a user.
+func (s AccessKeyStore) GetByUser(userID int) ([]*fm.AccessKey, error) {
+	v := []*fm.AccessKey{}
+	err := s.DB.Find("UserID", userID, &v)
+	if err == storm.ErrNotFound {
+		return v, nil
+	}
+
+	return v, err
+}
+
+// Save stores an access key on the database.
+func (s AccessKeyStore) Save(k *fm.AccessKey) error {
+	return s.DB.Save(k)
+}
+
+// Delete deletes an access key from the database.
+func (s AccessKeyStore) Delete(id string) error {
+	err := s.DB.DeleteStruct(&fm.AccessKey{ID: id})
+	if err == storm.ErrNotFound {
+		return fm.ErrNotExist
+	}
+
+	return err
+}
@@ -0,0 +1,48 @@
+package bolt
+
+import (
+	"github.com/asdine/storm"
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// APITokenStore is an API tokens store.
+type APITokenStore struct {
+	DB *storm.DB
+}
+
+// Get gets an API token from its ID.
+func (s APITokenStore) Get(id string) (*fm.APIToken, error) {
+	var v fm.APIToken
+	err := s.DB.One("ID", id, &v)
+	if err == storm.ErrNotFound {
+		return nil, fm.ErrNotExist
+	}
+
+	return &v, err
+}
+
+// GetByUser gets the API tokens of a user.
+func (s APITokenStore) GetByUser(userID int) ([]*fm.APIToken, error) {
+	v := []*fm.APIToken{}
+	err := s.DB.Find("UserID", userID, &v)
+	if err == storm.ErrNotFound {
+		return v, nil
+	}
+
+	return v, err
+}
+
+// Save stores an API token on the database.
+func (s APITokenStore) Save(t *fm.APIToken) error {
+	return s.DB.Save(t)
+}
+
+// Delete deletes an API token from the database.
+func (s APITokenStore) Delete(id string) error {
+	err := s.DB.DeleteStruct(&fm.APIToken{ID: id})
+	if err == storm.ErrNotFound {
+		return fm.ErrNotExist
+	}
+
+	return err
+}
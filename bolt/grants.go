@@ -0,0 +1,62 @@
+package bolt
+
+import (
+	"github.com/asdine/storm"
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// GrantStore is a store of the grants between users.
+type GrantStore struct {
+	DB *storm.DB
+}
+
+// Get gets a grant from its ID.
+func (s GrantStore) Get(id int) (*fm.Grant, error) {
+	var v fm.Grant
+	err := s.DB.One("ID", id, &v)
+	if err == storm.ErrNotFound {
+		return nil, fm.ErrNotExist
+	}
+
+	return &v, err
+}
+
+// GetByOwner gets the grants given by a user.
+func (s GrantStore) GetByOwner(ownerID int) ([]*fm.Grant, error) {
+	return s.find("OwnerID", ownerID)
+}
+
+// GetByUser gets the grants given to a user.
+func (s GrantStore) GetByUser(userID int) ([]*fm.Grant, error) {
+	return s.find("UserID", userID)
+}
+
+// GetByGroup gets the grants given to a group.
+func (s GrantStore) GetByGroup(group string) ([]*fm.Grant, error) {
+	return s.find("Group", group)
+}
+
+func (s GrantStore) find(field string, value interface{}) ([]*fm.Grant, error) {
+	v := []*fm.Grant{}
+	err := s.DB.Find(field, value, &v)
+	if err == storm.ErrNotFound {
+		return v, nil
+	}
+
+	return v, err
+}
+
+// Save stores a grant on the database.
+func (s GrantStore) Save(g *fm.Grant) error {
+	return s.DB.Save(g)
+}
+
+// Delete deletes a grant from the database.
+func (s GrantStore) Delete(id int) error {
+	err := s.DB.DeleteStruct(&fm.Grant{ID: id})
+	if err == storm.ErrNotFound {
+		return fm.ErrNotExist
+	}
+
+	return err
+}
@@ -0,0 +1,37 @@
+package bolt
+
+import (
+	"github.com/asdine/storm"
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// HookStore is the log of the hooks.
+type HookStore struct {
+	DB *storm.DB
+}
+
+// Gets gets all the executions of the hooks.
+func (s HookStore) Gets() ([]*fm.HookExecution, error) {
+	v := []*fm.HookExecution{}
+	err := s.DB.All(&v)
+	if err == storm.ErrNotFound {
+		return v, nil
+	}
+
+	return v, err
+}
+
+// Save stores an execution on the database.
+func (s HookStore) Save(e *fm.HookExecution) error {
+	return s.DB.Save(e)
+}
+
+// Delete deletes an execution from the database.
+func (s HookStore) Delete(id int) error {
+	err := s.DB.DeleteStruct(&fm.HookExecution{ID: id})
+	if err == storm.ErrNotFound {
+		return fm.ErrNotExist
+	}
+
+	return err
+}
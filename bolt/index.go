@@ -0,0 +1,171 @@
+package bolt
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/asdine/storm"
+	"github.com/asdine/storm/q"
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// indexTerm is the list of documents in which a term appears.
+type indexTerm struct {
+	Term  string `storm:"id"`
+	Paths []string
+}
+
+// IndexStore is a full-text search index store.
+type IndexStore struct {
+	DB *storm.DB
+}
+
+// Get gets an indexed document from its path.
+func (s IndexStore) Get(path string) (*fm.IndexDocument, error) {
+	var v fm.IndexDocument
+	err := s.DB.One("Path", path, &v)
+	if err == storm.ErrNotFound {
+		return nil, fm.ErrNotExist
+	}
+
+	return &v, err
+}
+
+// Lookup gets the paths of the documents which contain a term.
+func (s IndexStore) Lookup(term string) ([]string, error) {
+	var v indexTerm
+	err := s.DB.One("Term", term, &v)
+	if err == storm.ErrNotFound {
+		return nil, fm.ErrNotExist
+	}
+
+	return v.Paths, err
+}
+
+// Paths gets the paths of the documents under a directory.
+func (s IndexStore) Paths(dir string) ([]string, error) {
+	var v []*fm.IndexDocument
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	err := s.DB.Select(q.Re("Path", "^"+regexp.QuoteMeta(prefix))).Find(&v)
+	if err == storm.ErrNotFound {
+		return nil, fm.ErrNotExist
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, len(v))
+	for i := range v {
+		paths[i] = v[i].Path
+	}
+
+	return paths, nil
+}
+
+// Save stores a document on the index, replacing the previous version
+// and updating the terms it appears in.
+func (s IndexStore) Save(d *fm.IndexDocument) error {
+	var old []string
+	if prev, err := s.Get(d.Path); err == nil {
+		old = prev.Terms
+	}
+
+	added, removed := diffTerms(old, d.Terms)
+
+	for _, term := range removed {
+		if err := s.removePosting(term, d.Path); err != nil {
+			return err
+		}
+	}
+
+	for _, term := range added {
+		if err := s.addPosting(term, d.Path); err != nil {
+			return err
+		}
+	}
+
+	return s.DB.Save(d)
+}
+
+// Delete removes a document from the index.
+func (s IndexStore) Delete(path string) error {
+	d, err := s.Get(path)
+	if err != nil {
+		return err
+	}
+
+	for _, term := range d.Terms {
+		if err := s.removePosting(term, path); err != nil {
+			return err
+		}
+	}
+
+	return s.DB.DeleteStruct(&fm.IndexDocument{Path: path})
+}
+
+func (s IndexStore) addPosting(term, path string) error {
+	var v indexTerm
+	err := s.DB.One("Term", term, &v)
+	if err != nil && err != storm.ErrNotFound {
+		return err
+	}
+
+	i := sort.SearchStrings(v.Paths, path)
+	if i < len(v.Paths) && v.Paths[i] == path {
+		return nil
+	}
+
+	v.Term = term
+	v.Paths = append(v.Paths, "")
+	copy(v.Paths[i+1:], v.Paths[i:])
+	v.Paths[i] = path
+	return s.DB.Save(&v)
+}
+
+func (s IndexStore) removePosting(term, path string) error {
+	var v indexTerm
+	err := s.DB.One("Term", term, &v)
+	if err == storm.ErrNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	i := sort.SearchStrings(v.Paths, path)
+	if i == len(v.Paths) || v.Paths[i] != path {
+		return nil
+	}
+
+	v.Paths = append(v.Paths[:i], v.Paths[i+1:]...)
+	if len(v.Paths) == 0 {
+		return s.DB.DeleteStruct(&v)
+	}
+
+	return s.DB.Save(&v)
+}
+
+// diffTerms compares two sorted lists of terms.
+func diffTerms(old, new []string) (added, removed []string) {
+	i, j := 0, 0
+	for i < len(old) && j < len(new) {
+		switch {
+		case old[i] == new[j]:
+			i++
+			j++
+		case old[i] < new[j]:
+			removed = append(removed, old[i])
+			i++
+		default:
+			added = append(added, new[j])
+			j++
+		}
+	}
+
+	removed = append(removed, old[i:]...)
+	added = append(added, new[j:]...)
+	return added, removed
+}
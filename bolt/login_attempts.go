@@ -0,0 +1,48 @@
+package bolt
+
+import (
+	"github.com/asdine/storm"
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// LoginAttemptsStore is a store of the failed logins.
+type LoginAttemptsStore struct {
+	DB *storm.DB
+}
+
+// Get gets the failed logins of a key.
+func (s LoginAttemptsStore) Get(key string) (*fm.LoginAttempts, error) {
+	var v fm.LoginAttempts
+	err := s.DB.One("Key", key, &v)
+	if err == storm.ErrNotFound {
+		return nil, fm.ErrNotExist
+	}
+
+	return &v, err
+}
+
+// Gets gets all the failed logins.
+func (s LoginAttemptsStore) Gets() ([]*fm.LoginAttempts, error) {
+	v := []*fm.LoginAttempts{}
+	err := s.DB.All(&v)
+	if err == storm.ErrNotFound {
+		return v, nil
+	}
+
+	return v, err
+}
+
+// Save stores the failed logins of a key.
+func (s LoginAttemptsStore) Save(v *fm.LoginAttempts) error {
+	return s.DB.Save(v)
+}
+
+// Delete deletes the failed logins of a key.
+func (s LoginAttemptsStore) Delete(key string) error {
+	err := s.DB.DeleteStruct(&fm.LoginAttempts{Key: key})
+	if err == storm.ErrNotFound {
+		return fm.ErrNotExist
+	}
+
+	return err
+}
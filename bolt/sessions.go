@@ -0,0 +1,59 @@
+package bolt
+
+import (
+	"github.com/asdine/storm"
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// SessionStore is a sessions store.
+type SessionStore struct {
+	DB *storm.DB
+}
+
+// Get gets a session from its ID.
+func (s SessionStore) Get(id string) (*fm.Session, error) {
+	var v fm.Session
+	err := s.DB.One("ID", id, &v)
+	if err == storm.ErrNotFound {
+		return nil, fm.ErrNotExist
+	}
+
+	return &v, err
+}
+
+// GetByUser gets the sessions of a user.
+func (s SessionStore) GetByUser(userID int) ([]*fm.Session, error) {
+	v := []*fm.Session{}
+	err := s.DB.Find("UserID", userID, &v)
+	if err == storm.ErrNotFound {
+		return v, nil
+	}
+
+	return v, err
+}
+
+// Gets gets all the sessions.
+func (s SessionStore) Gets() ([]*fm.Session, error) {
+	v := []*fm.Session{}
+	err := s.DB.All(&v)
+	if err == storm.ErrNotFound {
+		return v, nil
+	}
+
+	return v, err
+}
+
+// Save stores a session on the database.
+func (s SessionStore) Save(v *fm.Session) error {
+	return s.DB.Save(v)
+}
+
+// Delete deletes a session from the database.
+func (s SessionStore) Delete(id string) error {
+	err := s.DB.DeleteStruct(&fm.Session{ID: id})
+	if err == storm.ErrNotFound {
+		return fm.ErrNotExist
+	}
+
+	return err
+}
@@ -1,6 +1,8 @@
 package bolt
 
 import (
+	"sync"
+
 	"github.com/asdine/storm"
 	"github.com/asdine/storm/q"
 	fm "github.com/rjchee/dcac_filemanager"
@@ -22,15 +24,26 @@ func (s ShareStore) Get(hash string) (*fm.ShareLink, error) {
 	return &v, err
 }
 
-// GetPermanent gets the permanent link from a path.
-func (s ShareStore) GetPermanent(path string) (*fm.ShareLink, error) {
-	var v fm.ShareLink
-	err := s.DB.Select(q.Eq("Path", path), q.Eq("Expires", false)).First(&v)
+// GetPermanent gets the permanent link without restrictions of a user
+// from a path.
+func (s ShareStore) GetPermanent(path string, userID int) (*fm.ShareLink, error) {
+	var v []*fm.ShareLink
+	err := s.DB.Select(q.Eq("Path", path), q.Eq("UserID", userID), q.Eq("Expires", false)).Find(&v)
 	if err == storm.ErrNotFound {
 		return nil, fm.ErrNotExist
 	}
 
-	return &v, err
+	if err != nil {
+		return nil, err
+	}
+
+	for _, l := range v {
+		if l.Unrestricted() {
+			return l, nil
+		}
+	}
+
+	return nil, fm.ErrNotExist
 }
 
 // GetByPath gets all the links for a specific path.
@@ -44,6 +57,17 @@ func (s ShareStore) GetByPath(hash string) ([]*fm.ShareLink, error) {
 	return v, err
 }
 
+// GetByUser gets all the links created by a user.
+func (s ShareStore) GetByUser(userID int) ([]*fm.ShareLink, error) {
+	v := []*fm.ShareLink{}
+	err := s.DB.Find("UserID", userID, &v)
+	if err == storm.ErrNotFound {
+		return v, nil
+	}
+
+	return v, err
+}
+
 // Gets retrieves all the shareable links.
 func (s ShareStore) Gets() ([]*fm.ShareLink, error) {
 	var v []*fm.ShareLink
@@ -64,3 +88,68 @@ func (s ShareStore) Save(l *fm.ShareLink) error {
 func (s ShareStore) Delete(hash string) error {
 	return s.DB.DeleteStruct(&fm.ShareLink{Hash: hash})
 }
+
+// shareMu serializes the updates of the counters of the links.
+var shareMu sync.Mutex
+
+// CountView counts a view of a Share Link.
+func (s ShareStore) CountView(hash string) (*fm.ShareLink, error) {
+	shareMu.Lock()
+	defer shareMu.Unlock()
+
+	l, err := s.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Views++
+	return l, s.DB.UpdateField(l, "Views", l.Views)
+}
+
+// CountDownload counts a download of a Share Link, unless it has reached
+// its maximum.
+func (s ShareStore) CountDownload(hash string) (*fm.ShareLink, error) {
+	shareMu.Lock()
+	defer shareMu.Unlock()
+
+	l, err := s.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Exhausted() {
+		return l, fm.ErrShareExhausted
+	}
+
+	l.Downloads++
+	return l, s.DB.UpdateField(l, "Downloads", l.Downloads)
+}
+
+// CountUpload counts an upload through a Share Link, unless it would
+// exceed its total size.
+func (s ShareStore) CountUpload(hash string, size int64) (*fm.ShareLink, error) {
+	shareMu.Lock()
+	defer shareMu.Unlock()
+
+	l, err := s.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > 0 && l.MaxTotalSize > 0 && l.UploadedBytes+size > l.MaxTotalSize {
+		return l, fm.ErrShareExhausted
+	}
+
+	if size < 0 {
+		l.Uploads--
+	} else {
+		l.Uploads++
+	}
+
+	l.UploadedBytes += size
+	if err := s.DB.UpdateField(l, "Uploads", l.Uploads); err != nil {
+		return nil, err
+	}
+
+	return l, s.DB.UpdateField(l, "UploadedBytes", l.UploadedBytes)
+}
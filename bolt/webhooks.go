@@ -0,0 +1,59 @@
+package bolt
+
+import (
+	"github.com/asdine/storm"
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// WebhookStore is the queue of the webhooks.
+type WebhookStore struct {
+	DB *storm.DB
+}
+
+// Get gets a delivery from its ID.
+func (s WebhookStore) Get(id int) (*fm.WebhookDelivery, error) {
+	var v fm.WebhookDelivery
+	err := s.DB.One("ID", id, &v)
+	if err == storm.ErrNotFound {
+		return nil, fm.ErrNotExist
+	}
+
+	return &v, err
+}
+
+// Gets gets all the deliveries.
+func (s WebhookStore) Gets() ([]*fm.WebhookDelivery, error) {
+	v := []*fm.WebhookDelivery{}
+	err := s.DB.All(&v)
+	if err == storm.ErrNotFound {
+		return v, nil
+	}
+
+	return v, err
+}
+
+// GetPending gets the deliveries which weren't sent yet.
+func (s WebhookStore) GetPending() ([]*fm.WebhookDelivery, error) {
+	v := []*fm.WebhookDelivery{}
+	err := s.DB.Find("Status", fm.DeliveryPending, &v)
+	if err == storm.ErrNotFound {
+		return v, nil
+	}
+
+	return v, err
+}
+
+// Save stores a delivery on the database.
+func (s WebhookStore) Save(d *fm.WebhookDelivery) error {
+	return s.DB.Save(d)
+}
+
+// Delete deletes a delivery from the database.
+func (s WebhookStore) Delete(id int) error {
+	err := s.DB.DeleteStruct(&fm.WebhookDelivery{ID: id})
+	if err == storm.ErrNotFound {
+		return fm.ErrNotExist
+	}
+
+	return err
+}
@@ -14,7 +14,7 @@ import (
 	"github.com/rjchee/dcac_filemanager"
 	"github.com/rjchee/dcac_filemanager/bolt"
 	"github.com/rjchee/dcac_filemanager/staticgen"
-	"github.com/hacdias/fileutils"
+	"github.com/rjchee/dcac_filemanager/vfs"
 	"github.com/mholt/caddy"
 	"github.com/mholt/caddy/caddyhttp/httpserver"
 )
@@ -50,6 +50,7 @@ func Parse(c *caddy.Controller, plugin string) ([]*filemanager.FileManager, erro
 		noAuth := false
 		reCaptchaKey := ""
 		reCaptchaSecret := ""
+		searchMaxResults := 1000
 
 		if plugin != "" {
 			baseURL = "/admin"
@@ -169,6 +170,15 @@ func Parse(c *caddy.Controller, plugin string) ([]*filemanager.FileManager, erro
 				}
 
 				reCaptchaSecret = c.Val()
+			case "search_max_results":
+				if !c.NextArg() {
+					return nil, c.ArgErr()
+				}
+
+				searchMaxResults, err = strconv.Atoi(c.Val())
+				if err != nil {
+					return nil, err
+				}
 			case "no_auth":
 				if !c.NextArg() {
 					noAuth = true
@@ -212,7 +222,7 @@ func Parse(c *caddy.Controller, plugin string) ([]*filemanager.FileManager, erro
 		}
 
 		u.Scope = scope
-		u.FileSystem = fileutils.Dir(scope)
+		u.FileSystem = vfs.New(scope)
 
 		var db *storm.DB
 		if stored, ok := databases[database]; ok {
@@ -227,19 +237,28 @@ func Parse(c *caddy.Controller, plugin string) ([]*filemanager.FileManager, erro
 		}
 
 		m := &filemanager.FileManager{
-			NoAuth:          noAuth,
-			BaseURL:         "",
-			PrefixURL:       "",
-			ReCaptchaKey:    reCaptchaKey,
-			ReCaptchaSecret: reCaptchaSecret,
-			DefaultUser:     u,
+			NoAuth:           noAuth,
+			BaseURL:          "",
+			PrefixURL:        "",
+			ReCaptchaKey:     reCaptchaKey,
+			ReCaptchaSecret:  reCaptchaSecret,
+			DefaultUser:      u,
+			SearchMaxResults: searchMaxResults,
 			Store: &filemanager.Store{
-				Config: bolt.ConfigStore{DB: db},
-				Users:  bolt.UsersStore{DB: db},
-				Share:  bolt.ShareStore{DB: db},
+				Config:        bolt.ConfigStore{DB: db},
+				Users:         bolt.UsersStore{DB: db},
+				Share:         bolt.ShareStore{DB: db},
+				Index:         bolt.IndexStore{DB: db},
+				AccessKeys:    bolt.AccessKeyStore{DB: db},
+				APITokens:     bolt.APITokenStore{DB: db},
+				Sessions:      bolt.SessionStore{DB: db},
+				LoginAttempts: bolt.LoginAttemptsStore{DB: db},
+				Grants:        bolt.GrantStore{DB: db},
+				Webhooks:      bolt.WebhookStore{DB: db},
+				Hooks:         bolt.HookStore{DB: db},
 			},
 			NewFS: func(scope string) filemanager.FileSystem {
-				return fileutils.Dir(scope)
+				return vfs.New(scope)
 			},
 		}
 
@@ -0,0 +1,207 @@
+package filemanager
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Captcha checks that a login comes from a human, or at least that it
+// was costly enough to slow down the guessing of the passwords.
+type Captcha interface {
+	// Name tells the front-end how to solve the challenges: "recaptcha"
+	// or "pow".
+	Name() string
+
+	// Challenge returns a new challenge for the front-end. It is empty
+	// when the front-end gets its own.
+	Challenge() (string, error)
+
+	// Verify checks the response of the front-end.
+	Verify(response, addr string) (bool, error)
+}
+
+const reCaptchaAPI = "https://www.google.com/recaptcha/api/siteverify"
+
+// ReCaptcha is a Google reCAPTCHA.
+type ReCaptcha struct {
+	Key    string
+	Secret string
+}
+
+// Name returns "recaptcha".
+func (c *ReCaptcha) Name() string {
+	return "recaptcha"
+}
+
+// Challenge returns nothing: the widget of Google gets its own.
+func (c *ReCaptcha) Challenge() (string, error) {
+	return "", nil
+}
+
+// Verify checks the response with the API of Google.
+func (c *ReCaptcha) Verify(response, addr string) (bool, error) {
+	body := url.Values{}
+	body.Set("secret", c.Secret)
+	body.Add("response", response)
+
+	resp, err := http.PostForm(reCaptchaAPI, body)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, nil
+	}
+
+	var data struct {
+		Success bool `json:"success"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return false, err
+	}
+
+	return data.Success, nil
+}
+
+// ProofOfWork is a self-hosted Captcha which needs no external service.
+// Its challenges are signed and the front-end solves them by finding a
+// counter such that the SHA-256 of "<challenge>:<counter>" starts with
+// Difficulty zero bits. Each one can only be used once.
+type ProofOfWork struct {
+	Difficulty int
+	Expiry     time.Duration
+
+	key []byte
+
+	mu   sync.Mutex
+	used map[string]time.Time
+}
+
+// NewProofOfWork creates a proof-of-work Captcha. A difficulty of 16
+// takes about a second to a browser.
+func NewProofOfWork(difficulty int) (*ProofOfWork, error) {
+	key, err := GenerateRandomBytes(32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ProofOfWork{
+		Difficulty: difficulty,
+		Expiry:     10 * time.Minute,
+		key:        key,
+		used:       map[string]time.Time{},
+	}, nil
+}
+
+// Name returns "pow".
+func (c *ProofOfWork) Name() string {
+	return "pow"
+}
+
+func (c *ProofOfWork) sign(payload string) string {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Challenge returns a new signed challenge, which also tells the
+// difficulty to the front-end.
+func (c *ProofOfWork) Challenge() (string, error) {
+	nonce, err := GenerateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+
+	payload := strconv.Itoa(c.Difficulty) + "." +
+		strconv.FormatInt(time.Now().Unix(), 10) + "." +
+		hex.EncodeToString(nonce)
+
+	return payload + "." + c.sign(payload), nil
+}
+
+// Verify checks the signature, the age and the work of a response.
+func (c *ProofOfWork) Verify(response, addr string) (bool, error) {
+	i := strings.LastIndex(response, ":")
+	if i == -1 {
+		return false, nil
+	}
+
+	challenge := response[:i]
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 4 {
+		return false, nil
+	}
+
+	payload := strings.Join(parts[:3], ".")
+	if !hmac.Equal([]byte(c.sign(payload)), []byte(parts[3])) {
+		return false, nil
+	}
+
+	difficulty, err := strconv.Atoi(parts[0])
+	if err != nil || difficulty < c.Difficulty {
+		return false, nil
+	}
+
+	issued, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return false, nil
+	}
+
+	expires := time.Unix(issued, 0).Add(c.Expiry)
+	if time.Now().After(expires) {
+		return false, nil
+	}
+
+	sum := sha256.Sum256([]byte(response))
+	if leadingZeros(sum[:]) < difficulty {
+		return false, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, exp := range c.used {
+		if time.Now().After(exp) {
+			delete(c.used, k)
+		}
+	}
+
+	if _, ok := c.used[challenge]; ok {
+		return false, nil
+	}
+
+	c.used[challenge] = expires
+	return true, nil
+}
+
+// leadingZeros counts the leading zero bits of a hash.
+func leadingZeros(b []byte) int {
+	n := 0
+	for len(b) >= 4 {
+		v := binary.BigEndian.Uint32(b)
+		if v != 0 {
+			for v&0x80000000 == 0 {
+				v <<= 1
+				n++
+			}
+
+			return n
+		}
+
+		n += 32
+		b = b[4:]
+	}
+
+	return n
+}
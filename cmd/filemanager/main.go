@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/asdine/storm"
 
@@ -17,33 +18,66 @@ import (
 	"github.com/rjchee/dcac_filemanager"
 	"github.com/rjchee/dcac_filemanager/bolt"
 	h "github.com/rjchee/dcac_filemanager/http"
+	"github.com/rjchee/dcac_filemanager/oidc"
+	"github.com/rjchee/dcac_filemanager/sftp"
 	"github.com/rjchee/dcac_filemanager/staticgen"
-	"github.com/hacdias/fileutils"
+	"github.com/rjchee/dcac_filemanager/vfs"
 	flag "github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
 var (
-	addr            string
-	config          string
-	database        string
-	scope           string
-	commands        string
-	logfile         string
-	staticg         string
-	locale          string
-	baseurl         string
-	prefixurl       string
-	viewMode        string
-	recaptchakey    string
-	recaptchasecret string
-	port            int
-	noAuth          bool
-	allowCommands   bool
-	allowEdit       bool
-	allowNew        bool
-	allowPublish    bool
-	showVer         bool
+	addr             string
+	config           string
+	database         string
+	scope            string
+	commands         string
+	logfile          string
+	staticg          string
+	locale           string
+	baseurl          string
+	prefixurl        string
+	viewMode         string
+	recaptchakey     string
+	recaptchasecret  string
+	captchaPoW       int
+	lockoutAttempts  int
+	lockoutDuration  time.Duration
+	passwordLength   int
+	passwordClasses  int
+	passwordHistory  int
+	passwordBreached string
+	port             int
+	searchMaxResults int
+	sftpAddress      string
+	sftpHostKey      string
+	oidcIssuer       string
+	oidcClientID     string
+	oidcSecret       string
+	oidcRedirectURL  string
+	oidcUsername     string
+	oidcScope        string
+	oidcGroups       string
+	oidcAdminGroups  string
+	oidcProvision    bool
+	ldapURL          string
+	ldapBindDN       string
+	ldapBindPassword string
+	ldapBaseDN       string
+	ldapUserFilter   string
+	ldapSyncFilter   string
+	ldapUsername     string
+	ldapGroups       string
+	ldapAdminGroups  string
+	ldapScope        string
+	ldapSync         string
+	ldapProvision    bool
+	noAuth           bool
+	allowCommands    bool
+	allowEdit        bool
+	allowNew         bool
+	allowPublish     bool
+	showVer          bool
 )
 
 func init() {
@@ -59,6 +93,13 @@ func init() {
 	flag.StringVar(&viewMode, "view-mode", "mosaic", "Default view mode for new users")
 	flag.StringVar(&recaptchakey, "recaptcha-key", "", "ReCaptcha site key")
 	flag.StringVar(&recaptchasecret, "recaptcha-secret", "", "ReCaptcha secret")
+	flag.IntVar(&captchaPoW, "captcha-pow", 0, "Difficulty, in bits, of the self-hosted proof-of-work captcha (disabled if 0)")
+	flag.IntVar(&lockoutAttempts, "lockout-attempts", filemanager.DefaultThrottle.LockoutAttempts, "Failed logins which lock a username out")
+	flag.DurationVar(&lockoutDuration, "lockout-duration", filemanager.DefaultThrottle.LockoutDuration, "Duration of the lockouts")
+	flag.IntVar(&passwordLength, "password-min-length", 8, "Minimum length of the passwords")
+	flag.IntVar(&passwordClasses, "password-min-classes", 1, "Minimum kinds of characters of the passwords, out of lowercase, uppercase, digits and symbols")
+	flag.IntVar(&passwordHistory, "password-history", 3, "Number of the last passwords of a user which can't be used again")
+	flag.StringVar(&passwordBreached, "password-breached-list", "", "File with the leaked passwords, or their SHA-1 hashes, one per line")
 	flag.BoolVar(&allowCommands, "allow-commands", true, "Default allow commands option for new users")
 	flag.BoolVar(&allowEdit, "allow-edit", true, "Default allow edit option for new users")
 	flag.BoolVar(&allowPublish, "allow-publish", true, "Default allow publish option for new users")
@@ -66,6 +107,30 @@ func init() {
 	flag.BoolVar(&noAuth, "no-auth", false, "Disables authentication")
 	flag.StringVar(&locale, "locale", "", "Default locale for new users, set it empty to enable auto detect from browser")
 	flag.StringVar(&staticg, "staticgen", "", "Static Generator you want to enable")
+	flag.IntVar(&searchMaxResults, "search-max-results", 1000, "Maximum number of results of a search; 0 means no limit")
+	flag.StringVar(&sftpAddress, "sftp-address", "", "Address of the SFTP server, such as :2022 (disabled if empty)")
+	flag.StringVar(&sftpHostKey, "sftp-host-key", "./sftp_host_key", "SFTP server host key; generated if it doesn't exist")
+	flag.StringVar(&oidcIssuer, "oidc-issuer", "", "Issuer URL of the OpenID Connect provider (login disabled if empty)")
+	flag.StringVar(&oidcClientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&oidcSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&oidcRedirectURL, "oidc-redirect-url", "", "OpenID Connect redirect URL, ending with /api/auth/oidc/callback")
+	flag.StringVar(&oidcUsername, "oidc-username-claim", "preferred_username", "Claim the users are matched by username with")
+	flag.BoolVar(&oidcProvision, "oidc-provision", false, "Create the users who log in with OpenID Connect for the first time")
+	flag.StringVar(&oidcScope, "oidc-scope", "", "Scope of the provisioned users, such as /home/{username} (default scope if empty)")
+	flag.StringVar(&oidcGroups, "oidc-groups-claim", "groups", "Claim with the groups of the users")
+	flag.StringVar(&oidcAdminGroups, "oidc-admin-groups", "", "Groups whose members are admins (not managed if empty)")
+	flag.StringVar(&ldapURL, "ldap-url", "", "URL of the LDAP server, such as ldaps://ldap.example.com (disabled if empty)")
+	flag.StringVar(&ldapBindDN, "ldap-bind-dn", "", "DN of the account the LDAP entries are searched with (anonymous if empty)")
+	flag.StringVar(&ldapBindPassword, "ldap-bind-password", "", "Password of the LDAP search account")
+	flag.StringVar(&ldapBaseDN, "ldap-base-dn", "", "Base DN of the LDAP searches")
+	flag.StringVar(&ldapUserFilter, "ldap-user-filter", "(uid={username})", "LDAP filter of the entry of a user who logs in")
+	flag.StringVar(&ldapSyncFilter, "ldap-sync-filter", "(objectClass=person)", "LDAP filter of the entries of the users to sync")
+	flag.StringVar(&ldapUsername, "ldap-username-attribute", "uid", "LDAP attribute with the username")
+	flag.StringVar(&ldapGroups, "ldap-groups-attribute", "memberOf", "LDAP attribute with the groups")
+	flag.StringVar(&ldapAdminGroups, "ldap-admin-groups", "", "LDAP groups whose members are admins (not managed if empty)")
+	flag.BoolVar(&ldapProvision, "ldap-provision", false, "Create the users of the LDAP directory")
+	flag.StringVar(&ldapScope, "ldap-scope", "", "Scope of the users created from LDAP, such as /home/{username} (default scope if empty)")
+	flag.StringVar(&ldapSync, "ldap-sync", "@hourly", "Schedule of the sync of the LDAP users (disabled if empty)")
 	flag.BoolVarP(&showVer, "version", "v", false, "Show version")
 }
 
@@ -89,6 +154,37 @@ func setupViper() {
 	viper.SetDefault("ViewMode", filemanager.MosaicViewMode)
 	viper.SetDefault("ReCaptchaKey", "")
 	viper.SetDefault("ReCaptchaSecret", "")
+	viper.SetDefault("CaptchaPoW", 0)
+	viper.SetDefault("LockoutAttempts", filemanager.DefaultThrottle.LockoutAttempts)
+	viper.SetDefault("LockoutDuration", filemanager.DefaultThrottle.LockoutDuration)
+	viper.SetDefault("PasswordMinLength", 8)
+	viper.SetDefault("PasswordMinClasses", 1)
+	viper.SetDefault("PasswordHistory", 3)
+	viper.SetDefault("PasswordBreachedList", "")
+	viper.SetDefault("SearchMaxResults", 1000)
+	viper.SetDefault("SFTPAddress", "")
+	viper.SetDefault("SFTPHostKey", "./sftp_host_key")
+	viper.SetDefault("OIDCIssuer", "")
+	viper.SetDefault("OIDCClientID", "")
+	viper.SetDefault("OIDCClientSecret", "")
+	viper.SetDefault("OIDCRedirectURL", "")
+	viper.SetDefault("OIDCUsernameClaim", "preferred_username")
+	viper.SetDefault("OIDCProvision", false)
+	viper.SetDefault("OIDCScope", "")
+	viper.SetDefault("OIDCGroupsClaim", "groups")
+	viper.SetDefault("OIDCAdminGroups", []string{})
+	viper.SetDefault("LDAPURL", "")
+	viper.SetDefault("LDAPBindDN", "")
+	viper.SetDefault("LDAPBindPassword", "")
+	viper.SetDefault("LDAPBaseDN", "")
+	viper.SetDefault("LDAPUserFilter", "(uid={username})")
+	viper.SetDefault("LDAPSyncFilter", "(objectClass=person)")
+	viper.SetDefault("LDAPUsernameAttribute", "uid")
+	viper.SetDefault("LDAPGroupsAttribute", "memberOf")
+	viper.SetDefault("LDAPAdminGroups", []string{})
+	viper.SetDefault("LDAPProvision", false)
+	viper.SetDefault("LDAPScope", "")
+	viper.SetDefault("LDAPSync", "@hourly")
 
 	viper.BindPFlag("Port", flag.Lookup("port"))
 	viper.BindPFlag("Address", flag.Lookup("address"))
@@ -108,6 +204,37 @@ func setupViper() {
 	viper.BindPFlag("ViewMode", flag.Lookup("view-mode"))
 	viper.BindPFlag("ReCaptchaKey", flag.Lookup("recaptcha-key"))
 	viper.BindPFlag("ReCaptchaSecret", flag.Lookup("recaptcha-secret"))
+	viper.BindPFlag("CaptchaPoW", flag.Lookup("captcha-pow"))
+	viper.BindPFlag("LockoutAttempts", flag.Lookup("lockout-attempts"))
+	viper.BindPFlag("LockoutDuration", flag.Lookup("lockout-duration"))
+	viper.BindPFlag("PasswordMinLength", flag.Lookup("password-min-length"))
+	viper.BindPFlag("PasswordMinClasses", flag.Lookup("password-min-classes"))
+	viper.BindPFlag("PasswordHistory", flag.Lookup("password-history"))
+	viper.BindPFlag("PasswordBreachedList", flag.Lookup("password-breached-list"))
+	viper.BindPFlag("SearchMaxResults", flag.Lookup("search-max-results"))
+	viper.BindPFlag("SFTPAddress", flag.Lookup("sftp-address"))
+	viper.BindPFlag("SFTPHostKey", flag.Lookup("sftp-host-key"))
+	viper.BindPFlag("OIDCIssuer", flag.Lookup("oidc-issuer"))
+	viper.BindPFlag("OIDCClientID", flag.Lookup("oidc-client-id"))
+	viper.BindPFlag("OIDCClientSecret", flag.Lookup("oidc-client-secret"))
+	viper.BindPFlag("OIDCRedirectURL", flag.Lookup("oidc-redirect-url"))
+	viper.BindPFlag("OIDCUsernameClaim", flag.Lookup("oidc-username-claim"))
+	viper.BindPFlag("OIDCProvision", flag.Lookup("oidc-provision"))
+	viper.BindPFlag("OIDCScope", flag.Lookup("oidc-scope"))
+	viper.BindPFlag("OIDCGroupsClaim", flag.Lookup("oidc-groups-claim"))
+	viper.BindPFlag("OIDCAdminGroups", flag.Lookup("oidc-admin-groups"))
+	viper.BindPFlag("LDAPURL", flag.Lookup("ldap-url"))
+	viper.BindPFlag("LDAPBindDN", flag.Lookup("ldap-bind-dn"))
+	viper.BindPFlag("LDAPBindPassword", flag.Lookup("ldap-bind-password"))
+	viper.BindPFlag("LDAPBaseDN", flag.Lookup("ldap-base-dn"))
+	viper.BindPFlag("LDAPUserFilter", flag.Lookup("ldap-user-filter"))
+	viper.BindPFlag("LDAPSyncFilter", flag.Lookup("ldap-sync-filter"))
+	viper.BindPFlag("LDAPUsernameAttribute", flag.Lookup("ldap-username-attribute"))
+	viper.BindPFlag("LDAPGroupsAttribute", flag.Lookup("ldap-groups-attribute"))
+	viper.BindPFlag("LDAPAdminGroups", flag.Lookup("ldap-admin-groups"))
+	viper.BindPFlag("LDAPProvision", flag.Lookup("ldap-provision"))
+	viper.BindPFlag("LDAPScope", flag.Lookup("ldap-scope"))
+	viper.BindPFlag("LDAPSync", flag.Lookup("ldap-sync"))
 
 	viper.SetConfigName("filemanager")
 	viper.AddConfigPath(".")
@@ -203,19 +330,69 @@ func handler() http.Handler {
 			Locale:        viper.GetString("Locale"),
 			CSS:           "",
 			Scope:         viper.GetString("Scope"),
-			FileSystem:    fileutils.Dir(viper.GetString("Scope")),
+			FileSystem:    vfs.New(viper.GetString("Scope")),
 			ViewMode:      viper.GetString("ViewMode"),
 		},
 		Store: &filemanager.Store{
-			Config: bolt.ConfigStore{DB: db},
-			Users:  bolt.UsersStore{DB: db},
-			Share:  bolt.ShareStore{DB: db},
+			Config:        bolt.ConfigStore{DB: db},
+			Users:         bolt.UsersStore{DB: db},
+			Share:         bolt.ShareStore{DB: db},
+			Index:         bolt.IndexStore{DB: db},
+			AccessKeys:    bolt.AccessKeyStore{DB: db},
+			APITokens:     bolt.APITokenStore{DB: db},
+			Sessions:      bolt.SessionStore{DB: db},
+			LoginAttempts: bolt.LoginAttemptsStore{DB: db},
+			Grants:        bolt.GrantStore{DB: db},
+			Webhooks:      bolt.WebhookStore{DB: db},
+			Hooks:         bolt.HookStore{DB: db},
 		},
 		NewFS: func(scope string) filemanager.FileSystem {
-			return fileutils.Dir(scope)
+			return vfs.New(scope)
 		},
-		DCACDir: viper.GetString("DCACDir"),
-		DatabaseFile: viper.GetString("Database"),
+		DCACDir:          viper.GetString("DCACDir"),
+		DatabaseFile:     viper.GetString("Database"),
+		SearchMaxResults: viper.GetInt("SearchMaxResults"),
+	}
+
+	throttle := filemanager.DefaultThrottle
+	throttle.LockoutAttempts = viper.GetInt("LockoutAttempts")
+	throttle.LockoutDuration = viper.GetDuration("LockoutDuration")
+	fm.Throttle = &throttle
+
+	fm.PasswordPolicy = &filemanager.PasswordPolicy{
+		MinLength:  viper.GetInt("PasswordMinLength"),
+		MinClasses: viper.GetInt("PasswordMinClasses"),
+		History:    viper.GetInt("PasswordHistory"),
+	}
+
+	if path := viper.GetString("PasswordBreachedList"); path != "" {
+		if err := fm.PasswordPolicy.LoadBreached(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if d := viper.GetInt("CaptchaPoW"); d > 0 {
+		fm.Captcha, err = filemanager.NewProofOfWork(d)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if viper.GetString("OIDCIssuer") != "" {
+		fm.OIDC = &filemanager.OIDC{
+			Provider: &oidc.Provider{
+				Issuer:       viper.GetString("OIDCIssuer"),
+				ClientID:     viper.GetString("OIDCClientID"),
+				ClientSecret: viper.GetString("OIDCClientSecret"),
+				RedirectURL:  viper.GetString("OIDCRedirectURL"),
+				Scopes:       []string{"profile", "email"},
+			},
+			UsernameClaim: viper.GetString("OIDCUsernameClaim"),
+			Provision:     viper.GetBool("OIDCProvision"),
+			ScopeTemplate: viper.GetString("OIDCScope"),
+			GroupsClaim:   viper.GetString("OIDCGroupsClaim"),
+			AdminGroups:   viper.GetStringSlice("OIDCAdminGroups"),
+		}
 	}
 
 	err = fm.Setup()
@@ -248,5 +425,60 @@ func handler() http.Handler {
 		}
 	}
 
+	if viper.GetString("LDAPURL") != "" {
+		setupLDAP(fm)
+	}
+
+	if viper.GetString("SFTPAddress") != "" {
+		startSFTP(fm)
+	}
+
 	return h.Handler(fm)
 }
+
+// setupLDAP checks the passwords of the users against an LDAP directory
+// and schedules the sync of its users.
+func setupLDAP(fm *filemanager.FileManager) {
+	l := &filemanager.LDAP{
+		URL:               viper.GetString("LDAPURL"),
+		BindDN:            viper.GetString("LDAPBindDN"),
+		BindPassword:      viper.GetString("LDAPBindPassword"),
+		BaseDN:            viper.GetString("LDAPBaseDN"),
+		UserFilter:        viper.GetString("LDAPUserFilter"),
+		SyncFilter:        viper.GetString("LDAPSyncFilter"),
+		UsernameAttribute: viper.GetString("LDAPUsernameAttribute"),
+		GroupsAttribute:   viper.GetString("LDAPGroupsAttribute"),
+		AdminGroups:       viper.GetStringSlice("LDAPAdminGroups"),
+		Provision:         viper.GetBool("LDAPProvision"),
+		ScopeTemplate:     viper.GetString("LDAPScope"),
+	}
+
+	fm.AuthProviders = append(fm.AuthProviders, l)
+
+	if spec := viper.GetString("LDAPSync"); spec != "" {
+		if err := fm.Cron.AddFunc(spec, l.SyncJob(fm)); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// startSFTP starts the SFTP server in the background.
+func startSFTP(fm *filemanager.FileManager) {
+	hostKey, err := sftp.LoadHostKey(viper.GetString("SFTPHostKey"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", viper.GetString("SFTPAddress"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println("SFTP listening on", listener.Addr().String())
+
+	go func() {
+		if err := sftp.New(fm, hostKey).Serve(listener); err != nil {
+			log.Fatal(err)
+		}
+	}()
+}
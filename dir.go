@@ -0,0 +1,61 @@
+package filemanager
+
+import (
+	"os"
+
+	"github.com/hacdias/fileutils"
+)
+
+// Dir is a FileSystem on a directory of the local disk.
+type Dir string
+
+// Root returns the directory on the local disk.
+func (d Dir) Root() string {
+	return string(d)
+}
+
+// Mkdir creates a directory.
+func (d Dir) Mkdir(name string, perm os.FileMode) error {
+	return fileutils.Dir(d).Mkdir(name, perm)
+}
+
+// OpenFile opens a file or a directory.
+func (d Dir) OpenFile(name string, flag int, perm os.FileMode) (Handle, error) {
+	f, err := fileutils.Dir(d).OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// ReadDir returns the files of a directory.
+func (d Dir) ReadDir(name string) ([]os.FileInfo, error) {
+	f, err := fileutils.Dir(d).OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return f.Readdir(-1)
+}
+
+// RemoveAll removes a file or a directory and its contents.
+func (d Dir) RemoveAll(name string) error {
+	return fileutils.Dir(d).RemoveAll(name)
+}
+
+// Rename renames a file or a directory.
+func (d Dir) Rename(oldName, newName string) error {
+	return fileutils.Dir(d).Rename(oldName, newName)
+}
+
+// Stat returns the information of a file or a directory.
+func (d Dir) Stat(name string) (os.FileInfo, error) {
+	return fileutils.Dir(d).Stat(name)
+}
+
+// Copy copies a file or a directory.
+func (d Dir) Copy(src, dst string) error {
+	return fileutils.Dir(d).Copy(src, dst)
+}
@@ -26,21 +26,73 @@ to import "github.com/rjchee/dcac_filemanager/bolt".
 			Locale:        "en",
 			CSS:           "",
 			Scope:         ".",
-			FileSystem:    fileutils.Dir("."),
+			FileSystem:    fm.Dir("."),
 		},
 		Store: &fm.Store{
-			Config: bolt.ConfigStore{DB: db},
-			Users:  bolt.UsersStore{DB: db},
-			Share:  bolt.ShareStore{DB: db},
+			Config:        bolt.ConfigStore{DB: db},
+			Users:         bolt.UsersStore{DB: db},
+			Share:         bolt.ShareStore{DB: db},
+			Index:         bolt.IndexStore{DB: db},
+			AccessKeys:    bolt.AccessKeyStore{DB: db},
+			APITokens:     bolt.APITokenStore{DB: db},
+			Sessions:      bolt.SessionStore{DB: db},
+			LoginAttempts: bolt.LoginAttemptsStore{DB: db},
+			Grants:        bolt.GrantStore{DB: db},
+			Webhooks:      bolt.WebhookStore{DB: db},
+			Hooks:         bolt.HookStore{DB: db},
 		},
 		NewFS: func(scope string) fm.FileSystem {
-			return fileutils.Dir(scope)
+			return fm.Dir(scope)
 		},
 	}
 
+To keep the files of the users elsewhere than on the local disk, use
+vfs.New, from "github.com/rjchee/dcac_filemanager/vfs", as NewFS. Their
+scope can then be the URL of an in-memory file system or of a bucket of
+an S3 compatible store, like MinIO.
+
+To let the users log in with an OpenID Connect provider, set m.OIDC with
+an oidc.Provider, from "github.com/rjchee/dcac_filemanager/oidc", which
+redirects to /api/auth/oidc/callback. The oidctest package has a mock
+provider to try it out locally.
+
+To check the passwords against an LDAP directory, append an fm.LDAP to
+m.AuthProviders, and schedule its SyncJob with m.Cron to keep the users
+in sync with the directory. The ldaptest package, from
+"github.com/rjchee/dcac_filemanager/ldap/ldaptest", has an in-memory
+server to try it out locally.
+
+The failed logins are throttled, as set by m.Throttle, when the Store has
+LoginAttempts. To also check that the logins come from humans, set
+m.Captcha with a ReCaptcha or, without access to Google, with a
+ProofOfWork from NewProofOfWork.
+
+With Grants in the Store, the users share the files of their local scope
+with the other users, or with groups, at the read or read-write level. The
+files shared with a user are in its /shared-with-me directory.
+
+The commands of m.Commands are run on the events with the event as JSON on
+their standard input, and within their timeout. A before_* command which
+exits with HookRejectExitCode rejects the operation, with its standard
+error as the message. With Hooks in the Store, the admins see the output
+of the runs on /api/hooks.
+
+Besides the changes of the files, there are events for the creation of
+the directories, the downloads, the share links, the logins, the changes
+of the users and the grants, which change the ACLs. Their details are in
+variables of their own, like LOGIN_METHOD, SHARE_HASH, TARGET_USERNAME or
+GRANT_USERNAME, which the commands get in their environment and the vars
+of the event.
+
+Besides the commands, the events can be sent to webhooks, set in m.Webhooks
+or in the settings, when the Store has Webhooks to queue them. They are
+signed with HMAC-SHA256 and retried with a backoff until they are
+delivered, and the admins see them on /api/webhooks.
+
 The credentials for the first user are always 'admin' for both the user and
-the password, and they can be changed later through the settings. The first
-user is always an Admin and has all of the permissions set to 'true'.
+the password, and the password must be changed at the first login. The first
+user is always an Admin and has all of the permissions set to 'true'. The new
+passwords are checked against m.PasswordPolicy, if set.
 
 Then, you should set the Prefix URL and the Base URL, using the following
 functions:
@@ -53,6 +53,9 @@ type File struct {
 
 	Metadata string `json:"metadata,omitempty"`
 	Language string `json:"language,omitempty"`
+
+	// fs is the file system the file was found on.
+	fs FileSystem
 }
 
 // A Listing is the context used to fill out a template.
@@ -75,9 +78,10 @@ func GetInfo(url *url.URL, c *FileManager, u *User) (*File, error) {
 	var err error
 
 	i := &File{
-		URL:         "/files" + url.String(),
+		URL:         "/files" + u.URLPrefix + url.String(),
 		VirtualPath: url.Path,
 		Path:        filepath.Join(u.Scope, url.Path),
+		fs:          u.FileSystem,
 	}
 
 	info, err := u.FileSystem.Stat(url.Path)
@@ -101,16 +105,9 @@ func GetInfo(url *url.URL, c *FileManager, u *User) (*File, error) {
 
 // GetListing gets the information about a specific directory and its files.
 func (i *File) GetListing(u *User, r *http.Request) error {
-	// Gets the directory information using the Virtual File System of
-	// the user configuration.
-	f, err := u.FileSystem.OpenFile(i.VirtualPath, os.O_RDONLY, 0)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	// Reads the directory and gets the information about the files.
-	files, err := f.Readdir(-1)
+	// Reads the directory using the Virtual File System of the user
+	// configuration and gets the information about the files.
+	files, err := u.FileSystem.ReadDir(i.VirtualPath)
 	if err != nil {
 		return err
 	}
@@ -136,7 +133,7 @@ func (i *File) GetListing(u *User, r *http.Request) error {
 		if strings.HasPrefix(f.Mode().String(), "L") {
 			// It's a symbolic link
 			// The FileInfo from Readdir treats symbolic link as a file only.
-			info, err := os.Stat(f.Name())
+			info, err := u.FileSystem.Stat(filepath.Join(i.VirtualPath, name))
 			if err != nil {
 				return err
 			}
@@ -163,6 +160,7 @@ func (i *File) GetListing(u *User, r *http.Request) error {
 			Extension:   filepath.Ext(name),
 			VirtualPath: filepath.Join(i.VirtualPath, name),
 			Path:        filepath.Join(i.Path, name),
+			fs:          u.FileSystem,
 		}
 
 		i.GetFileType(false)
@@ -215,7 +213,7 @@ func (i *File) GetFileType(checkContent bool) error {
 	mimetype := mime.TypeByExtension(i.Extension)
 
 	if mimetype == "" && checkContent {
-		file, err := os.Open(i.Path)
+		file, err := i.open()
 		if err != nil {
 			return err
 		}
@@ -270,7 +268,14 @@ End:
 	// If the file type is text, save its content.
 	if i.Type == "text" {
 		if len(content) == 0 {
-			content, err = ioutil.ReadFile(i.Path)
+			var file io.ReadCloser
+			file, err = i.open()
+			if err != nil {
+				return err
+			}
+
+			content, err = ioutil.ReadAll(file)
+			file.Close()
 			if err != nil {
 				return err
 			}
@@ -284,7 +289,7 @@ End:
 
 // Checksum retrieves the checksum of a file.
 func (i File) Checksum(algo string) (string, error) {
-	file, err := os.Open(i.Path)
+	file, err := i.open()
 	if err != nil {
 		return "", err
 	}
@@ -314,6 +319,16 @@ func (i File) Checksum(algo string) (string, error) {
 	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
+// open opens the file on the file system it was found on, or on the
+// local disk.
+func (i File) open() (io.ReadCloser, error) {
+	if i.fs == nil {
+		return os.Open(i.Path)
+	}
+
+	return i.fs.OpenFile(i.VirtualPath, os.O_RDONLY, 0)
+}
+
 // CanBeEdited checks if the extension of a file is supported by the editor
 func (i File) CanBeEdited() bool {
 	return i.Type == "text"
@@ -2,24 +2,26 @@ package filemanager
 
 import (
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"path/filepath"
-	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
 	"reflect"
 	"regexp"
 	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
 
 	"github.com/GeertJohan/go.rice"
-	"github.com/hacdias/fileutils"
-	"github.com/mholt/caddy"
 	"github.com/robfig/cron"
 
 	"github.com/rjchee/dcac_filemanager/dcac"
@@ -39,10 +41,21 @@ var (
 	ErrEmptyRequest       = errors.New("request body is empty")
 	ErrEmptyPassword      = errors.New("password is empty")
 	ErrEmptyUsername      = errors.New("username is empty")
+	ErrInvalidUsername    = errors.New("invalid username")
 	ErrEmptyScope         = errors.New("scope is empty")
 	ErrWrongDataType      = errors.New("wrong data type")
 	ErrInvalidUpdateField = errors.New("invalid field to update")
 	ErrInvalidOption      = errors.New("invalid option")
+	ErrInvalidPublicKey   = errors.New("invalid public key")
+	ErrQuotaExceeded      = errors.New("the quota is exceeded")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrPasswordTooShort   = errors.New("the password is too short")
+	ErrPasswordTooSimple  = errors.New("the password has too few kinds of characters")
+	ErrPasswordBreached   = errors.New("the password is known to have leaked")
+	ErrPasswordReused     = errors.New("the password was used before")
+	ErrShareExhausted     = errors.New("the share link has no downloads left")
+	ErrHookTimeout        = errors.New("the hook timed out")
+	ErrOtherSource        = errors.New("the user comes from another identity provider")
 )
 
 // FileManager is a file manager instance. It should be creating using the
@@ -54,6 +67,13 @@ type FileManager struct {
 	// The key used to sign the JWT tokens.
 	Key []byte
 
+	// OIDC enables the login with an OpenID Connect provider, if set.
+	OIDC *OIDC
+
+	// AuthProviders check the passwords of the users before File Manager,
+	// like an LDAP directory.
+	AuthProviders []AuthProvider
+
 	// The static assets.
 	Assets *rice.Box
 
@@ -79,14 +99,40 @@ type FileManager struct {
 	ReCaptchaKey    string
 	ReCaptchaSecret string
 
+	// Captcha checks the logins come from humans. It is a ReCaptcha
+	// when the ReCaptcha key and secret are set.
+	Captcha Captcha
+
+	// Throttle slows down the failed logins. DefaultThrottle is used when
+	// it is nil.
+	Throttle *Throttle
+
+	// PasswordPolicy is checked when the passwords are set, if any.
+	PasswordPolicy *PasswordPolicy
+
+	// Require2FA requires a second factor from the users who are admins
+	// or can execute commands.
+	Require2FA bool
+
 	// StaticGen is the static websit generator handler.
 	StaticGen StaticGen
 
 	// The Default User needed to build the New User page.
 	DefaultUser *User
 
-	// A map of events to a slice of commands.
-	Commands map[string][]string
+	// A map of events to the hooks run on them.
+	Commands map[string][]*Hook
+
+	// Webhooks maps the events to the URLs they are sent to. They are
+	// only sent when the Store has Webhooks to queue them.
+	Webhooks map[string][]*Webhook
+
+	// WebhookClient sends the webhooks. A client with a timeout of 15
+	// seconds is used when it is nil.
+	WebhookClient *http.Client
+
+	// webhookWake wakes the sender of the webhooks up.
+	webhookWake chan struct{}
 
 	// Global stylesheet.
 	CSS string
@@ -99,6 +145,14 @@ type FileManager struct {
 
 	// name of database file so DCAC operations don't touch it
 	DatabaseFile string
+
+	// Watcher pushes the changes to the directories users are viewing.
+	// It is nil when the system can't watch files.
+	Watcher *Watcher
+
+	// SearchMaxResults is the maximum number of results returned by a
+	// single search. Zero means there is no limit.
+	SearchMaxResults int
 }
 
 var commandEvents = []string{
@@ -114,6 +168,26 @@ var commandEvents = []string{
 	"after_upload",
 	"before_delete",
 	"after_delete",
+	"before_mkdir",
+	"after_mkdir",
+	"before_download",
+	"after_download",
+	"before_share",
+	"after_share",
+	"before_unshare",
+	"after_unshare",
+	"before_login",
+	"after_login",
+	"before_create_user",
+	"after_create_user",
+	"before_update_user",
+	"after_update_user",
+	"before_delete_user",
+	"after_delete_user",
+	"before_grant",
+	"after_grant",
+	"before_revoke",
+	"after_revoke",
 }
 
 // Command is a command function.
@@ -149,6 +223,11 @@ func (m *FileManager) Setup() error {
 		return err
 	}
 
+	// The ReCaptcha options predate the other Captchas.
+	if m.Captcha == nil && m.ReCaptchaKey != "" && m.ReCaptchaSecret != "" {
+		m.Captcha = &ReCaptcha{Key: m.ReCaptchaKey, Secret: m.ReCaptchaSecret}
+	}
+
 	// Get the global CSS.
 	err = m.Store.Config.Get("css", &m.CSS)
 	if err != nil && err == ErrNotExist {
@@ -159,6 +238,16 @@ func (m *FileManager) Setup() error {
 		return err
 	}
 
+	// Get the policy of the second factors.
+	err = m.Store.Config.Get("require2fa", &m.Require2FA)
+	if err != nil && err == ErrNotExist {
+		err = m.Store.Config.Save("require2fa", false)
+	}
+
+	if err != nil {
+		return err
+	}
+
 	// Tries to get the event commands from the database.
 	// If they don't exist, initialize them.
 	err = m.Store.Config.Get("commands", &m.Commands)
@@ -170,16 +259,16 @@ func (m *FileManager) Setup() error {
 				continue
 			}
 
-			m.Commands[command] = []string{}
+			m.Commands[command] = []*Hook{}
 		}
 	}
 
 	if err != nil && err == ErrNotExist {
-		m.Commands = map[string][]string{}
+		m.Commands = map[string][]*Hook{}
 
 		// Initialize the command handlers.
 		for _, command := range commandEvents {
-			m.Commands[command] = []string{}
+			m.Commands[command] = []*Hook{}
 		}
 
 		err = m.Store.Config.Save("commands", m.Commands)
@@ -189,6 +278,23 @@ func (m *FileManager) Setup() error {
 		return err
 	}
 
+	// The webhooks are set up like the commands.
+	err = m.Store.Config.Get("webhooks", &m.Webhooks)
+	if err != nil && err == ErrNotExist {
+		m.Webhooks = map[string][]*Webhook{}
+		err = m.Store.Config.Save("webhooks", m.Webhooks)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for _, event := range commandEvents {
+		if _, ok := m.Webhooks[event]; !ok {
+			m.Webhooks[event] = []*Webhook{}
+		}
+	}
+
 	// Tries to fetch the users from the database.
 	users, err := m.Store.Users.Gets(m.NewFS)
 	if err != nil && err != ErrNotExist {
@@ -219,6 +325,9 @@ func (m *FileManager) Setup() error {
 		return err
 	}
 	defer adminAttr.Drop()
+	// the gatekeeper may change the ACLs too, so the users can share
+	// the files they have access to with each other
+	mdACL := adminAttr.ACL().OrWith(gatekeeperAttr.ACL())
 	if _, err := os.Stat(m.DCACDir); os.IsNotExist(err) {
 		// initialize the ACL for everything
 		databaseFileInfo, _ := os.Stat(m.DatabaseFile)
@@ -233,7 +342,7 @@ func (m *FileManager) Setup() error {
 			if os.SameFile(databaseFileInfo, info) {
 				return nil
 			}
-			err = dcac.SetFileMdACL(path, adminAttr.ACL())
+			err = dcac.SetFileMdACL(path, mdACL)
 			if err != nil {
 				log.Printf("Error setting modify ACL for %s\n", path)
 			}
@@ -257,7 +366,7 @@ func (m *FileManager) Setup() error {
 	} else if os.IsPermission(err) {
 		return err
 	}
-	if err := dcac.SetDefMdACL(adminAttr.ACL()); err != nil {
+	if err := dcac.SetDefMdACL(mdACL); err != nil {
 		log.Fatal(err)
 	}
 
@@ -273,6 +382,9 @@ func (m *FileManager) Setup() error {
 			return err
 		}
 
+		// Its well known password must be changed at the first login.
+		u.MustChangePassword = true
+
 		// The first user must be an administrator.
 		u.Admin = true
 		u.AllowCommands = true
@@ -297,7 +409,35 @@ func (m *FileManager) Setup() error {
 	m.DefaultUser.Username = ""
 	m.DefaultUser.Password = ""
 
+	// Live updates are optional, so a system without inotify, or
+	// without watches left, only disables them.
+	watcher, err := NewWatcher()
+	if err != nil {
+		log.Printf("could not start the file watcher: %s\n", err)
+	}
+	m.Watcher = watcher
+
 	m.Cron.AddFunc("@hourly", m.ShareCleaner)
+	m.Cron.AddFunc("@daily", m.ThumbnailCleaner)
+	m.Cron.AddFunc("@daily", m.MultipartCleaner)
+	if m.Store.Sessions != nil {
+		m.Cron.AddFunc("@hourly", m.SessionCleaner)
+	}
+	if m.Store.LoginAttempts != nil {
+		m.Cron.AddFunc("@hourly", m.LoginAttemptsCleaner)
+	}
+	if m.Store.Hooks != nil {
+		m.Cron.AddFunc("@daily", m.HookCleaner)
+	}
+	if m.Store.Webhooks != nil {
+		m.webhookWake = make(chan struct{}, 1)
+		go m.webhookSender()
+		m.Cron.AddFunc("@daily", m.WebhookCleaner)
+	}
+	if m.Store.Index != nil {
+		go m.IndexBuilder()
+		m.Cron.AddFunc("@daily", m.IndexBuilder)
+	}
 	m.Cron.Start()
 	dcac.SetPMask(0111)
 
@@ -325,16 +465,63 @@ func (m FileManager) getUserAttr(u *User) (dcac.Attr, error) {
 	}
 }
 
+// AcquireAttrs adds the DCAC attributes of a user to the calling thread,
+// along with the admin attribute when the user is an administrator, so
+// file operations run with the user's permissions. The returned function
+// drops them again.
+func (m FileManager) AcquireAttrs(u *User) (func(), error) {
+	userAttr, err := m.getUserAttr(u)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []dcac.Attr{userAttr}
+
+	// Only administrators can open the admin gateway, and not with their
+	// API tokens, which never have the rights of an admin.
+	if u.Admin && u.Token == nil {
+		if adminAttr, err := dcac.OpenGatewayFile(m.AdminGatewayFile(), dcac.ADDMOD); err == nil {
+			attrs = append(attrs, adminAttr)
+		}
+	}
+
+	return func() {
+		for _, attr := range attrs {
+			attr.Drop()
+		}
+	}, nil
+}
+
 func (m *FileManager) UpdateUser(old, newU *User) error {
+	newU.TokenVersion = old.TokenVersion
+	if accessChanged(old, newU) {
+		newU.TokenVersion++
+	}
+
 	err := m.updateUserDCAC(old, newU)
 	if err != nil {
 		return err
 	}
-	return m.Store.Users.Save(newU)
+
+	if err := m.Store.Users.Save(newU); err != nil {
+		return err
+	}
+
+	if err := m.updateUserGrants(old, newU); err != nil {
+		return err
+	}
+
+	// The links of the files out of the new scope stop working.
+	if old.Scope != newU.Scope {
+		return m.CheckUserShares(newU)
+	}
+
+	return nil
 }
 
 func (m *FileManager) updateUserDCAC(old, newU *User) error {
-	adminChanged := old.Admin != newU.Admin
+	// Disabled users lose the rights of an admin.
+	adminChanged := old.Admin && !old.Disabled != (newU.Admin && !newU.Disabled)
 	scopeChanged := old.Scope != newU.Scope
 	permsChanged := old.AllowNew != newU.AllowNew || old.AllowEdit != newU.AllowEdit || len(old.Rules) != len(newU.Rules)
 	for i := 0; !permsChanged && i < len(old.Rules); i++ {
@@ -347,9 +534,9 @@ func (m *FileManager) updateUserDCAC(old, newU *User) error {
 			return err
 		}
 		if adminChanged {
-			m.setAdminDCAC(userAttr, newU.Admin)
+			m.setAdminDCAC(userAttr, newU.Admin && !newU.Disabled)
 		}
-		if scopeChanged {
+		if scopeChanged && old.LocalScope() {
 			dcacFileInfo, err := os.Stat(m.DCACDir)
 			if err != nil {
 				return err
@@ -415,6 +602,10 @@ func (m *FileManager) setupUserDCAC(u *User) error {
 			return err
 		}
 	}
+	// Other file systems have no ACLs to set.
+	if !u.LocalScope() {
+		return nil
+	}
 	dcacFileInfo, err := os.Stat(m.DCACDir)
 	if err != nil {
 		return err
@@ -521,9 +712,14 @@ func (m FileManager) ShareCleaner() {
 		return
 	}
 
-	// Find the expired ones.
+	// Find the expired ones and the ones which lost their user.
 	for i := range links {
-		if links[i].Expires && links[i].ExpireDate.Before(time.Now()) {
+		expired := links[i].Expires && links[i].ExpireDate.Before(time.Now())
+		if !expired {
+			_, _, err = m.ShareOwner(links[i])
+		}
+
+		if expired || err == ErrNotExist {
 			err = m.Store.Share.Delete(links[i].Hash)
 			if err != nil {
 				log.Print(err)
@@ -532,60 +728,48 @@ func (m FileManager) ShareCleaner() {
 	}
 }
 
-// Runner runs the commands for a certain event type.
+// Runner runs the hooks for a certain event type and queues its webhooks.
+// A before_* hook can reject the operation with a HookRejection.
 func (m FileManager) Runner(event string, path string, destination string, user *User) error {
-	commands := []string{}
-
-	// Get the commands from the File Manager instance itself.
-	if val, ok := m.Commands[event]; ok {
-		commands = append(commands, val...)
-	}
+	return m.RunnerVars(event, path, destination, user, nil)
+}
 
-	// Execute the commands.
-	for _, command := range commands {
-		args := strings.Split(command, " ")
-		nonblock := false
+// RunnerVars is like Runner, for the events with details of their own. The
+// names of the vars are the ones of their environment variables.
+func (m FileManager) RunnerVars(event, path, destination string, user *User, vars map[string]string) error {
+	data := newEventData(event, path, destination, user, vars)
 
-		if len(args) > 1 && args[len(args)-1] == "&" {
-			// Run command in background; non-blocking
-			nonblock = true
-			args = args[:len(args)-1]
-		}
+	var (
+		env   []string
+		input []byte
+	)
 
-		command, args, err := caddy.SplitCommandAndArgs(strings.Join(args, " "))
-		if err != nil {
-			return err
-		}
-
-		cmd := exec.Command(command, args...)
-		cmd.Env = append(os.Environ(), fmt.Sprintf("FILE=%s", path))
-		cmd.Env = append(cmd.Env, fmt.Sprintf("ROOT=%s", string(user.Scope)))
-		cmd.Env = append(cmd.Env, fmt.Sprintf("TRIGGER=%s", event))
-		cmd.Env = append(cmd.Env, fmt.Sprintf("USERNAME=%s", user.Username))
-
-		if destination != "" {
-			cmd.Env = append(cmd.Env, fmt.Sprintf("DESTINATION=%s", destination))
+	for _, h := range m.Commands[event] {
+		if !h.Matches(data.Path) && (data.Destination == "" || !h.Matches(data.Destination)) {
+			continue
 		}
 
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		if nonblock {
-			log.Printf("[INFO] Nonblocking Command:\"%s %s\"", command, strings.Join(args, " "))
-			if err := cmd.Start(); err != nil {
+		if input == nil {
+			var err error
+			input, err = json.Marshal(data)
+			if err != nil {
 				return err
 			}
 
-			continue
+			env = hookEnv(event, path, destination, user, vars)
 		}
 
-		log.Printf("[INFO] Blocking Command:\"%s %s\"", command, strings.Join(args, " "))
-		if err := cmd.Run(); err != nil {
+		if err := m.runHook(h, data, env, input); err != nil {
 			return err
 		}
 	}
 
+	// The webhooks are sent in the background, so they can't stop the
+	// action like the commands.
+	if err := m.queueWebhooks(data); err != nil {
+		log.Printf("could not queue the webhooks of %s: %s\n", event, err)
+	}
+
 	return nil
 }
 
@@ -602,7 +786,7 @@ var DefaultUser = User{
 	Admin:         true,
 	Locale:        "",
 	Scope:         ".",
-	FileSystem:    fileutils.Dir("."),
+	FileSystem:    Dir("."),
 	ViewMode:      "mosaic",
 }
 
@@ -639,6 +823,14 @@ type User struct {
 	// Prevents the user to change its password.
 	LockPassword bool `json:"lockPassword"`
 
+	// MustChangePassword users can't do anything but changing their
+	// password.
+	MustChangePassword bool `json:"mustChangePassword"`
+
+	// PasswordHistory are the hashes of the previous passwords, which
+	// can't be used again.
+	PasswordHistory []string `json:"passwordHistory"`
+
 	// These indicate if the user can perform certain actions.
 	AllowNew      bool `json:"allowNew"`      // Create files and folders
 	AllowEdit     bool `json:"allowEdit"`     // Edit/rename files
@@ -650,16 +842,123 @@ type User struct {
 
 	// User view mode for files and folders.
 	ViewMode string `json:"viewMode"`
+
+	// PublicKeys are the SSH public keys, in the authorized_keys
+	// format, the user can log in to the SFTP server with.
+	PublicKeys []string `json:"publicKeys"`
+
+	// QuotaBytes and QuotaFiles limit the size and the number of the
+	// files of the user. Zero means unlimited.
+	QuotaBytes int64 `json:"quotaBytes"`
+	QuotaFiles int64 `json:"quotaFiles"`
+
+	// UsedBytes and UsedFiles are the usage of the user, which is updated
+	// as its files change.
+	UsedBytes int64 `json:"usedBytes"`
+	UsedFiles int64 `json:"usedFiles"`
+
+	// ServiceAccount users can't log in with a password. They are meant
+	// for scripts, which use API tokens or access keys.
+	ServiceAccount bool `json:"serviceAccount"`
+
+	// Token is the API token the user authenticated with, if any, which
+	// restricts its access.
+	Token *APIToken `json:"-"`
+
+	// URLPrefix is put before the paths of the user in the URLs of its
+	// files. It is set while it browses a directory shared with it.
+	URLPrefix string `json:"-"`
+
+	// Groups are the groups the user belongs to, which may be managed by
+	// an identity provider.
+	Groups []string `json:"groups"`
+
+	// Source is the identity provider the user was created from, like
+	// "ldap" or "oidc". It is empty for the users created by the admins.
+	Source string `json:"source"`
+
+	// Disabled users can't log in.
+	Disabled bool `json:"disabled"`
+
+	// TokenVersion is bumped when the password or the permissions of the
+	// user change, which revokes the JWTs issued before.
+	TokenVersion int `json:"tokenVersion"`
+
+	// TwoFactor is the second factor of the user.
+	TwoFactor TwoFactor `json:"twoFactor"`
+}
+
+// HideSecrets removes the password hash, the secrets of the second
+// factor and the credentials of the scope so they never arrive to the
+// front-end.
+func (u *User) HideSecrets() {
+	u.Password = ""
+	u.PasswordHistory = nil
+	u.TwoFactor.Secret = ""
+	u.TwoFactor.RecoveryCodes = nil
+	u.Scope = HideScope(u.Scope)
+}
+
+// HideScope removes the credentials from the URL of a scope which isn't
+// on the local disk, like the keys of an S3 bucket.
+func HideScope(scope string) string {
+	if !strings.Contains(scope, "://") {
+		return scope
+	}
+
+	u, err := url.Parse(scope)
+	if err != nil || u.User == nil {
+		return scope
+	}
+
+	u.User = nil
+	return u.String()
 }
 
 // Allowed checks if the user has permission to access a directory/file.
 func (u User) Allowed(url string) bool {
+	if u.Token != nil && !u.Token.Allows(url) {
+		return false
+	}
+
+	// Without DCAC, the rules of the user are checked here.
+	if !u.LocalScope() {
+		return u.rulesAllowed(url)
+	}
+
 	println(url)
 	dcac.PrintAttrs()
 	_, err := ioutil.ReadFile(filepath.Join(u.Scope, url))
 	return err != nil || url[len(url) - 1:] != "/"
 }
 
+// LocalScope checks if the scope of the user is on the local disk, where
+// the DCAC attributes and ACLs apply.
+func (u User) LocalScope() bool {
+	if u.FileSystem == nil {
+		return true
+	}
+
+	_, ok := u.FileSystem.(LocalFileSystem)
+	return ok
+}
+
+func (u User) rulesAllowed(url string) bool {
+	for i := len(u.Rules) - 1; i >= 0; i-- {
+		rule := u.Rules[i]
+
+		if rule.Regex {
+			if rule.Regexp.MatchString(url) {
+				return rule.Allow
+			}
+		} else if strings.HasPrefix(url, rule.Path) {
+			return rule.Allow
+		}
+	}
+
+	return true
+}
+
 // Rule is a dissalow/allow rule.
 type Rule struct {
 	// Regex indicates if this rule uses Regular Expressions or not.
@@ -696,14 +995,114 @@ type ShareLink struct {
 	Path       string    `json:"path" storm:"index"`
 	Expires    bool      `json:"expires"`
 	ExpireDate time.Time `json:"expireDate"`
+
+	// UserID is the user who created the link. The file is served with
+	// its rights.
+	UserID int `json:"userID" storm:"index"`
+
+	// PasswordHash is the bcrypt hash of the password asked before the
+	// file is shown, if any.
+	PasswordHash string `json:"passwordHash"`
+
+	// MaxDownloads is how many times the file can be downloaded, or 0 for
+	// no limit. Downloads and Views count the uses of the link.
+	MaxDownloads int `json:"maxDownloads"`
+	Downloads    int `json:"downloads"`
+	Views        int `json:"views"`
+
+	// AllowedIPs are the addresses and CIDR ranges the link can be opened
+	// from. Any address can when it's empty.
+	AllowedIPs []string `json:"allowedIPs"`
+
+	// ViewOnly links show the file but don't let it be downloaded.
+	ViewOnly bool `json:"viewOnly"`
+
+	// Upload links let anyone upload files into a directory, but not see
+	// its content. MaxFileSize and MaxTotalSize limit the uploads, if not
+	// 0, and Uploads and UploadedBytes count them.
+	Upload        bool  `json:"upload"`
+	MaxFileSize   int64 `json:"maxFileSize"`
+	MaxTotalSize  int64 `json:"maxTotalSize"`
+	Uploads       int   `json:"uploads"`
+	UploadedBytes int64 `json:"uploadedBytes"`
+}
+
+// AccessKey is a key pair users sign their S3 requests with. The secret
+// must be kept because signatures are checked by computing them again.
+type AccessKey struct {
+	ID      string    `json:"id" storm:"id"`
+	Secret  string    `json:"secret"`
+	UserID  int       `json:"userID" storm:"index"`
+	Created time.Time `json:"created"`
+}
+
+// NewAccessKey generates a new access key for a user.
+func NewAccessKey(userID int) (*AccessKey, error) {
+	id, err := GenerateRandomBytes(10)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := GenerateRandomBytes(30)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessKey{
+		ID:      "FM" + strings.ToUpper(hex.EncodeToString(id)),
+		Secret:  base64.RawURLEncoding.EncodeToString(secret),
+		UserID:  userID,
+		Created: time.Now(),
+	}, nil
+}
+
+// MultipartDir is where the parts of the S3 multipart uploads are kept
+// until the uploads are completed.
+func (m FileManager) MultipartDir() string {
+	return filepath.Join(m.DCACDir, "multipart")
+}
+
+// MultipartCleaner removes the multipart uploads which were neither
+// completed nor aborted within a week.
+func (m FileManager) MultipartCleaner() {
+	uploads, err := ioutil.ReadDir(m.MultipartDir())
+	if err != nil {
+		return
+	}
+
+	for _, upload := range uploads {
+		if time.Since(upload.ModTime()) < 7*24*time.Hour {
+			continue
+		}
+
+		if err := os.RemoveAll(filepath.Join(m.MultipartDir(), upload.Name())); err != nil {
+			log.Print(err)
+		}
+	}
 }
 
 // Store is a collection of the stores needed to get
 // and save information.
 type Store struct {
-	Users  UsersStore
-	Config ConfigStore
-	Share  ShareStore
+	Users      UsersStore
+	Config     ConfigStore
+	Share      ShareStore
+	Index      IndexStore
+	AccessKeys AccessKeyStore
+	APITokens  APITokenStore
+	Sessions   SessionStore
+
+	// LoginAttempts throttles the logins when it is set.
+	LoginAttempts LoginAttemptsStore
+
+	// Grants lets the users share files with each other when it is set.
+	Grants GrantStore
+
+	// Webhooks queues the webhooks, which aren't sent when it is nil.
+	Webhooks WebhookStore
+
+	// Hooks logs the executions of the hooks when it is set.
+	Hooks HookStore
 }
 
 // UsersStore is the interface to manage users.
@@ -716,6 +1115,40 @@ type UsersStore interface {
 	Delete(id int) error
 }
 
+// GrantStore is the interface to manage the grants between users.
+type GrantStore interface {
+	Get(id int) (*Grant, error)
+	GetByOwner(ownerID int) ([]*Grant, error)
+	GetByUser(userID int) ([]*Grant, error)
+	GetByGroup(group string) ([]*Grant, error)
+	Save(g *Grant) error
+	Delete(id int) error
+}
+
+// HookStore is the interface to manage the log of the hooks.
+type HookStore interface {
+	Gets() ([]*HookExecution, error)
+	Save(e *HookExecution) error
+	Delete(id int) error
+}
+
+// WebhookStore is the interface to manage the queue of the webhooks.
+type WebhookStore interface {
+	Get(id int) (*WebhookDelivery, error)
+	Gets() ([]*WebhookDelivery, error)
+	GetPending() ([]*WebhookDelivery, error)
+	Save(d *WebhookDelivery) error
+	Delete(id int) error
+}
+
+// LoginAttemptsStore is the interface to manage the failed logins.
+type LoginAttemptsStore interface {
+	Get(key string) (*LoginAttempts, error)
+	Gets() ([]*LoginAttempts, error)
+	Save(a *LoginAttempts) error
+	Delete(key string) error
+}
+
 // ConfigStore is the interface to manage configuration.
 type ConfigStore interface {
 	Get(name string, to interface{}) error
@@ -725,11 +1158,47 @@ type ConfigStore interface {
 // ShareStore is the interface to manage share links.
 type ShareStore interface {
 	Get(hash string) (*ShareLink, error)
-	GetPermanent(path string) (*ShareLink, error)
+	GetPermanent(path string, userID int) (*ShareLink, error)
 	GetByPath(path string) ([]*ShareLink, error)
+	GetByUser(userID int) ([]*ShareLink, error)
 	Gets() ([]*ShareLink, error)
 	Save(s *ShareLink) error
 	Delete(hash string) error
+
+	// CountView counts a view of the link. CountDownload counts a
+	// download, or returns ErrShareExhausted if there are none left.
+	CountView(hash string) (*ShareLink, error)
+	CountDownload(hash string) (*ShareLink, error)
+
+	// CountUpload counts an upload of size bytes, or returns
+	// ErrShareExhausted if it would exceed the total size. A negative
+	// size cancels an upload which failed.
+	CountUpload(hash string, size int64) (*ShareLink, error)
+}
+
+// AccessKeyStore is the interface to manage the S3 access keys.
+type AccessKeyStore interface {
+	Get(id string) (*AccessKey, error)
+	GetByUser(userID int) ([]*AccessKey, error)
+	Save(k *AccessKey) error
+	Delete(id string) error
+}
+
+// APITokenStore is the interface to manage the API tokens.
+type APITokenStore interface {
+	Get(id string) (*APIToken, error)
+	GetByUser(userID int) ([]*APIToken, error)
+	Save(t *APIToken) error
+	Delete(id string) error
+}
+
+// SessionStore is the interface to manage the sessions.
+type SessionStore interface {
+	Get(id string) (*Session, error)
+	GetByUser(userID int) ([]*Session, error)
+	Gets() ([]*Session, error)
+	Save(s *Session) error
+	Delete(id string) error
 }
 
 // StaticGen is a static website generator.
@@ -746,13 +1215,32 @@ type StaticGen interface {
 // FileSystem is the interface to work with the file system.
 type FileSystem interface {
 	Mkdir(name string, perm os.FileMode) error
-	OpenFile(name string, flag int, perm os.FileMode) (*os.File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (Handle, error)
+	ReadDir(name string) ([]os.FileInfo, error)
 	RemoveAll(name string) error
 	Rename(oldName, newName string) error
 	Stat(name string) (os.FileInfo, error)
 	Copy(src, dst string) error
 }
 
+// Handle is an open file, or directory, of a FileSystem.
+type Handle interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+	Readdir(count int) ([]os.FileInfo, error)
+	Stat() (os.FileInfo, error)
+}
+
+// LocalFileSystem is a FileSystem on the local disk, where the DCAC
+// attributes and ACLs apply. The access to the other file systems is
+// only checked by File Manager, with the rules of the users.
+type LocalFileSystem interface {
+	FileSystem
+	Root() string
+}
+
 // Context contains the needed information to make handlers work.
 type Context struct {
 	*FileManager
@@ -760,6 +1248,8 @@ type Context struct {
 	File *File
 	// On API handlers, Router is the APi handler we want.
 	Router string
+	// Session is the session the request is authenticated with, if any.
+	Session *Session
 }
 
 // HashPassword generates an hash from a password using bcrypt.
@@ -768,6 +1258,16 @@ func HashPassword(password string) (string, error) {
 	return string(bytes), err
 }
 
+// ParsePublicKey parses an SSH public key in the authorized_keys format.
+func ParsePublicKey(key string) (ssh.PublicKey, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+	if err != nil {
+		return nil, ErrInvalidPublicKey
+	}
+
+	return pk, nil
+}
+
 // CheckPasswordHash compares a password with an hash to check if they match.
 func CheckPasswordHash(password, hash string) bool {
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
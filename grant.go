@@ -0,0 +1,371 @@
+package filemanager
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rjchee/dcac_filemanager/dcac"
+)
+
+// SharedWithMe is the virtual directory where the users find the files
+// the other users shared with them.
+const SharedWithMe = "/shared-with-me"
+
+// Grant gives a user, or the members of a group, access to a path of
+// another user. It is enforced by adding the DCAC attributes of the
+// recipients to the ACLs of the path.
+type Grant struct {
+	ID      int    `json:"id" storm:"id,increment"`
+	Path    string `json:"path" storm:"index"`
+	OwnerID int    `json:"ownerID" storm:"index"`
+
+	// UserID is the recipient of the grant, or 0 if it is Group.
+	UserID int    `json:"userID" storm:"index"`
+	Group  string `json:"group" storm:"index"`
+
+	// Write lets the recipients change the files too.
+	Write   bool      `json:"write"`
+	Created time.Time `json:"created"`
+}
+
+// Name is the name of the shared file or directory.
+func (g *Grant) Name() string {
+	return filepath.Base(g.Path)
+}
+
+// DirName is the name of the grant in the SharedWithMe directory.
+func (g *Grant) DirName() string {
+	return strconv.Itoa(g.ID) + "_" + g.Name()
+}
+
+// Includes tells if a user is a recipient of the grant.
+func (g *Grant) Includes(u *User) bool {
+	if g.UserID != 0 {
+		return g.UserID == u.ID
+	}
+
+	for _, group := range u.Groups {
+		if group == g.Group {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseGrantPath splits a path of the SharedWithMe directory into the ID
+// of the grant and the path in the shared directory. It returns false
+// if the path is the SharedWithMe directory itself.
+func ParseGrantPath(p string) (int, string, bool) {
+	p = strings.TrimPrefix(strings.TrimPrefix(p, SharedWithMe), "/")
+	if p == "" {
+		return 0, "", false
+	}
+
+	sub := "/"
+	if i := strings.Index(p, "/"); i != -1 {
+		p, sub = p[:i], p[i:]
+	}
+
+	i := strings.Index(p, "_")
+	if i == -1 {
+		return 0, "", false
+	}
+
+	id, err := strconv.Atoi(p[:i])
+	if err != nil {
+		return 0, "", false
+	}
+
+	return id, sub, true
+}
+
+// CanGrant tells if the calling thread, which holds the attributes of
+// the sharer, may read, or write, a path. A user can't give a right it
+// doesn't have.
+func CanGrant(path string, write bool) bool {
+	mode := uint32(4) // R_OK
+	if write {
+		mode |= 2 // W_OK
+	}
+
+	return syscall.Access(path, mode) == nil
+}
+
+// UserGrants returns the grants a user received, directly or through its
+// groups.
+func (m *FileManager) UserGrants(u *User) ([]*Grant, error) {
+	grants, err := m.Store.Grants.GetByUser(u.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range u.Groups {
+		g, err := m.Store.Grants.GetByGroup(group)
+		if err != nil {
+			return nil, err
+		}
+
+		grants = append(grants, g...)
+	}
+
+	return grants, nil
+}
+
+// grantRecipients returns the users a grant gives access to.
+func (m *FileManager) grantRecipients(g *Grant) ([]*User, error) {
+	if g.UserID != 0 {
+		u, err := m.Store.Users.Get(g.UserID, m.NewFS)
+		if err == ErrNotExist {
+			return nil, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return []*User{u}, nil
+	}
+
+	users, err := m.Store.Users.Gets(m.NewFS)
+	if err != nil && err != ErrNotExist {
+		return nil, err
+	}
+
+	recipients := []*User{}
+	for _, u := range users {
+		if g.Includes(u) {
+			recipients = append(recipients, u)
+		}
+	}
+
+	return recipients, nil
+}
+
+// userACL returns the ACL with the DCAC attribute of a user, without
+// adding it to the calling thread.
+func (m *FileManager) userACL(u *User) (dcac.ACL, error) {
+	usersAttr, err := dcac.OpenGatewayFile(m.UsersGatewayFile(), dcac.ADDMOD)
+	if err != nil {
+		return nil, err
+	}
+	defer usersAttr.Drop()
+
+	return dcac.NewACL(usersAttr.Name.SubAttr(u.Username).String()), nil
+}
+
+// setGrantDCAC adds, or removes, the attributes of users to the ACLs of
+// the path of a grant and of everything under it.
+func (m *FileManager) setGrantDCAC(g *Grant, users []*User, add bool) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	var acl dcac.ACL
+	for _, u := range users {
+		a, err := m.userACL(u)
+		if err != nil {
+			return err
+		}
+
+		acl = acl.OrWith(a)
+	}
+
+	diff := &dcac.FileACLs{Read: acl}
+	if g.Write {
+		diff.Write = acl
+	}
+
+	dcacFileInfo, err := os.Stat(m.DCACDir)
+	if err != nil {
+		return err
+	}
+	databaseFileInfo, _ := os.Stat(m.DatabaseFile)
+
+	return filepath.Walk(g.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			log.Printf("Could not open %s\n", path)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		} else if os.SameFile(dcacFileInfo, info) {
+			return filepath.SkipDir
+		} else if os.SameFile(databaseFileInfo, info) {
+			return nil
+		}
+
+		if add {
+			err = dcac.ModifyFileACLs(path, diff, nil)
+		} else {
+			err = dcac.ModifyFileACLs(path, nil, diff)
+		}
+
+		// The root of the grant must be changed, the rest is best effort
+		// like for the scopes.
+		if err != nil && path == g.Path {
+			return err
+		}
+
+		if err != nil {
+			log.Printf("error modifying file %s's ACL: %s\n", path, err)
+		}
+		return nil
+	})
+}
+
+// AddGrant saves a grant and gives its recipients access to its path.
+func (m *FileManager) AddGrant(g *Grant) error {
+	users, err := m.grantRecipients(g)
+	if err != nil {
+		return err
+	}
+
+	if err := m.setGrantDCAC(g, users, true); err != nil {
+		return err
+	}
+
+	return m.Store.Grants.Save(g)
+}
+
+// RevokeGrant deletes a grant and takes the access to its path back from
+// its recipients, except for what they can still access on their own or
+// through other grants.
+func (m *FileManager) RevokeGrant(g *Grant) error {
+	if err := m.Store.Grants.Delete(g.ID); err != nil {
+		return err
+	}
+
+	users, err := m.grantRecipients(g)
+	if err != nil {
+		return err
+	}
+
+	if err := m.setGrantDCAC(g, users, false); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if err := m.restoreUserDCAC(u, g.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreUserDCAC gives a user back the rights on a path which it has
+// through its scope or its other grants.
+func (m *FileManager) restoreUserDCAC(u *User, path string) error {
+	if u.LocalScope() && overlaps(u.Scope, path) {
+		if err := m.setupUserDCAC(u); err != nil {
+			return err
+		}
+	}
+
+	return m.applyUserGrants(u, nil)
+}
+
+// applyUserGrants gives a user the access of all its grants, and takes
+// the one of the removed grants back.
+func (m *FileManager) applyUserGrants(u *User, removed []*Grant) error {
+	for _, g := range removed {
+		if err := m.setGrantDCAC(g, []*User{u}, false); err != nil {
+			log.Print(err)
+		}
+	}
+
+	grants, err := m.UserGrants(u)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range grants {
+		if err := m.setGrantDCAC(g, []*User{u}, true); err != nil {
+			log.Print(err)
+		}
+	}
+
+	return nil
+}
+
+// updateUserGrants applies the grants of a user after its scope, its
+// rules or its groups changed.
+func (m *FileManager) updateUserGrants(old, newU *User) error {
+	if m.Store.Grants == nil {
+		return nil
+	}
+
+	// Changing the scope or the rules may take back rights the grants give.
+	if old.Scope == newU.Scope && sameStrings(old.Groups, newU.Groups) && sameRules(old.Rules, newU.Rules) &&
+		old.AllowNew == newU.AllowNew && old.AllowEdit == newU.AllowEdit {
+		return nil
+	}
+
+	oldGrants, err := m.UserGrants(old)
+	if err != nil {
+		return err
+	}
+
+	removed := []*Grant{}
+	for _, g := range oldGrants {
+		if !g.Includes(newU) {
+			removed = append(removed, g)
+		}
+	}
+
+	return m.applyUserGrants(newU, removed)
+}
+
+// DeleteUserGrants revokes the grants given by a user and deletes the
+// ones it received.
+func (m *FileManager) DeleteUserGrants(u *User) error {
+	if m.Store.Grants == nil {
+		return nil
+	}
+
+	given, err := m.Store.Grants.GetByOwner(u.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range given {
+		if err := m.RevokeGrant(g); err != nil {
+			return err
+		}
+	}
+
+	// A new user with the same name must not get them back.
+	received, err := m.UserGrants(u)
+	if err != nil {
+		return err
+	}
+
+	for _, g := range received {
+		if err := m.setGrantDCAC(g, []*User{u}, false); err != nil {
+			log.Print(err)
+		}
+
+		if g.UserID != u.ID {
+			continue
+		}
+
+		if err := m.Store.Grants.Delete(g.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// overlaps tells if one of the paths is in the other.
+func overlaps(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	sep := string(filepath.Separator)
+	return a == b || strings.HasPrefix(a, b+sep) || strings.HasPrefix(b, a+sep)
+}
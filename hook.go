@@ -0,0 +1,415 @@
+package filemanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+// HookRejectExitCode is the exit code of the before_* hooks which reject
+// the operation. What they write on the standard error is shown to the
+// user.
+const HookRejectExitCode = 2
+
+var (
+	// DefaultHookTimeout is the timeout of the hooks which don't set one.
+	DefaultHookTimeout = 5 * time.Minute
+
+	// maxHookOutput is the size of the output kept from each stream.
+	maxHookOutput = 64 << 10
+
+	// hookRetention is how long the executions of the hooks are logged.
+	hookRetention = 30 * 24 * time.Hour
+)
+
+// EventData describes an event to the hooks, on their standard input,
+// and to the webhooks.
+type EventData struct {
+	Event       string     `json:"event"`
+	Time        time.Time  `json:"time"`
+	User        EventUser  `json:"user"`
+	Path        string     `json:"path"`
+	Destination string     `json:"destination,omitempty"`
+	File        *EventFile `json:"file,omitempty"`
+
+	// Vars are the details specific to the event, which the hooks also
+	// get as environment variables.
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+// EventUser is the user who caused an event.
+type EventUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+// EventFile is the metadata of the file of an event, once it happened.
+type EventFile struct {
+	Name    string      `json:"name"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"modified"`
+	Mode    os.FileMode `json:"mode"`
+	IsDir   bool        `json:"isDir"`
+}
+
+// newEventData describes an event. The paths are the ones in the scope of
+// the user, as the hooks may be given the paths on the disk.
+func newEventData(event, p, destination string, u *User, vars map[string]string) *EventData {
+	data := &EventData{
+		Event:       event,
+		Time:        time.Now(),
+		User:        EventUser{ID: u.ID, Username: u.Username},
+		Path:        eventPath(u, p),
+		Destination: eventPath(u, destination),
+		Vars:        vars,
+	}
+
+	// The file is the one the event led to.
+	if strings.HasPrefix(event, "after_") && event != "after_delete" && data.Path != "" {
+		target := data.Path
+		if data.Destination != "" {
+			target = data.Destination
+		}
+
+		data.File = eventFile(u, target)
+	}
+
+	return data
+}
+
+// eventPath returns the path of a file in the scope of a user.
+func eventPath(u *User, p string) string {
+	if p == "" || !u.LocalScope() {
+		return p
+	}
+
+	rel, err := filepath.Rel(filepath.Clean(u.Scope), filepath.Clean(p))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return p
+	}
+
+	return path.Clean("/" + filepath.ToSlash(rel))
+}
+
+// eventFile returns the metadata of a file, or nil if it doesn't exist.
+func eventFile(u *User, p string) *EventFile {
+	if u.FileSystem == nil {
+		return nil
+	}
+
+	info, err := u.FileSystem.Stat(p)
+	if err != nil {
+		return nil
+	}
+
+	return &EventFile{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Mode:    info.Mode(),
+		IsDir:   info.IsDir(),
+	}
+}
+
+// Hook is a command run on an event. A command ending with " &" runs in
+// the background, so it can't stop the operation.
+type Hook struct {
+	Command string `json:"command"`
+
+	// Timeout is the number of seconds after which the command is killed.
+	// DefaultHookTimeout is used when it is zero.
+	Timeout int `json:"timeout"`
+
+	// Globs restrict the hook to the files matching one of them. The
+	// globs with a slash are matched against the path in the scope, and
+	// the others against the name of the file.
+	Globs []string `json:"globs"`
+}
+
+// UnmarshalJSON reads the hooks, which used to be plain commands.
+func (h *Hook) UnmarshalJSON(data []byte) error {
+	var command string
+	if err := json.Unmarshal(data, &command); err == nil {
+		*h = Hook{Command: command}
+		return nil
+	}
+
+	type hook Hook
+	return json.Unmarshal(data, (*hook)(h))
+}
+
+// Check checks the command, the timeout and the globs of the hook.
+func (h *Hook) Check() error {
+	if _, _, err := h.split(); err != nil {
+		return ErrInvalidOption
+	}
+
+	if h.Timeout < 0 {
+		return ErrInvalidOption
+	}
+
+	for _, g := range h.Globs {
+		if _, err := path.Match(g, ""); err != nil {
+			return ErrInvalidOption
+		}
+	}
+
+	return nil
+}
+
+// Matches tells if the hook fires for a path in the scope.
+func (h *Hook) Matches(p string) bool {
+	if len(h.Globs) == 0 {
+		return true
+	}
+
+	for _, g := range h.Globs {
+		target := path.Base(p)
+		if strings.Contains(g, "/") {
+			target = p
+			if !strings.HasPrefix(g, "/") {
+				g = "/" + g
+			}
+		}
+
+		if ok, _ := path.Match(g, target); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Background tells if the command runs in the background.
+func (h *Hook) Background() bool {
+	return strings.HasSuffix(strings.TrimSpace(h.Command), " &")
+}
+
+func (h *Hook) split() (string, []string, error) {
+	command := strings.TrimSpace(h.Command)
+	if h.Background() {
+		command = strings.TrimSpace(strings.TrimSuffix(command, "&"))
+	}
+
+	name, args, err := caddy.SplitCommandAndArgs(command)
+	if err == nil && name == "" {
+		err = ErrInvalidOption
+	}
+
+	return name, args, err
+}
+
+func (h *Hook) timeout() time.Duration {
+	if h.Timeout == 0 {
+		return DefaultHookTimeout
+	}
+
+	return time.Duration(h.Timeout) * time.Second
+}
+
+// HookRejection is the error of a before_* hook which rejected the
+// operation.
+type HookRejection struct {
+	Event   string
+	Message string
+}
+
+func (e *HookRejection) Error() string {
+	return e.Message
+}
+
+// Status is the HTTP status of the rejection. The content of the files
+// which are saved or uploaded is unprocessable, the other operations are
+// forbidden.
+func (e *HookRejection) Status() int {
+	switch e.Event {
+	case "before_save", "before_upload", "before_publish":
+		return http.StatusUnprocessableEntity
+	}
+
+	return http.StatusForbidden
+}
+
+// HookExecution is the record of a hook which ran.
+type HookExecution struct {
+	ID          int           `json:"id" storm:"id,increment"`
+	Event       string        `json:"event" storm:"index"`
+	Command     string        `json:"command"`
+	Username    string        `json:"username"`
+	Path        string        `json:"path"`
+	Destination string        `json:"destination"`
+	Started     time.Time     `json:"started"`
+	Duration    time.Duration `json:"duration"`
+	ExitCode    int           `json:"exitCode"`
+	TimedOut    bool          `json:"timedOut"`
+	Rejected    bool          `json:"rejected"`
+	Output      string        `json:"output"`
+	Errors      string        `json:"errors"`
+	Error       string        `json:"error"`
+}
+
+// limitedBuffer keeps the first bytes written to it.
+type limitedBuffer struct {
+	bytes.Buffer
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if n := b.max - b.Len(); n < len(p) {
+		if n > 0 {
+			b.Buffer.Write(p[:n])
+		}
+
+		return len(p), nil
+	}
+
+	return b.Buffer.Write(p)
+}
+
+// runHook runs a hook with the data of its event on the standard input.
+func (m FileManager) runHook(h *Hook, data *EventData, env []string, input []byte) error {
+	name, args, err := h.split()
+	if err != nil {
+		return err
+	}
+
+	run := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout())
+		defer cancel()
+
+		stdout := &limitedBuffer{max: maxHookOutput}
+		stderr := &limitedBuffer{max: maxHookOutput}
+
+		cmd := exec.CommandContext(ctx, name, args...)
+		cmd.Env = env
+		cmd.Stdin = bytes.NewReader(input)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+
+		// The children left holding the output don't hold the operation.
+		cmd.WaitDelay = time.Second
+
+		e := &HookExecution{
+			Event:       data.Event,
+			Command:     h.Command,
+			Username:    data.User.Username,
+			Path:        data.Path,
+			Destination: data.Destination,
+			Started:     time.Now(),
+		}
+
+		err := cmd.Run()
+		e.Duration = time.Since(e.Started)
+		e.Output = stdout.String()
+		e.Errors = stderr.String()
+		if cmd.ProcessState != nil {
+			e.ExitCode = cmd.ProcessState.ExitCode()
+		}
+
+		switch {
+		case ctx.Err() == context.DeadlineExceeded:
+			e.TimedOut = true
+			err = ErrHookTimeout
+		case err != nil && e.ExitCode == HookRejectExitCode && strings.HasPrefix(data.Event, "before_"):
+			e.Rejected = true
+			err = &HookRejection{Event: data.Event, Message: rejectionMessage(e.Errors)}
+		}
+
+		if err != nil {
+			e.Error = err.Error()
+		}
+
+		m.logHook(e)
+		return err
+	}
+
+	if h.Background() {
+		log.Printf("[INFO] Nonblocking Command:\"%s %s\"", name, strings.Join(args, " "))
+		go func() {
+			if err := run(); err != nil {
+				log.Printf("hook %q of %s failed: %s\n", h.Command, data.Event, err)
+			}
+		}()
+
+		return nil
+	}
+
+	log.Printf("[INFO] Blocking Command:\"%s %s\"", name, strings.Join(args, " "))
+	return run()
+}
+
+// rejectionMessage is the message shown to the user when a hook rejects
+// an operation.
+func rejectionMessage(stderr string) string {
+	msg := strings.TrimSpace(stderr)
+	if msg == "" {
+		return "the operation was rejected by a hook"
+	}
+
+	if len(msg) > 1024 {
+		msg = msg[:1024]
+	}
+
+	return msg
+}
+
+// logHook records the execution of a hook, if there is a log.
+func (m FileManager) logHook(e *HookExecution) {
+	if m.Store.Hooks == nil {
+		return
+	}
+
+	if err := m.Store.Hooks.Save(e); err != nil {
+		log.Print(err)
+	}
+}
+
+// hookEnv is the environment of the hooks.
+func hookEnv(event, p, destination string, u *User, vars map[string]string) []string {
+	env := append(os.Environ(),
+		fmt.Sprintf("FILE=%s", p),
+		fmt.Sprintf("ROOT=%s", HideScope(u.Scope)),
+		fmt.Sprintf("TRIGGER=%s", event),
+		fmt.Sprintf("USERNAME=%s", u.Username),
+	)
+
+	if destination != "" {
+		env = append(env, fmt.Sprintf("DESTINATION=%s", destination))
+	}
+
+	for k, v := range vars {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	return env
+}
+
+// HookCleaner deletes the old executions of the hooks.
+func (m FileManager) HookCleaner() {
+	executions, err := m.Store.Hooks.Gets()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, e := range executions {
+		if time.Since(e.Started) < hookRetention {
+			continue
+		}
+
+		if err := m.Store.Hooks.Delete(e.ID); err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -2,8 +2,9 @@ package http
 
 import (
 	"encoding/json"
+	"log"
 	"net/http"
-	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,44 +13,29 @@ import (
 	fm "github.com/rjchee/dcac_filemanager"
 )
 
-const reCaptchaAPI = "https://www.google.com/recaptcha/api/siteverify"
-
 type cred struct {
-	Password  string `json:"password"`
-	Username  string `json:"username"`
+	Password string `json:"password"`
+	Username string `json:"username"`
+	OTP      string `json:"otp"`
+
+	// ReCaptcha is the response to the Captcha, whichever it is.
 	ReCaptcha string `json:"recaptcha"`
 }
 
-// reCaptcha checks the reCaptcha code.
-func reCaptcha(secret string, response string) (bool, error) {
-	body := url.Values{}
-	body.Set("secret", secret)
-	body.Add("response", response)
-
-	client := &http.Client{}
-
-	resp, err := client.Post(reCaptchaAPI, "application/x-www-form-urlencoded", strings.NewReader(body.Encode()))
-	if err != nil {
-		return false, err
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return false, nil
-	}
-
-	var data struct {
-		Success     bool        `json:"success"`
-		ChallengeTS time.Time   `json:"challenge_ts"`
-		Hostname    string      `json:"hostname"`
-		ErrorCodes  interface{} `json:"error-codes"`
+// captchaHandler gives a new challenge of the Captcha to the front-end.
+func captchaHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.Captcha == nil {
+		return http.StatusNotFound, nil
 	}
 
-	err = json.NewDecoder(resp.Body).Decode(&data)
+	challenge, err := c.Captcha.Challenge()
 	if err != nil {
-		return false, err
+		return http.StatusInternalServerError, err
 	}
 
-	return data.Success, nil
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(challenge))
+	return 0, nil
 }
 
 // authHandler processes the authentication for the user.
@@ -70,9 +56,9 @@ func authHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, er
 		return http.StatusForbidden, nil
 	}
 
-	// If ReCaptcha is enabled, check the code.
-	if len(c.ReCaptchaSecret) > 0 {
-		ok, err := reCaptcha(c.ReCaptchaSecret, cred.ReCaptcha)
+	// If a Captcha is enabled, check the response.
+	if c.Captcha != nil {
+		ok, err := c.Captcha.Verify(cred.ReCaptcha, r.RemoteAddr)
 		if err != nil {
 			return http.StatusForbidden, err
 		}
@@ -82,19 +68,81 @@ func authHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, er
 		}
 	}
 
-	// Checks if the user exists.
-	u, err := c.Store.Users.GetByUsername(cred.Username, c.NewFS)
-	if err != nil {
+	// Checks if the user exists and if the password is correct, unless
+	// there were too many failures lately.
+	u, err := c.AuthenticateFrom(cred.Username, cred.Password, r.RemoteAddr)
+	if t, ok := err.(*fm.ThrottledError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(t.Until).Seconds())+1))
+		return http.StatusTooManyRequests, nil
+	}
+
+	if err == fm.ErrInvalidCredentials {
 		return http.StatusForbidden, nil
 	}
 
-	// Checks if the password is correct.
-	if !fm.CheckPasswordHash(cred.Password, u.Password) {
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Service accounts can't log in interactively.
+	if u.ServiceAccount {
 		return http.StatusForbidden, nil
 	}
 
+	// The users with a second factor must give its code too. Without
+	// one, the front-end is told to ask for it.
+	if u.TwoFactor.Enabled {
+		if cred.OTP == "" {
+			return http.StatusUnauthorized, nil
+		}
+
+		ok, err := c.CheckTwoFactor(u, cred.OTP)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		if !ok {
+			if err := c.LoginFailed(cred.Username, r.RemoteAddr); err != nil {
+				log.Print(err)
+			}
+
+			return http.StatusForbidden, nil
+		}
+	}
+
+	if err := c.LoginSucceeded(cred.Username); err != nil {
+		log.Print(err)
+	}
+
+	vars := loginVars(r, "password")
+	if err := c.RunnerVars("before_login", "", "", u, vars); err != nil {
+		return hookStatus(err), err
+	}
+
 	c.User = u
-	return printToken(c, w)
+	code, err := printToken(c, w, r)
+	if err == nil {
+		loggedIn(c, vars)
+	}
+
+	return code, err
+}
+
+// loginVars are the details of a login given to its hooks.
+func loginVars(r *http.Request, method string) map[string]string {
+	return map[string]string{
+		"LOGIN_METHOD": method,
+		"REMOTE_ADDR":  r.RemoteAddr,
+		"USER_AGENT":   r.UserAgent(),
+	}
+}
+
+// loggedIn fires the after_login hooks. The token was already issued, so
+// their failures are only logged.
+func loggedIn(c *fm.Context, vars map[string]string) {
+	if err := c.RunnerVars("after_login", "", "", c.User, vars); err != nil {
+		log.Print(err)
+	}
 }
 
 // renewAuthHandler is used when the front-end already has a JWT token
@@ -105,23 +153,60 @@ func renewAuthHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (in
 		return http.StatusForbidden, nil
 	}
 
+	// An API token can't be traded for a token without its restrictions.
+	if u.Token != nil {
+		return http.StatusForbidden, nil
+	}
+
 	c.User = u
-	return printToken(c, w)
+	return replaceToken(c, w, r)
+}
+
+// replaceToken prints a new token to the user, whose session replaces
+// the one of the old token.
+func replaceToken(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	old := c.Session
+
+	code, err := printToken(c, w, r)
+	if err == nil && old != nil {
+		if err := c.Store.Sessions.Delete(old.ID); err != nil && err != fm.ErrNotExist {
+			log.Print(err)
+		}
+	}
+
+	return code, err
 }
 
 // claims is the JWT claims.
 type claims struct {
 	fm.User
 	jwt.StandardClaims
+
+	// NeedsEnrollment tells the front-end the user must enroll a second
+	// factor before anything else.
+	NeedsEnrollment bool `json:"needsEnrollment"`
 }
 
 // printToken prints the final JWT token to the user.
-func printToken(c *fm.Context, w http.ResponseWriter) (int, error) {
+func printToken(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	signed, err := issueToken(c, r)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Writes the token.
+	w.Header().Set("Content-Type", "cty")
+	w.Write([]byte(signed))
+	return 0, nil
+}
+
+// issueToken opens a session for the user and returns its signed JWT.
+func issueToken(c *fm.Context, r *http.Request) (string, error) {
 	// Creates a copy of the user and removes it password
-	// hash so it never arrives to the user.
+	// hash and secrets so they never arrive to the user.
 	u := fm.User{}
 	u = *c.User
-	u.Password = ""
+	u.HideSecrets()
 
 	// Builds the claims.
 	claims := claims{
@@ -130,20 +215,43 @@ func printToken(c *fm.Context, w http.ResponseWriter) (int, error) {
 			ExpiresAt: time.Now().Add(time.Hour * 24).Unix(),
 			Issuer:    "File Manager",
 		},
+		c.NeedsEnrollment(c.User),
+	}
+
+	// Tracks the session so it can be revoked.
+	if c.Store.Sessions != nil {
+		s, err := fm.NewSession(c.User.ID, time.Hour*24)
+		if err != nil {
+			return "", err
+		}
+
+		s.Address = r.RemoteAddr
+		s.UserAgent = r.UserAgent()
+
+		if err := c.Store.Sessions.Save(s); err != nil {
+			return "", err
+		}
+
+		claims.Id = s.ID
 	}
 
 	// Creates the token and signs it.
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	signed, err := token.SignedString(c.Key)
+	return token.SignedString(c.SigningKey())
+}
 
-	if err != nil {
-		return http.StatusInternalServerError, err
+// changingPassword tells if a request is allowed to a user who must change
+// its password: the renewal of its token and the update of itself, which
+// usersPutHandler limits to the password.
+func changingPassword(r *http.Request, u *fm.User) bool {
+	switch {
+	case r.URL.Path == "/auth/renew":
+		return true
+	case r.Method == http.MethodPut && r.URL.Path == "/users/"+strconv.Itoa(u.ID):
+		return true
 	}
 
-	// Writes the token.
-	w.Header().Set("Content-Type", "cty")
-	w.Write([]byte(signed))
-	return 0, nil
+	return false
 }
 
 type extractor []string
@@ -174,8 +282,12 @@ func validateAuth(c *fm.Context, r *http.Request) (bool, *fm.User) {
 		return true, c.User
 	}
 
+	if token, ok := bearerToken(r); ok {
+		return apiTokenAuth(c, token)
+	}
+
 	keyFunc := func(token *jwt.Token) (interface{}, error) {
-		return c.Key, nil
+		return c.SigningKey(), nil
 	}
 
 	var claims claims
@@ -190,7 +302,27 @@ func validateAuth(c *fm.Context, r *http.Request) (bool, *fm.User) {
 	}
 
 	u, err := c.Store.Users.Get(claims.User.ID, c.NewFS)
-	if err != nil {
+	if err != nil || u.Disabled {
+		return false, nil
+	}
+
+	// The tokens issued before a change of the password or of the
+	// permissions of the user are revoked.
+	if claims.User.TokenVersion != u.TokenVersion {
+		return false, nil
+	}
+
+	if c.Store.Sessions != nil {
+		s, err := c.Store.Sessions.Get(claims.Id)
+		if err != nil || s.UserID != u.ID {
+			return false, nil
+		}
+
+		c.Session = s
+	}
+
+	// The users who must change their password can't do anything else.
+	if u.MustChangePassword && !changingPassword(r, u) {
 		return false, nil
 	}
 
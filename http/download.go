@@ -3,9 +3,11 @@ package http
 import (
 	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -14,6 +16,44 @@ import (
 	"github.com/mholt/archiver"
 )
 
+// downloadEventHandler fires the download hooks around downloadHandler.
+// The requests which resume a download don't fire them again.
+func downloadEventHandler(c *fm.Context, w http.ResponseWriter, r *http.Request, vars map[string]string) (int, error) {
+	if rng := r.Header.Get("Range"); rng != "" && !strings.HasPrefix(rng, "bytes=0-") {
+		return downloadHandler(c, w, r)
+	}
+
+	if vars == nil {
+		vars = map[string]string{}
+	}
+
+	if c.File.IsDir {
+		format := r.URL.Query().Get("format")
+		if format == "true" || format == "" {
+			format = "zip"
+		}
+
+		vars["DOWNLOAD_FORMAT"] = format
+		vars["DOWNLOAD_FILES"] = r.URL.Query().Get("files")
+	}
+
+	if err := c.RunnerVars("before_download", c.File.VirtualPath, "", c.User, vars); err != nil {
+		return hookStatus(err), err
+	}
+
+	code, err := downloadHandler(c, w, r)
+	if err != nil || code >= 300 {
+		return code, err
+	}
+
+	// The file was sent, so failures are only logged.
+	if err := c.RunnerVars("after_download", c.File.VirtualPath, "", c.User, vars); err != nil {
+		log.Print(err)
+	}
+
+	return code, nil
+}
+
 // downloadHandler creates an archive in one of the supported formats (zip, tar,
 // tar.gz or tar.bz2) and sends it to be downloaded.
 func downloadHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
@@ -23,6 +63,11 @@ func downloadHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 		return downloadFileHandler(c, w, r)
 	}
 
+	// The archivers need the files on the local disk.
+	if !c.User.LocalScope() {
+		return http.StatusNotImplemented, nil
+	}
+
 	query := r.URL.Query().Get("format")
 	files := []string{}
 	names := strings.Split(r.URL.Query().Get("files"), ",")
@@ -39,12 +84,22 @@ func downloadHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 
 			// Clean the slashes.
 			name = fileutils.SlashClean(name)
+
+			// The files the rules hide are left out, like in the listings.
+			if !c.User.Allowed(path.Join(c.File.VirtualPath, name)) {
+				continue
+			}
+
 			files = append(files, filepath.Join(c.File.Path, name))
 		}
 	} else {
 		files = append(files, c.File.Path)
 	}
 
+	if len(files) == 0 {
+		return http.StatusNotFound, nil
+	}
+
 	// If the format is true, just set it to "zip".
 	if query == "true" || query == "" {
 		query = "zip"
@@ -111,6 +166,12 @@ func downloadFileHandler(c *fm.Context, w http.ResponseWriter, r *http.Request)
 		w.Header().Set("Content-Disposition", `attachment; filename="`+c.File.Name+`"`)
 	}
 
-	http.ServeFile(w, r, c.File.Path)
+	file, err := c.User.FileSystem.OpenFile(c.File.VirtualPath, os.O_RDONLY, 0)
+	if err != nil {
+		return ErrorToHTTP(err, false), err
+	}
+	defer file.Close()
+
+	http.ServeContent(w, r, c.File.Name, c.File.ModTime, file)
 	return 0, nil
 }
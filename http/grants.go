@@ -0,0 +1,274 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// grantOptions is the body of the requests which share a path with a
+// user or a group.
+type grantOptions struct {
+	Username string `json:"username"`
+	Group    string `json:"group"`
+	Write    bool   `json:"write"`
+}
+
+// grantInfo is a grant as the users see it. The sharers see the path in
+// their scope and the recipients the one in the SharedWithMe directory.
+type grantInfo struct {
+	ID       int       `json:"id"`
+	Path     string    `json:"path"`
+	Name     string    `json:"name"`
+	Owner    string    `json:"owner"`
+	Username string    `json:"username"`
+	Group    string    `json:"group"`
+	Write    bool      `json:"write"`
+	Created  time.Time `json:"created"`
+}
+
+func grantsHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.Store.Grants == nil {
+		return http.StatusNotImplemented, nil
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		return grantsGetHandler(c, w, r)
+	case http.MethodPost:
+		return grantsPostHandler(c, w, r)
+	case http.MethodDelete:
+		return grantsDeleteHandler(c, w, r)
+	}
+
+	return http.StatusMethodNotAllowed, nil
+}
+
+// grantsGetHandler lists the grants the user gave, or the ones it
+// received with ?received.
+func grantsGetHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	_, received := r.URL.Query()["received"]
+
+	var (
+		grants []*fm.Grant
+		err    error
+	)
+
+	if received {
+		grants, err = c.UserGrants(c.User)
+	} else {
+		grants, err = c.Store.Grants.GetByOwner(c.User.ID)
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	users, err := c.Store.Users.Gets(c.NewFS)
+	if err != nil && err != fm.ErrNotExist {
+		return http.StatusInternalServerError, err
+	}
+
+	byID := map[int]*fm.User{}
+	for _, u := range users {
+		byID[u.ID] = u
+	}
+
+	infos := []grantInfo{}
+	for _, g := range grants {
+		info := grantInfo{
+			ID:      g.ID,
+			Name:    g.Name(),
+			Group:   g.Group,
+			Write:   g.Write,
+			Created: g.Created,
+		}
+
+		if u, ok := byID[g.OwnerID]; ok {
+			info.Owner = u.Username
+		}
+
+		if u, ok := byID[g.UserID]; ok {
+			info.Username = u.Username
+		}
+
+		if received {
+			info.Path = fm.SharedWithMe + "/" + g.DirName()
+		} else {
+			rel, err := filepath.Rel(c.User.Scope, g.Path)
+			if err != nil {
+				continue
+			}
+
+			info.Path = path.Clean("/" + filepath.ToSlash(rel))
+		}
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+
+	return renderJSON(w, infos)
+}
+
+// grantsPostHandler shares a path of the user with another user, or with
+// a group. Sharing it again with the same recipient changes the level of
+// access.
+func grantsPostHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	// The grants are enforced by the ACLs of the files on the disk.
+	if !c.User.LocalScope() {
+		return http.StatusBadRequest, nil
+	}
+
+	if r.Body == nil {
+		return http.StatusBadRequest, nil
+	}
+
+	var opts grantOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if (opts.Username == "") == (opts.Group == "") {
+		return http.StatusBadRequest, fm.ErrInvalidOption
+	}
+
+	if opts.Write && !c.User.AllowEdit {
+		return http.StatusForbidden, nil
+	}
+
+	vpath := sanitizeURL(r.URL.Path)
+	if _, err := c.User.FileSystem.Stat(vpath); err != nil {
+		return ErrorToHTTP(err, false), err
+	}
+
+	g := &fm.Grant{
+		Path:    filepath.Join(c.User.Scope, vpath),
+		OwnerID: c.User.ID,
+		Group:   opts.Group,
+		Write:   opts.Write,
+		Created: time.Now(),
+	}
+
+	if opts.Username != "" {
+		u, err := c.Store.Users.GetByUsername(opts.Username, c.NewFS)
+		if err == fm.ErrNotExist {
+			return http.StatusNotFound, err
+		}
+
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		if u.ID == c.User.ID {
+			return http.StatusBadRequest, nil
+		}
+
+		g.UserID = u.ID
+	}
+
+	// A user can't give more than it has.
+	if !fm.CanGrant(g.Path, g.Write) {
+		return http.StatusForbidden, nil
+	}
+
+	vars := grantVars(g, opts.Username)
+	if err := c.RunnerVars("before_grant", g.Path, "", c.User, vars); err != nil {
+		return hookStatus(err), err
+	}
+
+	given, err := c.Store.Grants.GetByOwner(c.User.ID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	for _, old := range given {
+		if old.Path != g.Path || old.UserID != g.UserID || old.Group != g.Group {
+			continue
+		}
+
+		if err := c.RevokeGrant(old); err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	if err := c.AddGrant(g); err != nil {
+		return ErrorToHTTP(err, false), err
+	}
+
+	vars["GRANT_ID"] = strconv.Itoa(g.ID)
+	if err := c.RunnerVars("after_grant", g.Path, "", c.User, vars); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return renderJSON(w, g.ID)
+}
+
+// grantsDeleteHandler revokes a grant. Only the users who gave it and the
+// admins can do it.
+func grantsDeleteHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	g, err := c.Store.Grants.Get(id)
+	if err == fm.ErrNotExist {
+		return http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if g.OwnerID != c.User.ID && !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	var username string
+	if g.UserID != 0 {
+		if u, err := c.Store.Users.Get(g.UserID, c.NewFS); err == nil {
+			username = u.Username
+		}
+	}
+
+	vars := grantVars(g, username)
+	if err := c.RunnerVars("before_revoke", g.Path, "", c.User, vars); err != nil {
+		return hookStatus(err), err
+	}
+
+	if err := c.RevokeGrant(g); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if err := c.RunnerVars("after_revoke", g.Path, "", c.User, vars); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// grantVars are the details of a grant given to the hooks of the changes
+// of the ACLs.
+func grantVars(g *fm.Grant, username string) map[string]string {
+	vars := map[string]string{
+		"GRANT_USERNAME": username,
+		"GRANT_GROUP":    g.Group,
+		"GRANT_WRITE":    strconv.FormatBool(g.Write),
+	}
+
+	if g.ID != 0 {
+		vars["GRANT_ID"] = strconv.Itoa(g.ID)
+	}
+
+	return vars
+}
@@ -0,0 +1,63 @@
+package http
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// maxHookExecutions is the number of executions listed by default.
+const maxHookExecutions = 100
+
+// hooksHandler lets the admins see the log of the hooks, the latest
+// first. It may be filtered with ?event.
+func hooksHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	if c.Store.Hooks == nil {
+		return http.StatusNotImplemented, nil
+	}
+
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	limit := maxHookExecutions
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			return http.StatusBadRequest, fm.ErrInvalidOption
+		}
+	}
+
+	executions, err := c.Store.Hooks.Gets()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if event := r.URL.Query().Get("event"); event != "" {
+		filtered := []*fm.HookExecution{}
+		for _, e := range executions {
+			if e.Event == event {
+				filtered = append(filtered, e)
+			}
+		}
+
+		executions = filtered
+	}
+
+	sort.Slice(executions, func(i, j int) bool {
+		return executions[i].ID > executions[j].ID
+	})
+
+	if len(executions) > limit {
+		executions = executions[:limit]
+	}
+
+	return renderJSON(w, executions)
+}
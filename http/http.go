@@ -5,7 +5,9 @@ import (
 	"html/template"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -27,6 +29,12 @@ func Handler(m *fm.FileManager) http.Handler {
 			w.WriteHeader(code)
 
 			txt := http.StatusText(code)
+
+			// The hooks which reject an operation tell the user why.
+			if rej, ok := err.(*fm.HookRejection); ok {
+				txt = rej.Message
+			}
+
 			log.Printf("%v: %v %v\n", r.URL.Path, code, txt)
 			w.Write([]byte(txt + "\n"))
 		}
@@ -80,6 +88,16 @@ func serve(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
 		return c.StaticGen.Preview(c, w, r)
 	}
 
+	// S3 clients sign their requests instead of logging in.
+	if r.URL.Path == "/s3" || strings.HasPrefix(r.URL.Path, "/s3/") {
+		return s3Handler(c, w, r)
+	}
+
+	// WebDAV clients mount the user's scope from /dav/.
+	if r.URL.Path == "/dav" || strings.HasPrefix(r.URL.Path, "/dav/") {
+		return davHandler(c, w, r)
+	}
+
 	if strings.HasPrefix(r.URL.Path, "/share/") {
 		r.URL.Path = strings.TrimPrefix(r.URL.Path, "/share/")
 		return sharePage(c, w, r)
@@ -113,6 +131,18 @@ func apiHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, err
 		return renewAuthHandler(c, w, r)
 	}
 
+	if r.URL.Path == "/auth/captcha" {
+		return captchaHandler(c, w, r)
+	}
+
+	if r.URL.Path == "/auth/oidc" {
+		return oidcLoginHandler(c, w, r)
+	}
+
+	if r.URL.Path == "/auth/oidc/callback" {
+		return oidcCallbackHandler(c, w, r)
+	}
+
 	valid, user := validateAuth(c, r)
 	if !valid {
 		return http.StatusForbidden, nil
@@ -121,33 +151,43 @@ func apiHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, err
 	// TODO: check if locking is required
 	//runtime.LockOSThread()
 	//defer runtime.UnlockOSThread()
-	usersAttr, gatewayErr := dcac.OpenGatewayFile(c.UsersGatewayFile(), dcac.ADDMOD)
-	if gatewayErr != nil {
-		log.Printf("error opening gateway: %s\n", gatewayErr)
-		usersAttr.Drop()
+	release, err := c.AcquireAttrs(user)
+	if err != nil {
+		log.Printf("error acquiring the attributes of %s: %s\n", user.Username, err)
 		// abuse the bad gateway http response
 		return http.StatusBadGateway, nil
 	}
-	userAttr, err := usersAttr.AddSub(user.Username, dcac.ADDMOD)
-	if err != nil {
-		// could not add subattr
-		log.Printf("error adding subattribute: %s.%s\n", usersAttr, user.Username)
-		return http.StatusInternalServerError, nil
-	}
-	defer userAttr.Drop()
-	// try to grab the admin attribute as well (which will fail if the user is not an Admin)
-	if adminAttr, err := dcac.OpenGatewayFile(c.AdminGatewayFile(), dcac.ADDMOD); err == nil {
-		defer adminAttr.Drop()
-	}
-	usersAttr.Drop()
+	defer release()
 	dcac.PrintAttrs()
 
 	c.Router, r.URL.Path = splitURL(r.URL.Path)
 
+	if !checkTokenAccess(c, r) {
+		return http.StatusForbidden, nil
+	}
+
+	// The users the policy requires a second factor from can't do
+	// anything else before enrolling one. API tokens are created
+	// after the login, so they're spared, and the password comes first.
+	if !c.NoAuth && user.Token == nil && !user.MustChangePassword &&
+		c.Router != "totp" && c.NeedsEnrollment(user) {
+		return http.StatusForbidden, nil
+	}
+
 	if !c.User.Allowed(r.URL.Path) {
 		return http.StatusForbidden, nil
 	}
 
+	if sharedWithMe(c, r) {
+		if strings.TrimSuffix(sanitizeURL(r.URL.Path), "/") == fm.SharedWithMe {
+			return sharedWithMeListing(c, w, r)
+		}
+
+		if code, err := enterGrant(c, r); code != 0 || err != nil {
+			return code, err
+		}
+	}
+
 	if c.StaticGen != nil {
 		// If we are using the 'magic url' for the settings,
 		// we should redirect the request for the acutual path.
@@ -162,7 +202,7 @@ func apiHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, err
 		}
 	}
 
-	if c.Router == "checksum" || c.Router == "download" {
+	if c.Router == "checksum" || c.Router == "download" || c.Router == "thumbnail" {
 		var err error
 		c.File, err = fm.GetInfo(r.URL, c.FileManager, c.User)
 		if err != nil {
@@ -174,13 +214,19 @@ func apiHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, err
 
 	switch c.Router {
 	case "download":
-		code, err = downloadHandler(c, w, r)
+		code, err = downloadEventHandler(c, w, r, nil)
 	case "checksum":
 		code, err = checksumHandler(c, w, r)
+	case "thumbnail":
+		code, err = thumbnailHandler(c, w, r)
 	case "command":
 		code, err = command(c, w, r)
 	case "search":
 		code, err = search(c, w, r)
+	case "watch":
+		code, err = watchHandler(c, w, r)
+	case "index":
+		code, err = reindexHandler(c, w, r)
 	case "resource":
 		code, err = resourceHandler(c, w, r)
 	case "users":
@@ -189,6 +235,26 @@ func apiHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, err
 		code, err = settingsHandler(c, w, r)
 	case "share":
 		code, err = shareHandler(c, w, r)
+	case "shares":
+		code, err = sharesHandler(c, w, r)
+	case "grants":
+		code, err = grantsHandler(c, w, r)
+	case "webhooks":
+		code, err = webhooksHandler(c, w, r)
+	case "hooks":
+		code, err = hooksHandler(c, w, r)
+	case "keys":
+		code, err = keysHandler(c, w, r)
+	case "usage":
+		code, err = usageHandler(c, w, r)
+	case "tokens":
+		code, err = tokensHandler(c, w, r)
+	case "sessions":
+		code, err = sessionsHandler(c, w, r)
+	case "lockouts":
+		code, err = lockoutsHandler(c, w, r)
+	case "totp":
+		code, err = totpHandler(c, w, r)
 	default:
 		code = http.StatusNotFound
 	}
@@ -254,6 +320,12 @@ func renderFile(c *fm.Context, w http.ResponseWriter, file string) (int, error)
 		"ReCaptcha":       c.ReCaptchaKey != "" && c.ReCaptchaSecret != "",
 		"ReCaptchaKey":    c.ReCaptchaKey,
 		"ReCaptchaSecret": c.ReCaptchaSecret,
+		"OIDC":            c.OIDC != nil && !c.NoAuth,
+		"Captcha":         "",
+	}
+
+	if c.Captcha != nil {
+		data["Captcha"] = c.Captcha.Name()
 	}
 
 	if c.StaticGen != nil {
@@ -271,7 +343,13 @@ func renderFile(c *fm.Context, w http.ResponseWriter, file string) (int, error)
 
 // sharePage build the share page.
 func sharePage(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
-	s, err := c.Store.Share.Get(r.URL.Path)
+	// The path after the hash is in the shared directory.
+	hash, sub := r.URL.Path, "/"
+	if i := strings.Index(hash, "/"); i != -1 {
+		hash, sub = hash[:i], hash[i:]
+	}
+
+	s, err := c.Store.Share.Get(hash)
 	if err == fm.ErrNotExist {
 		w.WriteHeader(http.StatusNotFound)
 		return renderFile(c, w, "static/share/404.html")
@@ -287,41 +365,96 @@ func sharePage(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, erro
 		return renderFile(c, w, "static/share/404.html")
 	}
 
-	r.URL.Path = s.Path
+	if !s.Allows(r.RemoteAddr) {
+		return http.StatusForbidden, nil
+	}
 
-	info, err := os.Stat(s.Path)
+	if s.HasPassword() && !shareUnlocked(c, r, s) {
+		return sharePasswordPage(c, w, r, s)
+	}
+
+	// The file is served with the rights of the user who shared it, as
+	// long as it is still in its scope.
+	owner, root, err := c.ShareOwner(s)
+	if err == fm.ErrNotExist {
+		c.Store.Share.Delete(s.Hash)
+		w.WriteHeader(http.StatusNotFound)
+		return renderFile(c, w, "static/share/404.html")
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if owner.Disabled {
+		return http.StatusForbidden, nil
+	}
+
+	release, err := c.AcquireAttrs(owner)
 	if err != nil {
+		log.Printf("error acquiring the attributes of %s: %s\n", owner.Username, err)
+		return http.StatusBadGateway, nil
+	}
+	defer release()
+
+	c.User = owner
+
+	if _, err := owner.FileSystem.Stat(root); os.IsNotExist(err) {
 		c.Store.Share.Delete(s.Hash)
+		return http.StatusNotFound, err
+	}
+
+	// The upload links don't show anything of their directory.
+	if s.Upload {
+		return shareUploadHandler(c, w, r, s, root, sub)
+	}
+
+	// Nothing out of the shared directory can be reached: the path is
+	// cleaned and the symbolic links can't lead out of it either.
+	sub = path.Clean("/" + sub)
+	target := path.Join(root, sub)
+	if !s.Contains(owner, target) || !owner.Allowed(target) {
+		w.WriteHeader(http.StatusNotFound)
+		return renderFile(c, w, "static/share/404.html")
+	}
+
+	c.File, err = fm.GetInfo(&url.URL{Path: target}, c.FileManager, owner)
+	if err != nil {
 		return ErrorToHTTP(err, false), err
 	}
 
-	c.File = &fm.File{
-		Path:    s.Path,
-		Name:    info.Name(),
-		ModTime: info.ModTime(),
-		Mode:    info.Mode(),
-		IsDir:   info.IsDir(),
-		Size:    info.Size(),
+	r.URL.Path = target
+
+	switch {
+	case queryFlag(r, "raw"):
+		return shareRawHandler(c, w, r, s)
+	case queryFlag(r, "view"):
+		return sharePreviewPage(c, w, r, s, sub)
+	case queryFlag(r, "dl"):
+		return shareDownloadHandler(c, w, r, s)
+	case c.File.IsDir:
+		return shareListingPage(c, w, r, s, sub)
 	}
 
-	dl := r.URL.Query().Get("dl")
+	if _, err := c.Store.Share.CountView(s.Hash); err != nil {
+		return http.StatusInternalServerError, err
+	}
 
-	if dl == "" || dl == "0" {
-		tpl := template.Must(template.New("file").Parse(c.Assets.MustString("static/share/index.html")))
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	tpl := template.Must(template.New("file").Parse(c.Assets.MustString("static/share/index.html")))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
-		err := tpl.Execute(w, map[string]interface{}{
-			"BaseURL": c.RootURL(),
-			"File":    c.File,
-		})
+	err = tpl.Execute(w, map[string]interface{}{
+		"BaseURL":     c.RootURL(),
+		"File":        c.File,
+		"ViewOnly":    s.ViewOnly,
+		"Previewable": sharePreviewType(c.File) != "",
+	})
 
-		if err != nil {
-			return http.StatusInternalServerError, err
-		}
-		return 0, nil
+	if err != nil {
+		return http.StatusInternalServerError, err
 	}
 
-	return downloadHandler(c, w, r)
+	return 0, nil
 }
 
 // renderJSON prints the JSON version of data to the browser.
@@ -347,11 +480,22 @@ func matchURL(first, second string) bool {
 	return strings.HasPrefix(first, second)
 }
 
+// hookStatus returns the status of an error of the hooks.
+func hookStatus(err error) int {
+	if rej, ok := err.(*fm.HookRejection); ok {
+		return rej.Status()
+	}
+
+	return http.StatusInternalServerError
+}
+
 // ErrorToHTTP converts errors to HTTP Status Code.
 func ErrorToHTTP(err error, gone bool) int {
 	switch {
 	case err == nil:
 		return http.StatusOK
+	case err == fm.ErrQuotaExceeded:
+		return http.StatusInsufficientStorage
 	case os.IsPermission(err):
 		return http.StatusForbidden
 	case os.IsNotExist(err):
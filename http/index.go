@@ -0,0 +1,248 @@
+package http
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+var (
+	pathRegexp   = regexp.MustCompile(`path:(\S+)`)
+	phraseRegexp = regexp.MustCompile(`"([^"]*)"`)
+)
+
+// snippetContext is the number of bytes shown around a match in the
+// snippets returned by a content search.
+const snippetContext = 60
+
+type contentSearchOptions struct {
+	// Phrases must all appear in a file for it to match. They are
+	// lowercased and single words are phrases too.
+	Phrases []string
+	// Terms are the index terms found in the phrases.
+	Terms      []string
+	Conditions []condition
+	// Prefixes restricts the results to paths starting with one
+	// of them, relative to the search scope.
+	Prefixes []string
+}
+
+// parseContentSearch parses a full-text query. Besides words and
+// "quoted phrases", it understands the 'type:' option of the file
+// search and 'path:' to only search under some directory.
+func parseContentSearch(value string) *contentSearchOptions {
+	opts := &contentSearchOptions{
+		Phrases:    []string{},
+		Conditions: []condition{},
+		Prefixes:   []string{},
+	}
+
+	for _, t := range typeRegexp.FindAllStringSubmatch(value, -1) {
+		opts.Conditions = append(opts.Conditions, typeCondition(t[1]))
+	}
+	value = typeRegexp.ReplaceAllString(value, "")
+
+	for _, p := range pathRegexp.FindAllStringSubmatch(value, -1) {
+		opts.Prefixes = append(opts.Prefixes, strings.TrimPrefix(p[1], "/"))
+	}
+	value = pathRegexp.ReplaceAllString(value, "")
+
+	value = strings.ToLower(value)
+	for _, p := range phraseRegexp.FindAllStringSubmatch(value, -1) {
+		if phrase := strings.TrimSpace(p[1]); phrase != "" {
+			opts.Phrases = append(opts.Phrases, phrase)
+		}
+	}
+	value = phraseRegexp.ReplaceAllString(value, "")
+
+	opts.Phrases = append(opts.Phrases, strings.Fields(value)...)
+	opts.Terms = fm.IndexTerms(strings.Join(opts.Phrases, " "))
+	return opts
+}
+
+// contentSearch searches for text inside the files under scope using
+// the full-text index. Every candidate is read with the current user's
+// attributes, so files it can't read never show up in the results.
+func contentSearch(c *fm.Context, s *searchSession, value, scope string) error {
+	search := parseContentSearch(value)
+	if len(search.Terms) == 0 {
+		return nil
+	}
+
+	scope, err := filepath.Abs(scope)
+	if err != nil {
+		return err
+	}
+
+	userScope, err := filepath.Abs(c.User.Scope)
+	if err != nil {
+		return err
+	}
+
+	paths, err := c.SearchIndex(search.Terms)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		if err := s.scan(); err != nil {
+			return err
+		}
+
+		if path != scope && !strings.HasPrefix(path, scope+"/") {
+			continue
+		}
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(path, scope), "/")
+		if !matchContentFilters(search, rel) {
+			continue
+		}
+
+		if !c.User.Allowed(strings.TrimPrefix(path, userScope)) {
+			continue
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			// The index is out of date.
+			if err := c.Unindex(path); err != nil {
+				log.Print(err)
+			}
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		snippet, ok := matchContent(search.Phrases, string(content))
+		if !ok {
+			continue
+		}
+
+		err = s.result(map[string]interface{}{
+			"dir":     false,
+			"path":    rel,
+			"snippet": snippet,
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchContentFilters checks the 'type:' and 'path:' options of a
+// content search against a path relative to the search scope.
+func matchContentFilters(search *contentSearchOptions, path string) bool {
+	if len(search.Prefixes) > 0 {
+		match := false
+		for _, prefix := range search.Prefixes {
+			if strings.HasPrefix(path, prefix) {
+				match = true
+				break
+			}
+		}
+
+		if !match {
+			return false
+		}
+	}
+
+	if len(search.Conditions) == 0 {
+		return true
+	}
+
+	for _, t := range search.Conditions {
+		if t(path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchContent checks that every phrase appears in the content, ignoring
+// the case, and returns a snippet around the first one.
+func matchContent(phrases []string, content string) (string, bool) {
+	lower := strings.ToLower(content)
+
+	// Lowercasing may change the length of some characters, in which
+	// case the snippet is taken from the lowercased text.
+	if len(lower) != len(content) {
+		content = lower
+	}
+
+	start := -1
+	for _, phrase := range phrases {
+		i := strings.Index(lower, phrase)
+		if i == -1 {
+			return "", false
+		}
+
+		if start == -1 {
+			start = i
+		}
+	}
+
+	if start == -1 {
+		return "", false
+	}
+
+	from, to := start-snippetContext, start+len(phrases[0])+snippetContext
+	if from < 0 {
+		from = 0
+	}
+
+	if to > len(content) {
+		to = len(content)
+	}
+
+	// Don't cut characters in half.
+	for from > 0 && !utf8.RuneStart(content[from]) {
+		from--
+	}
+
+	for to < len(content) && !utf8.RuneStart(content[to]) {
+		to++
+	}
+
+	snippet := strings.Join(strings.Fields(content[from:to]), " ")
+	if from > 0 {
+		snippet = "…" + snippet
+	}
+
+	if to < len(content) {
+		snippet += "…"
+	}
+
+	return snippet, true
+}
+
+// reindexHandler updates the full-text index for a directory of the
+// user's scope, using the user's attributes to read the files.
+func reindexHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodPost {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	if !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	path := filepath.Join(c.User.Scope, sanitizeURL(r.URL.Path))
+	if err := c.Reindex(path); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
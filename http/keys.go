@@ -0,0 +1,64 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// keysHandler manages the S3 access keys of the current user. Secrets
+// are only shown once, when the key is created.
+func keysHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.Store.AccessKeys == nil {
+		return http.StatusNotImplemented, nil
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		keys, err := c.Store.AccessKeys.GetByUser(c.User.ID)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		for _, k := range keys {
+			k.Secret = ""
+		}
+
+		return renderJSON(w, keys)
+	case http.MethodPost:
+		k, err := fm.NewAccessKey(c.User.ID)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		if err := c.Store.AccessKeys.Save(k); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		return renderJSON(w, k)
+	case http.MethodDelete:
+		id := strings.TrimPrefix(r.URL.Path, "/")
+
+		k, err := c.Store.AccessKeys.Get(id)
+		if err == fm.ErrNotExist {
+			return http.StatusNotFound, nil
+		}
+
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		if k.UserID != c.User.ID && !c.User.Admin {
+			return http.StatusForbidden, nil
+		}
+
+		if err := c.Store.AccessKeys.Delete(id); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		return http.StatusOK, nil
+	}
+
+	return http.StatusMethodNotAllowed, nil
+}
@@ -0,0 +1,49 @@
+package http
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// lockoutsHandler lets the admins see the recent failed logins, with a
+// GET, and unlock a username or an address, with a DELETE to
+// /api/lockouts/user:<username> or /api/lockouts/ip:<address>.
+func lockoutsHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	if c.Store.LoginAttempts == nil {
+		return http.StatusNotImplemented, nil
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		attempts, err := c.Store.LoginAttempts.Gets()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		sort.Slice(attempts, func(i, j int) bool {
+			return attempts[i].LastFailure.After(attempts[j].LastFailure)
+		})
+
+		return renderJSON(w, attempts)
+	case http.MethodDelete:
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if key == "" {
+			return http.StatusBadRequest, nil
+		}
+
+		if err := c.Unlock(key); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		return http.StatusOK, nil
+	}
+
+	return http.StatusMethodNotAllowed, nil
+}
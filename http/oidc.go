@@ -0,0 +1,143 @@
+package http
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	fm "github.com/rjchee/dcac_filemanager"
+	"github.com/rjchee/dcac_filemanager/oidc"
+)
+
+// oidcCookie keeps the state, the nonce and the code verifier of a login
+// with the OpenID Connect provider until the provider redirects back.
+const oidcCookie = "oidc"
+
+// oidcLoginHandler redirects to the OpenID Connect provider to log in.
+func oidcLoginHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.OIDC == nil || c.NoAuth {
+		return http.StatusNotFound, nil
+	}
+
+	var values [3]string
+	for i := range values {
+		v, err := oidc.RandomString()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		values[i] = v
+	}
+
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	u, err := c.OIDC.AuthURL(state, nonce, verifier)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    strings.Join(values[:], "."),
+		Path:     c.RootURL() + "/api/auth/oidc",
+		MaxAge:   600,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.Redirect(w, r, u, http.StatusFound)
+	return 0, nil
+}
+
+// oidcCallbackHandler is where the OpenID Connect provider redirects to
+// after the login. It logs the user in like the web interface does, with
+// the auth cookie, and redirects to the files.
+func oidcCallbackHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.OIDC == nil || c.NoAuth {
+		return http.StatusNotFound, nil
+	}
+
+	cookie, err := r.Cookie(oidcCookie)
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	// The login can't be completed twice.
+	http.SetCookie(w, &http.Cookie{
+		Name:   oidcCookie,
+		Path:   c.RootURL() + "/api/auth/oidc",
+		MaxAge: -1,
+	})
+
+	values := strings.Split(cookie.Value, ".")
+	if len(values) != 3 {
+		return http.StatusBadRequest, nil
+	}
+
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return http.StatusForbidden, errors.New("oidc: " + e + ": " + q.Get("error_description"))
+	}
+
+	if subtle.ConstantTimeCompare([]byte(q.Get("state")), []byte(state)) != 1 {
+		return http.StatusBadRequest, nil
+	}
+
+	raw, err := c.OIDC.Exchange(q.Get("code"), verifier)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+
+	claims, err := c.OIDC.Verify(raw, nonce)
+	if err != nil {
+		return http.StatusForbidden, err
+	}
+
+	u, err := c.OIDCUser(claims)
+	if err == fm.ErrNotExist || err == fm.ErrOtherSource {
+		return http.StatusForbidden, nil
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Service accounts can't log in interactively, nor can the disabled
+	// users.
+	if u.ServiceAccount || u.Disabled {
+		return http.StatusForbidden, nil
+	}
+
+	vars := loginVars(r, "oidc")
+	if err := c.RunnerVars("before_login", "", "", u, vars); err != nil {
+		return hookStatus(err), err
+	}
+
+	c.User = u
+	token, err := issueToken(c, r)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	loggedIn(c, vars)
+
+	path := c.RootURL()
+	if path == "" {
+		path = "/"
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   "auth",
+		Value:  token,
+		Path:   path,
+		MaxAge: 86400,
+		Secure: r.TLS != nil,
+	})
+
+	http.Redirect(w, r, c.RootURL()+"/files/", http.StatusFound)
+	return 0, nil
+}
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"net/http"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// checkUpload checks the quota of the user before a file is uploaded.
+// The size of the upload must be known when the user has a quota of
+// bytes.
+func checkUpload(c *fm.Context, name string, size int64) (func(int64), int, error) {
+	if c.User.QuotaBytes > 0 && size < 0 {
+		return nil, http.StatusLengthRequired, nil
+	}
+
+	account, err := c.CheckWrite(c.User, name, size)
+	if err != nil {
+		return nil, ErrorToHTTP(err, false), err
+	}
+
+	return account, 0, nil
+}
+
+type usage struct {
+	QuotaBytes int64 `json:"quotaBytes"`
+	QuotaFiles int64 `json:"quotaFiles"`
+	UsedBytes  int64 `json:"usedBytes"`
+	UsedFiles  int64 `json:"usedFiles"`
+}
+
+func userUsage(u *fm.User) usage {
+	return usage{
+		QuotaBytes: u.QuotaBytes,
+		QuotaFiles: u.QuotaFiles,
+		UsedBytes:  u.UsedBytes,
+		UsedFiles:  u.UsedFiles,
+	}
+}
+
+// usageHandler shows the quota and the usage of the current user. The
+// admins can recompute the usage of any user, by walking its scope, with
+// a POST to /api/usage/<id>.
+func usageHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	switch r.Method {
+	case http.MethodGet:
+		return renderJSON(w, userUsage(c.User))
+	case http.MethodPost:
+		if !c.User.Admin {
+			return http.StatusForbidden, nil
+		}
+
+		id, err := getUserID(r)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		u, err := c.Store.Users.Get(id, c.NewFS)
+		if err == fm.ErrNotExist {
+			return http.StatusNotFound, nil
+		}
+
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		if err := c.RecomputeUsage(u); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		return renderJSON(w, userUsage(u))
+	}
+
+	return http.StatusMethodNotAllowed, nil
+}
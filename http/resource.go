@@ -39,7 +39,7 @@ func resourceHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 		// Before save command handler.
 		path := filepath.Join(c.User.Scope, r.URL.Path)
 		if err := c.Runner("before_save", path, "", c.User); err != nil {
-			return http.StatusInternalServerError, err
+			return hookStatus(err), err
 		}
 
 		code, err := resourcePostPutHandler(c, w, r)
@@ -141,14 +141,20 @@ func resourceDeleteHandler(c *fm.Context, w http.ResponseWriter, r *http.Request
 
 	// Fire the before trigger.
 	if err := c.Runner("before_delete", r.URL.Path, "", c.User); err != nil {
-		return http.StatusInternalServerError, err
+		return hookStatus(err), err
 	}
 
 	// Remove the file or folder.
+	freed := c.TrackRemove(c.User, r.URL.Path)
 	err := c.User.FileSystem.RemoveAll(r.URL.Path)
 	if err != nil {
 		return ErrorToHTTP(err, true), err
 	}
+	freed()
+
+	if err := c.Unindex(filepath.Join(c.User.Scope, r.URL.Path)); err != nil {
+		log.Print(err)
+	}
 
 	// Fire the after trigger.
 	if err := c.Runner("after_delete", r.URL.Path, "", c.User); err != nil {
@@ -182,8 +188,19 @@ func resourcePostPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Reques
 		}
 
 		// Otherwise we try to create the directory.
-		err := c.User.FileSystem.Mkdir(r.URL.Path, 0776)
-		return ErrorToHTTP(err, false), err
+		if err := c.Runner("before_mkdir", r.URL.Path, "", c.User); err != nil {
+			return hookStatus(err), err
+		}
+
+		if err := c.User.FileSystem.Mkdir(r.URL.Path, 0776); err != nil {
+			return ErrorToHTTP(err, false), err
+		}
+
+		if err := c.Runner("after_mkdir", r.URL.Path, "", c.User); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		return http.StatusOK, nil
 	}
 
 	// If using POST method, we are trying to create a new file so it is not
@@ -195,9 +212,15 @@ func resourcePostPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Reques
 		}
 	}
 
+	// Checks the quota before anything is written.
+	account, code, err := checkUpload(c, r.URL.Path, r.ContentLength)
+	if code != 0 {
+		return code, err
+	}
+
 	// Fire the before trigger.
 	if err := c.Runner("before_upload", r.URL.Path, "", c.User); err != nil {
-		return http.StatusInternalServerError, err
+		return hookStatus(err), err
 	}
 
 	// Create/Open the file.
@@ -219,6 +242,8 @@ func resourcePostPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Reques
 		return ErrorToHTTP(err, false), err
 	}
 
+	account(fi.Size())
+
 	// Check if this instance has a Static Generator and handles publishing
 	// or scheduling if it's the case.
 	if c.StaticGen != nil {
@@ -232,6 +257,10 @@ func resourcePostPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Reques
 	etag := fmt.Sprintf(`"%x%x"`, fi.ModTime().UnixNano(), fi.Size())
 	w.Header().Set("ETag", etag)
 
+	if err := c.Reindex(filepath.Join(c.User.Scope, r.URL.Path)); err != nil {
+		log.Print(err)
+	}
+
 	// Fire the after trigger.
 	if err := c.Runner("after_upload", r.URL.Path, "", c.User); err != nil {
 		return http.StatusInternalServerError, err
@@ -276,7 +305,7 @@ func resourcePublish(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 
 	// Before save command handler.
 	if err := c.Runner("before_publish", path, "", c.User); err != nil {
-		return http.StatusInternalServerError, err
+		return hookStatus(err), err
 	}
 
 	code, err := c.StaticGen.Publish(c, w, r)
@@ -286,7 +315,7 @@ func resourcePublish(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 
 	// Executed the before publish command.
 	if err := c.Runner("before_publish", path, "", c.User); err != nil {
-		return http.StatusInternalServerError, err
+		return hookStatus(err), err
 	}
 
 	return code, nil
@@ -311,14 +340,34 @@ func resourcePatchHandler(c *fm.Context, w http.ResponseWriter, r *http.Request)
 		return http.StatusForbidden, nil
 	}
 
+	// The destination is checked like the source, which the prefix of the
+	// API tokens and the rules already allowed.
+	if !c.User.Allowed(dst) {
+		return http.StatusForbidden, nil
+	}
+
 	if action == "copy" {
+		// Checks the quota before anything is copied.
+		var account func()
+		account, err = c.CheckCopy(c.User, src, dst)
+		if err != nil {
+			return ErrorToHTTP(err, false), err
+		}
+
 		// Fire the after trigger.
 		if err := c.Runner("before_copy", src, dst, c.User); err != nil {
-			return http.StatusInternalServerError, err
+			return hookStatus(err), err
 		}
 
 		// Copy the file.
 		err = c.User.FileSystem.Copy(src, dst)
+		if err == nil {
+			account()
+
+			if err := c.Reindex(filepath.Join(c.User.Scope, dst)); err != nil {
+				log.Print(err)
+			}
+		}
 
 		// Fire the after trigger.
 		if err := c.Runner("after_copy", src, dst, c.User); err != nil {
@@ -327,11 +376,20 @@ func resourcePatchHandler(c *fm.Context, w http.ResponseWriter, r *http.Request)
 	} else {
 		// Fire the after trigger.
 		if err := c.Runner("before_rename", src, dst, c.User); err != nil {
-			return http.StatusInternalServerError, err
+			return hookStatus(err), err
 		}
 
 		// Rename the file.
 		err = c.User.FileSystem.Rename(src, dst)
+		if err == nil {
+			if err := c.Unindex(filepath.Join(c.User.Scope, src)); err != nil {
+				log.Print(err)
+			}
+
+			if err := c.Reindex(filepath.Join(c.User.Scope, dst)); err != nil {
+				log.Print(err)
+			}
+		}
 
 		// Fire the after trigger.
 		if err := c.Runner("after_rename", src, dst, c.User); err != nil {
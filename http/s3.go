@@ -0,0 +1,664 @@
+package http
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	fm "github.com/rjchee/dcac_filemanager"
+	"github.com/rjchee/dcac_filemanager/sigv4"
+)
+
+const (
+	s3Namespace  = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys    = 1000
+)
+
+// s3Error is an error as returned by S3.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+var (
+	s3AccessDenied        = &s3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	s3InvalidAccessKeyID  = &s3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key does not exist"}
+	s3SignatureMismatch   = &s3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match"}
+	s3Expired             = &s3Error{http.StatusForbidden, "AccessDenied", "The request has expired"}
+	s3MalformedAuth       = &s3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization is malformed"}
+	s3ContentHashMismatch = &s3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The content hash does not match"}
+	s3IncompleteBody      = &s3Error{http.StatusBadRequest, "IncompleteBody", "The body is incomplete or malformed"}
+	s3BadDigest           = &s3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 does not match"}
+	s3InvalidArgument     = &s3Error{http.StatusBadRequest, "InvalidArgument", "Invalid argument"}
+	s3InvalidBucketName   = &s3Error{http.StatusBadRequest, "InvalidBucketName", "The bucket name is not valid"}
+	s3MalformedXML        = &s3Error{http.StatusBadRequest, "MalformedXML", "The XML is not well-formed"}
+	s3InvalidPart         = &s3Error{http.StatusBadRequest, "InvalidPart", "One or more parts could not be found"}
+	s3InvalidPartOrder    = &s3Error{http.StatusBadRequest, "InvalidPartOrder", "The parts are not in ascending order"}
+	s3NoSuchBucket        = &s3Error{http.StatusNotFound, "NoSuchBucket", "The bucket does not exist"}
+	s3NoSuchKey           = &s3Error{http.StatusNotFound, "NoSuchKey", "The key does not exist"}
+	s3NoSuchUpload        = &s3Error{http.StatusNotFound, "NoSuchUpload", "The upload does not exist"}
+	s3MethodNotAllowed    = &s3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The method is not allowed"}
+	s3BucketAlreadyOwned  = &s3Error{http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists"}
+	s3BucketNotEmpty      = &s3Error{http.StatusConflict, "BucketNotEmpty", "The bucket is not empty"}
+	s3QuotaExceeded       = &s3Error{http.StatusInsufficientStorage, "QuotaExceeded", "The quota of the user is exceeded"}
+	s3InternalError       = &s3Error{http.StatusInternalServerError, "InternalError", "Internal error"}
+	s3NotImplemented      = &s3Error{http.StatusNotImplemented, "NotImplemented", "The operation is not implemented"}
+)
+
+// s3Fail writes an error in the format of S3. The body is written here,
+// so the handlers return 0.
+func s3Fail(w http.ResponseWriter, r *http.Request, err error) (int, error) {
+	e, ok := err.(*s3Error)
+	if rej, isRejection := err.(*fm.HookRejection); isRejection {
+		e, ok = &s3Error{rej.Status(), "AccessDenied", rej.Message}, true
+	}
+
+	if !ok {
+		switch {
+		case os.IsNotExist(err):
+			e = s3NoSuchKey
+		case os.IsPermission(err):
+			e = s3AccessDenied
+		case err == fm.ErrQuotaExceeded:
+			e = s3QuotaExceeded
+		case err == sigv4.ErrContentHash:
+			e = s3ContentHashMismatch
+		case err == sigv4.ErrChunkSignature:
+			e = s3SignatureMismatch
+		case err == sigv4.ErrMalformedPayload:
+			e = s3IncompleteBody
+		default:
+			log.Printf("s3: %s %s: %s\n", r.Method, r.URL.Path, err)
+			e = s3InternalError
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.Status)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(xml.Header))
+		xml.NewEncoder(w).Encode(struct {
+			XMLName  xml.Name `xml:"Error"`
+			Code     string
+			Message  string
+			Resource string
+		}{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+	}
+
+	return 0, nil
+}
+
+// s3Render writes a successful XML response.
+func s3Render(w http.ResponseWriter, v interface{}) (int, error) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// s3Auth checks the signature of a request and loads the user who owns
+// the access key.
+func s3Auth(c *fm.Context, r *http.Request) (*sigv4.Signature, error) {
+	var key *fm.AccessKey
+
+	sig, err := sigv4.Verify(r, func(id string) (string, error) {
+		k, err := c.Store.AccessKeys.Get(id)
+		if err != nil {
+			return "", err
+		}
+
+		key = k
+		return k.Secret, nil
+	}, time.Now())
+
+	switch err {
+	case nil:
+	case sigv4.ErrMissingAuth, sigv4.ErrUnsignedHeader:
+		return nil, s3AccessDenied
+	case sigv4.ErrUnknownKey:
+		return nil, s3InvalidAccessKeyID
+	case sigv4.ErrSignature:
+		return nil, s3SignatureMismatch
+	case sigv4.ErrExpired:
+		return nil, s3Expired
+	default:
+		return nil, s3MalformedAuth
+	}
+
+	u, err := c.Store.Users.Get(key.UserID, c.NewFS)
+	if err == fm.ErrNotExist {
+		return nil, s3InvalidAccessKeyID
+	}
+
+	if err == nil && u.Disabled {
+		return nil, s3AccessDenied
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.User = u
+	return sig, nil
+}
+
+// s3Handler serves an S3 compatible API on /s3/. Requests are signed with
+// the access keys of the users, and the buckets are the folders at the
+// root of their scope.
+func s3Handler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.Store.AccessKeys == nil {
+		return s3Fail(w, r, s3NotImplemented)
+	}
+
+	sig, err := s3Auth(c, r)
+	if err != nil {
+		return s3Fail(w, r, err)
+	}
+
+	release, err := c.AcquireAttrs(c.User)
+	if err != nil {
+		log.Printf("error acquiring the attributes of %s: %s\n", c.User.Username, err)
+		return s3Fail(w, r, s3InternalError)
+	}
+	defer release()
+
+	r.Body = sig.Body(r.Body)
+
+	bucket, key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/s3"), "/"), ""
+	if i := strings.Index(bucket, "/"); i != -1 {
+		bucket, key = bucket[:i], bucket[i+1:]
+	}
+
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			return s3Fail(w, r, s3MethodNotAllowed)
+		}
+
+		return s3ListBuckets(c, w, r)
+	}
+
+	if !s3ValidName(bucket) || strings.HasPrefix(bucket, ".") {
+		return s3Fail(w, r, s3InvalidBucketName)
+	}
+
+	if key == "" {
+		err = s3BucketHandler(c, w, r, bucket)
+	} else if !s3ValidName(strings.TrimSuffix(key, "/")) {
+		err = s3InvalidArgument
+	} else {
+		err = s3ObjectHandler(c, w, r, bucket, key)
+	}
+
+	if err != nil {
+		return s3Fail(w, r, err)
+	}
+
+	return 0, nil
+}
+
+// s3ValidName checks that a key maps to a single path on the file system,
+// without empty, "." or ".." segments.
+func s3ValidName(key string) bool {
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.Contains(segment, "\\") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// s3Internal checks if a path of the user is one of the files File
+// Manager keeps for itself, which are never exposed.
+func s3Internal(c *fm.Context, name string) bool {
+	p, err := filepath.Abs(filepath.Join(c.User.Scope, name))
+	if err != nil {
+		return true
+	}
+
+	for _, internal := range []string{c.DCACDir, c.DatabaseFile} {
+		if internal == "" {
+			continue
+		}
+
+		abs, err := filepath.Abs(internal)
+		if err != nil {
+			return true
+		}
+
+		if p == abs || strings.HasPrefix(p, abs+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// s3ETag is the ETag of a file, as the API computes it.
+func s3ETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func s3Owner(u *fm.User) s3OwnerXML {
+	return s3OwnerXML{ID: strconv.Itoa(u.ID), DisplayName: u.Username}
+}
+
+type s3OwnerXML struct {
+	ID          string
+	DisplayName string
+}
+
+type s3BucketXML struct {
+	Name         string
+	CreationDate string
+}
+
+func s3ListBuckets(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	files, err := c.User.FileSystem.ReadDir("/")
+	if err != nil {
+		return s3Fail(w, r, err)
+	}
+
+	buckets := []s3BucketXML{}
+	for _, file := range files {
+		name := "/" + file.Name() + "/"
+		if !file.IsDir() || strings.HasPrefix(file.Name(), ".") || s3Internal(c, name) || !c.User.Allowed(name) {
+			continue
+		}
+
+		buckets = append(buckets, s3BucketXML{
+			Name:         file.Name(),
+			CreationDate: file.ModTime().UTC().Format(s3TimeFormat),
+		})
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Name < buckets[j].Name
+	})
+
+	return s3Render(w, struct {
+		XMLName xml.Name      `xml:"ListAllMyBucketsResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Owner   s3OwnerXML    `xml:"Owner"`
+		Buckets []s3BucketXML `xml:"Buckets>Bucket"`
+	}{Xmlns: s3Namespace, Owner: s3Owner(c.User), Buckets: buckets})
+}
+
+// s3CheckBucket returns an error if the bucket doesn't exist or if the
+// user can't see it.
+func s3CheckBucket(c *fm.Context, bucket string) error {
+	name := "/" + bucket + "/"
+	if s3Internal(c, name) || !c.User.Allowed(name) {
+		return s3AccessDenied
+	}
+
+	info, err := c.User.FileSystem.Stat(name)
+	if os.IsNotExist(err) || err == nil && !info.IsDir() {
+		return s3NoSuchBucket
+	}
+
+	return err
+}
+
+func s3BucketHandler(c *fm.Context, w http.ResponseWriter, r *http.Request, bucket string) error {
+	query := r.URL.Query()
+
+	if r.Method == http.MethodPut {
+		return s3CreateBucket(c, w, bucket)
+	}
+
+	if err := s3CheckBucket(c, bucket); err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodGet:
+		if _, ok := query["location"]; ok {
+			_, err := s3Render(w, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3Namespace})
+			return err
+		}
+
+		if _, ok := query["uploads"]; ok {
+			return s3NotImplemented
+		}
+
+		return s3ListObjects(c, w, r, bucket)
+	case http.MethodDelete:
+		return s3DeleteBucket(c, w, bucket)
+	case http.MethodPost:
+		if _, ok := query["delete"]; ok {
+			return s3DeleteObjects(c, w, r, bucket)
+		}
+	}
+
+	return s3MethodNotAllowed
+}
+
+func s3CreateBucket(c *fm.Context, w http.ResponseWriter, bucket string) error {
+	name := "/" + bucket + "/"
+	if !c.User.AllowNew || s3Internal(c, name) || !c.User.Allowed(name) {
+		return s3AccessDenied
+	}
+
+	if _, err := c.User.FileSystem.Stat(name); err == nil {
+		return s3BucketAlreadyOwned
+	}
+
+	if err := c.Runner("before_upload", name, "", c.User); err != nil {
+		return err
+	}
+
+	if err := c.User.FileSystem.Mkdir(name, 0776); err != nil {
+		return err
+	}
+
+	if err := c.Runner("after_upload", name, "", c.User); err != nil {
+		log.Print(err)
+	}
+
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func s3DeleteBucket(c *fm.Context, w http.ResponseWriter, bucket string) error {
+	name := "/" + bucket + "/"
+	if !c.User.AllowEdit {
+		return s3AccessDenied
+	}
+
+	files, err := c.User.FileSystem.ReadDir(name)
+	if err != nil {
+		return err
+	}
+
+	if len(files) > 0 {
+		return s3BucketNotEmpty
+	}
+
+	if err := c.Runner("before_delete", name, "", c.User); err != nil {
+		return err
+	}
+
+	if err := c.User.FileSystem.RemoveAll(name); err != nil {
+		return err
+	}
+
+	if err := c.Runner("after_delete", name, "", c.User); err != nil {
+		log.Print(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// s3Entry is an object or a common prefix of a listing.
+type s3Entry struct {
+	Key  string
+	Info os.FileInfo
+}
+
+type s3ObjectXML struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+	Owner        *s3OwnerXML `xml:",omitempty"`
+}
+
+type s3PrefixXML struct {
+	Prefix string
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Marker                *string       `xml:",omitempty"`
+	NextMarker            string        `xml:",omitempty"`
+	KeyCount              *int          `xml:",omitempty"`
+	ContinuationToken     string        `xml:",omitempty"`
+	NextContinuationToken string        `xml:",omitempty"`
+	StartAfter            string        `xml:",omitempty"`
+	Contents              []s3ObjectXML `xml:"Contents"`
+	CommonPrefixes        []s3PrefixXML `xml:"CommonPrefixes"`
+}
+
+// s3ListObjects lists the objects of a bucket, with both versions of the
+// API. Folders are only listed as common prefixes, and the keys are
+// sorted like S3 does, so a listing can be continued after any key.
+func s3ListObjects(c *fm.Context, w http.ResponseWriter, r *http.Request, bucket string) error {
+	query := r.URL.Query()
+	v2 := query.Get("list-type") == "2"
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	maxKeys := s3MaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s3InvalidArgument
+		}
+
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			b, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return s3InvalidArgument
+			}
+			after = string(b)
+		}
+	}
+
+	entries, err := s3Walk(c, bucket, prefix, delimiter)
+	if err != nil {
+		return err
+	}
+
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].Key > after
+	})
+	entries = entries[i:]
+
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = s3URLEncode
+	}
+
+	result := s3ListResult{
+		Xmlns:        s3Namespace,
+		Name:         bucket,
+		Prefix:       encode(prefix),
+		Delimiter:    encode(delimiter),
+		MaxKeys:      maxKeys,
+		EncodingType: query.Get("encoding-type"),
+		IsTruncated:  len(entries) > maxKeys,
+	}
+
+	if len(entries) > maxKeys {
+		entries = entries[:maxKeys]
+	}
+
+	for _, e := range entries {
+		if e.Info == nil {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3PrefixXML{Prefix: encode(e.Key)})
+			continue
+		}
+
+		object := s3ObjectXML{
+			Key:          encode(e.Key),
+			LastModified: e.Info.ModTime().UTC().Format(s3TimeFormat),
+			ETag:         s3ETag(e.Info),
+			Size:         e.Info.Size(),
+			StorageClass: "STANDARD",
+		}
+
+		if !v2 || query.Get("fetch-owner") == "true" {
+			owner := s3Owner(c.User)
+			object.Owner = &owner
+		}
+
+		result.Contents = append(result.Contents, object)
+	}
+
+	var last string
+	if len(entries) > 0 {
+		last = entries[len(entries)-1].Key
+	}
+
+	if v2 {
+		count := len(entries)
+		result.KeyCount = &count
+		result.ContinuationToken = query.Get("continuation-token")
+		result.StartAfter = encode(query.Get("start-after"))
+		if result.IsTruncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		marker := encode(query.Get("marker"))
+		result.Marker = &marker
+		if result.IsTruncated {
+			result.NextMarker = encode(last)
+		}
+	}
+
+	_, err = s3Render(w, result)
+	return err
+}
+
+// s3Walk collects the entries of a bucket which match a prefix, sorted by
+// key. The common prefixes have no file info.
+func s3Walk(c *fm.Context, bucket, prefix, delimiter string) ([]s3Entry, error) {
+	// Only the folder of the prefix needs to be walked.
+	start := prefix[:strings.LastIndex(prefix, "/")+1]
+	if start != "" && !s3ValidName(strings.TrimSuffix(start, "/")) {
+		return nil, nil
+	}
+
+	w := &s3Walker{c: c, bucket: bucket, prefix: prefix, delimiter: delimiter, prefixes: map[string]bool{}}
+	if err := w.walk(start); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(w.entries, func(i, j int) bool {
+		return w.entries[i].Key < w.entries[j].Key
+	})
+
+	return w.entries, nil
+}
+
+type s3Walker struct {
+	c         *fm.Context
+	bucket    string
+	prefix    string
+	delimiter string
+	entries   []s3Entry
+	prefixes  map[string]bool
+}
+
+func (w *s3Walker) addPrefix(p string) {
+	if !w.prefixes[p] {
+		w.prefixes[p] = true
+		w.entries = append(w.entries, s3Entry{Key: p})
+	}
+}
+
+// walk adds the entries of a folder, given by its key. Folders which
+// can't be read are skipped.
+func (w *s3Walker) walk(dir string) error {
+	files, err := w.c.User.FileSystem.ReadDir("/" + w.bucket + "/" + dir)
+	if err != nil {
+		return nil
+	}
+
+	for _, info := range files {
+		key := dir + info.Name()
+		name := "/" + w.bucket + "/" + key
+
+		if info.IsDir() {
+			key += "/"
+			name += "/"
+		}
+
+		if s3Internal(w.c, name) || !w.c.User.Allowed(name) {
+			continue
+		}
+
+		if info.IsDir() {
+			switch {
+			case strings.HasPrefix(w.prefix, key):
+				// The prefix goes deeper.
+				err = w.walk(key)
+			case !strings.HasPrefix(key, w.prefix):
+			case w.delimiter == "/":
+				// Folders are listed even if they are empty.
+				w.addPrefix(key)
+			default:
+				err = w.walk(key)
+			}
+
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(key, w.prefix) {
+			continue
+		}
+
+		if w.delimiter != "" {
+			if i := strings.Index(key[len(w.prefix):], w.delimiter); i != -1 {
+				w.addPrefix(key[:len(w.prefix)+i+len(w.delimiter)])
+				continue
+			}
+		}
+
+		w.entries = append(w.entries, s3Entry{Key: key, Info: info})
+	}
+
+	return nil
+}
+
+// s3URLEncode encodes a key for the listings requested with the url
+// encoding type.
+func s3URLEncode(s string) string {
+	return strings.Replace(url.QueryEscape(s), "%2F", "/", -1)
+}
@@ -0,0 +1,664 @@
+package http
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// s3MaxParts is the number of parts a multipart upload may have.
+const s3MaxParts = 10000
+
+func s3ObjectHandler(c *fm.Context, w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	if err := s3CheckBucket(c, bucket); err != nil {
+		return err
+	}
+
+	name := "/" + bucket + "/" + key
+	if s3Internal(c, name) || !c.User.Allowed(name) {
+		return s3AccessDenied
+	}
+
+	query := r.URL.Query()
+	_, uploads := query["uploads"]
+	uploadID := query.Get("uploadId")
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if uploadID != "" {
+			return s3NotImplemented
+		}
+
+		return s3GetObject(c, w, r, name)
+	case http.MethodPut:
+		if r.Header.Get("X-Amz-Copy-Source") != "" {
+			return s3NotImplemented
+		}
+
+		if uploadID != "" {
+			return s3UploadPart(c, w, r, bucket, key)
+		}
+
+		return s3PutObject(c, w, r, name)
+	case http.MethodPost:
+		if uploads {
+			return s3CreateUpload(c, w, bucket, key)
+		}
+
+		if uploadID != "" {
+			return s3CompleteUpload(c, w, r, bucket, key)
+		}
+	case http.MethodDelete:
+		if uploadID != "" {
+			dir, err := s3LoadUpload(c, uploadID, bucket, key)
+			if err != nil {
+				return err
+			}
+
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+
+		if err := s3DeleteObject(c, name); err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return s3MethodNotAllowed
+}
+
+// s3GetObject serves an object. Folders are only objects if the key ends
+// with a slash, like the folder markers created by the S3 clients.
+func s3GetObject(c *fm.Context, w http.ResponseWriter, r *http.Request, name string) error {
+	info, err := c.User.FileSystem.Stat(name)
+	if os.IsNotExist(err) || err == nil && info.IsDir() != strings.HasSuffix(name, "/") {
+		return s3NoSuchKey
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var content io.ReadSeeker = bytes.NewReader(nil)
+	if !info.IsDir() {
+		f, err := c.User.FileSystem.OpenFile(name, os.O_RDONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		content = f
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", s3ETag(info))
+
+	// Presigned URLs may override some headers of the response.
+	query := r.URL.Query()
+	for _, h := range []string{"Content-Type", "Content-Language", "Expires", "Cache-Control", "Content-Disposition", "Content-Encoding"} {
+		if v := query.Get("response-" + strings.ToLower(h)); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+	return nil
+}
+
+// s3Event returns the command fired when a file is written: overwriting
+// a file is a save and creating one an upload, like on the API. It also
+// checks the user may do it.
+func s3Event(c *fm.Context, name string) (string, string, error) {
+	info, err := c.User.FileSystem.Stat(name)
+	if err == nil {
+		if info.IsDir() {
+			return "", "", s3InvalidArgument
+		}
+
+		if !c.User.AllowEdit {
+			return "", "", s3AccessDenied
+		}
+
+		return "save", filepath.Join(c.User.Scope, name), nil
+	}
+
+	if !os.IsNotExist(err) {
+		return "", "", err
+	}
+
+	if !c.User.AllowNew {
+		return "", "", s3AccessDenied
+	}
+
+	return "upload", name, nil
+}
+
+// s3MkdirAll creates the folders of a key which don't exist yet.
+func s3MkdirAll(c *fm.Context, dir string) error {
+	info, err := c.User.FileSystem.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return s3InvalidArgument
+		}
+		return nil
+	}
+
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	if !c.User.AllowNew {
+		return s3AccessDenied
+	}
+
+	if err := s3MkdirAll(c, path.Dir(dir)); err != nil {
+		return err
+	}
+
+	err = c.User.FileSystem.Mkdir(dir, 0776)
+	if os.IsExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// s3Stage writes a body out of the scope and returns its MD5 sum, so a
+// failed or tampered upload never changes the file of the user.
+func s3Stage(name string, body io.Reader) ([]byte, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, hash), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(name)
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// s3Commit writes staged files to a file of the user. The file is
+// written in place, like on the API, so its ACLs are kept.
+func s3Commit(c *fm.Context, name string, parts ...string) error {
+	f, err := c.User.FileSystem.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0776)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range parts {
+		if err = s3Append(f, part); err != nil {
+			break
+		}
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+func s3Append(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// s3Write fires the commands around the writing of staged files to a
+// file of the user and updates the index.
+func s3Write(c *fm.Context, name string, parts ...string) error {
+	event, hookPath, err := s3Event(c, name)
+	if err != nil {
+		return err
+	}
+
+	// The parts are staged outside of the scope of the user, so the quota
+	// is checked before anything is written in it.
+	var size int64
+	for _, part := range parts {
+		info, err := os.Stat(part)
+		if err != nil {
+			return err
+		}
+
+		size += info.Size()
+	}
+
+	account, err := c.CheckWrite(c.User, name, size)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Runner("before_"+event, hookPath, "", c.User); err != nil {
+		return err
+	}
+
+	if err := s3MkdirAll(c, path.Dir(name)); err != nil {
+		return err
+	}
+
+	if err := s3Commit(c, name, parts...); err != nil {
+		return err
+	}
+
+	account(size)
+
+	if err := c.Reindex(filepath.Join(c.User.Scope, name)); err != nil {
+		log.Print(err)
+	}
+
+	// The object is written, so failures are only logged.
+	if err := c.Runner("after_"+event, hookPath, "", c.User); err != nil {
+		log.Print(err)
+	}
+
+	return nil
+}
+
+// s3StagingName returns a new name in the folder of the multipart
+// uploads, which is cleaned regularly.
+func s3StagingName(c *fm.Context, prefix string) (string, error) {
+	b, err := fm.GenerateRandomBytes(16)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(c.MultipartDir(), 0700); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(c.MultipartDir(), prefix+hex.EncodeToString(b)), nil
+}
+
+// s3CheckMD5 compares the sum of a body with its Content-MD5 header.
+func s3CheckMD5(r *http.Request, sum []byte) error {
+	v := r.Header.Get("Content-MD5")
+	if v == "" {
+		return nil
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || !bytes.Equal(expected, sum) {
+		return s3BadDigest
+	}
+
+	return nil
+}
+
+func s3PutObject(c *fm.Context, w http.ResponseWriter, r *http.Request, name string) error {
+	// Keys ending with a slash are folders.
+	if strings.HasSuffix(name, "/") {
+		if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+			return err
+		}
+
+		if err := s3MkdirAll(c, strings.TrimSuffix(name, "/")); err != nil {
+			return err
+		}
+
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(nil)))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	staged, err := s3StagingName(c, "put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(staged)
+
+	sum, err := s3Stage(staged, r.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := s3CheckMD5(r, sum); err != nil {
+		return err
+	}
+
+	if err := s3Write(c, name, staged); err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// s3DeleteObject deletes an object. Like on S3, deleting a key which
+// doesn't exist succeeds, and folders are only deleted when their key
+// ends with a slash and they are empty.
+func s3DeleteObject(c *fm.Context, name string) error {
+	if !c.User.AllowEdit {
+		return s3AccessDenied
+	}
+
+	info, err := c.User.FileSystem.Stat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		if !strings.HasSuffix(name, "/") {
+			return nil
+		}
+
+		files, err := c.User.FileSystem.ReadDir(name)
+		if err != nil {
+			return err
+		}
+
+		if len(files) > 0 {
+			return nil
+		}
+	}
+
+	if err := c.Runner("before_delete", name, "", c.User); err != nil {
+		return err
+	}
+
+	freed := c.TrackRemove(c.User, name)
+	if err := c.User.FileSystem.RemoveAll(name); err != nil {
+		return err
+	}
+	freed()
+
+	if err := c.Unindex(filepath.Join(c.User.Scope, name)); err != nil {
+		log.Print(err)
+	}
+
+	if err := c.Runner("after_delete", name, "", c.User); err != nil {
+		log.Print(err)
+	}
+
+	return nil
+}
+
+func s3DeleteObjects(c *fm.Context, w http.ResponseWriter, r *http.Request, bucket string) error {
+	var req struct {
+		Quiet  bool
+		Object []struct {
+			Key string
+		}
+	}
+
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Object) > s3MaxKeys {
+		return s3MalformedXML
+	}
+
+	type deleted struct {
+		Key string
+	}
+
+	type failed struct {
+		Key     string
+		Code    string
+		Message string
+	}
+
+	result := struct {
+		XMLName xml.Name  `xml:"DeleteResult"`
+		Xmlns   string    `xml:"xmlns,attr"`
+		Deleted []deleted `xml:"Deleted"`
+		Error   []failed  `xml:"Error"`
+	}{Xmlns: s3Namespace}
+
+	for _, o := range req.Object {
+		name := "/" + bucket + "/" + o.Key
+
+		var err error
+		if !s3ValidName(strings.TrimSuffix(o.Key, "/")) {
+			err = s3InvalidArgument
+		} else if s3Internal(c, name) || !c.User.Allowed(name) {
+			err = s3AccessDenied
+		} else {
+			err = s3DeleteObject(c, name)
+		}
+
+		if err == nil {
+			if !req.Quiet {
+				result.Deleted = append(result.Deleted, deleted{o.Key})
+			}
+			continue
+		}
+
+		e, ok := err.(*s3Error)
+		if !ok {
+			log.Print(err)
+			e = s3InternalError
+		}
+
+		result.Error = append(result.Error, failed{o.Key, e.Code, e.Message})
+	}
+
+	_, err := s3Render(w, result)
+	return err
+}
+
+// s3Upload is a multipart upload in progress. Its parts are kept next to
+// it, named after their number and their MD5 sum.
+type s3Upload struct {
+	UserID    int       `json:"userID"`
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	Initiated time.Time `json:"initiated"`
+}
+
+func s3CreateUpload(c *fm.Context, w http.ResponseWriter, bucket, key string) error {
+	if strings.HasSuffix(key, "/") {
+		return s3InvalidArgument
+	}
+
+	// The permissions are checked now so the client doesn't upload the
+	// parts for nothing, and again when the upload is completed.
+	if _, _, err := s3Event(c, "/"+bucket+"/"+key); err != nil {
+		return err
+	}
+
+	dir, err := s3StagingName(c, "")
+	if err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(s3Upload{
+		UserID:    c.User.ID,
+		Bucket:    bucket,
+		Key:       key,
+		Initiated: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "upload.json"), data, 0600); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	_, err = s3Render(w, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string
+		Key      string
+		UploadId string
+	}{Xmlns: s3Namespace, Bucket: bucket, Key: key, UploadId: filepath.Base(dir)})
+	return err
+}
+
+// s3LoadUpload returns the folder of a multipart upload of the user.
+func s3LoadUpload(c *fm.Context, id, bucket, key string) (string, error) {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 16 {
+		return "", s3NoSuchUpload
+	}
+
+	dir := filepath.Join(c.MultipartDir(), id)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "upload.json"))
+	if err != nil {
+		return "", s3NoSuchUpload
+	}
+
+	var upload s3Upload
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return "", err
+	}
+
+	if upload.UserID != c.User.ID || upload.Bucket != bucket || upload.Key != key {
+		return "", s3NoSuchUpload
+	}
+
+	return dir, nil
+}
+
+func s3PartName(dir string, number int, sum string) string {
+	return filepath.Join(dir, fmt.Sprintf("%05d-%s", number, sum))
+}
+
+func s3UploadPart(c *fm.Context, w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	dir, err := s3LoadUpload(c, r.URL.Query().Get("uploadId"), bucket, key)
+	if err != nil {
+		return err
+	}
+
+	number, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > s3MaxParts {
+		return s3InvalidArgument
+	}
+
+	staged := filepath.Join(dir, "part-"+strconv.Itoa(number)+"-"+strconv.FormatInt(time.Now().UnixNano(), 36))
+	sum, err := s3Stage(staged, r.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := s3CheckMD5(r, sum); err != nil {
+		os.Remove(staged)
+		return err
+	}
+
+	if err := os.Rename(staged, s3PartName(dir, number, hex.EncodeToString(sum))); err != nil {
+		os.Remove(staged)
+		return err
+	}
+
+	w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sum))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func s3CompleteUpload(c *fm.Context, w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	dir, err := s3LoadUpload(c, r.URL.Query().Get("uploadId"), bucket, key)
+	if err != nil {
+		return err
+	}
+
+	var req struct {
+		Part []struct {
+			PartNumber int
+			ETag       string
+		}
+	}
+
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Part) == 0 {
+		return s3MalformedXML
+	}
+
+	var (
+		parts = make([]string, len(req.Part))
+		sums  []byte
+		last  int
+	)
+
+	for i, p := range req.Part {
+		if p.PartNumber <= last {
+			return s3InvalidPartOrder
+		}
+		last = p.PartNumber
+
+		sum, err := hex.DecodeString(strings.Trim(p.ETag, `"`))
+		if err != nil || len(sum) != md5.Size {
+			return s3InvalidPart
+		}
+
+		parts[i] = s3PartName(dir, p.PartNumber, hex.EncodeToString(sum))
+		if _, err := os.Stat(parts[i]); err != nil {
+			return s3InvalidPart
+		}
+
+		sums = append(sums, sum...)
+	}
+
+	name := "/" + bucket + "/" + key
+	if err := s3Write(c, name, parts...); err != nil {
+		return err
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		log.Print(err)
+	}
+
+	// Like S3, the ETag is the sum of the sums of the parts.
+	_, err = s3Render(w, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		Xmlns:    s3Namespace,
+		Location: c.RootURL() + "/s3" + name,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     fmt.Sprintf(`"%x-%d"`, md5.Sum(sums), len(parts)),
+	})
+	return err
+}
@@ -0,0 +1,647 @@
+package http
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// The search query language. A query is a list of terms and filters:
+//
+//	report type:pdf size:>10MB modified:<2026-01-01 -draft
+//	(name:/^IMG_\d+\.jpg$/ OR type:video) AND dir:photos
+//
+// Terms match anywhere in the path and "quoted terms" may contain spaces.
+// Filters have the form key:value:
+//
+//	type:image, type:md       the file type, or its extension
+//	size:>10MB, size:<=1k     the file size; a bare size means at least
+//	modified:>=2026-01-01     the modification date; a bare date means that day
+//	name:foo, name:/regex/    the base name of the file
+//	dir:, dir:foo             only directories, optionally with foo in the name
+//	file:, file:foo           only files, optionally with foo in the name
+//	case:insensitive          ignore the case of terms and names
+//
+// Anything can be negated with a leading '-' or NOT and grouped with
+// parentheses. AND and OR, in capitals, combine terms explicitly. For
+// backward compatibility, terms that are only separated by spaces are
+// alternatives, as are several type: filters, while everything else
+// must match too.
+
+// searchItem is a file being tested against a query.
+type searchItem struct {
+	// Path is relative to the search scope and lowercased on case
+	// insensitive searches.
+	Path string
+	Name string
+	Info os.FileInfo
+}
+
+// searchNode is a node of a parsed search query.
+type searchNode interface {
+	match(f *searchItem) bool
+}
+
+type termNode string
+
+func (n termNode) match(f *searchItem) bool {
+	return strings.Contains(f.Path, string(n))
+}
+
+type andNode []searchNode
+
+func (n andNode) match(f *searchItem) bool {
+	for _, child := range n {
+		if !child.match(f) {
+			return false
+		}
+	}
+	return true
+}
+
+type orNode []searchNode
+
+func (n orNode) match(f *searchItem) bool {
+	for _, child := range n {
+		if child.match(f) {
+			return true
+		}
+	}
+	return false
+}
+
+type notNode struct {
+	node searchNode
+}
+
+func (n notNode) match(f *searchItem) bool {
+	return !n.node.match(f)
+}
+
+// filterNode is a key:value filter. The key tells how it should be
+// grouped with its neighbours.
+type filterNode struct {
+	key  string
+	test func(f *searchItem) bool
+}
+
+func (n filterNode) match(f *searchItem) bool {
+	return n.test(f)
+}
+
+// searchQuery is a parsed search query. A nil Root matches everything.
+type searchQuery struct {
+	CaseInsensitive bool
+	Root            searchNode
+}
+
+// Match checks if a file matches the query.
+func (q *searchQuery) Match(f *searchItem) bool {
+	return q.Root == nil || q.Root.match(f)
+}
+
+// searchSyntaxError is an error in a search query. Pos is the offset,
+// in bytes, where the error was found.
+type searchSyntaxError struct {
+	Pos     int
+	Message string
+}
+
+func (e *searchSyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Pos)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenQuoted
+	tokenLParen
+	tokenRParen
+	tokenMinus
+	tokenAnd
+	tokenOr
+	tokenNot
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+	pos   int
+}
+
+// lexSearch splits a query into tokens.
+func lexSearch(value string) ([]token, error) {
+	var tokens []token
+	i := 0
+
+	for i < len(value) {
+		c := value[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{tokenLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{tokenRParen, ")", i})
+			i++
+		case c == '-' && i+1 < len(value) && value[i+1] != ' ':
+			tokens = append(tokens, token{tokenMinus, "-", i})
+			i++
+		case c == '"':
+			end := strings.IndexByte(value[i+1:], '"')
+			if end == -1 {
+				return nil, &searchSyntaxError{i, "unterminated quote"}
+			}
+			tokens = append(tokens, token{tokenQuoted, value[i+1 : i+1+end], i})
+			i += end + 2
+		default:
+			start := i
+			for i < len(value) && !strings.ContainsRune(" \t\n()\"", rune(value[i])) {
+				// A regular expression or a quoted value after a
+				// filter key runs until its closing delimiter.
+				if value[i] == ':' && i+1 < len(value) && (value[i+1] == '/' || value[i+1] == '"') {
+					delim := value[i+1]
+					end := i + 2
+					for end < len(value) && value[end] != delim {
+						if value[end] == '\\' && delim == '/' {
+							end++
+						}
+						end++
+					}
+
+					if end >= len(value) {
+						return nil, &searchSyntaxError{i + 1, "unterminated filter value"}
+					}
+
+					i = end
+				}
+				i++
+			}
+
+			word := value[start:i]
+			kind := tokenWord
+			switch word {
+			case "AND":
+				kind = tokenAnd
+			case "OR":
+				kind = tokenOr
+			case "NOT":
+				kind = tokenNot
+			}
+
+			tokens = append(tokens, token{kind, word, start})
+		}
+	}
+
+	return append(tokens, token{tokenEOF, "", len(value)}), nil
+}
+
+type searchParser struct {
+	tokens          []token
+	pos             int
+	caseInsensitive bool
+}
+
+func (p *searchParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *searchParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// parseSearch parses a search query.
+func parseSearch(value string) (*searchQuery, error) {
+	tokens, err := lexSearch(value)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &searchQuery{}
+
+	// The case option applies to the whole query, wherever it is.
+	kept := tokens[:0]
+	for _, t := range tokens {
+		if t.kind == tokenWord && strings.HasPrefix(t.value, "case:") {
+			switch t.value {
+			case "case:insensitive":
+				query.CaseInsensitive = true
+			case "case:sensitive":
+				query.CaseInsensitive = false
+			default:
+				return nil, &searchSyntaxError{t.pos, "case must be sensitive or insensitive"}
+			}
+			continue
+		}
+		kept = append(kept, t)
+	}
+
+	p := &searchParser{tokens: kept, caseInsensitive: query.CaseInsensitive}
+	if p.peek().kind == tokenEOF {
+		return query, nil
+	}
+
+	query.Root, err = p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		if t.kind == tokenRParen {
+			return nil, &searchSyntaxError{t.pos, "unexpected )"}
+		}
+		return nil, &searchSyntaxError{t.pos, "unexpected " + t.value}
+	}
+
+	return query, nil
+}
+
+// parseOr parses expressions separated by OR.
+func (p *searchParser) parseOr() (searchNode, error) {
+	var nodes orNode
+
+	for {
+		node, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+
+		if p.peek().kind != tokenOr {
+			break
+		}
+		p.next()
+	}
+
+	if len(nodes) == 1 {
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+// parseAnd parses runs of expressions separated by AND. Each run of
+// expressions only separated by spaces is grouped by implicitGroup.
+func (p *searchParser) parseAnd() (searchNode, error) {
+	var (
+		nodes andNode
+		run   []searchNode
+	)
+
+	for {
+		t := p.peek()
+		switch t.kind {
+		case tokenEOF, tokenRParen, tokenOr:
+			if len(run) == 0 {
+				return nil, p.missingOperand(t)
+			}
+			nodes = append(nodes, implicitGroup(run))
+
+			if len(nodes) == 1 {
+				return nodes[0], nil
+			}
+			return nodes, nil
+		case tokenAnd:
+			if len(run) == 0 {
+				return nil, p.missingOperand(t)
+			}
+			p.next()
+			nodes = append(nodes, implicitGroup(run))
+			run = nil
+		default:
+			node, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			run = append(run, node)
+		}
+	}
+}
+
+func (p *searchParser) missingOperand(t token) error {
+	if t.kind == tokenEOF {
+		return &searchSyntaxError{t.pos, "unexpected end of query"}
+	}
+	return &searchSyntaxError{t.pos, "missing search term before " + t.value}
+}
+
+// implicitGroup combines expressions only separated by spaces: plain
+// terms are alternatives, as are filters with the same type: key, and
+// the resulting groups must all match.
+func implicitGroup(nodes []searchNode) searchNode {
+	var (
+		result andNode
+		terms  orNode
+		types  orNode
+	)
+
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case termNode:
+			terms = append(terms, n)
+		case filterNode:
+			if n.key == "type" {
+				types = append(types, n)
+				continue
+			}
+			result = append(result, n)
+		default:
+			result = append(result, n)
+		}
+	}
+
+	for _, group := range []orNode{types, terms} {
+		switch len(group) {
+		case 0:
+		case 1:
+			result = append(result, group[0])
+		default:
+			result = append(result, group)
+		}
+	}
+
+	if len(result) == 1 {
+		return result[0]
+	}
+	return result
+}
+
+// parseUnary parses a possibly negated term, filter or group.
+func (p *searchParser) parseUnary() (searchNode, error) {
+	t := p.next()
+
+	switch t.kind {
+	case tokenMinus, tokenNot:
+		if k := p.peek().kind; k == tokenEOF || k == tokenRParen || k == tokenAnd || k == tokenOr {
+			return nil, &searchSyntaxError{t.pos, "nothing to exclude after " + t.value}
+		}
+
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node}, nil
+	case tokenLParen:
+		if p.peek().kind == tokenRParen {
+			return nil, &searchSyntaxError{t.pos, "empty parentheses"}
+		}
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek().kind != tokenRParen {
+			return nil, &searchSyntaxError{t.pos, "unclosed ("}
+		}
+		p.next()
+		return node, nil
+	case tokenQuoted:
+		return p.term(t.value), nil
+	case tokenWord:
+		return p.parseWord(t)
+	}
+
+	return nil, &searchSyntaxError{t.pos, "unexpected " + t.value}
+}
+
+func (p *searchParser) term(value string) searchNode {
+	if p.caseInsensitive {
+		value = strings.ToLower(value)
+	}
+	return termNode(value)
+}
+
+// parseWord parses a plain term or a key:value filter. Words with an
+// unknown key, such as URLs, are plain terms.
+func (p *searchParser) parseWord(t token) (searchNode, error) {
+	i := strings.IndexByte(t.value, ':')
+	if i == -1 {
+		return p.term(t.value), nil
+	}
+
+	key, value := t.value[:i], t.value[i+1:]
+	pos := t.pos + i + 1
+
+	// Strip the quotes of key:"value".
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+
+	var (
+		test func(f *searchItem) bool
+		err  error
+	)
+
+	switch key {
+	case "type":
+		if value == "" {
+			return nil, &searchSyntaxError{pos, "missing type"}
+		}
+		cond := typeCondition(value)
+		test = func(f *searchItem) bool { return cond(f.Path) }
+	case "size":
+		test, err = parseSizeFilter(value, pos)
+	case "modified":
+		test, err = parseDateFilter(value, pos)
+	case "name":
+		var match func(string) bool
+		match, err = p.parseNameMatcher(value, pos)
+		test = func(f *searchItem) bool { return match(f.Name) }
+	case "dir", "file":
+		var match func(string) bool
+		match, err = p.parseNameMatcher(value, pos)
+		isDir := key == "dir"
+		test = func(f *searchItem) bool {
+			return f.Info.IsDir() == isDir && (value == "" || match(f.Name))
+		}
+	default:
+		return p.term(t.value), nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return filterNode{key, test}, nil
+}
+
+// parseNameMatcher parses the value of the name: filter, which is
+// either a /regular expression/ or a substring.
+func (p *searchParser) parseNameMatcher(value string, pos int) (func(string) bool, error) {
+	if len(value) >= 2 && value[0] == '/' && value[len(value)-1] == '/' {
+		expr := value[1 : len(value)-1]
+		if p.caseInsensitive {
+			expr = "(?i)" + expr
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, &searchSyntaxError{pos, "invalid regular expression: " + err.Error()}
+		}
+		return re.MatchString, nil
+	}
+
+	if p.caseInsensitive {
+		value = strings.ToLower(value)
+		return func(name string) bool {
+			return strings.Contains(strings.ToLower(name), value)
+		}, nil
+	}
+
+	return func(name string) bool {
+		return strings.Contains(name, value)
+	}, nil
+}
+
+// splitComparison splits the comparison operator from a filter value.
+// Values without one use def.
+func splitComparison(value, def string) (string, string) {
+	for _, op := range []string{"<=", ">=", "<", ">", "="} {
+		if strings.HasPrefix(value, op) {
+			return op, value[len(op):]
+		}
+	}
+	return def, value
+}
+
+var sizeUnits = map[string]int64{
+	"":   1,
+	"b":  1,
+	"k":  1 << 10,
+	"kb": 1 << 10,
+	"m":  1 << 20,
+	"mb": 1 << 20,
+	"g":  1 << 30,
+	"gb": 1 << 30,
+	"t":  1 << 40,
+	"tb": 1 << 40,
+}
+
+// parseSizeFilter parses the value of the size: filter, such as >10MB.
+func parseSizeFilter(value string, pos int) (func(f *searchItem) bool, error) {
+	op, value := splitComparison(value, ">=")
+
+	i := strings.IndexFunc(value, func(r rune) bool {
+		return !unicode.IsDigit(r) && r != '.'
+	})
+	if i == -1 {
+		i = len(value)
+	}
+
+	number, err := strconv.ParseFloat(value[:i], 64)
+	if err != nil {
+		return nil, &searchSyntaxError{pos, "invalid size " + strconv.Quote(value)}
+	}
+
+	unit, ok := sizeUnits[strings.ToLower(value[i:])]
+	if !ok {
+		return nil, &searchSyntaxError{pos, "unknown size unit " + strconv.Quote(value[i:])}
+	}
+
+	size := int64(number * float64(unit))
+
+	return func(f *searchItem) bool {
+		return compare(op, f.Info.Size(), size)
+	}, nil
+}
+
+// parseDateFilter parses the value of the modified: filter, such as
+// <2026-01-01. Dates are in the server's time zone.
+func parseDateFilter(value string, pos int) (func(f *searchItem) bool, error) {
+	op, value := splitComparison(value, "=")
+
+	var (
+		start  time.Time
+		length time.Duration
+		err    error
+	)
+
+	for _, layout := range []struct {
+		format string
+		length time.Duration
+	}{
+		{"2006-01-02T15:04:05", time.Second},
+		{"2006-01-02T15:04", time.Minute},
+		{"2006-01-02", 24 * time.Hour},
+		{"2006-01", 0},
+		{"2006", 0},
+	} {
+		start, err = time.ParseInLocation(layout.format, value, time.Local)
+		if err != nil {
+			continue
+		}
+
+		length = layout.length
+		switch layout.format {
+		case "2006-01":
+			length = start.AddDate(0, 1, 0).Sub(start)
+		case "2006":
+			length = start.AddDate(1, 0, 0).Sub(start)
+		}
+		break
+	}
+
+	if err != nil {
+		return nil, &searchSyntaxError{pos, "invalid date " + strconv.Quote(value) + ", use YYYY-MM-DD"}
+	}
+
+	end := start.Add(length)
+
+	return func(f *searchItem) bool {
+		t := f.Info.ModTime()
+		switch op {
+		case "<":
+			return t.Before(start)
+		case "<=":
+			return t.Before(end)
+		case ">":
+			return !t.Before(end)
+		case ">=":
+			return !t.Before(start)
+		default:
+			return !t.Before(start) && t.Before(end)
+		}
+	}, nil
+}
+
+func compare(op string, a, b int64) bool {
+	switch op {
+	case "<":
+		return a < b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	case ">=":
+		return a >= b
+	default:
+		return a == b
+	}
+}
+
+// searchPath returns the path of a search result relative to the
+// search scope, which is the form terms are matched against.
+func searchPath(scope, path string, caseInsensitive bool) string {
+	path = strings.TrimPrefix(path, scope)
+	path = strings.TrimPrefix(path, "/")
+	path = filepath.ToSlash(path)
+
+	if caseInsensitive {
+		path = strings.ToLower(path)
+	}
+
+	return path
+}
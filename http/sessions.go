@@ -0,0 +1,97 @@
+package http
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+type sessionInfo struct {
+	*fm.Session
+	Current bool `json:"current"`
+}
+
+// sessionsHandler lists and revokes the sessions. The users manage their
+// own sessions and the admins those of every user, with ?user=<id>. The
+// admins can also rotate the key the tokens are signed with, which ends
+// every session, with a POST to /api/sessions/key.
+func sessionsHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.Store.Sessions == nil {
+		return http.StatusNotImplemented, nil
+	}
+
+	if r.URL.Path == "/key" {
+		if r.Method != http.MethodPost {
+			return http.StatusMethodNotAllowed, nil
+		}
+
+		if !c.User.Admin {
+			return http.StatusForbidden, nil
+		}
+
+		if err := c.RotateKey(); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		return http.StatusOK, nil
+	}
+
+	id := c.User.ID
+	if s := r.URL.Query().Get("user"); s != "" {
+		var err error
+		if id, err = strconv.Atoi(s); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	if id != c.User.ID && !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		sessions, err := c.Store.Sessions.GetByUser(id)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		infos := []sessionInfo{}
+		for _, s := range sessions {
+			infos = append(infos, sessionInfo{s, c.Session != nil && s.ID == c.Session.ID})
+		}
+
+		return renderJSON(w, infos)
+	case http.MethodDelete:
+		// Revokes all the sessions of the user.
+		if r.URL.Path == "/" || r.URL.Path == "" {
+			if err := c.RevokeSessions(id); err != nil {
+				return http.StatusInternalServerError, err
+			}
+
+			return http.StatusOK, nil
+		}
+
+		s, err := c.Store.Sessions.Get(strings.TrimPrefix(r.URL.Path, "/"))
+		if err == fm.ErrNotExist {
+			return http.StatusNotFound, nil
+		}
+
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		if s.UserID != c.User.ID && !c.User.Admin {
+			return http.StatusForbidden, nil
+		}
+
+		if err := c.Store.Sessions.Delete(s.ID); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		return http.StatusOK, nil
+	}
+
+	return http.StatusMethodNotAllowed, nil
+}
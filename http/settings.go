@@ -13,9 +13,11 @@ import (
 type modifySettingsRequest struct {
 	*modifyRequest
 	Data struct {
-		CSS       string                 `json:"css"`
-		Commands  map[string][]string    `json:"commands"`
-		StaticGen map[string]interface{} `json:"staticGen"`
+		CSS        string                   `json:"css"`
+		Commands   map[string][]*fm.Hook    `json:"commands"`
+		Webhooks   map[string][]*fm.Webhook `json:"webhooks"`
+		StaticGen  map[string]interface{}   `json:"staticGen"`
+		Require2FA bool                     `json:"require2fa"`
 	} `json:"data"`
 }
 
@@ -62,9 +64,11 @@ func settingsHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 }
 
 type settingsGetRequest struct {
-	CSS       string              `json:"css"`
-	Commands  map[string][]string `json:"commands"`
-	StaticGen []option            `json:"staticGen"`
+	CSS        string                   `json:"css"`
+	Commands   map[string][]*fm.Hook    `json:"commands"`
+	Webhooks   map[string][]*fm.Webhook `json:"webhooks"`
+	StaticGen  []option                 `json:"staticGen"`
+	Require2FA bool                     `json:"require2fa"`
 }
 
 func settingsGetHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
@@ -73,9 +77,11 @@ func settingsGetHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (
 	}
 
 	result := &settingsGetRequest{
-		Commands:  c.Commands,
-		StaticGen: []option{},
-		CSS:       c.CSS,
+		Commands:   c.Commands,
+		Webhooks:   c.Webhooks,
+		StaticGen:  []option{},
+		CSS:        c.CSS,
+		Require2FA: c.Require2FA,
 	}
 
 	if c.StaticGen != nil {
@@ -109,6 +115,18 @@ func settingsPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (
 
 	// Update the commands.
 	if mod.Which == "commands" {
+		for _, hooks := range mod.Data.Commands {
+			for _, h := range hooks {
+				if h == nil {
+					return http.StatusBadRequest, fm.ErrInvalidOption
+				}
+
+				if err := h.Check(); err != nil {
+					return http.StatusBadRequest, err
+				}
+			}
+		}
+
 		if err := c.Store.Config.Save("commands", mod.Data.Commands); err != nil {
 			return http.StatusInternalServerError, err
 		}
@@ -117,6 +135,28 @@ func settingsPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (
 		return http.StatusOK, nil
 	}
 
+	// Update the webhooks.
+	if mod.Which == "webhooks" {
+		for _, hooks := range mod.Data.Webhooks {
+			for _, h := range hooks {
+				if h == nil {
+					return http.StatusBadRequest, fm.ErrInvalidOption
+				}
+
+				if err := h.Check(); err != nil {
+					return http.StatusBadRequest, err
+				}
+			}
+		}
+
+		if err := c.Store.Config.Save("webhooks", mod.Data.Webhooks); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		c.Webhooks = mod.Data.Webhooks
+		return http.StatusOK, nil
+	}
+
 	// Update the global CSS.
 	if mod.Which == "css" {
 		if err := c.Store.Config.Save("css", mod.Data.CSS); err != nil {
@@ -127,6 +167,16 @@ func settingsPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (
 		return http.StatusOK, nil
 	}
 
+	// Update the policy of the second factors.
+	if mod.Which == "require2fa" {
+		if err := c.Store.Config.Save("require2fa", mod.Data.Require2FA); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		c.Require2FA = mod.Data.Require2FA
+		return http.StatusOK, nil
+	}
+
 	// Update the static generator options.
 	if mod.Which == "staticGen" {
 		err = mapstructure.Decode(mod.Data.StaticGen, c.StaticGen)
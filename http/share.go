@@ -2,7 +2,12 @@ package http
 
 import (
 	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -11,6 +16,53 @@ import (
 	fm "github.com/rjchee/dcac_filemanager"
 )
 
+// shareOptions are the restrictions of a new share link.
+type shareOptions struct {
+	Password     string   `json:"password"`
+	MaxDownloads int      `json:"maxDownloads"`
+	AllowedIPs   []string `json:"allowedIPs"`
+	ViewOnly     bool     `json:"viewOnly"`
+	Upload       bool     `json:"upload"`
+	MaxFileSize  int64    `json:"maxFileSize"`
+	MaxTotalSize int64    `json:"maxTotalSize"`
+}
+
+func (o shareOptions) empty() bool {
+	return o.Password == "" && o.MaxDownloads == 0 && len(o.AllowedIPs) == 0 &&
+		!o.ViewOnly && !o.Upload
+}
+
+// check validates the options of a link to a file or a directory.
+func (o shareOptions) check(isDir bool) error {
+	if o.MaxDownloads < 0 || o.MaxFileSize < 0 || o.MaxTotalSize < 0 {
+		return fm.ErrInvalidOption
+	}
+
+	// The upload links only receive files into a directory.
+	if o.Upload && (!isDir || o.MaxDownloads != 0 || o.ViewOnly) {
+		return fm.ErrInvalidOption
+	}
+
+	if !o.Upload && (o.MaxFileSize != 0 || o.MaxTotalSize != 0) {
+		return fm.ErrInvalidOption
+	}
+
+	_, err := fm.ParseIPRanges(o.AllowedIPs)
+	return err
+}
+
+// shareInfo is a share link as its owner sees it, without the hash of
+// its password.
+type shareInfo struct {
+	*fm.ShareLink
+	PasswordHash string `json:"passwordHash,omitempty"`
+	HasPassword  bool   `json:"hasPassword"`
+}
+
+func newShareInfo(s *fm.ShareLink) shareInfo {
+	return shareInfo{ShareLink: s, HasPassword: s.HasPassword()}
+}
+
 func shareHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
 	r.URL.Path = sanitizeURL(r.URL.Path)
 
@@ -37,18 +89,24 @@ func shareGetHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 		return http.StatusInternalServerError, err
 	}
 
-	for i, link := range s {
+	// The users only see their own links.
+	links := []shareInfo{}
+	for _, link := range s {
 		if link.Expires && link.ExpireDate.Before(time.Now()) {
 			c.Store.Share.Delete(link.Hash)
-			s = append(s[:i], s[i+1:]...)
+			continue
+		}
+
+		if link.UserID == c.User.ID {
+			links = append(links, newShareInfo(link))
 		}
 	}
 
-	if len(s) == 0 {
+	if len(links) == 0 {
 		return http.StatusNotFound, nil
 	}
 
-	return renderJSON(w, s)
+	return renderJSON(w, links)
 }
 
 func sharePostHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
@@ -58,12 +116,33 @@ func sharePostHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (in
 	expire := r.URL.Query().Get("expires")
 	unit := r.URL.Query().Get("unit")
 
-	if expire == "" {
+	var opts shareOptions
+	if r.Body != nil && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	info, err := c.User.FileSystem.Stat(r.URL.Path)
+	if err != nil {
+		return ErrorToHTTP(err, false), err
+	}
+
+	if err := opts.check(info.IsDir()); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// The users who can't create files can't let others do it.
+	if opts.Upload && !c.User.AllowNew {
+		return http.StatusForbidden, nil
+	}
+
+	// The permanent link without restrictions is reused.
+	if expire == "" && opts.empty() {
 		var err error
-		s, err = c.Store.Share.GetPermanent(path)
+		s, err = c.Store.Share.GetPermanent(path, c.User.ID)
 		if err == nil {
-			w.Write([]byte(c.RootURL() + "/share/" + s.Hash))
-			return 0, nil
+			return renderJSON(w, newShareInfo(s))
 		}
 	}
 
@@ -75,9 +154,20 @@ func sharePostHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (in
 	str := hex.EncodeToString(bytes)
 
 	s = &fm.ShareLink{
-		Path:    path,
-		Hash:    str,
-		Expires: expire != "",
+		Path:         path,
+		Hash:         str,
+		Expires:      expire != "",
+		UserID:       c.User.ID,
+		MaxDownloads: opts.MaxDownloads,
+		AllowedIPs:   opts.AllowedIPs,
+		ViewOnly:     opts.ViewOnly,
+		Upload:       opts.Upload,
+		MaxFileSize:  opts.MaxFileSize,
+		MaxTotalSize: opts.MaxTotalSize,
+	}
+
+	if err := s.SetPassword(opts.Password); err != nil {
+		return http.StatusInternalServerError, err
 	}
 
 	if expire != "" {
@@ -101,11 +191,35 @@ func sharePostHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (in
 		s.ExpireDate = time.Now().Add(add)
 	}
 
+	vars := shareVars(s)
+	if err := c.RunnerVars("before_share", path, "", c.User, vars); err != nil {
+		return hookStatus(err), err
+	}
+
 	if err := c.Store.Share.Save(s); err != nil {
 		return http.StatusInternalServerError, err
 	}
 
-	return renderJSON(w, s)
+	if err := c.RunnerVars("after_share", path, "", c.User, vars); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return renderJSON(w, newShareInfo(s))
+}
+
+// shareVars are the details of a link given to its hooks.
+func shareVars(s *fm.ShareLink) map[string]string {
+	vars := map[string]string{
+		"SHARE_HASH":     s.Hash,
+		"SHARE_UPLOAD":   strconv.FormatBool(s.Upload),
+		"SHARE_PASSWORD": strconv.FormatBool(s.HasPassword()),
+	}
+
+	if s.Expires {
+		vars["SHARE_EXPIRES"] = s.ExpireDate.Format(time.RFC3339)
+	}
+
+	return vars
 }
 
 func shareDeleteHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
@@ -118,10 +232,310 @@ func shareDeleteHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (
 		return http.StatusInternalServerError, err
 	}
 
+	if s.UserID != c.User.ID && !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	vars := shareVars(s)
+	if err := c.RunnerVars("before_unshare", s.Path, "", c.User, vars); err != nil {
+		return hookStatus(err), err
+	}
+
 	err = c.Store.Share.Delete(s.Hash)
 	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
+	if err := c.RunnerVars("after_unshare", s.Path, "", c.User, vars); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
 	return http.StatusOK, nil
 }
+
+// shareUnlocked tells if the password of the link was given before.
+func shareUnlocked(c *fm.Context, r *http.Request, s *fm.ShareLink) bool {
+	cookie, err := r.Cookie(fm.ShareCookie + s.Hash)
+	if err != nil {
+		return false
+	}
+
+	return c.CheckShareToken(s, cookie.Value)
+}
+
+// sharePasswordPage asks for the password of a link and checks it. The
+// guesses are throttled like the logins.
+func sharePasswordPage(c *fm.Context, w http.ResponseWriter, r *http.Request, s *fm.ShareLink) (int, error) {
+	var message string
+	code := http.StatusUnauthorized
+	name := "share:" + s.Hash
+
+	if r.Method == http.MethodPost {
+		err := c.CheckLogin(name, r.RemoteAddr)
+		terr, throttled := err.(*fm.ThrottledError)
+
+		switch {
+		case throttled:
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(terr.Until).Seconds())+1))
+			code, message = http.StatusTooManyRequests, "Too many wrong passwords, try again later."
+		case err != nil:
+			return http.StatusInternalServerError, err
+		case fm.CheckPasswordHash(r.PostFormValue("password"), s.PasswordHash):
+			if err := c.LoginSucceeded(name); err != nil {
+				return http.StatusInternalServerError, err
+			}
+
+			http.SetCookie(w, &http.Cookie{
+				Name:     fm.ShareCookie + s.Hash,
+				Value:    c.ShareToken(s),
+				Path:     c.RootURL() + "/share/" + s.Hash,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteLaxMode,
+			})
+
+			http.Redirect(w, r, c.RootURL()+"/share/"+s.Hash, http.StatusSeeOther)
+			return 0, nil
+		default:
+			if err := c.LoginFailed(name, r.RemoteAddr); err != nil {
+				return http.StatusInternalServerError, err
+			}
+
+			message = "Wrong password."
+		}
+	}
+
+	tpl := template.Must(template.New("file").Parse(c.Assets.MustString("static/share/password.html")))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+
+	err := tpl.Execute(w, map[string]interface{}{
+		"BaseURL": c.RootURL(),
+		"Error":   message,
+	})
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return 0, nil
+}
+
+// maxSharePreview is the size of the largest text file previewed on a
+// share page.
+const maxSharePreview = 1 << 20
+
+// queryFlag tells if a flag of the query is set, like "?dl=1".
+func queryFlag(r *http.Request, name string) bool {
+	v := r.URL.Query().Get(name)
+	return v != "" && v != "0"
+}
+
+// shareURL is the URL of a path of a shared directory.
+func shareURL(c *fm.Context, s *fm.ShareLink, sub string) string {
+	u := url.URL{Path: c.RootURL() + "/share/" + s.Hash + sub}
+	return u.String()
+}
+
+// sharePreviewType tells if a file can be previewed on a share page:
+// "image", "text" or empty.
+func sharePreviewType(f *fm.File) string {
+	if f.IsDir {
+		return ""
+	}
+
+	if strings.HasPrefix(mime.TypeByExtension(f.Extension), "image") {
+		return "image"
+	}
+
+	if f.Size > maxSharePreview {
+		return ""
+	}
+
+	if err := f.GetFileType(true); err != nil || f.Type != "text" {
+		return ""
+	}
+
+	return "text"
+}
+
+// shareDownloadHandler downloads a shared file, a shared directory or a
+// selection of its files.
+func shareDownloadHandler(c *fm.Context, w http.ResponseWriter, r *http.Request, s *fm.ShareLink) (int, error) {
+	if s.ViewOnly {
+		return http.StatusForbidden, nil
+	}
+
+	// No part of a file is sent once the link has no downloads left.
+	if s.Exhausted() {
+		return http.StatusGone, nil
+	}
+
+	// The requests of the next parts of a file, when a download is resumed,
+	// aren't new downloads.
+	if rng := r.Header.Get("Range"); rng == "" || strings.HasPrefix(rng, "bytes=0-") {
+		_, err := c.Store.Share.CountDownload(s.Hash)
+		if err == fm.ErrShareExhausted {
+			return http.StatusGone, nil
+		}
+
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	}
+
+	return downloadEventHandler(c, w, r, map[string]string{"SHARE_HASH": s.Hash})
+}
+
+// sharePreviewPage shows a text file or an image of a share in the
+// browser. The previews are views, so they don't count as downloads, but
+// the links which have none left can't be previewed either.
+func sharePreviewPage(c *fm.Context, w http.ResponseWriter, r *http.Request, s *fm.ShareLink, sub string) (int, error) {
+	if s.Exhausted() {
+		return http.StatusGone, nil
+	}
+
+	kind := sharePreviewType(c.File)
+	if kind == "" {
+		return http.StatusNotFound, nil
+	}
+
+	if _, err := c.Store.Share.CountView(s.Hash); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	tpl := template.Must(template.New("file").Parse(c.Assets.MustString("static/share/preview.html")))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	err := tpl.Execute(w, map[string]interface{}{
+		"BaseURL":  c.RootURL(),
+		"File":     c.File,
+		"Kind":     kind,
+		"URL":      shareURL(c, s, sub),
+		"Parent":   shareURL(c, s, strings.TrimSuffix(path.Dir(sub), "/")+"/"),
+		"Root":     sub == "/",
+		"ViewOnly": s.ViewOnly,
+	})
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return 0, nil
+}
+
+// shareRawHandler serves the images of the previews. They're sandboxed,
+// so the scripts of an SVG don't run with the origin of File Manager.
+func shareRawHandler(c *fm.Context, w http.ResponseWriter, r *http.Request, s *fm.ShareLink) (int, error) {
+	if s.Exhausted() {
+		return http.StatusGone, nil
+	}
+
+	if sharePreviewType(c.File) != "image" {
+		return http.StatusNotFound, nil
+	}
+
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	r.URL.RawQuery = "inline=true"
+	return downloadFileHandler(c, w, r)
+}
+
+// shareItem is a file of a shared directory listing.
+type shareItem struct {
+	*fm.File
+	Link        string
+	HumanSize   string
+	Previewable bool
+}
+
+// humanSize formats a size in bytes like "1.5 MB".
+func humanSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.FormatInt(size, 10) + " B"
+	}
+
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return strconv.FormatFloat(float64(size)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "B"
+}
+
+// shareCrumb is a directory of the path of a shared directory listing.
+type shareCrumb struct {
+	Name string
+	Link string
+}
+
+// shareListingPage shows the files of a shared directory.
+func shareListingPage(c *fm.Context, w http.ResponseWriter, r *http.Request, s *fm.ShareLink, sub string) (int, error) {
+	f := c.File
+	if err := f.GetListing(c.User, r); err != nil {
+		return ErrorToHTTP(err, true), err
+	}
+
+	sort, order, err := handleSortOrder(w, r, c.RootURL()+"/share/"+s.Hash)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	f.Listing.Sort, f.Listing.Order = sort, order
+	f.Listing.ApplySort()
+
+	if _, err := c.Store.Share.CountView(s.Hash); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	items := []shareItem{}
+	for _, i := range f.Listing.Items {
+		link := shareURL(c, s, path.Join(sub, i.Name))
+		if i.IsDir {
+			link += "/"
+		}
+
+		items = append(items, shareItem{
+			File:        i,
+			Link:        link,
+			HumanSize:   humanSize(i.Size),
+			Previewable: !i.IsDir && (i.Type == "image" || i.Type == "text" && i.Size <= maxSharePreview),
+		})
+	}
+
+	root := filepath.Base(s.Path)
+	crumbs := []shareCrumb{{Name: root, Link: shareURL(c, s, "/")}}
+	parts := strings.Split(strings.Trim(sub, "/"), "/")
+	for i, name := range parts {
+		if name == "" {
+			continue
+		}
+
+		crumbs = append(crumbs, shareCrumb{
+			Name: name,
+			Link: shareURL(c, s, "/"+strings.Join(parts[:i+1], "/")+"/"),
+		})
+	}
+
+	tpl := template.Must(template.New("file").Parse(c.Assets.MustString("static/share/listing.html")))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	err = tpl.Execute(w, map[string]interface{}{
+		"BaseURL":  c.RootURL(),
+		"Name":     root,
+		"Crumbs":   crumbs,
+		"Items":    items,
+		"URL":      shareURL(c, s, strings.TrimSuffix(sub, "/")+"/"),
+		"Sort":     sort,
+		"Order":    order,
+		"ViewOnly": s.ViewOnly,
+	})
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return 0, nil
+}
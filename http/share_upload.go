@@ -0,0 +1,152 @@
+package http
+
+import (
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// shareUploadHandler shows the page of an upload link with a GET and
+// receives a file with a POST of its content to ?name=<name>.
+func shareUploadHandler(c *fm.Context, w http.ResponseWriter, r *http.Request, s *fm.ShareLink, root, sub string) (int, error) {
+	if sub != "/" {
+		return http.StatusNotFound, nil
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		return shareUploadPage(c, w, s)
+	case http.MethodPost:
+		return shareUploadFile(c, w, r, s, root)
+	}
+
+	return http.StatusMethodNotAllowed, nil
+}
+
+func shareUploadPage(c *fm.Context, w http.ResponseWriter, s *fm.ShareLink) (int, error) {
+	if _, err := c.Store.Share.CountView(s.Hash); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	tpl := template.Must(template.New("file").Parse(c.Assets.MustString("static/share/upload.html")))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	data := map[string]interface{}{
+		"BaseURL":     c.RootURL(),
+		"URL":         shareURL(c, s, "/"),
+		"MaxFileSize": s.MaxFileSize,
+		"Remaining":   int64(-1),
+	}
+
+	if s.MaxFileSize > 0 {
+		data["FileLimit"] = humanSize(s.MaxFileSize)
+	}
+
+	if s.MaxTotalSize > 0 {
+		data["Remaining"] = s.MaxTotalSize - s.UploadedBytes
+		data["TotalLimit"] = humanSize(s.MaxTotalSize - s.UploadedBytes)
+	}
+
+	err := tpl.Execute(w, data)
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return 0, nil
+}
+
+// shareUploadFile saves a file uploaded through a link like an upload of
+// the user who created it, with its hooks and its rights.
+func shareUploadFile(c *fm.Context, w http.ResponseWriter, r *http.Request, s *fm.ShareLink, root string) (int, error) {
+	// Discard any invalid upload before returning to avoid connection
+	// reset error.
+	defer func() {
+		io.Copy(ioutil.Discard, r.Body)
+	}()
+
+	if !c.User.AllowNew {
+		return http.StatusForbidden, nil
+	}
+
+	name, err := fm.UploadName(r.URL.Query().Get("name"))
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	// The size must be known to check it against the limits.
+	size := r.ContentLength
+	if size < 0 {
+		return http.StatusLengthRequired, nil
+	}
+
+	if s.MaxFileSize > 0 && size > s.MaxFileSize {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+
+	vpath := path.Join(root, name)
+
+	account, code, err := checkUpload(c, vpath, size)
+	if code != 0 {
+		return code, err
+	}
+
+	_, err = c.Store.Share.CountUpload(s.Hash, size)
+	if err == fm.ErrShareExhausted {
+		return http.StatusRequestEntityTooLarge, nil
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	written, code, err := shareWriteUpload(c, r, vpath, size)
+	if code != 0 {
+		// The upload didn't use the space it took.
+		if _, err := c.Store.Share.CountUpload(s.Hash, -size); err != nil {
+			log.Print(err)
+		}
+
+		return code, err
+	}
+
+	account(written)
+
+	if err := c.Reindex(filepath.Join(c.User.Scope, vpath)); err != nil {
+		log.Print(err)
+	}
+
+	if err := c.Runner("after_upload", vpath, "", c.User); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// shareWriteUpload writes the body of an upload, up to its size.
+func shareWriteUpload(c *fm.Context, r *http.Request, vpath string, size int64) (int64, int, error) {
+	if err := c.Runner("before_upload", vpath, "", c.User); err != nil {
+		return 0, hookStatus(err), err
+	}
+
+	f, err := c.User.FileSystem.OpenFile(vpath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0776)
+	if err != nil {
+		return 0, ErrorToHTTP(err, false), err
+	}
+	defer f.Close()
+
+	written, err := io.Copy(f, io.LimitReader(r.Body, size))
+	if err != nil {
+		c.User.FileSystem.RemoveAll(vpath)
+		return 0, ErrorToHTTP(err, false), err
+	}
+
+	return written, 0, nil
+}
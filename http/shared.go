@@ -0,0 +1,139 @@
+package http
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// sharedWithMe tells if a request is about the files shared with the user.
+// They are reached through the SharedWithMe directory, which hides the
+// one with the same name in its scope, if any.
+func sharedWithMe(c *fm.Context, r *http.Request) bool {
+	if c.Store.Grants == nil {
+		return false
+	}
+
+	switch c.Router {
+	case "resource", "download", "checksum", "thumbnail":
+	default:
+		return false
+	}
+
+	p := sanitizeURL(r.URL.Path)
+	return p == fm.SharedWithMe || strings.HasPrefix(p, fm.SharedWithMe+"/")
+}
+
+// sharedWithMeListing lists the grants the user received as the
+// directories of the SharedWithMe directory.
+func sharedWithMeListing(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.Router != "resource" || r.Method != http.MethodGet {
+		return http.StatusForbidden, nil
+	}
+
+	grants, err := c.UserGrants(c.User)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	items := []*fm.File{}
+	dirs := 0
+	for _, g := range grants {
+		// The files which were removed since are left out.
+		info, err := os.Stat(g.Path)
+		if err != nil {
+			continue
+		}
+
+		name := g.DirName()
+		if info.IsDir() {
+			name += "/"
+			dirs++
+		}
+
+		item := &fm.File{
+			Name:        g.DirName(),
+			URL:         (&url.URL{Path: "/files" + fm.SharedWithMe + "/" + name}).String(),
+			Size:        info.Size(),
+			ModTime:     info.ModTime(),
+			Mode:        info.Mode(),
+			IsDir:       info.IsDir(),
+			Extension:   filepath.Ext(g.Name()),
+			VirtualPath: fm.SharedWithMe + "/" + g.DirName(),
+		}
+
+		item.GetFileType(false)
+		items = append(items, item)
+	}
+
+	f := &fm.File{
+		Kind:        "listing",
+		Name:        strings.TrimPrefix(fm.SharedWithMe, "/"),
+		URL:         "/files" + fm.SharedWithMe + "/",
+		IsDir:       true,
+		VirtualPath: fm.SharedWithMe,
+		Listing: &fm.Listing{
+			Items:    items,
+			NumDirs:  dirs,
+			NumFiles: len(items) - dirs,
+		},
+	}
+
+	return renderJSON(w, f)
+}
+
+// enterGrant makes the request about a path of a grant the user received,
+// on behalf of the user but within the scope of the grant and with the
+// rights it gives.
+func enterGrant(c *fm.Context, r *http.Request) (int, error) {
+	p := sanitizeURL(r.URL.Path)
+	id, sub, ok := fm.ParseGrantPath(p)
+	if !ok {
+		return http.StatusNotFound, nil
+	}
+
+	g, err := c.Store.Grants.Get(id)
+	if err == fm.ErrNotExist {
+		return http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	prefix := fm.SharedWithMe + "/" + g.DirName()
+	if !g.Includes(c.User) || !strings.HasPrefix(p+"/", prefix+"/") {
+		return http.StatusNotFound, nil
+	}
+
+	// The files are moved and copied within the grant only.
+	if dst := r.Header.Get("Destination"); dst != "" {
+		dst, err = url.QueryUnescape(dst)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+
+		dst = sanitizeURL(dst)
+		if !strings.HasPrefix(dst, prefix+"/") {
+			return http.StatusForbidden, nil
+		}
+
+		r.Header.Set("Destination", url.QueryEscape(strings.TrimPrefix(dst, prefix)))
+	}
+
+	u := *c.User
+	u.Scope = g.Path
+	u.FileSystem = c.NewFS(g.Path)
+	u.AllowNew = u.AllowNew && g.Write
+	u.AllowEdit = u.AllowEdit && g.Write
+	u.Rules = nil
+	u.URLPrefix = prefix
+	c.User = &u
+
+	r.URL.Path = sub
+	return 0, nil
+}
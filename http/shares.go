@@ -0,0 +1,68 @@
+package http
+
+import (
+	"net/http"
+	"sort"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// userShares are the links created by a user.
+type userShares struct {
+	UserID   int         `json:"userID"`
+	Username string      `json:"username"`
+	Links    []shareInfo `json:"links"`
+}
+
+// sharesHandler lets the admins see all the share links, grouped by the
+// users who created them. They are deleted through /api/share/<hash>.
+func sharesHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	links, err := c.Store.Share.Gets()
+	if err != nil && err != fm.ErrNotExist {
+		return http.StatusInternalServerError, err
+	}
+
+	users, err := c.Store.Users.Gets(c.NewFS)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	names := map[int]string{}
+	for _, u := range users {
+		names[u.ID] = u.Username
+	}
+
+	byUser := map[int]*userShares{}
+	for _, l := range links {
+		s, ok := byUser[l.UserID]
+		if !ok {
+			s = &userShares{UserID: l.UserID, Username: names[l.UserID], Links: []shareInfo{}}
+			byUser[l.UserID] = s
+		}
+
+		s.Links = append(s.Links, newShareInfo(l))
+	}
+
+	shares := []*userShares{}
+	for _, s := range byUser {
+		sort.Slice(s.Links, func(i, j int) bool {
+			return s.Links[i].Path < s.Links[j].Path
+		})
+
+		shares = append(shares, s)
+	}
+
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].Username < shares[j].Username
+	})
+
+	return renderJSON(w, shares)
+}
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// thumbnailHandler serves a resized version of an image or the poster
+// frame of a video.
+func thumbnailHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Method != http.MethodGet {
+		return http.StatusMethodNotAllowed, nil
+	}
+
+	if c.File.IsDir {
+		return http.StatusBadRequest, nil
+	}
+
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = "small"
+	}
+
+	if _, ok := fm.ThumbnailSizes[size]; !ok {
+		return http.StatusBadRequest, fm.ErrInvalidOption
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = fm.ThumbnailJPEG
+	}
+
+	// The cached thumbnail may have been created by another user, so
+	// open the original with the current user's attributes to make sure
+	// it is allowed to read it.
+	f, err := c.User.FileSystem.OpenFile(r.URL.Path, os.O_RDONLY, 0)
+	if err != nil {
+		return ErrorToHTTP(err, false), err
+	}
+	f.Close()
+
+	if err := c.File.GetFileType(false); err != nil {
+		return ErrorToHTTP(err, false), err
+	}
+
+	path, err := c.Thumbnail(c.File, size, format)
+	if err == fm.ErrNoThumbnail {
+		return http.StatusUnsupportedMediaType, nil
+	} else if err == fm.ErrInvalidOption {
+		return http.StatusBadRequest, err
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	thumb, err := os.Open(path)
+	if err != nil {
+		return ErrorToHTTP(err, false), err
+	}
+	defer thumb.Close()
+
+	info, err := thumb.Stat()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// The format may differ from the requested one if ffmpeg is missing.
+	w.Header().Set("Content-Type", "image/"+strings.TrimPrefix(filepath.Ext(path), "."))
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", info.ModTime(), thumb)
+	return 0, nil
+}
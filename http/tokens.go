@@ -0,0 +1,204 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgrijalva/jwt-go/request"
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// tokenRouters are the API routers the API tokens give access to. The
+// tokens are meant to move files, not to manage File Manager.
+var tokenRouters = map[string]bool{
+	"resource":  true,
+	"download":  true,
+	"checksum":  true,
+	"thumbnail": true,
+	"search":    true,
+	"usage":     true,
+}
+
+// apiTokenAuth authenticates an API token. The user it returns is
+// restricted to what the token gives access to.
+func apiTokenAuth(c *fm.Context, token string) (bool, *fm.User) {
+	if c.Store.APITokens == nil {
+		return false, nil
+	}
+
+	id, secret, ok := fm.ParseAPIToken(token)
+	if !ok {
+		return false, nil
+	}
+
+	t, err := c.Store.APITokens.Get(id)
+	if err != nil || !t.Check(secret) {
+		return false, nil
+	}
+
+	u, err := c.Store.Users.Get(t.UserID, c.NewFS)
+	if err != nil || u.Disabled {
+		return false, nil
+	}
+
+	u.WithToken(t)
+	c.User = u
+	return true, u
+}
+
+// bearerToken returns the API token of the Authorization header, if any.
+func bearerToken(r *http.Request) (string, bool) {
+	token, _ := request.AuthorizationHeaderExtractor.ExtractToken(r)
+	return token, strings.HasPrefix(token, fm.APITokenPrefix)
+}
+
+// checkTokenAccess checks the router and the method of a request are
+// allowed by the API token it was authenticated with.
+func checkTokenAccess(c *fm.Context, r *http.Request) bool {
+	t := c.User.Token
+	if t == nil {
+		return true
+	}
+
+	if !tokenRouters[c.Router] {
+		return false
+	}
+
+	return !t.ReadOnly || r.Method == http.MethodGet || r.Method == http.MethodHead
+}
+
+type tokenRequest struct {
+	Name     string `json:"name"`
+	UserID   int    `json:"userID"`
+	ReadOnly bool   `json:"readOnly"`
+	Prefix   string `json:"prefix"`
+	Expires  string `json:"expires"`
+}
+
+// tokensHandler manages the API tokens. The users manage their own
+// tokens and the admins those of every user, like the service accounts
+// which can't log in. Tokens are only shown once, when they are created.
+func tokensHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.Store.APITokens == nil {
+		return http.StatusNotImplemented, nil
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		return tokensGetHandler(c, w, r)
+	case http.MethodPost:
+		return tokensPostHandler(c, w, r)
+	case http.MethodDelete:
+		return tokensDeleteHandler(c, w, r)
+	}
+
+	return http.StatusMethodNotAllowed, nil
+}
+
+func tokensGetHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	id := c.User.ID
+	if s := r.URL.Query().Get("user"); s != "" {
+		var err error
+		if id, err = strconv.Atoi(s); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	if id != c.User.ID && !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	tokens, err := c.Store.APITokens.GetByUser(id)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	for _, t := range tokens {
+		t.Hash = ""
+	}
+
+	return renderJSON(w, tokens)
+}
+
+func tokensPostHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if r.Body == nil {
+		return http.StatusBadRequest, fm.ErrEmptyRequest
+	}
+
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	if req.UserID == 0 {
+		req.UserID = c.User.ID
+	}
+
+	if req.UserID != c.User.ID && !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	if _, err := c.Store.Users.Get(req.UserID, c.NewFS); err == fm.ErrNotExist {
+		return http.StatusNotFound, nil
+	} else if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	t, token, err := fm.NewAPIToken(req.UserID)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	t.Name = req.Name
+	t.ReadOnly = req.ReadOnly
+
+	if req.Prefix != "" {
+		t.Prefix = path.Clean("/" + req.Prefix)
+	}
+
+	// The expiry is either a date or a duration from now, like "720h".
+	if req.Expires != "" {
+		if d, err := time.ParseDuration(req.Expires); err == nil {
+			t.Expires = time.Now().Add(d)
+		} else if t.Expires, err = time.Parse(time.RFC3339, req.Expires); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	if err := c.Store.APITokens.Save(t); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	t.Hash = ""
+	return renderJSON(w, struct {
+		*fm.APIToken
+		Token string `json:"token"`
+	}{t, token})
+}
+
+func tokensDeleteHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	id := strings.TrimPrefix(r.URL.Path, "/")
+
+	t, err := c.Store.APITokens.Get(id)
+	if err == fm.ErrNotExist {
+		return http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if t.UserID != c.User.ID && !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	if err := c.Store.APITokens.Delete(id); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
@@ -0,0 +1,202 @@
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+type totpStatus struct {
+	Enabled       bool `json:"enabled"`
+	Required      bool `json:"required"`
+	RecoveryCodes int  `json:"recoveryCodes"`
+}
+
+type totpEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type totpRequest struct {
+	Code string `json:"code"`
+}
+
+// totpHandler manages the second factor of the user:
+//
+//	GET    /api/totp          tells if it is enabled or required
+//	POST   /api/totp          starts the enrollment and returns the secret
+//	POST   /api/totp/verify   enables it with a first code
+//	POST   /api/totp/recovery replaces the recovery codes
+//	DELETE /api/totp          disables it
+//
+// The recovery codes are only returned once. The admins can also disable
+// the second factor of a user who lost its device with a DELETE to
+// /api/totp/<id>.
+func totpHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.NoAuth {
+		return http.StatusNotImplemented, nil
+	}
+
+	switch {
+	case r.Method == http.MethodGet && (r.URL.Path == "/" || r.URL.Path == ""):
+		return renderJSON(w, totpStatus{
+			Enabled:       c.User.TwoFactor.Enabled,
+			Required:      c.TwoFactorRequired(c.User),
+			RecoveryCodes: len(c.User.TwoFactor.RecoveryCodes),
+		})
+	case r.Method == http.MethodPost && (r.URL.Path == "/" || r.URL.Path == ""):
+		return totpEnrollHandler(c, w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/verify":
+		return totpVerifyHandler(c, w, r)
+	case r.Method == http.MethodPost && r.URL.Path == "/recovery":
+		return totpRecoveryHandler(c, w, r)
+	case r.Method == http.MethodDelete:
+		return totpDeleteHandler(c, w, r)
+	}
+
+	return http.StatusMethodNotAllowed, nil
+}
+
+func totpEnrollHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.User.TwoFactor.Enabled {
+		return http.StatusConflict, nil
+	}
+
+	secret, err := fm.NewTOTPSecret()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	c.User.TwoFactor = fm.TwoFactor{Secret: secret}
+	if err := c.Store.Users.Update(c.User, "TwoFactor"); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return renderJSON(w, totpEnrollment{
+		Secret: secret,
+		URI:    fm.TOTPURI("File Manager", c.User.Username, secret),
+	})
+}
+
+func totpVerifyHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if c.User.TwoFactor.Enabled {
+		return http.StatusConflict, nil
+	}
+
+	if c.User.TwoFactor.Secret == "" {
+		return http.StatusBadRequest, nil
+	}
+
+	code, err := getTOTPCode(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	ok, err := c.VerifyTOTP(c.User, code)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if !ok {
+		return http.StatusForbidden, nil
+	}
+
+	c.User.TwoFactor.Enabled = true
+	return renderRecoveryCodes(c, w)
+}
+
+func totpRecoveryHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if code, err := checkTOTPCode(c, r); code != 0 || err != nil {
+		return code, err
+	}
+
+	return renderRecoveryCodes(c, w)
+}
+
+func totpDeleteHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	u := c.User
+
+	if r.URL.Path != "/" && r.URL.Path != "" {
+		if !c.User.Admin {
+			return http.StatusForbidden, nil
+		}
+
+		id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			return http.StatusNotFound, nil
+		}
+
+		u, err = c.Store.Users.Get(id, c.NewFS)
+		if err == fm.ErrNotExist {
+			return http.StatusNotFound, nil
+		}
+
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+	} else if code, err := checkTOTPCode(c, r); code != 0 || err != nil {
+		return code, err
+	}
+
+	u.TwoFactor = fm.TwoFactor{}
+	if err := c.Store.Users.Update(u, "TwoFactor"); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, nil
+}
+
+// checkTOTPCode checks the code of the second factor in the request, so a
+// stolen session can't change it.
+func checkTOTPCode(c *fm.Context, r *http.Request) (int, error) {
+	if !c.User.TwoFactor.Enabled {
+		return http.StatusBadRequest, nil
+	}
+
+	code, err := getTOTPCode(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	ok, err := c.CheckTwoFactor(c.User, code)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if !ok {
+		return http.StatusForbidden, nil
+	}
+
+	return 0, nil
+}
+
+func getTOTPCode(r *http.Request) (string, error) {
+	if r.Body == nil {
+		return "", fm.ErrEmptyRequest
+	}
+
+	var req totpRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return "", err
+	}
+
+	return req.Code, nil
+}
+
+// renderRecoveryCodes generates new recovery codes for the user, saves
+// its second factor and prints them.
+func renderRecoveryCodes(c *fm.Context, w http.ResponseWriter) (int, error) {
+	codes, err := c.User.TwoFactor.NewRecoveryCodes()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if err := c.Store.Users.Update(c.User, "TwoFactor"); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return renderJSON(w, codes)
+}
@@ -3,6 +3,7 @@ package http
 import (
 	"encoding/json"
 	"errors"
+	"log"
 	"net/http"
 	"os"
 	"sort"
@@ -86,10 +87,27 @@ func getUser(c *fm.Context, r *http.Request) (*fm.User, string, error) {
 	return mod.Data, mod.Which, nil
 }
 
+// checkPublicKeys checks that every SSH public key of a user is valid.
+func checkPublicKeys(u *fm.User) (int, error) {
+	if u.PublicKeys == nil {
+		u.PublicKeys = []string{}
+	}
+
+	for _, key := range u.PublicKeys {
+		if _, err := fm.ParsePublicKey(key); err != nil {
+			return http.StatusBadRequest, err
+		}
+	}
+
+	return 0, nil
+}
+
 func usersGetHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
 	// Request for the default user data.
 	if r.URL.Path == "/base" {
-		return renderJSON(w, c.DefaultUser)
+		u := *c.DefaultUser
+		u.HideSecrets()
+		return renderJSON(w, u)
 	}
 
 	// Request for the listing of users.
@@ -100,9 +118,9 @@ func usersGetHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 		}
 
 		for _, u := range users {
-			// Removes the user password so it won't
-			// be sent to the front-end.
-			u.Password = ""
+			// Removes the user password and secrets so
+			// they won't be sent to the front-end.
+			u.HideSecrets()
 		}
 
 		sort.Slice(users, func(i, j int) bool {
@@ -126,7 +144,7 @@ func usersGetHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 		return http.StatusInternalServerError, err
 	}
 
-	u.Password = ""
+	u.HideSecrets()
 	return renderJSON(w, u)
 }
 
@@ -150,8 +168,9 @@ func usersPostHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (in
 		return http.StatusBadRequest, fm.ErrEmptyScope
 	}
 
-	// Checks if password isn't empty.
-	if u.Password == "" {
+	// Checks if password isn't empty. Service accounts can't log in with
+	// one.
+	if u.Password == "" && !u.ServiceAccount {
 		return http.StatusBadRequest, fm.ErrEmptyPassword
 	}
 
@@ -170,24 +189,42 @@ func usersPostHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (in
 		u.Commands = []string{}
 	}
 
+	// Checks if the public keys are valid.
+	if code, err := checkPublicKeys(u); err != nil {
+		return code, err
+	}
+
 	// It's a new user so the ID will be auto created.
 	if u.ID != 0 {
 		u.ID = 0
 	}
 
 	// Checks if the scope exists.
-	if code, err := checkFS(u.Scope); err != nil {
+	if code, err := checkFS(u.FileSystem); err != nil {
 		return code, err
 	}
 
-	// Hashes the password.
-	pw, err := fm.HashPassword(u.Password)
-	if err != nil {
-		return http.StatusInternalServerError, err
-	}
+	// Checks the password against the policy and hashes it. The admin
+	// may still want the user to choose its own.
+	if password := u.Password; password != "" {
+		must := u.MustChangePassword
+		u.Password = ""
 
-	u.Password = pw
+		if err := c.SetPassword(u, password); err != nil {
+			return passwordStatus(err), err
+		}
+
+		u.MustChangePassword = must
+	}
+	u.PasswordHistory = nil
 	u.ViewMode = fm.MosaicViewMode
+	u.UsedBytes, u.UsedFiles = 0, 0
+	u.Source = ""
+	u.TwoFactor = fm.TwoFactor{}
+
+	if err := c.RunnerVars("before_create_user", "", "", c.User, userVars(u, "")); err != nil {
+		return hookStatus(err), err
+	}
 
 	// Saves the user to the database.
 	err = c.SaveUser(u)
@@ -199,21 +236,61 @@ func usersPostHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (in
 		return http.StatusInternalServerError, err
 	}
 
+	// The scope may already have files.
+	if err := c.RecomputeUsage(u); err != nil {
+		log.Print(err)
+	}
+
+	if err := c.RunnerVars("after_create_user", "", "", c.User, userVars(u, "")); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
 	// Set the Location header and return.
 	w.Header().Set("Location", "/settings/users/"+strconv.Itoa(u.ID))
 	w.WriteHeader(http.StatusCreated)
 	return 0, nil
 }
 
-func checkFS(path string) (int, error) {
-	info, err := os.Stat(path)
+// userVars are the details of the user an event is about, given to its
+// hooks. The update is the part of the user which is updated.
+func userVars(u *fm.User, update string) map[string]string {
+	vars := map[string]string{
+		"TARGET_ID":       strconv.Itoa(u.ID),
+		"TARGET_USERNAME": u.Username,
+		"TARGET_ADMIN":    strconv.FormatBool(u.Admin),
+	}
+
+	if update != "" {
+		vars["USER_UPDATE"] = update
+	}
+
+	return vars
+}
+
+// passwordStatus returns the status of an error of SetPassword.
+func passwordStatus(err error) int {
+	if fm.IsPasswordPolicyError(err) {
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+func checkFS(fs fm.FileSystem) (int, error) {
+	info, err := fs.Stat("/")
 
 	if err != nil {
+		// Only the directories of the local disk are created.
+		local, ok := fs.(fm.LocalFileSystem)
+		if !ok {
+			return http.StatusBadRequest, err
+		}
+
 		if !os.IsNotExist(err) {
 			return http.StatusInternalServerError, err
 		}
 
-		err = os.MkdirAll(path, 0666)
+		err = os.MkdirAll(local.Root(), 0666)
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
@@ -238,6 +315,26 @@ func usersDeleteHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (
 		return http.StatusInternalServerError, err
 	}
 
+	u, err := c.Store.Users.Get(id, c.NewFS)
+	if err == fm.ErrNotExist {
+		return http.StatusNotFound, fm.ErrNotExist
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	vars := userVars(u, "")
+	if err := c.RunnerVars("before_delete_user", "", "", c.User, vars); err != nil {
+		return hookStatus(err), err
+	}
+
+	// The files it shared with the other users, or which were shared
+	// with it, aren't anymore.
+	if err := c.DeleteUserGrants(u); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
 	// Deletes the user from the database.
 	err = c.Store.Users.Delete(id)
 	if err == fm.ErrNotExist {
@@ -248,6 +345,48 @@ func usersDeleteHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (
 		return http.StatusInternalServerError, err
 	}
 
+	// Its access keys must not outlive it.
+	if c.Store.AccessKeys != nil {
+		keys, err := c.Store.AccessKeys.GetByUser(id)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		for _, k := range keys {
+			if err := c.Store.AccessKeys.Delete(k.ID); err != nil {
+				return http.StatusInternalServerError, err
+			}
+		}
+	}
+
+	// So must its API tokens.
+	if c.Store.APITokens != nil {
+		tokens, err := c.Store.APITokens.GetByUser(id)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		for _, t := range tokens {
+			if err := c.Store.APITokens.Delete(t.ID); err != nil {
+				return http.StatusInternalServerError, err
+			}
+		}
+	}
+
+	// And its sessions.
+	if err := c.RevokeSessions(id); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Its share links are served with its rights, which are gone.
+	if err := c.DeleteUserShares(id); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if err := c.RunnerVars("after_delete_user", "", "", c.User, vars); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
 	return http.StatusOK, nil
 }
 
@@ -274,6 +413,11 @@ func usersPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 		return http.StatusBadRequest, err
 	}
 
+	// The users who must change their password can't update anything else.
+	if c.User.MustChangePassword && which != "password" {
+		return http.StatusForbidden, nil
+	}
+
 	// If we're updating the default user. Only for NoAuth
 	// implementations. Used to change the viewMode.
 	if id == 0 && c.NoAuth {
@@ -283,6 +427,11 @@ func usersPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 
 	// Updates the CSS and locale.
 	if which == "partial" {
+		vars := userVars(c.User, which)
+		if err := c.RunnerVars("before_update_user", "", "", c.User, vars); err != nil {
+			return hookStatus(err), err
+		}
+
 		c.User.CSS = u.CSS
 		c.User.Locale = u.Locale
 		c.User.ViewMode = u.ViewMode
@@ -292,6 +441,10 @@ func usersPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 			return http.StatusInternalServerError, err
 		}
 
+		if err := c.RunnerVars("after_update_user", "", "", c.User, vars); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
 		return http.StatusOK, nil
 	}
 
@@ -305,16 +458,71 @@ func usersPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 			return http.StatusForbidden, nil
 		}
 
-		c.User.Password, err = fm.HashPassword(u.Password)
+		vars := userVars(c.User, which)
+		if err := c.RunnerVars("before_update_user", "", "", c.User, vars); err != nil {
+			return hookStatus(err), err
+		}
+
+		if err := c.SetPassword(c.User, u.Password); err != nil {
+			return passwordStatus(err), err
+		}
+
+		// The sessions opened with the old password are revoked.
+		c.User.TokenVersion++
+
+		err = c.Store.Users.Update(c.User, "Password", "PasswordHistory", "MustChangePassword", "TokenVersion")
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		// The password is changed, so the new token is sent anyway.
+		if err := c.RunnerVars("after_update_user", "", "", c.User, vars); err != nil {
+			log.Print(err)
+		}
+
+		// But the current one goes on with a new token.
+		if c.NoAuth {
+			return http.StatusOK, nil
+		}
+
+		return replaceToken(c, w, r)
+	}
+
+	// Updates the SSH public keys.
+	if which == "keys" {
+		if code, err := checkPublicKeys(u); err != nil {
+			return code, err
+		}
+
+		// The admins may update the keys of the other users.
+		target, err := c.Store.Users.Get(id, c.NewFS)
+		if err == fm.ErrNotExist {
+			return http.StatusNotFound, nil
+		}
+
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
 
-		err = c.Store.Users.Update(c.User, "Password")
+		vars := userVars(target, which)
+		if err := c.RunnerVars("before_update_user", "", "", c.User, vars); err != nil {
+			return hookStatus(err), err
+		}
+
+		target.PublicKeys = u.PublicKeys
+		if target.ID == c.User.ID {
+			c.User.PublicKeys = u.PublicKeys
+		}
+
+		err = c.Store.Users.Update(target, "PublicKeys")
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
 
+		if err := c.RunnerVars("after_update_user", "", "", c.User, vars); err != nil {
+			return http.StatusInternalServerError, err
+		}
+
 		return http.StatusOK, nil
 	}
 
@@ -323,18 +531,40 @@ func usersPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 		return http.StatusBadRequest, fm.ErrInvalidUpdateField
 	}
 
+	// The whole user has what grants access, like the groups, the admin
+	// flag, the scope and the quota, so only the admins update it.
+	if !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
 	// Checks if username isn't empty.
 	if u.Username == "" {
 		return http.StatusBadRequest, fm.ErrEmptyUsername
 	}
 
+	// Gets the current saved user from the in-memory map.
+	suser, err := c.Store.Users.Get(id, c.NewFS)
+	if err == fm.ErrNotExist {
+		return http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
 	// Checks if filesystem isn't empty.
 	if u.Scope == "" {
 		return http.StatusBadRequest, fm.ErrEmptyScope
 	}
 
+	// The scope is sent back without its credentials, which are kept.
+	if u.Scope == fm.HideScope(suser.Scope) {
+		u.Scope = suser.Scope
+		u.FileSystem = suser.FileSystem
+	}
+
 	// Checks if the scope exists.
-	if code, err := checkFS(u.Scope); err != nil {
+	if code, err := checkFS(u.FileSystem); err != nil {
 		return code, err
 	}
 
@@ -348,28 +578,39 @@ func usersPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 		u.Commands = []string{}
 	}
 
-	// Gets the current saved user from the in-memory map.
-	suser, err := c.Store.Users.Get(id, c.NewFS)
-	if err == fm.ErrNotExist {
-		return http.StatusNotFound, nil
-	}
-
-	if err != nil {
-		return http.StatusInternalServerError, err
+	// Checks if the public keys are valid.
+	if code, err := checkPublicKeys(u); err != nil {
+		return code, err
 	}
 
 	u.ID = id
 
 	// Changes the password if the request wants it.
-	if u.Password != "" {
-		pw, err := fm.HashPassword(u.Password)
-		if err != nil {
-			return http.StatusInternalServerError, err
+	password := u.Password
+	u.Password = suser.Password
+	u.PasswordHistory = suser.PasswordHistory
+
+	if password != "" {
+		must := u.MustChangePassword
+		if err := c.SetPassword(u, password); err != nil {
+			return passwordStatus(err), err
 		}
 
-		u.Password = pw
+		u.MustChangePassword = must
 	} else {
-		u.Password = suser.Password
+		// Only a new password clears the need to change it.
+		u.MustChangePassword = suser.MustChangePassword
+	}
+
+	// The usage, the source and the second factor are managed by the
+	// server.
+	u.UsedBytes, u.UsedFiles = suser.UsedBytes, suser.UsedFiles
+	u.Source = suser.Source
+	u.TwoFactor = suser.TwoFactor
+
+	vars := userVars(u, which)
+	if err := c.RunnerVars("before_update_user", "", "", c.User, vars); err != nil {
+		return hookStatus(err), err
 	}
 
 	// Updates the whole User struct because we always are supposed
@@ -378,5 +619,15 @@ func usersPutHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int
 		return http.StatusInternalServerError, err
 	}
 
+	if u.Scope != suser.Scope {
+		if err := c.RecomputeUsage(u); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if err := c.RunnerVars("after_update_user", "", "", c.User, vars); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
 	return http.StatusOK, nil
 }
@@ -0,0 +1,193 @@
+package http
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// watchMessage is a change pushed to the clients viewing a directory.
+type watchMessage struct {
+	Op string `json:"op"`
+	// Name is the name of the file inside the watched directory and
+	// URL its path on the API.
+	Name    string `json:"name,omitempty"`
+	URL     string `json:"url,omitempty"`
+	OldName string `json:"oldName,omitempty"`
+	OldURL  string `json:"oldURL,omitempty"`
+
+	IsDir   bool       `json:"isDir,omitempty"`
+	Size    int64      `json:"size,omitempty"`
+	ModTime *time.Time `json:"modified,omitempty"`
+}
+
+// watchHandler pushes the changes to a directory through a websocket,
+// as lists of create, modify, delete, rename and resync messages.
+func watchHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	// Only the local disk can be watched.
+	if c.Watcher == nil || !c.User.LocalScope() {
+		return http.StatusNotImplemented, nil
+	}
+
+	// Opening the directory checks that the user can list it, before
+	// the connection is upgraded.
+	dir, err := c.User.FileSystem.OpenFile(r.URL.Path, os.O_RDONLY, 0)
+	if err != nil {
+		return ErrorToHTTP(err, false), err
+	}
+
+	info, err := dir.Stat()
+	dir.Close()
+	if err != nil {
+		return ErrorToHTTP(err, false), err
+	}
+
+	if !info.IsDir() {
+		return http.StatusBadRequest, nil
+	}
+
+	sub, err := c.Watcher.Subscribe(filepath.Join(c.User.Scope, r.URL.Path))
+	if err != nil {
+		return ErrorToHTTP(err, false), err
+	}
+	defer sub.Close()
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// The client doesn't send anything, but reading is needed to
+	// notice when it goes away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// The events are filtered here, by the goroutine which holds the
+	// user's attributes.
+	for {
+		select {
+		case <-closed:
+			return 0, nil
+		case events, ok := <-sub.Events:
+			if !ok {
+				return 0, nil
+			}
+
+			messages := watchMessages(c, r.URL.Path, sub.Dir, events)
+			if len(messages) == 0 {
+				continue
+			}
+
+			if err := conn.WriteJSON(messages); err != nil {
+				return 0, nil
+			}
+		}
+	}
+}
+
+// watchMessages converts the events of a directory into the messages
+// sent to the user, leaving out the files it may not see.
+func watchMessages(c *fm.Context, url, dir string, events []fm.WatchEvent) []watchMessage {
+	messages := []watchMessage{}
+
+	// The access to the directory is checked once for each batch.
+	checked, readable := false, false
+	dirReadable := func() bool {
+		if !checked {
+			_, readable = watchStat(c, url)
+			checked = true
+		}
+
+		return readable
+	}
+
+	for _, e := range events {
+		if e.Op == fm.WatchResync || e.Path == dir {
+			// The directory itself is gone or some events were lost.
+			messages = append(messages, watchMessage{Op: fm.WatchResync})
+			continue
+		}
+
+		name := filepath.Base(e.Path)
+		m := watchMessage{
+			Op:   e.Op,
+			Name: name,
+			URL:  path.Join(url, name),
+		}
+
+		if e.Op == fm.WatchRename {
+			m.OldName = filepath.Base(e.OldPath)
+			m.OldURL = path.Join(url, m.OldName)
+
+			if !c.User.Allowed(m.OldURL) {
+				m.Op = fm.WatchCreate
+				m.OldName, m.OldURL = "", ""
+			}
+		}
+
+		if !c.User.Allowed(m.URL) {
+			if m.Op != fm.WatchRename {
+				continue
+			}
+
+			// Moved out of sight.
+			m = watchMessage{Op: fm.WatchDelete, Name: m.OldName, URL: m.OldURL}
+		}
+
+		if m.Op != fm.WatchDelete {
+			info, ok := watchStat(c, m.URL)
+			if !ok {
+				if m.Op != fm.WatchRename {
+					continue
+				}
+
+				m = watchMessage{Op: fm.WatchDelete, Name: m.OldName, URL: m.OldURL}
+			} else {
+				modTime := info.ModTime()
+				m.IsDir = info.IsDir()
+				m.Size = info.Size()
+				m.ModTime = &modTime
+			}
+		}
+
+		// The deleted files can't be opened anymore, so the user must
+		// still be able to open the directory they were in.
+		if m.Op == fm.WatchDelete && !dirReadable() {
+			continue
+		}
+
+		if m.IsDir && !strings.HasSuffix(m.URL, "/") {
+			m.URL += "/"
+		}
+
+		messages = append(messages, m)
+	}
+
+	return messages
+}
+
+// watchStat gets the information of a changed file, if the user can
+// read it.
+func watchStat(c *fm.Context, url string) (os.FileInfo, bool) {
+	f, err := c.User.FileSystem.OpenFile(url, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	return info, err == nil
+}
@@ -0,0 +1,302 @@
+package http
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	fm "github.com/rjchee/dcac_filemanager"
+	"golang.org/x/net/webdav"
+)
+
+// davLocks holds the WebDAV locks of each user. Locks only live in
+// memory, so they are lost when the server restarts.
+var davLocks = struct {
+	sync.Mutex
+	systems map[davLockKey]webdav.LockSystem
+}{systems: map[davLockKey]webdav.LockSystem{}}
+
+type davLockKey struct {
+	m  *fm.FileManager
+	id int
+}
+
+func davLockSystem(c *fm.Context) webdav.LockSystem {
+	davLocks.Lock()
+	defer davLocks.Unlock()
+
+	key := davLockKey{c.FileManager, c.User.ID}
+	ls, ok := davLocks.systems[key]
+	if !ok {
+		ls = webdav.NewMemLS()
+		davLocks.systems[key] = ls
+	}
+
+	return ls
+}
+
+// davFileSystem exposes the file system of a user to WebDAV, applying
+// the same rules and permissions as the API.
+type davFileSystem struct {
+	user *fm.User
+}
+
+func (d davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if !d.user.AllowNew || !d.user.Allowed(name) {
+		return os.ErrPermission
+	}
+
+	return d.user.FileSystem.Mkdir(name, perm)
+}
+
+func (d davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if !d.user.Allowed(name) {
+		return nil, os.ErrPermission
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		_, err := d.user.FileSystem.Stat(name)
+		if err == nil && !d.user.AllowEdit || err != nil && !d.user.AllowNew {
+			return nil, os.ErrPermission
+		}
+	}
+
+	f, err := d.user.FileSystem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (d davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	// Prevent the removal of the root directory.
+	if name == "/" || !d.user.AllowEdit || !d.user.Allowed(name) {
+		return os.ErrPermission
+	}
+
+	return d.user.FileSystem.RemoveAll(name)
+}
+
+func (d davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	if oldName == "/" || newName == "/" || !d.user.AllowEdit {
+		return os.ErrPermission
+	}
+
+	if !d.user.Allowed(oldName) || !d.user.Allowed(newName) {
+		return os.ErrPermission
+	}
+
+	return d.user.FileSystem.Rename(oldName, newName)
+}
+
+func (d davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	if !d.user.Allowed(name) {
+		return nil, os.ErrPermission
+	}
+
+	return d.user.FileSystem.Stat(name)
+}
+
+// davResponseWriter records the status of a WebDAV response so the
+// hooks only run after successful requests.
+type davResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *davResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *davResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// davAuth authenticates a WebDAV request, either with the username and
+// password of the user, for the clients which only support Basic auth,
+// or with a token like the API. An API token can also be given as the
+// password, which the users with a second factor must do.
+func davAuth(c *fm.Context, r *http.Request) (bool, *fm.User) {
+	username, password, ok := r.BasicAuth()
+	if !ok || c.NoAuth {
+		return validateAuth(c, r)
+	}
+
+	if strings.HasPrefix(password, fm.APITokenPrefix) {
+		return apiTokenAuth(c, password)
+	}
+
+	u, err := c.AuthenticateFrom(username, password, r.RemoteAddr)
+	if err != nil || u.ServiceAccount || !c.PasswordOnly(u) {
+		return false, nil
+	}
+
+	if err := c.LoginSucceeded(username); err != nil {
+		log.Print(err)
+	}
+
+	c.User = u
+	return true, u
+}
+
+// davHandler serves the files of the user over WebDAV on /dav/, with
+// the user's attributes, and fires the same commands as the API.
+func davHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	valid, user := davAuth(c, r)
+	if !valid {
+		w.Header().Set("WWW-Authenticate", `Basic realm="File Manager"`)
+		return http.StatusUnauthorized, nil
+	}
+
+	release, err := c.AcquireAttrs(user)
+	if err != nil {
+		log.Printf("error acquiring the attributes of %s: %s\n", user.Username, err)
+		return http.StatusBadGateway, nil
+	}
+	defer release()
+
+	// The handler strips the prefix from the request path and from
+	// the destination of copies and moves, which are full URLs, and
+	// adds it back to the paths it returns.
+	prefix := c.RootURL() + "/dav"
+	name := sanitizeURL(strings.TrimPrefix(r.URL.Path, "/dav"))
+	r.URL.Path = prefix + name
+
+	if !c.User.Allowed(name) {
+		return http.StatusForbidden, nil
+	}
+
+	var (
+		event string
+		src   = name
+		dst   string
+	)
+
+	switch r.Method {
+	case http.MethodPut:
+		// Overwriting a file is a save, creating one an upload.
+		if _, err := c.User.FileSystem.Stat(name); err == nil {
+			event = "save"
+			src = filepath.Join(c.User.Scope, name)
+		} else {
+			event = "upload"
+		}
+	case http.MethodDelete:
+		event = "delete"
+	case "MKCOL":
+		event = "mkdir"
+	case "COPY", "MOVE":
+		event = "copy"
+		if r.Method == "MOVE" {
+			event = "rename"
+		}
+
+		u, err := url.Parse(r.Header.Get("Destination"))
+		if err != nil || !strings.HasPrefix(u.Path, prefix+"/") {
+			return http.StatusBadRequest, nil
+		}
+		dst = sanitizeURL(strings.TrimPrefix(u.Path, prefix))
+	}
+
+	account, code, err := davQuota(c, event, name, dst, r.ContentLength)
+	if code != 0 {
+		return code, err
+	}
+
+	if event != "" {
+		if err := c.Runner("before_"+event, src, dst, c.User); err != nil {
+			return hookStatus(err), err
+		}
+	}
+
+	rw := &davResponseWriter{ResponseWriter: w}
+	handler := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: davFileSystem{user: c.User},
+		LockSystem: davLockSystem(c),
+		Logger: func(r *http.Request, err error) {
+			if err != nil && !os.IsPermission(err) && !os.IsNotExist(err) {
+				log.Printf("webdav: %s %s: %s\n", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+
+	handler.ServeHTTP(rw, r)
+
+	if event == "" || rw.status < 200 || rw.status >= 300 {
+		return 0, nil
+	}
+
+	account()
+	davReindex(c, event, name, dst)
+
+	// The response was already sent, so failures are only logged.
+	if err := c.Runner("after_"+event, src, dst, c.User); err != nil {
+		log.Print(err)
+	}
+
+	return 0, nil
+}
+
+// davQuota checks the quota of the user before a change. The returned
+// function accounts for the change once it is done.
+func davQuota(c *fm.Context, event, name, dst string, size int64) (func(), int, error) {
+	switch event {
+	case "save", "upload":
+		done, code, err := checkUpload(c, name, size)
+		if code != 0 {
+			return nil, code, err
+		}
+
+		return func() {
+			if info, err := c.User.FileSystem.Stat(name); err == nil {
+				done(info.Size())
+			}
+		}, 0, nil
+	case "copy":
+		done, err := c.CheckCopy(c.User, name, dst)
+		if err != nil {
+			return nil, ErrorToHTTP(err, false), err
+		}
+
+		return done, 0, nil
+	case "delete":
+		return c.TrackRemove(c.User, name), 0, nil
+	}
+
+	return func() {}, 0, nil
+}
+
+// davReindex updates the full-text index after a successful change.
+func davReindex(c *fm.Context, event, name, dst string) {
+	var err error
+
+	switch event {
+	case "save", "upload":
+		err = c.Reindex(filepath.Join(c.User.Scope, name))
+	case "delete":
+		err = c.Unindex(filepath.Join(c.User.Scope, name))
+	case "copy":
+		err = c.Reindex(filepath.Join(c.User.Scope, dst))
+	case "rename":
+		if err = c.Unindex(filepath.Join(c.User.Scope, name)); err == nil {
+			err = c.Reindex(filepath.Join(c.User.Scope, dst))
+		}
+	}
+
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,94 @@
+package http
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// maxDeliveries is the number of deliveries listed by default.
+const maxDeliveries = 100
+
+// webhooksHandler lets the admins see the deliveries of the webhooks,
+// the latest first, and send them again.
+func webhooksHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	if !c.User.Admin {
+		return http.StatusForbidden, nil
+	}
+
+	if c.Store.Webhooks == nil {
+		return http.StatusNotImplemented, nil
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		return webhooksGetHandler(c, w, r)
+	case http.MethodPost:
+		return webhooksPostHandler(c, w, r)
+	}
+
+	return http.StatusMethodNotAllowed, nil
+}
+
+func webhooksGetHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	limit := maxDeliveries
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			return http.StatusBadRequest, fm.ErrInvalidOption
+		}
+	}
+
+	deliveries, err := c.Store.Webhooks.Gets()
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if status := r.URL.Query().Get("status"); status != "" {
+		filtered := []*fm.WebhookDelivery{}
+		for _, d := range deliveries {
+			if d.Status == status {
+				filtered = append(filtered, d)
+			}
+		}
+
+		deliveries = filtered
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID > deliveries[j].ID
+	})
+
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return renderJSON(w, deliveries)
+}
+
+// webhooksPostHandler sends a delivery again, on /api/webhooks/<id>.
+func webhooksPostHandler(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+	if err != nil {
+		return http.StatusBadRequest, nil
+	}
+
+	d, err := c.Store.Webhooks.Get(id)
+	if err == fm.ErrNotExist {
+		return http.StatusNotFound, nil
+	}
+
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if err := c.RedeliverWebhook(d); err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return renderJSON(w, d)
+}
@@ -2,7 +2,9 @@ package http
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"mime"
 	"net/http"
 	"os"
@@ -145,12 +147,6 @@ var (
 
 type condition func(path string) bool
 
-type searchOptions struct {
-	CaseInsensitive bool
-	Conditions      []condition
-	Terms           []string
-}
-
 func extensionCondition(extension string) condition {
 	return func(path string) bool {
 		return filepath.Ext(path) == "."+extension
@@ -178,65 +174,163 @@ func videoCondition(path string) bool {
 	return strings.HasPrefix(mimetype, "video")
 }
 
-func parseSearch(value string) *searchOptions {
-	opts := &searchOptions{
-		CaseInsensitive: strings.Contains(value, "case:insensitive"),
-		Conditions:      []condition{},
-		Terms:           []string{},
+// typeCondition returns the condition for a 'type:' search option.
+func typeCondition(t string) condition {
+	switch t {
+	case "image":
+		return imageCondition
+	case "audio", "music":
+		return audioCondition
+	case "video":
+		return videoCondition
+	default:
+		return extensionCondition(t)
 	}
+}
+
+// searchProgressInterval is how often a search reports its progress.
+const searchProgressInterval = 250 * time.Millisecond
+
+// errSearchLimit stops a search which reached the maximum number of
+// results.
+var errSearchLimit = errors.New("search result limit reached")
+
+// searchRequest is a message sent by the client on the search socket.
+type searchRequest struct {
+	// Type is "start", "next" or "cancel".
+	Type    string `json:"type"`
+	Query   string `json:"query"`
+	Content bool   `json:"content"`
+	// PageSize is the number of results sent before waiting for a
+	// "next" request. Zero sends every result at once.
+	PageSize int `json:"pageSize"`
+}
 
-	// removes the options from the value
-	value = strings.Replace(value, "case:insensitive", "", -1)
-	value = strings.Replace(value, "case:sensitive", "", -1)
-	value = strings.TrimSpace(value)
+// searchSession is a search running on a websocket. Clients start it
+// with a "start" request and receive "result", "progress" and "page"
+// events until a "done" or "error" event. Clients which send the bare
+// query instead only receive the results, like they always did.
+//
+// The search runs on the handler goroutine, which holds the user's
+// attributes, while another goroutine reads the requests and cancels
+// the context when the socket closes.
+type searchSession struct {
+	conn   *websocket.Conn
+	legacy bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	next   chan struct{}
+
+	pageSize   int
+	maxResults int
+
+	scanned      int
+	matched      int
+	truncated    bool
+	lastProgress time.Time
+}
+
+// send sends an event to the client. Legacy clients only get the
+// results and the errors, without the type.
+func (s *searchSession) send(event string, data map[string]interface{}) error {
+	if s.legacy {
+		if event != "result" && event != "error" {
+			return nil
+		}
+	} else {
+		data["type"] = event
+	}
 
-	types := typeRegexp.FindAllStringSubmatch(value, -1)
-	for _, t := range types {
-		if len(t) == 1 {
+	response, _ := json.Marshal(data)
+	return s.conn.WriteMessage(websocket.TextMessage, response)
+}
+
+// read handles the client requests once the search started.
+func (s *searchSession) read() {
+	defer s.cancel()
+
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req searchRequest
+		if json.Unmarshal(message, &req) != nil {
 			continue
 		}
 
-		switch t[1] {
-		case "image":
-			opts.Conditions = append(opts.Conditions, imageCondition)
-		case "audio", "music":
-			opts.Conditions = append(opts.Conditions, audioCondition)
-		case "video":
-			opts.Conditions = append(opts.Conditions, videoCondition)
-		default:
-			opts.Conditions = append(opts.Conditions, extensionCondition(t[1]))
+		switch req.Type {
+		case "next":
+			select {
+			case s.next <- struct{}{}:
+			default:
+			}
+		case "cancel":
+			return
 		}
 	}
+}
 
-	if len(types) > 0 {
-		// Remove the fields from the search value.
-		value = typeRegexp.ReplaceAllString(value, "")
+// scan counts a scanned file and reports the progress from time to
+// time. It fails once the search is cancelled.
+func (s *searchSession) scan() error {
+	if err := s.ctx.Err(); err != nil {
+		return err
 	}
 
-	// If it's canse insensitive, put everything in lowercase.
-	if opts.CaseInsensitive {
-		value = strings.ToLower(value)
+	s.scanned++
+	if time.Since(s.lastProgress) < searchProgressInterval {
+		return nil
 	}
 
-	// Remove the spaces from the search value.
-	value = strings.TrimSpace(value)
+	s.lastProgress = time.Now()
+	return s.send("progress", map[string]interface{}{
+		"scanned": s.scanned,
+		"matched": s.matched,
+	})
+}
 
-	if value == "" {
-		return opts
+// result sends a result, first waiting for the client to ask for the
+// next page if the current one is full.
+func (s *searchSession) result(data map[string]interface{}) error {
+	if err := s.ctx.Err(); err != nil {
+		return err
 	}
 
-	// if the value starts with " and finishes what that character, we will
-	// only search for that term
-	if value[0] == '"' && value[len(value)-1] == '"' {
-		unique := strings.TrimPrefix(value, "\"")
-		unique = strings.TrimSuffix(unique, "\"")
+	if s.maxResults > 0 && s.matched >= s.maxResults {
+		s.truncated = true
+		return errSearchLimit
+	}
 
-		opts.Terms = []string{unique}
-		return opts
+	if !s.legacy && s.pageSize > 0 && s.matched > 0 && s.matched%s.pageSize == 0 {
+		err := s.send("page", map[string]interface{}{
+			"matched": s.matched,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-s.next:
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
 	}
 
-	opts.Terms = strings.Split(value, " ")
-	return opts
+	s.matched++
+	return s.send("result", data)
+}
+
+// done reports the end of the search.
+func (s *searchSession) done() error {
+	return s.send("done", map[string]interface{}{
+		"scanned":   s.scanned,
+		"matched":   s.matched,
+		"truncated": s.truncated,
+		"canceled":  s.ctx.Err() != nil,
+	})
 }
 
 // search searches for a file or directory.
@@ -249,91 +343,129 @@ func search(c *fm.Context, w http.ResponseWriter, r *http.Request) (int, error)
 	defer conn.Close()
 
 	var (
-		value   string
-		search  *searchOptions
+		req     searchRequest
 		message []byte
+		legacy  bool
 	)
 
-	// Starts an infinite loop until a valid command is captured.
+	// Starts an infinite loop until a search is requested.
 	for {
 		_, message, err = conn.ReadMessage()
 		if err != nil {
 			return http.StatusInternalServerError, err
 		}
 
-		if len(message) != 0 {
-			value = string(message)
+		if len(message) == 0 {
+			continue
+		}
+
+		if json.Unmarshal(message, &req) != nil || req.Type == "" {
+			req = searchRequest{Type: "start", Query: string(message)}
+			legacy = true
+		}
+
+		if req.Type == "start" {
 			break
 		}
 	}
 
-	search = parseSearch(value)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := &searchSession{
+		conn:         conn,
+		legacy:       legacy,
+		ctx:          ctx,
+		cancel:       cancel,
+		next:         make(chan struct{}, 1),
+		pageSize:     req.PageSize,
+		maxResults:   c.SearchMaxResults,
+		lastProgress: time.Now(),
+	}
+
+	go s.read()
+
 	scope := strings.TrimPrefix(r.URL.Path, "/")
 	scope = "/" + scope
 	scope = c.User.Scope + scope
 	scope = strings.Replace(scope, "\\", "/", -1)
 	scope = filepath.Clean(scope)
 
-	err = filepath.Walk(scope, func(path string, f os.FileInfo, err error) error {
-		if search.CaseInsensitive {
-			path = strings.ToLower(path)
+	// Searches inside the files use the full-text index instead
+	// of walking the tree.
+	if req.Content || r.URL.Query().Get("content") == "true" {
+		err = contentSearch(c, s, req.Query, scope)
+	} else {
+		err = walkSearch(c, s, r.URL.Path, req.Query, scope)
+	}
+
+	switch err {
+	case nil, errSearchLimit, context.Canceled:
+	default:
+		if serr, ok := err.(*searchSyntaxError); ok {
+			// Syntax errors are reported to the client, which shows
+			// where the query went wrong.
+			err = s.send("error", map[string]interface{}{
+				"error":    serr.Error(),
+				"position": serr.Pos,
+			})
+
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+
+			return 0, nil
 		}
 
-		path = strings.TrimPrefix(path, scope)
-		path = strings.TrimPrefix(path, "/")
-		path = strings.Replace(path, "\\", "/", -1)
+		s.send("error", map[string]interface{}{"error": err.Error()})
+		return http.StatusInternalServerError, err
+	}
 
-		// Only execute if there are conditions to meet.
-		if len(search.Conditions) > 0 {
-			match := false
+	// The client is gone if it cancelled the search by closing the
+	// socket, so there is no one to tell.
+	s.done()
+	return 0, nil
+}
 
-			for _, t := range search.Conditions {
-				if t(path) {
-					match = true
-					break
-				}
-			}
+// walkSearch searches for the files under scope whose path matches
+// the query.
+func walkSearch(c *fm.Context, s *searchSession, url, value, scope string) error {
+	search, err := parseSearch(value)
+	if err != nil {
+		return err
+	}
 
-			// If doesn't meet the condition, go to the next.
-			if !match {
-				return nil
-			}
+	return filepath.Walk(scope, func(path string, f os.FileInfo, err error) error {
+		if err := s.scan(); err != nil {
+			return err
 		}
 
-		if len(search.Terms) > 0 {
-			is := false
+		if err != nil {
+			return nil
+		}
 
-			// Checks if matches the terms and if it is allowed.
-			for _, term := range search.Terms {
-				if is {
-					break
-				}
+		rel := searchPath(scope, path, false)
+		if rel == "" {
+			return nil
+		}
 
-				if strings.Contains(path, term) {
-					if !c.User.Allowed(path) {
-						return nil
-					}
+		item := &searchItem{
+			Path: searchPath(scope, path, search.CaseInsensitive),
+			Name: f.Name(),
+			Info: f,
+		}
 
-					is = true
-				}
-			}
+		if !search.Match(item) {
+			return nil
+		}
 
-			if !is {
-				return nil
-			}
+		if !c.User.Allowed(filepath.ToSlash(filepath.Join(url, rel))) {
+			return nil
 		}
 
-		response, _ := json.Marshal(map[string]interface{}{
+		return s.result(map[string]interface{}{
 			"dir":  f.IsDir(),
-			"path": path,
+			"path": rel,
 		})
-
-		return conn.WriteMessage(websocket.TextMessage, response)
 	})
-
-	if err != nil {
-		return http.StatusInternalServerError, err
-	}
-
-	return 0, nil
 }
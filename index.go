@@ -0,0 +1,269 @@
+package filemanager
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxIndexedFileSize is the size above which text files are not
+	// added to the full-text index.
+	maxIndexedFileSize = 10 << 20
+
+	// maxIndexedTerms caps the number of distinct terms kept for a
+	// single document.
+	maxIndexedTerms = 10000
+)
+
+// IndexDocument is a text file in the full-text search index.
+type IndexDocument struct {
+	// Path is the absolute path of the file.
+	Path    string    `json:"path" storm:"id"`
+	ModTime time.Time `json:"modified"`
+	Size    int64     `json:"size"`
+	// Terms is the sorted list of distinct terms found in the file.
+	Terms []string `json:"terms"`
+}
+
+// IndexStore is the interface to manage the full-text search index.
+type IndexStore interface {
+	Get(path string) (*IndexDocument, error)
+	// Lookup returns the paths of the documents which contain the term.
+	Lookup(term string) ([]string, error)
+	// Paths returns the paths of the documents under a directory.
+	Paths(dir string) ([]string, error)
+	Save(d *IndexDocument) error
+	Delete(path string) error
+}
+
+// IndexTerms splits a text into the lowercased, distinct and sorted
+// terms used by the full-text index.
+func IndexTerms(text string) []string {
+	set := map[string]struct{}{}
+
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if len(word) < 2 || len(word) > 64 {
+			continue
+		}
+
+		set[strings.ToLower(word)] = struct{}{}
+		if len(set) == maxIndexedTerms {
+			break
+		}
+	}
+
+	terms := make([]string, 0, len(set))
+	for term := range set {
+		terms = append(terms, term)
+	}
+
+	sort.Strings(terms)
+	return terms
+}
+
+// Reindex brings the full-text index up to date for the file or
+// directory at path. Files that haven't changed since they were last
+// indexed are skipped, so it is cheap to call on large trees. Files the
+// process can't currently read are left untouched. Documents are always
+// stored by their absolute path.
+func (m FileManager) Reindex(path string) error {
+	if m.Store.Index == nil {
+		return nil
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	dcacFileInfo, _ := os.Stat(m.DCACDir)
+	databaseFileInfo, _ := os.Stat(m.DatabaseFile)
+
+	return filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if dcacFileInfo != nil && os.SameFile(dcacFileInfo, info) {
+			return filepath.SkipDir
+		}
+
+		if info.IsDir() || databaseFileInfo != nil && os.SameFile(databaseFileInfo, info) {
+			return nil
+		}
+
+		return m.indexFile(path, info)
+	})
+}
+
+// IndexBuilder brings the full-text index of the scopes of all the users
+// up to date, so the files which were there before the index are found
+// too. Every scope is read with the attributes of its user. It runs on
+// Setup and then daily in the Cron of File Manager.
+func (m FileManager) IndexBuilder() {
+	if m.Store.Index == nil {
+		return
+	}
+
+	users, err := m.Store.Users.Gets(m.NewFS)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, u := range users {
+		if u.Disabled || !u.LocalScope() {
+			continue
+		}
+
+		if err := m.reindexAs(u); err != nil {
+			log.Printf("could not index the scope of %s: %s\n", u.Username, err)
+		}
+	}
+}
+
+// reindexAs indexes the scope of a user on a thread holding its
+// attributes.
+func (m FileManager) reindexAs(u *User) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	release, err := m.AcquireAttrs(u)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return m.Reindex(u.Scope)
+}
+
+// indexFile adds a single file to the full-text index, if it is a text
+// file and it changed since it was last indexed.
+func (m FileManager) indexFile(path string, info os.FileInfo) error {
+	doc, err := m.Store.Index.Get(path)
+	if err == nil && doc.ModTime.Equal(info.ModTime()) && doc.Size == info.Size() {
+		return nil
+	}
+
+	if err != nil && err != ErrNotExist {
+		return err
+	}
+
+	if info.Size() > maxIndexedFileSize {
+		if doc != nil {
+			return m.Store.Index.Delete(path)
+		}
+		return nil
+	}
+
+	f := &File{
+		Name:      info.Name(),
+		Path:      path,
+		Extension: filepath.Ext(info.Name()),
+	}
+
+	if err := f.GetFileType(true); err != nil {
+		if os.IsPermission(err) {
+			return nil
+		}
+		return err
+	}
+
+	if f.Type != "text" {
+		if doc != nil {
+			return m.Store.Index.Delete(path)
+		}
+		return nil
+	}
+
+	return m.Store.Index.Save(&IndexDocument{
+		Path:    path,
+		ModTime: info.ModTime(),
+		Size:    info.Size(),
+		Terms:   IndexTerms(f.Content),
+	})
+}
+
+// Unindex removes the file or directory at path, and everything below
+// it, from the full-text index.
+func (m FileManager) Unindex(path string) error {
+	if m.Store.Index == nil {
+		return nil
+	}
+
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	paths, err := m.Store.Index.Paths(path)
+	if err != nil && err != ErrNotExist {
+		return err
+	}
+
+	paths = append(paths, path)
+	for _, p := range paths {
+		if err := m.Store.Index.Delete(p); err != nil && err != ErrNotExist {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SearchIndex returns the paths of the indexed documents which contain
+// every one of the terms.
+func (m FileManager) SearchIndex(terms []string) ([]string, error) {
+	if m.Store.Index == nil || len(terms) == 0 {
+		return []string{}, nil
+	}
+
+	var result []string
+
+	for i, term := range terms {
+		paths, err := m.Store.Index.Lookup(term)
+		if err == ErrNotExist {
+			return []string{}, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			result = paths
+			continue
+		}
+
+		set := make(map[string]struct{}, len(paths))
+		for _, p := range paths {
+			set[p] = struct{}{}
+		}
+
+		kept := result[:0]
+		for _, p := range result {
+			if _, ok := set[p]; ok {
+				kept = append(kept, p)
+			}
+		}
+
+		result = kept
+		if len(result) == 0 {
+			break
+		}
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
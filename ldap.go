@@ -0,0 +1,245 @@
+package filemanager
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/rjchee/dcac_filemanager/ldap"
+)
+
+// LDAP authenticates the users against an LDAP directory, by binding as
+// them, and syncs the users of File Manager with its entries.
+type LDAP struct {
+	// URL is the ldap:// or ldaps:// URL of the server.
+	URL       string
+	TLSConfig *tls.Config
+
+	// BindDN and BindPassword are the account the entries are searched
+	// with. The searches are anonymous when BindDN is empty.
+	BindDN       string
+	BindPassword string
+
+	BaseDN string
+
+	// UserFilter finds the entry of a user who logs in, like
+	// "(uid={username})", where {username} is replaced by the username.
+	UserFilter string
+
+	// SyncFilter finds the entries of all the users to sync, like
+	// "(objectClass=person)".
+	SyncFilter string
+
+	// UsernameAttribute and GroupsAttribute are the attributes with the
+	// username and the groups of the users.
+	UsernameAttribute string
+	GroupsAttribute   string
+
+	// AdminGroups are the groups whose members are admins. The directory
+	// doesn't manage who is an admin when it is empty.
+	AdminGroups []string
+
+	// Provision creates the users who aren't found from the DefaultUser,
+	// with the scope template like the OpenID Connect login.
+	Provision     bool
+	ScopeTemplate string
+}
+
+var errAmbiguousUser = errors.New("ldap: the username matches several entries")
+
+// dial connects to the server, with the search account if any.
+func (l *LDAP) dial() (*ldap.Conn, error) {
+	conn, err := ldap.Dial(l.URL, l.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (l *LDAP) search(conn *ldap.Conn, filter string, limit int) ([]*ldap.Entry, error) {
+	attrs := []string{l.UsernameAttribute}
+	if l.GroupsAttribute != "" {
+		attrs = append(attrs, l.GroupsAttribute)
+	}
+
+	return conn.Search(&ldap.SearchRequest{
+		BaseDN:     l.BaseDN,
+		Scope:      ldap.ScopeSubtree,
+		Filter:     filter,
+		Attributes: attrs,
+		SizeLimit:  limit,
+	})
+}
+
+// apply returns a function which sets the groups of a user from its
+// entry. The directory decides which of its users are enabled.
+func (l *LDAP) apply(e *ldap.Entry) func(*User) {
+	return func(u *User) {
+		if u.Source == "ldap" {
+			u.Disabled = false
+		}
+
+		if l.GroupsAttribute != "" {
+			setGroups(u, groupNames(e.GetAll(l.GroupsAttribute)), l.AdminGroups)
+		}
+	}
+}
+
+// groupNames returns the names of groups, which are often given by their
+// DN, like "cn=admins,ou=groups,dc=example,dc=com".
+func groupNames(groups []string) []string {
+	names := []string{}
+	for _, g := range groups {
+		if strings.Contains(g, "=") {
+			g = strings.SplitN(strings.SplitN(g, ",", 2)[0], "=", 2)[1]
+		}
+
+		names = append(names, g)
+	}
+
+	return names
+}
+
+// Authenticate binds as the user to check its password. The local users,
+// like the admins, can still log in while the server can't be reached.
+func (l *LDAP) Authenticate(m *FileManager, username, password string) (*User, error) {
+	conn, err := l.dial()
+	if _, ok := err.(net.Error); ok {
+		log.Printf("ldap: %s\n", err)
+		return nil, ErrNotExist
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	filter := strings.Replace(l.UserFilter, "{username}", ldap.EscapeFilter(username), -1)
+	entries, err := l.search(conn, filter, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(entries) {
+	case 0:
+		return nil, ErrNotExist
+	case 1:
+	default:
+		return nil, errAmbiguousUser
+	}
+
+	e := entries[0]
+	if name := e.Get(l.UsernameAttribute); name != "" {
+		username = name
+	}
+
+	// Only the users from the directory are mapped, so an entry can't
+	// take over a local user of the same name.
+	u, err := m.Store.Users.GetByUsername(username, m.NewFS)
+	if err == nil && u.Source != "ldap" {
+		return nil, ErrOtherSource
+	}
+
+	if err != nil && err != ErrNotExist {
+		return nil, err
+	}
+
+	if err := conn.Bind(e.DN, password); ldap.IsInvalidCredentials(err) {
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	if u != nil {
+		return m.syncUser(u, l.apply(e))
+	}
+
+	if !l.Provision {
+		return nil, ErrNotExist
+	}
+
+	return m.provisionUser(username, "ldap", l.ScopeTemplate, l.apply(e))
+}
+
+// Sync creates and updates the users of the entries of the directory,
+// and disables the users from the directory whose entry was removed.
+func (l *LDAP) Sync(m *FileManager) error {
+	conn, err := l.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	entries, err := l.search(conn, l.SyncFilter, 0)
+	if err != nil {
+		return err
+	}
+
+	seen := map[string]bool{}
+	for _, e := range entries {
+		username := e.Get(l.UsernameAttribute)
+		if username == "" {
+			continue
+		}
+
+		seen[username] = true
+
+		u, err := m.Store.Users.GetByUsername(username, m.NewFS)
+		if err == ErrNotExist && l.Provision {
+			_, err = m.provisionUser(username, "ldap", l.ScopeTemplate, l.apply(e))
+		} else if err == nil && u.Source == "ldap" {
+			_, err = m.syncUser(u, l.apply(e))
+		}
+
+		if err != nil && err != ErrNotExist {
+			log.Printf("ldap: syncing %s: %s\n", username, err)
+		}
+	}
+
+	// A search which finds nothing is more likely a mistake than the
+	// removal of everyone.
+	if len(entries) == 0 {
+		return nil
+	}
+
+	users, err := m.Store.Users.Gets(m.NewFS)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if u.Source != "ldap" || u.Disabled || seen[u.Username] {
+			continue
+		}
+
+		_, err := m.syncUser(u, func(u *User) { u.Disabled = true })
+		if err == nil {
+			err = m.RevokeSessions(u.ID)
+		}
+
+		if err != nil {
+			log.Printf("ldap: disabling %s: %s\n", u.Username, err)
+		}
+	}
+
+	return nil
+}
+
+// SyncJob returns the sync as a job for the Cron of File Manager.
+func (l *LDAP) SyncJob(m *FileManager) func() {
+	return func() {
+		if err := l.Sync(m); err != nil {
+			log.Print(err)
+		}
+	}
+}
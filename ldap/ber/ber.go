@@ -0,0 +1,251 @@
+// Package ber encodes and decodes the subset of the Basic Encoding Rules
+// of ASN.1 which LDAP messages use.
+package ber
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// Classes of the tags.
+const (
+	Universal   byte = 0x00
+	Application byte = 0x40
+	Context     byte = 0x80
+)
+
+// Universal tags.
+const (
+	TagBoolean     = 0x01
+	TagInteger     = 0x02
+	TagOctetString = 0x04
+	TagNull        = 0x05
+	TagEnumerated  = 0x0a
+	TagSequence    = 0x10
+	TagSet         = 0x11
+)
+
+// maxLength limits the size of the packets which are read.
+const maxLength = 16 << 20
+
+var ErrMalformed = errors.New("ber: malformed packet")
+
+// Packet is an element of a message. Primitive packets have a value and
+// constructed ones have children.
+type Packet struct {
+	Class       byte
+	Constructed bool
+	Tag         int
+	Value       []byte
+	Children    []*Packet
+}
+
+// Is checks the class and the tag of the packet.
+func (p *Packet) Is(class byte, tag int) bool {
+	return p.Class == class && p.Tag == tag
+}
+
+// String returns the value of the packet as a string.
+func (p *Packet) String() string {
+	return string(p.Value)
+}
+
+// Int returns the value of an integer or an enumerated packet.
+func (p *Packet) Int() int64 {
+	var n int64
+	for i, b := range p.Value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+
+		n = n<<8 | int64(b)
+	}
+
+	return n
+}
+
+// Bool returns the value of a boolean packet.
+func (p *Packet) Bool() bool {
+	return len(p.Value) > 0 && p.Value[0] != 0
+}
+
+// Child returns a child of the packet, or an empty packet when it
+// doesn't exist, so malformed messages don't have to be checked at every
+// step.
+func (p *Packet) Child(i int) *Packet {
+	if i < 0 || i >= len(p.Children) {
+		return &Packet{}
+	}
+
+	return p.Children[i]
+}
+
+// Bytes encodes the packet.
+func (p *Packet) Bytes() []byte {
+	value := p.Value
+	if p.Constructed {
+		value = nil
+		for _, c := range p.Children {
+			value = append(value, c.Bytes()...)
+		}
+	}
+
+	id := p.Class | byte(p.Tag)
+	if p.Constructed {
+		id |= 0x20
+	}
+
+	b := append([]byte{id}, encodeLength(len(value))...)
+	return append(b, value...)
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// Read reads a packet.
+func Read(r *bufio.Reader) (*Packet, error) {
+	id, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(first)
+	if first&0x80 != 0 {
+		n := int(first & 0x7f)
+		if n == 0 || n > 4 {
+			return nil, ErrMalformed
+		}
+
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+
+			length = length<<8 | int(b)
+		}
+	}
+
+	if length > maxLength || id&0x1f == 0x1f {
+		return nil, ErrMalformed
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+
+	p := &Packet{
+		Class:       id & 0xc0,
+		Constructed: id&0x20 != 0,
+		Tag:         int(id & 0x1f),
+	}
+
+	if !p.Constructed {
+		p.Value = value
+		return p, nil
+	}
+
+	br := bufio.NewReader(&sliceReader{b: value})
+	for {
+		c, err := Read(br)
+		if err == io.EOF {
+			return p, nil
+		}
+
+		if err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, ErrMalformed
+			}
+
+			return nil, err
+		}
+
+		p.Children = append(p.Children, c)
+	}
+}
+
+type sliceReader struct {
+	b []byte
+}
+
+func (s *sliceReader) Read(p []byte) (int, error) {
+	if len(s.b) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p, s.b)
+	s.b = s.b[n:]
+	return n, nil
+}
+
+// Sequence returns a sequence of packets.
+func Sequence(children ...*Packet) *Packet {
+	return &Packet{Class: Universal, Constructed: true, Tag: TagSequence, Children: children}
+}
+
+// Set returns a set of packets.
+func Set(children ...*Packet) *Packet {
+	return &Packet{Class: Universal, Constructed: true, Tag: TagSet, Children: children}
+}
+
+// Constructed returns a constructed packet of another class.
+func Constructed(class byte, tag int, children ...*Packet) *Packet {
+	return &Packet{Class: class, Constructed: true, Tag: tag, Children: children}
+}
+
+// Primitive returns a primitive packet of another class.
+func Primitive(class byte, tag int, value []byte) *Packet {
+	return &Packet{Class: class, Tag: tag, Value: value}
+}
+
+// OctetString returns a string packet.
+func OctetString(s string) *Packet {
+	return Primitive(Universal, TagOctetString, []byte(s))
+}
+
+// Integer returns an integer packet.
+func Integer(n int64) *Packet {
+	return Primitive(Universal, TagInteger, encodeInt(n))
+}
+
+// Enumerated returns an enumerated packet.
+func Enumerated(n int64) *Packet {
+	return Primitive(Universal, TagEnumerated, encodeInt(n))
+}
+
+// Boolean returns a boolean packet.
+func Boolean(v bool) *Packet {
+	if v {
+		return Primitive(Universal, TagBoolean, []byte{0xff})
+	}
+
+	return Primitive(Universal, TagBoolean, []byte{0})
+}
+
+func encodeInt(n int64) []byte {
+	b := []byte{byte(n)}
+	for n > 0x7f || n < -0x80 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+
+	return b
+}
@@ -0,0 +1,209 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/rjchee/dcac_filemanager/ldap/ber"
+)
+
+// The tags of the filters.
+const (
+	FilterAnd            = 0
+	FilterOr             = 1
+	FilterNot            = 2
+	FilterEquality       = 3
+	FilterSubstrings     = 4
+	FilterGreaterOrEqual = 5
+	FilterLessOrEqual    = 6
+	FilterPresent        = 7
+	FilterApprox         = 8
+)
+
+// The tags of the parts of a substrings filter.
+const (
+	SubstringInitial = 0
+	SubstringAny     = 1
+	SubstringFinal   = 2
+)
+
+var ErrInvalidFilter = errors.New("ldap: invalid filter")
+
+// EscapeFilter escapes a value, such as a username, so it can be put in a
+// filter.
+func EscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			b.WriteString(`\` + hex.EncodeToString([]byte{c}))
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return b.String()
+}
+
+// CompileFilter encodes a filter in the string format of RFC 4515, like
+// "(&(objectClass=person)(uid=john))".
+func CompileFilter(filter string) (*ber.Packet, error) {
+	p, rest, err := compile(strings.TrimSpace(filter))
+	if err != nil {
+		return nil, err
+	}
+
+	if rest != "" {
+		return nil, ErrInvalidFilter
+	}
+
+	return p, nil
+}
+
+// compile compiles the filter at the start of s and returns what follows.
+func compile(s string) (*ber.Packet, string, error) {
+	if len(s) < 3 || s[0] != '(' {
+		return nil, "", ErrInvalidFilter
+	}
+
+	switch s[1] {
+	case '&', '|':
+		tag := FilterAnd
+		if s[1] == '|' {
+			tag = FilterOr
+		}
+
+		p := ber.Constructed(ber.Context, tag)
+		rest := s[2:]
+		for len(rest) > 0 && rest[0] == '(' {
+			child, r, err := compile(rest)
+			if err != nil {
+				return nil, "", err
+			}
+
+			p.Children = append(p.Children, child)
+			rest = r
+		}
+
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", ErrInvalidFilter
+		}
+
+		return p, rest[1:], nil
+	case '!':
+		child, rest, err := compile(s[2:])
+		if err != nil {
+			return nil, "", err
+		}
+
+		if len(rest) == 0 || rest[0] != ')' {
+			return nil, "", ErrInvalidFilter
+		}
+
+		return ber.Constructed(ber.Context, FilterNot, child), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", ErrInvalidFilter
+	}
+
+	p, err := compileItem(s[1:end])
+	if err != nil {
+		return nil, "", err
+	}
+
+	return p, s[end+1:], nil
+}
+
+// compileItem compiles a simple filter, like "uid=john".
+func compileItem(s string) (*ber.Packet, error) {
+	eq := strings.IndexByte(s, '=')
+	if eq < 1 {
+		return nil, ErrInvalidFilter
+	}
+
+	attr, value := s[:eq], s[eq+1:]
+
+	tag := FilterEquality
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = FilterGreaterOrEqual, attr[:len(attr)-1]
+	case '<':
+		tag, attr = FilterLessOrEqual, attr[:len(attr)-1]
+	case '~':
+		tag, attr = FilterApprox, attr[:len(attr)-1]
+	}
+
+	if attr == "" || strings.ContainsAny(attr, "()*\\") {
+		return nil, ErrInvalidFilter
+	}
+
+	if tag == FilterEquality && value == "*" {
+		return ber.Primitive(ber.Context, FilterPresent, []byte(attr)), nil
+	}
+
+	if tag == FilterEquality && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		subs := ber.Sequence()
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+
+			v, err := unescape(part)
+			if err != nil {
+				return nil, err
+			}
+
+			t := SubstringAny
+			switch i {
+			case 0:
+				t = SubstringInitial
+			case len(parts) - 1:
+				t = SubstringFinal
+			}
+
+			subs.Children = append(subs.Children, ber.Primitive(ber.Context, t, []byte(v)))
+		}
+
+		return ber.Constructed(ber.Context, FilterSubstrings, ber.OctetString(attr), subs), nil
+	}
+
+	v, err := unescape(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return ber.Constructed(ber.Context, tag, ber.OctetString(attr), ber.OctetString(v)), nil
+}
+
+// unescape decodes the \xx escapes of a value.
+func unescape(s string) (string, error) {
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+
+		if i+3 > len(s) {
+			return "", ErrInvalidFilter
+		}
+
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", ErrInvalidFilter
+		}
+
+		b = append(b, c[0])
+		i += 2
+	}
+
+	return string(b), nil
+}
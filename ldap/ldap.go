@@ -0,0 +1,296 @@
+// Package ldap is a minimal LDAP v3 client: it binds with a password and
+// searches a directory, which is what the login against a directory and
+// the sync of its users need.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rjchee/dcac_filemanager/ldap/ber"
+)
+
+// The tags of the protocol operations.
+const (
+	OpBindRequest           = 0
+	OpBindResponse          = 1
+	OpUnbindRequest         = 2
+	OpSearchRequest         = 3
+	OpSearchResultEntry     = 4
+	OpSearchResultDone      = 5
+	OpSearchResultReference = 19
+)
+
+// The result codes File Manager cares about.
+const (
+	ResultSuccess            = 0
+	ResultSizeLimitExceeded  = 4
+	ResultNoSuchObject       = 32
+	ResultInvalidCredentials = 49
+)
+
+// The scopes of a search.
+const (
+	ScopeBase    = 0
+	ScopeOne     = 1
+	ScopeSubtree = 2
+)
+
+const (
+	protocolVersion = 3
+	dialTimeout     = 10 * time.Second
+	timeout         = 30 * time.Second
+)
+
+var ErrEmptyPassword = errors.New("ldap: empty password")
+
+// Error is an error result of the server.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// IsInvalidCredentials checks if an error is a failed bind.
+func IsInvalidCredentials(err error) bool {
+	e, ok := err.(*Error)
+	return err == ErrEmptyPassword || ok && e.Code == ResultInvalidCredentials
+}
+
+// Conn is a connection to an LDAP server. Its operations run one at a
+// time.
+type Conn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+	id   int64
+}
+
+// Dial connects to an ldap:// or an ldaps:// URL.
+func Dial(rawurl string, config *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &net.Dialer{Timeout: dialTimeout}
+
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+
+		conn, err = d.Dial("tcp", host)
+	case "ldaps":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+
+		if config == nil {
+			config = &tls.Config{ServerName: u.Hostname()}
+		}
+
+		conn, err = tls.DialWithDialer(d, "tcp", host, config)
+	default:
+		return nil, fmt.Errorf("ldap: unknown scheme %q", u.Scheme)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.send(ber.Primitive(ber.Application, OpUnbindRequest, nil))
+	return c.conn.Close()
+}
+
+// send sends a request and returns its message ID.
+func (c *Conn) send(op *ber.Packet) (int64, error) {
+	c.id++
+	msg := ber.Sequence(ber.Integer(c.id), op)
+
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	_, err := c.conn.Write(msg.Bytes())
+	return c.id, err
+}
+
+// receive reads the next response to a request.
+func (c *Conn) receive(id int64) (*ber.Packet, error) {
+	for {
+		msg, err := ber.Read(c.r)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(msg.Children) < 2 {
+			return nil, ber.ErrMalformed
+		}
+
+		// Unsolicited notifications have the ID 0, like the notice of
+		// disconnection.
+		if msg.Child(0).Int() == 0 {
+			return nil, resultError(msg.Child(1))
+		}
+
+		if msg.Child(0).Int() == id {
+			return msg.Child(1), nil
+		}
+	}
+}
+
+// resultError returns the error of an LDAPResult, or nil on success.
+func resultError(p *ber.Packet) error {
+	code := int(p.Child(0).Int())
+	if code == ResultSuccess {
+		return nil
+	}
+
+	return &Error{Code: code, Message: p.Child(2).String()}
+}
+
+// Bind authenticates with a DN and a password. Empty passwords are
+// refused, because servers take them for anonymous binds which always
+// succeed.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, err := c.send(ber.Constructed(ber.Application, OpBindRequest,
+		ber.Integer(protocolVersion),
+		ber.OctetString(dn),
+		ber.Primitive(ber.Context, 0, []byte(password)),
+	))
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+
+	if !resp.Is(ber.Application, OpBindResponse) {
+		return ber.ErrMalformed
+	}
+
+	return resultError(resp)
+}
+
+// SearchRequest is a search of a directory.
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int
+	Filter     string
+	Attributes []string
+	SizeLimit  int
+}
+
+// Entry is an entry of a directory.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the first value of an attribute.
+func (e *Entry) Get(name string) string {
+	values := e.GetAll(name)
+	if len(values) == 0 {
+		return ""
+	}
+
+	return values[0]
+}
+
+// GetAll returns the values of an attribute. The names of the
+// attributes are case-insensitive.
+func (e *Entry) GetAll(name string) []string {
+	return e.Attributes[strings.ToLower(name)]
+}
+
+// Search searches a directory and returns the entries it finds.
+func (c *Conn) Search(req *SearchRequest) ([]*Entry, error) {
+	filter, err := CompileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := ber.Sequence()
+	for _, a := range req.Attributes {
+		attrs.Children = append(attrs.Children, ber.OctetString(a))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, err := c.send(ber.Constructed(ber.Application, OpSearchRequest,
+		ber.OctetString(req.BaseDN),
+		ber.Enumerated(int64(req.Scope)),
+		ber.Enumerated(0),
+		ber.Integer(int64(req.SizeLimit)),
+		ber.Integer(0),
+		ber.Boolean(false),
+		filter,
+		attrs,
+	))
+
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for {
+		resp, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case resp.Is(ber.Application, OpSearchResultEntry):
+			entries = append(entries, parseEntry(resp))
+		case resp.Is(ber.Application, OpSearchResultReference):
+			// Referrals to other servers aren't followed.
+		case resp.Is(ber.Application, OpSearchResultDone):
+			return entries, resultError(resp)
+		default:
+			return nil, ber.ErrMalformed
+		}
+	}
+}
+
+func parseEntry(p *ber.Packet) *Entry {
+	e := &Entry{DN: p.Child(0).String(), Attributes: map[string][]string{}}
+	for _, attr := range p.Child(1).Children {
+		name := strings.ToLower(attr.Child(0).String())
+		for _, v := range attr.Child(1).Children {
+			e.Attributes[name] = append(e.Attributes[name], v.String())
+		}
+	}
+
+	return e
+}
@@ -0,0 +1,310 @@
+// Package ldaptest provides an in-process LDAP server, to test the login
+// against a directory and the sync of its users without a real one. It
+// supports simple binds and searches.
+package ldaptest
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/rjchee/dcac_filemanager/ldap"
+	"github.com/rjchee/dcac_filemanager/ldap/ber"
+)
+
+// Server is an in-memory directory served on a local address. The
+// passwords of the entries are their "userPassword" attribute, which is
+// never returned by searches.
+type Server struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	entries map[string]*ldap.Entry
+}
+
+// NewServer starts a server with an empty directory. It must be closed
+// once done.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{listener: l, entries: map[string]*ldap.Entry{}}
+	go s.serve()
+	return s, nil
+}
+
+// URL returns the ldap:// URL of the server.
+func (s *Server) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.listener.Close()
+}
+
+// Add adds an entry to the directory, or replaces it.
+func (s *Server) Add(dn string, attrs map[string][]string) {
+	e := &ldap.Entry{DN: dn, Attributes: map[string][]string{}}
+	for k, v := range attrs {
+		e.Attributes[strings.ToLower(k)] = v
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.entries[normalize(dn)] = e
+}
+
+// Remove removes an entry from the directory.
+func (s *Server) Remove(dn string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, normalize(dn))
+}
+
+func normalize(dn string) string {
+	parts := strings.Split(dn, ",")
+	for i, p := range parts {
+		parts[i] = strings.ToLower(strings.TrimSpace(p))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	for {
+		msg, err := ber.Read(r)
+		if err != nil {
+			return
+		}
+
+		id, op := msg.Child(0).Int(), msg.Child(1)
+
+		var responses []*ber.Packet
+		switch {
+		case op.Is(ber.Application, ldap.OpBindRequest):
+			responses = []*ber.Packet{s.bind(op)}
+		case op.Is(ber.Application, ldap.OpSearchRequest):
+			responses = s.search(op)
+		case op.Is(ber.Application, ldap.OpUnbindRequest):
+			return
+		default:
+			return
+		}
+
+		for _, resp := range responses {
+			if _, err := conn.Write(ber.Sequence(ber.Integer(id), resp).Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func result(op, code int, message string) *ber.Packet {
+	return ber.Constructed(ber.Application, op,
+		ber.Enumerated(int64(code)),
+		ber.OctetString(""),
+		ber.OctetString(message),
+	)
+}
+
+func (s *Server) bind(op *ber.Packet) *ber.Packet {
+	dn, password := op.Child(1).String(), op.Child(2).String()
+
+	// Anonymous binds.
+	if dn == "" && password == "" {
+		return result(ldap.OpBindResponse, ldap.ResultSuccess, "")
+	}
+
+	s.mu.Lock()
+	e, ok := s.entries[normalize(dn)]
+	s.mu.Unlock()
+
+	if !ok || password == "" || e.Get("userPassword") != password {
+		return result(ldap.OpBindResponse, ldap.ResultInvalidCredentials, "invalid credentials")
+	}
+
+	return result(ldap.OpBindResponse, ldap.ResultSuccess, "")
+}
+
+func (s *Server) search(op *ber.Packet) []*ber.Packet {
+	base := normalize(op.Child(0).String())
+	scope := int(op.Child(1).Int())
+	limit := int(op.Child(3).Int())
+	filter := op.Child(6)
+
+	var attrs []string
+	for _, a := range op.Child(7).Children {
+		attrs = append(attrs, strings.ToLower(a.String()))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.entries[base]; !ok && base != "" {
+		return []*ber.Packet{result(ldap.OpSearchResultDone, ldap.ResultNoSuchObject, "no such object")}
+	}
+
+	var responses []*ber.Packet
+	for dn, e := range s.entries {
+		if !inScope(dn, base, scope) || !match(filter, e) {
+			continue
+		}
+
+		if limit > 0 && len(responses) == limit {
+			return append(responses, result(ldap.OpSearchResultDone, ldap.ResultSizeLimitExceeded, "size limit exceeded"))
+		}
+
+		responses = append(responses, entryPacket(e, attrs))
+	}
+
+	return append(responses, result(ldap.OpSearchResultDone, ldap.ResultSuccess, ""))
+}
+
+func inScope(dn, base string, scope int) bool {
+	switch scope {
+	case ldap.ScopeBase:
+		return dn == base
+	case ldap.ScopeOne:
+		i := strings.IndexByte(dn, ',')
+		return i >= 0 && dn[i+1:] == base
+	}
+
+	return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+func entryPacket(e *ldap.Entry, attrs []string) *ber.Packet {
+	list := ber.Sequence()
+	for name, values := range e.Attributes {
+		if name == "userpassword" || !wanted(name, attrs) {
+			continue
+		}
+
+		set := ber.Set()
+		for _, v := range values {
+			set.Children = append(set.Children, ber.OctetString(v))
+		}
+
+		list.Children = append(list.Children, ber.Sequence(ber.OctetString(name), set))
+	}
+
+	return ber.Constructed(ber.Application, ldap.OpSearchResultEntry, ber.OctetString(e.DN), list)
+}
+
+func wanted(name string, attrs []string) bool {
+	if len(attrs) == 0 {
+		return true
+	}
+
+	for _, a := range attrs {
+		if a == name || a == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// match evaluates a filter on an entry. The comparisons are
+// case-insensitive, like most attributes of a directory.
+func match(f *ber.Packet, e *ldap.Entry) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, c := range f.Children {
+			if !match(c, e) {
+				return false
+			}
+		}
+
+		return true
+	case ldap.FilterOr:
+		for _, c := range f.Children {
+			if match(c, e) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterNot:
+		return !match(f.Child(0), e)
+	case ldap.FilterPresent:
+		return len(e.GetAll(f.String())) > 0
+	case ldap.FilterSubstrings:
+		for _, v := range e.GetAll(f.Child(0).String()) {
+			if matchSubstrings(strings.ToLower(v), f.Child(1).Children) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	want := strings.ToLower(f.Child(1).String())
+	for _, v := range e.GetAll(f.Child(0).String()) {
+		v = strings.ToLower(v)
+		switch f.Tag {
+		case ldap.FilterEquality, ldap.FilterApprox:
+			if v == want {
+				return true
+			}
+		case ldap.FilterGreaterOrEqual:
+			if v >= want {
+				return true
+			}
+		case ldap.FilterLessOrEqual:
+			if v <= want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func matchSubstrings(v string, parts []*ber.Packet) bool {
+	for _, p := range parts {
+		sub := strings.ToLower(p.String())
+		switch p.Tag {
+		case ldap.SubstringInitial:
+			if !strings.HasPrefix(v, sub) {
+				return false
+			}
+
+			v = v[len(sub):]
+		case ldap.SubstringFinal:
+			if !strings.HasSuffix(v, sub) {
+				return false
+			}
+
+			v = v[:len(v)-len(sub)]
+		default:
+			i := strings.Index(v, sub)
+			if i < 0 {
+				return false
+			}
+
+			v = v[i+len(sub):]
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,433 @@
+package filemanager_test
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	fm "github.com/rjchee/dcac_filemanager"
+	"github.com/rjchee/dcac_filemanager/dcac"
+	"github.com/rjchee/dcac_filemanager/ldap/ldaptest"
+	"github.com/rjchee/dcac_filemanager/vfs"
+)
+
+// memUsers is a users store in memory.
+type memUsers struct {
+	mu    sync.Mutex
+	users map[int]fm.User
+	next  int
+}
+
+func (s *memUsers) get(u fm.User, builder fm.FSBuilder) *fm.User {
+	u.FileSystem = builder(u.Scope)
+	return &u
+}
+
+func (s *memUsers) Get(id int, builder fm.FSBuilder) (*fm.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[id]
+	if !ok {
+		return nil, fm.ErrNotExist
+	}
+
+	return s.get(u, builder), nil
+}
+
+func (s *memUsers) GetByUsername(username string, builder fm.FSBuilder) (*fm.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, u := range s.users {
+		if u.Username == username {
+			return s.get(u, builder), nil
+		}
+	}
+
+	return nil, fm.ErrNotExist
+}
+
+func (s *memUsers) Gets(builder fm.FSBuilder) ([]*fm.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []*fm.User{}
+	for _, u := range s.users {
+		users = append(users, s.get(u, builder))
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return users, nil
+}
+
+func (s *memUsers) Save(u *fm.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u.ID == 0 {
+		s.next++
+		u.ID = s.next
+	}
+
+	s.users[u.ID] = *u
+	return nil
+}
+
+func (s *memUsers) Update(u *fm.User, fields ...string) error {
+	return s.Save(u)
+}
+
+func (s *memUsers) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.users, id)
+	return nil
+}
+
+// memSessions is a sessions store in memory.
+type memSessions struct {
+	mu       sync.Mutex
+	sessions map[string]fm.Session
+}
+
+func (s *memSessions) Get(id string) (*fm.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[id]
+	if !ok {
+		return nil, fm.ErrNotExist
+	}
+
+	return &session, nil
+}
+
+func (s *memSessions) GetByUser(userID int) ([]*fm.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := []*fm.Session{}
+	for _, session := range s.sessions {
+		if session.UserID == userID {
+			session := session
+			sessions = append(sessions, &session)
+		}
+	}
+
+	return sessions, nil
+}
+
+func (s *memSessions) Gets() ([]*fm.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := []*fm.Session{}
+	for _, session := range s.sessions {
+		session := session
+		sessions = append(sessions, &session)
+	}
+
+	return sessions, nil
+}
+
+func (s *memSessions) Save(session *fm.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sessions[session.ID] = *session
+	return nil
+}
+
+func (s *memSessions) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, id)
+	return nil
+}
+
+const baseDN = "dc=example,dc=com"
+
+// newDirectory starts a directory with a search account and the entries
+// of alice, a member of staff, and bob, an admin.
+func newDirectory(t *testing.T) *ldaptest.Server {
+	s, err := ldaptest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { s.Close() })
+
+	s.Add(baseDN, map[string][]string{"objectClass": {"domain"}})
+	s.Add("cn=search,"+baseDN, map[string][]string{
+		"objectClass":  {"account"},
+		"userPassword": {"search"},
+	})
+	s.Add("uid=alice,"+baseDN, map[string][]string{
+		"objectClass":  {"person"},
+		"uid":          {"alice"},
+		"userPassword": {"alice-password"},
+		"memberOf":     {"cn=staff,ou=groups," + baseDN},
+	})
+	s.Add("uid=bob,"+baseDN, map[string][]string{
+		"objectClass":  {"person"},
+		"uid":          {"bob"},
+		"userPassword": {"bob-password"},
+		"memberOf":     {"cn=staff,ou=groups," + baseDN, "cn=admins,ou=groups," + baseDN},
+	})
+
+	return s
+}
+
+func newLDAP(url string) *fm.LDAP {
+	return &fm.LDAP{
+		URL:               url,
+		BindDN:            "cn=search," + baseDN,
+		BindPassword:      "search",
+		BaseDN:            baseDN,
+		UserFilter:        "(uid={username})",
+		SyncFilter:        "(objectClass=person)",
+		UsernameAttribute: "uid",
+		GroupsAttribute:   "memberOf",
+		ScopeTemplate:     "/home/{username}",
+	}
+}
+
+func newManager(t *testing.T, l *fm.LDAP, users ...fm.User) *fm.FileManager {
+	m := &fm.FileManager{
+		DCACDir: t.TempDir(),
+		NewFS:   func(string) fm.FileSystem { return vfs.NewMem() },
+		Store: &fm.Store{
+			Users:    &memUsers{users: map[int]fm.User{}},
+			Sessions: &memSessions{sessions: map[string]fm.Session{}},
+		},
+		DefaultUser:   &fm.User{Scope: "/", AllowEdit: true},
+		AuthProviders: []fm.AuthProvider{l},
+	}
+
+	for _, u := range users {
+		u := u
+		if err := m.Store.Users.Save(&u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return m
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	s := newDirectory(t)
+	l := newLDAP(s.URL())
+	m := newManager(t, l, fm.User{Username: "alice", Source: "ldap"})
+
+	u, err := m.Authenticate("alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(u.Groups) != 1 || u.Groups[0] != "staff" {
+		t.Errorf("the groups weren't synced: %v", u.Groups)
+	}
+
+	for _, password := range []string{"bob-password", ""} {
+		if _, err := m.Authenticate("alice", password); err != fm.ErrInvalidCredentials {
+			t.Errorf("password %q: got %v, want %v", password, err, fm.ErrInvalidCredentials)
+		}
+	}
+
+	// The users of the directory aren't created without provisioning.
+	if _, err := l.Authenticate(m, "bob", "bob-password"); err != fm.ErrNotExist {
+		t.Errorf("unknown user: got %v, want %v", err, fm.ErrNotExist)
+	}
+
+	l.BindPassword = "wrong"
+	if _, err := l.Authenticate(m, "alice", "alice-password"); err == nil || err == fm.ErrNotExist {
+		t.Errorf("wrong search account: %v", err)
+	}
+}
+
+func TestLDAPEscapeFilter(t *testing.T) {
+	s := newDirectory(t)
+	l := newLDAP(s.URL())
+	m := newManager(t, l, fm.User{Username: "alice", Source: "ldap"})
+
+	// Unescaped, these would find the entry of alice, or both entries.
+	for _, username := range []string{"ali*", "*", "alice)(uid=*", `alice\`} {
+		if _, err := l.Authenticate(m, username, "alice-password"); err != fm.ErrNotExist {
+			t.Errorf("username %q: got %v, want %v", username, err, fm.ErrNotExist)
+		}
+	}
+}
+
+func TestLDAPUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := "ldap://" + listener.Addr().String()
+	listener.Close()
+
+	hash, err := fm.HashPassword("admin-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := newLDAP(url)
+	m := newManager(t, l, fm.User{Username: "admin", Password: hash, Admin: true})
+
+	if _, err := l.Authenticate(m, "admin", "admin-password"); err != fm.ErrNotExist {
+		t.Fatalf("got %v, want %v", err, fm.ErrNotExist)
+	}
+
+	u, err := m.Authenticate("admin", "admin-password")
+	if err != nil {
+		t.Fatalf("the local user can't log in: %v", err)
+	}
+
+	if u.Username != "admin" {
+		t.Errorf("logged in as %s", u.Username)
+	}
+}
+
+func TestLDAPProvision(t *testing.T) {
+	s := newDirectory(t)
+	l := newLDAP(s.URL())
+	l.Provision = true
+	m := newManager(t, l)
+
+	// The new users get the rights of their scope through DCAC.
+	attr, err := dcac.OpenGatewayFile(m.UsersGatewayFile(), dcac.ADDMOD)
+	if err != nil {
+		t.Skip("DCAC is not available:", err)
+	}
+	attr.Drop()
+
+	u, err := m.Authenticate("alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u.ID == 0 || u.Source != "ldap" || u.Scope != "/home/alice" || u.Admin {
+		t.Errorf("provisioned user: %+v", u)
+	}
+
+	l.AdminGroups = []string{"admins"}
+	if err := l.Sync(m); err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := m.Store.Users.GetByUsername("bob", m.NewFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bob.Admin || bob.Source != "ldap" {
+		t.Errorf("synced user: %+v", bob)
+	}
+}
+
+func TestLDAPSync(t *testing.T) {
+	s := newDirectory(t)
+	l := newLDAP(s.URL())
+	m := newManager(t, l,
+		fm.User{Username: "alice", Source: "ldap", Disabled: true},
+		fm.User{Username: "carol", Source: "ldap"},
+		fm.User{Username: "dave"},
+	)
+
+	carol, _ := m.Store.Users.GetByUsername("carol", m.NewFS)
+	session, err := fm.NewSession(carol.ID, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Store.Sessions.Save(session); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Sync(m); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(username string) *fm.User {
+		u, err := m.Store.Users.GetByUsername(username, m.NewFS)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return u
+	}
+
+	if u := get("alice"); u.Disabled || len(u.Groups) != 1 {
+		t.Errorf("alice wasn't enabled and synced: %+v", u)
+	}
+
+	if !get("carol").Disabled {
+		t.Error("carol, who left the directory, wasn't disabled")
+	}
+
+	if sessions, _ := m.Store.Sessions.GetByUser(carol.ID); len(sessions) != 0 {
+		t.Error("the sessions of carol weren't revoked")
+	}
+
+	if get("dave").Disabled {
+		t.Error("dave, a local user, was disabled")
+	}
+
+	if _, err := m.Store.Users.GetByUsername("bob", m.NewFS); err != fm.ErrNotExist {
+		t.Error("bob was created without provisioning")
+	}
+
+	// Nobody is disabled when the search finds nothing.
+	l.SyncFilter = "(objectClass=nothing)"
+	if err := l.Sync(m); err != nil {
+		t.Fatal(err)
+	}
+
+	if get("alice").Disabled {
+		t.Error("alice was disabled by an empty search")
+	}
+}
+
+func TestLDAPLocalUser(t *testing.T) {
+	hash, err := fm.HashPassword("local-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := newDirectory(t)
+	l := newLDAP(s.URL())
+	l.Provision = true
+	l.AdminGroups = []string{"admins"}
+	m := newManager(t, l, fm.User{Username: "alice", Password: hash, Admin: true, Groups: []string{"local"}})
+
+	if _, err := l.Authenticate(m, "alice", "alice-password"); err != fm.ErrOtherSource {
+		t.Fatalf("got %v, want %v", err, fm.ErrOtherSource)
+	}
+
+	// The entry of the directory can't log in as the local user.
+	if _, err := m.Authenticate("alice", "alice-password"); err != fm.ErrInvalidCredentials {
+		t.Errorf("login with the password of the directory: %v", err)
+	}
+
+	if _, err := m.Authenticate("alice", "local-password"); err != nil {
+		t.Errorf("login with the local password: %v", err)
+	}
+
+	if err := l.Sync(m); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := m.Store.Users.GetByUsername("alice", m.NewFS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !u.Admin || u.Source != "" || len(u.Groups) != 1 || u.Groups[0] != "local" {
+		t.Errorf("the local user was changed: %+v", u)
+	}
+}
@@ -0,0 +1,61 @@
+package filemanager
+
+import (
+	"github.com/rjchee/dcac_filemanager/oidc"
+)
+
+// OIDC configures the login with an OpenID Connect provider, which maps
+// its users to the users of File Manager.
+type OIDC struct {
+	*oidc.Provider
+
+	// UsernameClaim is the claim the users are matched by username with.
+	UsernameClaim string
+
+	// Provision creates the users who aren't found from the DefaultUser.
+	Provision bool
+
+	// ScopeTemplate is the scope of the provisioned users, where
+	// {username} is replaced by their username. The scope of the
+	// DefaultUser is used when it is empty.
+	ScopeTemplate string
+
+	// GroupsClaim is the claim with the groups of the users.
+	GroupsClaim string
+
+	// AdminGroups are the groups whose members are admins. The provider
+	// doesn't manage who is an admin when it is empty.
+	AdminGroups []string
+}
+
+// OIDCUser returns the user of the claims of an ID token, provisioning it
+// if needed, and updates its groups and its admin status. Only the users
+// from the provider are mapped, so the local users, with their password
+// and second factor, can't be taken over by the same username.
+func (m *FileManager) OIDCUser(claims oidc.Claims) (*User, error) {
+	username := claims.String(m.OIDC.UsernameClaim)
+	if username == "" {
+		return nil, ErrEmptyUsername
+	}
+
+	apply := func(u *User) {
+		if m.OIDC.GroupsClaim != "" {
+			setGroups(u, claims.Strings(m.OIDC.GroupsClaim), m.OIDC.AdminGroups)
+		}
+	}
+
+	u, err := m.Store.Users.GetByUsername(username, m.NewFS)
+	if err == ErrNotExist && m.OIDC.Provision {
+		return m.provisionUser(username, "oidc", m.OIDC.ScopeTemplate, apply)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Source != "oidc" {
+		return nil, ErrOtherSource
+	}
+
+	return m.syncUser(u, apply)
+}
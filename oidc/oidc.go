@@ -0,0 +1,292 @@
+// Package oidc implements the login with an OpenID Connect provider: the
+// discovery of its configuration, the authorization code flow with PKCE
+// and the validation of the ID tokens it issues.
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+var (
+	ErrInvalidToken = errors.New("oidc: invalid ID token")
+	ErrUnknownKey   = errors.New("oidc: unknown signing key")
+	ErrNoIDToken    = errors.New("oidc: no ID token in the token response")
+)
+
+// algorithms are the signing algorithms of the ID tokens which are
+// accepted. The symmetric ones would use the client secret as the key.
+var algorithms = map[string]bool{
+	"RS256": true, "RS384": true, "RS512": true,
+	"ES256": true, "ES384": true, "ES512": true,
+}
+
+// Provider is an OpenID Connect provider File Manager is registered at as
+// a client. Its endpoints are discovered from its issuer URL the first
+// time they are needed.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the URL of the callback of File Manager, which must
+	// be registered at the provider.
+	RedirectURL string
+
+	// Scopes are requested besides "openid".
+	Scopes []string
+
+	// Client makes the requests to the provider. http.DefaultClient is
+	// used when it is nil.
+	Client *http.Client
+
+	mu      sync.Mutex
+	config  *config
+	keys    map[string]interface{}
+	fetched time.Time
+}
+
+// config is the part of the discovery document File Manager uses.
+type config struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func (p *Provider) client() *http.Client {
+	if p.Client == nil {
+		return http.DefaultClient
+	}
+
+	return p.Client
+}
+
+// getJSON gets a JSON document from the provider.
+func (p *Provider) getJSON(u string, v interface{}) error {
+	resp, err := p.client().Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("oidc: GET %s: %s", u, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover returns the configuration of the provider, which is fetched
+// once.
+func (p *Provider) discover() (*config, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.config != nil {
+		return p.config, nil
+	}
+
+	var c config
+	u := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(u, &c); err != nil {
+		return nil, err
+	}
+
+	if c.Issuer != p.Issuer {
+		return nil, fmt.Errorf("oidc: the issuer %q doesn't match the expected %q", c.Issuer, p.Issuer)
+	}
+
+	if c.AuthorizationEndpoint == "" || c.TokenEndpoint == "" || c.JWKSURI == "" {
+		return nil, errors.New("oidc: the discovery document is incomplete")
+	}
+
+	p.config = &c
+	return p.config, nil
+}
+
+// RandomString returns a random string fit for the state, the nonce and
+// the PKCE code verifier of a login.
+func RandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge returns the S256 PKCE challenge of a code verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns the URL of the provider the user logs in at. The
+// provider redirects to RedirectURL with the code and the state.
+func (p *Provider) AuthURL(state, nonce, verifier string) (string, error) {
+	c, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(c.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.ClientID)
+	q.Set("redirect_uri", p.RedirectURL)
+	q.Set("scope", strings.Join(append([]string{"openid"}, p.Scopes...), " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", Challenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange exchanges the code the provider redirected with for the ID
+// token, which must then be verified.
+func (p *Provider) Exchange(code, verifier string) (string, error) {
+	c, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequest(http.MethodPost, c.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	if body.Error != "" {
+		return "", fmt.Errorf("oidc: %s: %s", body.Error, body.ErrorDescription)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oidc: token request: %s", resp.Status)
+	}
+
+	if body.IDToken == "" {
+		return "", ErrNoIDToken
+	}
+
+	return body.IDToken, nil
+}
+
+// Verify verifies the signature, the issuer, the audience, the expiry and
+// the nonce of an ID token and returns its claims.
+func (p *Provider) Verify(raw, nonce string) (Claims, error) {
+	c, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		if !algorithms[t.Method.Alg()] {
+			return nil, ErrInvalidToken
+		}
+
+		kid, _ := t.Header["kid"].(string)
+		return p.key(c, kid)
+	})
+
+	if err != nil {
+		if e, ok := err.(*jwt.ValidationError); ok && e.Inner == ErrUnknownKey {
+			return nil, ErrUnknownKey
+		}
+
+		return nil, ErrInvalidToken
+	}
+
+	cl := Claims(claims)
+	if cl.String("iss") != c.Issuer || !cl.hasAudience(p.ClientID) || cl.String("nonce") != nonce {
+		return nil, ErrInvalidToken
+	}
+
+	// The expiry is only checked by the parser when it is a number.
+	if _, ok := claims["exp"].(float64); !ok {
+		return nil, ErrInvalidToken
+	}
+
+	return cl, nil
+}
+
+// Claims are the claims of an ID token.
+type Claims map[string]interface{}
+
+// String returns a claim which is a string.
+func (c Claims) String(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// Strings returns a claim which is a list of strings, or a single one.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var list []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+
+		return list
+	}
+
+	return nil
+}
+
+func (c Claims) hasAudience(aud string) bool {
+	for _, a := range c.Strings("aud") {
+		if a == aud {
+			return true
+		}
+	}
+
+	return false
+}
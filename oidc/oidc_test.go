@@ -0,0 +1,193 @@
+package oidc_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/rjchee/dcac_filemanager/oidc"
+	"github.com/rjchee/dcac_filemanager/oidc/oidctest"
+)
+
+const redirectURL = "http://localhost/api/auth/oidc/callback"
+
+func newIssuer(t *testing.T) (*oidctest.Issuer, *oidc.Provider) {
+	issuer, err := oidctest.NewIssuer("filemanager", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(issuer.Close)
+	return issuer, issuer.Provider(redirectURL)
+}
+
+// authorize logs in at the issuer and returns the code it redirects with.
+func authorize(t *testing.T, p *oidc.Provider, state, nonce, verifier string) string {
+	t.Helper()
+
+	u, err := p.AuthURL(state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := *p.Client
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization: %s, %v", resp.Status, err)
+	}
+
+	if location.Query().Get("state") != state {
+		t.Fatalf("the state %q wasn't given back", state)
+	}
+
+	return location.Query().Get("code")
+}
+
+func TestLogin(t *testing.T) {
+	issuer, p := newIssuer(t)
+	issuer.SetClaims(map[string]interface{}{
+		"preferred_username": "alice",
+		"groups":             []string{"staff", "admins"},
+	})
+
+	verifier, _ := oidc.RandomString()
+	code := authorize(t, p, "state", "nonce", verifier)
+
+	if _, err := p.Exchange(code, "wrong"); err == nil {
+		t.Fatal("a code was exchanged with the wrong verifier")
+	}
+
+	// The codes are single use, even when the exchange fails.
+	code = authorize(t, p, "state", "nonce", verifier)
+	raw, err := p.Exchange(code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Exchange(code, verifier); err == nil {
+		t.Error("a code was exchanged twice")
+	}
+
+	claims, err := p.Verify(raw, "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := claims.String("preferred_username"); got != "alice" {
+		t.Errorf("username claim: %q", got)
+	}
+
+	if got := claims.Strings("groups"); len(got) != 2 || got[1] != "admins" {
+		t.Errorf("groups claim: %v", got)
+	}
+
+	if _, err := p.Verify(raw, "other"); err != oidc.ErrInvalidToken {
+		t.Errorf("verification with another nonce: %v", err)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	issuer, p := newIssuer(t)
+
+	tests := []struct {
+		name  string
+		edit  func(jwt.MapClaims)
+		valid bool
+	}{
+		{"valid", func(c jwt.MapClaims) {}, true},
+		{"one of the audiences", func(c jwt.MapClaims) { c["aud"] = []string{"other", "filemanager"} }, true},
+		{"other audience", func(c jwt.MapClaims) { c["aud"] = "other" }, false},
+		{"no audience", func(c jwt.MapClaims) { delete(c, "aud") }, false},
+		{"other issuer", func(c jwt.MapClaims) { c["iss"] = "https://example.com" }, false},
+		{"other nonce", func(c jwt.MapClaims) { c["nonce"] = "other" }, false},
+		{"no expiry", func(c jwt.MapClaims) { delete(c, "exp") }, false},
+		{"null expiry", func(c jwt.MapClaims) { c["exp"] = nil }, false},
+		{"text expiry", func(c jwt.MapClaims) { c["exp"] = "tomorrow" }, false},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, false},
+	}
+
+	for _, tt := range tests {
+		claims := issuer.Claims("nonce")
+		tt.edit(claims)
+
+		raw, err := issuer.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = p.Verify(raw, "nonce")
+		if tt.valid && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+
+		if !tt.valid && err != oidc.ErrInvalidToken {
+			t.Errorf("%s: got %v, want %v", tt.name, err, oidc.ErrInvalidToken)
+		}
+	}
+}
+
+func TestVerifyAlgorithms(t *testing.T) {
+	issuer, p := newIssuer(t)
+	claims := issuer.Claims("nonce")
+
+	// The client secret, which the provider knows, can't sign the tokens.
+	hs, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, raw := range map[string]string{"HS256": hs, "none": none} {
+		if _, err := p.Verify(raw, "nonce"); err != oidc.ErrInvalidToken {
+			t.Errorf("%s: got %v, want %v", name, err, oidc.ErrInvalidToken)
+		}
+	}
+}
+
+func TestVerifyKeys(t *testing.T) {
+	issuer, p := newIssuer(t)
+	claims := issuer.Claims("nonce")
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+
+		raw, err := token.SignedString(other)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return raw
+	}
+
+	if _, err := p.Verify(sign("oidctest"), "nonce"); err != oidc.ErrInvalidToken {
+		t.Errorf("token signed with another key: %v", err)
+	}
+
+	if _, err := p.Verify(sign("unknown"), "nonce"); err != oidc.ErrUnknownKey {
+		t.Errorf("token signed with an unknown key: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package filemanager
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// PasswordPolicy is what the passwords of the users must comply with.
+type PasswordPolicy struct {
+	// MinLength is the minimum number of characters.
+	MinLength int
+
+	// MinClasses is the minimum number of the kinds of characters, out of
+	// lowercase and uppercase letters, digits and symbols.
+	MinClasses int
+
+	// History is the number of the previous passwords of a user which
+	// can't be used again.
+	History int
+
+	// breached are the SHA-1 hashes of the leaked passwords.
+	breached map[string]bool
+}
+
+// LoadBreached loads a list of leaked passwords, with one per line. The
+// lines may also be the uppercase SHA-1 hashes of the passwords, with an
+// optional count after a colon, as in the lists of Have I Been Pwned.
+func (p *PasswordPolicy) LoadBreached(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	p.breached = map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		hash := strings.SplitN(line, ":", 2)[0]
+		if len(hash) == 40 && isHex(hash) {
+			p.breached[strings.ToUpper(hash)] = true
+			continue
+		}
+
+		p.breached[sha1Hex(line)] = true
+	}
+
+	return scanner.Err()
+}
+
+func isHex(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// passwordClasses counts the kinds of characters of a password.
+func passwordClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	return lower + upper + digit + symbol
+}
+
+// Check checks a new password of a user against the policy, and against
+// its current and previous passwords.
+func (p *PasswordPolicy) Check(u *User, password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return ErrPasswordTooShort
+	}
+
+	if passwordClasses(password) < p.MinClasses {
+		return ErrPasswordTooSimple
+	}
+
+	if p.breached[sha1Hex(password)] {
+		return ErrPasswordBreached
+	}
+
+	if p.History > 0 {
+		if u.Password != "" && CheckPasswordHash(password, u.Password) {
+			return ErrPasswordReused
+		}
+
+		for _, hash := range u.PasswordHistory {
+			if CheckPasswordHash(password, hash) {
+				return ErrPasswordReused
+			}
+		}
+	}
+
+	return nil
+}
+
+// SetPassword checks a new password of a user against the policy and
+// sets its hash, keeping the previous one in the history. The user must
+// then be saved.
+func (m *FileManager) SetPassword(u *User, password string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
+
+	if m.PasswordPolicy != nil {
+		if err := m.PasswordPolicy.Check(u, password); err != nil {
+			return err
+		}
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	if m.PasswordPolicy != nil && m.PasswordPolicy.History > 0 && u.Password != "" {
+		u.PasswordHistory = append([]string{u.Password}, u.PasswordHistory...)
+		if len(u.PasswordHistory) > m.PasswordPolicy.History-1 {
+			u.PasswordHistory = u.PasswordHistory[:m.PasswordPolicy.History-1]
+		}
+	}
+
+	u.Password = hash
+	u.MustChangePassword = false
+	return nil
+}
+
+// IsPasswordPolicyError tells if an error of SetPassword comes from the
+// password itself.
+func IsPasswordPolicyError(err error) bool {
+	switch err {
+	case ErrEmptyPassword, ErrPasswordTooShort, ErrPasswordTooSimple,
+		ErrPasswordBreached, ErrPasswordReused:
+		return true
+	}
+
+	return false
+}
@@ -0,0 +1,89 @@
+package filemanager
+
+import (
+	"os"
+	"strings"
+)
+
+// validUsername checks a username given by an identity provider can be
+// put in a scope.
+func validUsername(username string) bool {
+	return username != "" && username != "." && username != ".." &&
+		!strings.ContainsAny(username, `/\`)
+}
+
+// provisionUser creates a user from the DefaultUser, for a user who is
+// known by an identity provider. The scope template may contain
+// {username}.
+func (m *FileManager) provisionUser(username, source, scopeTemplate string, apply func(*User)) (*User, error) {
+	if !validUsername(username) {
+		return nil, ErrInvalidUsername
+	}
+
+	u := *m.DefaultUser
+	u.ID = 0
+	u.Username = username
+	u.Password = ""
+	u.Admin = false
+	u.Source = source
+	u.Rules = append([]*Rule{}, m.DefaultUser.Rules...)
+	u.Commands = append([]string{}, m.DefaultUser.Commands...)
+	u.PublicKeys = nil
+	u.UsedBytes, u.UsedFiles = 0, 0
+	u.TwoFactor = TwoFactor{}
+
+	if scopeTemplate != "" {
+		u.Scope = strings.Replace(scopeTemplate, "{username}", username, -1)
+	}
+
+	u.FileSystem = m.NewFS(u.Scope)
+
+	// Only the directories of the local disk are created.
+	if local, ok := u.FileSystem.(LocalFileSystem); ok {
+		if err := os.MkdirAll(local.Root(), 0775); err != nil {
+			return nil, err
+		}
+	}
+
+	apply(&u)
+
+	if err := m.SaveUser(&u); err != nil {
+		return nil, err
+	}
+
+	return &u, nil
+}
+
+// syncUser updates a user with what an identity provider knows about it,
+// if anything changed.
+func (m *FileManager) syncUser(u *User, apply func(*User)) (*User, error) {
+	updated := *u
+	apply(&updated)
+
+	if !accessChanged(u, &updated) {
+		return u, nil
+	}
+
+	if err := m.UpdateUser(u, &updated); err != nil {
+		return nil, err
+	}
+
+	return &updated, nil
+}
+
+// setGroups sets the groups of a user and, unless there are no admin
+// groups, whether it is an admin.
+func setGroups(u *User, groups, adminGroups []string) {
+	u.Groups = groups
+
+	if len(adminGroups) == 0 {
+		return
+	}
+
+	u.Admin = false
+	for _, g := range groups {
+		for _, admin := range adminGroups {
+			u.Admin = u.Admin || g == admin
+		}
+	}
+}
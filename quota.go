@@ -0,0 +1,192 @@
+package filemanager
+
+import (
+	"log"
+	"path"
+	"sync"
+)
+
+// usageMu serializes the updates of the usage of the users, which are
+// read again from the store each time.
+var usageMu sync.Mutex
+
+// Usage returns the size and the number of files of a file, or of a
+// directory and all its contents.
+func Usage(fs FileSystem, name string) (int64, int64, error) {
+	info, err := fs.Stat(name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if !info.IsDir() {
+		return info.Size(), 1, nil
+	}
+
+	infos, err := fs.ReadDir(name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var bytes, files int64
+	for _, info := range infos {
+		if !info.IsDir() {
+			bytes += info.Size()
+			files++
+			continue
+		}
+
+		b, f, err := Usage(fs, path.Join(name, info.Name()))
+		if err != nil {
+			return 0, 0, err
+		}
+
+		bytes += b
+		files += f
+	}
+
+	return bytes, files, nil
+}
+
+// CheckQuota returns ErrQuotaExceeded if storing bytes and files more
+// would exceed the quota of the user.
+func (m FileManager) CheckQuota(u *User, bytes, files int64) error {
+	if u.QuotaBytes <= 0 && u.QuotaFiles <= 0 {
+		return nil
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	current, err := m.Store.Users.Get(u.ID, m.NewFS)
+	if err == ErrNotExist {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if bytes > 0 && u.QuotaBytes > 0 && current.UsedBytes+bytes > u.QuotaBytes {
+		return ErrQuotaExceeded
+	}
+
+	if files > 0 && u.QuotaFiles > 0 && current.UsedFiles+files > u.QuotaFiles {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// AddUsage adds bytes and files to the usage of the user. They are
+// negative when files are removed.
+func (m FileManager) AddUsage(u *User, bytes, files int64) error {
+	if bytes == 0 && files == 0 {
+		return nil
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	// The default user of the instances without authentication isn't
+	// stored.
+	current, err := m.Store.Users.Get(u.ID, m.NewFS)
+	if err == ErrNotExist {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	current.UsedBytes += bytes
+	current.UsedFiles += files
+
+	// Usages computed before the quotas existed may be too low.
+	if current.UsedBytes < 0 {
+		current.UsedBytes = 0
+	}
+
+	if current.UsedFiles < 0 {
+		current.UsedFiles = 0
+	}
+
+	if err := m.Store.Users.Update(current, "UsedBytes", "UsedFiles"); err != nil {
+		return err
+	}
+
+	u.UsedBytes, u.UsedFiles = current.UsedBytes, current.UsedFiles
+	return nil
+}
+
+// RecomputeUsage computes the usage of the user by walking its scope.
+func (m FileManager) RecomputeUsage(u *User) error {
+	bytes, files, err := Usage(u.FileSystem, "/")
+	if err != nil {
+		return err
+	}
+
+	usageMu.Lock()
+	defer usageMu.Unlock()
+
+	u.UsedBytes, u.UsedFiles = bytes, files
+	return m.Store.Users.Update(u, "UsedBytes", "UsedFiles")
+}
+
+// CheckWrite checks the quota of the user before a file is written with
+// size bytes, replacing the file if it exists. The returned function
+// accounts for the file once it is written, with its final size.
+func (m FileManager) CheckWrite(u *User, name string, size int64) (func(written int64), error) {
+	var old, files int64 = 0, 1
+	if info, err := u.FileSystem.Stat(name); err == nil && !info.IsDir() {
+		old, files = info.Size(), 0
+	}
+
+	if err := m.CheckQuota(u, size-old, files); err != nil {
+		return nil, err
+	}
+
+	return func(written int64) {
+		if err := m.AddUsage(u, written-old, files); err != nil {
+			log.Print(err)
+		}
+	}, nil
+}
+
+// CheckCopy checks the quota of the user before a file or a directory is
+// copied. The returned function accounts for the copy once it is done.
+func (m FileManager) CheckCopy(u *User, src, dst string) (func(), error) {
+	bytes, files, err := Usage(u.FileSystem, src)
+	if err != nil {
+		return nil, err
+	}
+
+	// The files replaced at the destination are freed.
+	if b, f, err := Usage(u.FileSystem, dst); err == nil {
+		bytes, files = bytes-b, files-f
+	}
+
+	if err := m.CheckQuota(u, bytes, files); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := m.AddUsage(u, bytes, files); err != nil {
+			log.Print(err)
+		}
+	}, nil
+}
+
+// TrackRemove measures a file or a directory before it is removed. The
+// returned function frees its usage once it is removed.
+func (m FileManager) TrackRemove(u *User, name string) func() {
+	bytes, files, err := Usage(u.FileSystem, name)
+	if err != nil {
+		return func() {}
+	}
+
+	return func() {
+		if err := m.AddUsage(u, -bytes, -files); err != nil {
+			log.Print(err)
+		}
+	}
+}
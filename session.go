@@ -0,0 +1,168 @@
+package filemanager
+
+import (
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+)
+
+// keyMu guards the key the JWTs are signed with, which can be rotated
+// while requests are served.
+var keyMu sync.RWMutex
+
+// Session is a login of a user, which is tracked so it can be listed and
+// revoked. Its ID is the ID of the JWT it was issued with.
+type Session struct {
+	ID        string    `json:"id" storm:"id"`
+	UserID    int       `json:"userID" storm:"index"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	Address   string    `json:"address"`
+	UserAgent string    `json:"userAgent"`
+}
+
+// NewSession creates a new session for a user, valid for a duration.
+func NewSession(userID int, d time.Duration) (*Session, error) {
+	id, err := GenerateRandomBytes(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return &Session{
+		ID:      hex.EncodeToString(id),
+		UserID:  userID,
+		Created: now,
+		Expires: now.Add(d),
+	}, nil
+}
+
+// SigningKey returns the key the JWTs are signed with.
+func (m *FileManager) SigningKey() []byte {
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+
+	return m.Key
+}
+
+// RotateKey replaces the key the JWTs are signed with. Every token issued
+// before is invalid, so all the sessions are removed.
+func (m *FileManager) RotateKey() error {
+	key, err := GenerateRandomBytes(64)
+	if err != nil {
+		return err
+	}
+
+	keyMu.Lock()
+	defer keyMu.Unlock()
+
+	if err := m.Store.Config.Save("key", key); err != nil {
+		return err
+	}
+
+	m.Key = key
+
+	if m.Store.Sessions == nil {
+		return nil
+	}
+
+	sessions, err := m.Store.Sessions.Gets()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sessions {
+		if err := m.Store.Sessions.Delete(s.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RevokeSessions removes all the sessions of a user.
+func (m FileManager) RevokeSessions(userID int) error {
+	if m.Store.Sessions == nil {
+		return nil
+	}
+
+	sessions, err := m.Store.Sessions.GetByUser(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sessions {
+		if err := m.Store.Sessions.Delete(s.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SessionCleaner removes the expired sessions.
+func (m FileManager) SessionCleaner() {
+	sessions, err := m.Store.Sessions.Gets()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, s := range sessions {
+		if s.Expires.Before(time.Now()) {
+			if err := m.Store.Sessions.Delete(s.ID); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
+
+// accessChanged checks if the password or the permissions of a user
+// changed, which revokes the tokens issued before.
+func accessChanged(old, newU *User) bool {
+	return old.Password != newU.Password ||
+		old.Admin != newU.Admin ||
+		old.Scope != newU.Scope ||
+		old.AllowNew != newU.AllowNew ||
+		old.AllowEdit != newU.AllowEdit ||
+		old.AllowCommands != newU.AllowCommands ||
+		old.AllowPublish != newU.AllowPublish ||
+		old.ServiceAccount != newU.ServiceAccount ||
+		old.Disabled != newU.Disabled ||
+		!sameStrings(old.Commands, newU.Commands) ||
+		!sameStrings(old.Groups, newU.Groups) ||
+		!sameRules(old.Rules, newU.Rules)
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sameRules(a, b []*Rule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Regex != b[i].Regex || a[i].Allow != b[i].Allow || a[i].Path != b[i].Path {
+			return false
+		}
+
+		if a[i].Regex && a[i].Regexp.Raw != b[i].Regexp.Raw {
+			return false
+		}
+	}
+
+	return true
+}
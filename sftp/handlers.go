@@ -0,0 +1,428 @@
+package sftp
+
+import (
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/pkg/sftp"
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// handler runs the SFTP requests of a user on its file system. Every
+// operation runs with the user's attributes and fires the same commands
+// as the API.
+type handler struct {
+	m    *fm.FileManager
+	user *fm.User
+}
+
+// as runs fn on a thread holding the user's attributes.
+func (h *handler) as(fn func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	release, err := h.m.AcquireAttrs(h.user)
+	if err != nil {
+		log.Printf("error acquiring the attributes of %s: %s\n", h.user.Username, err)
+		return sftp.ErrSSHFxFailure
+	}
+	defer release()
+
+	return fn()
+}
+
+// hookError returns the error of a before_* hook to the client. The
+// rejections are denied permissions, as SFTP has no room for their
+// message.
+func hookError(err error) error {
+	log.Print(err)
+	if _, ok := err.(*fm.HookRejection); ok {
+		return os.ErrPermission
+	}
+
+	return sftp.ErrSSHFxFailure
+}
+
+func (h *handler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	var f fm.Handle
+
+	err := h.as(func() error {
+		if !h.user.Allowed(r.Filepath) {
+			return os.ErrPermission
+		}
+
+		var err error
+		f, err = h.user.FileSystem.OpenFile(r.Filepath, os.O_RDONLY, 0)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return at(f), nil
+}
+
+func (h *handler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	var f io.WriterAt
+
+	err := h.as(func() error {
+		if !h.user.Allowed(r.Filepath) {
+			return os.ErrPermission
+		}
+
+		// Overwriting a file is a save, creating one an upload.
+		event, hookPath := "upload", r.Filepath
+		var old int64
+		if info, err := h.user.FileSystem.Stat(r.Filepath); err == nil {
+			if !h.user.AllowEdit {
+				return os.ErrPermission
+			}
+
+			event, hookPath = "save", filepath.Join(h.user.Scope, r.Filepath)
+			old = info.Size()
+		} else if !h.user.AllowNew {
+			return os.ErrPermission
+		}
+
+		// The size of the file isn't known before it is written, so it
+		// is checked as it grows, and accounted for once the client
+		// closes it.
+		account, err := h.m.CheckWrite(h.user, r.Filepath, 0)
+		if err != nil {
+			return err
+		}
+
+		if err := h.m.Runner("before_"+event, hookPath, "", h.user); err != nil {
+			return hookError(err)
+		}
+
+		flags := os.O_WRONLY
+		pflags := r.Pflags()
+		if pflags.Creat {
+			flags |= os.O_CREATE
+		}
+		if pflags.Trunc {
+			flags |= os.O_TRUNC
+		}
+		if pflags.Excl {
+			flags |= os.O_EXCL
+		}
+
+		file, err := h.user.FileSystem.OpenFile(r.Filepath, flags, 0776)
+		if err != nil {
+			return err
+		}
+
+		size := old
+		if pflags.Trunc {
+			size = 0
+		}
+
+		f = &writer{file: at(file), m: h.m, user: h.user, old: old, size: size, done: func() {
+			h.as(func() error {
+				if info, err := h.user.FileSystem.Stat(r.Filepath); err == nil {
+					account(info.Size())
+				}
+
+				if err := h.m.Reindex(filepath.Join(h.user.Scope, r.Filepath)); err != nil {
+					log.Print(err)
+				}
+
+				if err := h.m.Runner("after_"+event, hookPath, "", h.user); err != nil {
+					log.Print(err)
+				}
+				return nil
+			})
+		}}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// writer is a file being uploaded. The after commands run once the
+// client closes it.
+type writer struct {
+	file fileAt
+	done func()
+
+	// The quota is checked when the file grows past its size, which was
+	// old before it was opened.
+	m         *fm.FileManager
+	user      *fm.User
+	old, size int64
+	mu        sync.Mutex
+}
+
+// WriteAt writes to the file, unless it grows over the quota of the
+// user. The client sees ErrQuotaExceeded as a failure.
+func (w *writer) WriteAt(p []byte, off int64) (int, error) {
+	if err := w.grow(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+
+	return w.file.WriteAt(p, off)
+}
+
+func (w *writer) grow(end int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if end <= w.size {
+		return nil
+	}
+
+	if err := w.m.CheckQuota(w.user, end-w.old, 0); err != nil {
+		return err
+	}
+
+	w.size = end
+	return nil
+}
+
+func (w *writer) Close() error {
+	err := w.file.Close()
+	if err == nil {
+		w.done()
+	}
+
+	return err
+}
+
+// fileAt is a file which can be read and written at any offset.
+type fileAt interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+}
+
+// at returns a handle as a fileAt. The handles of the file systems
+// which don't support it seek before each read or write.
+func at(f fm.Handle) fileAt {
+	if f, ok := f.(fileAt); ok {
+		return f
+	}
+
+	return &seeker{Handle: f}
+}
+
+type seeker struct {
+	fm.Handle
+	mu sync.Mutex
+}
+
+func (s *seeker) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(s.Handle, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (s *seeker) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return s.Write(p)
+}
+
+func (h *handler) Filecmd(r *sftp.Request) error {
+	return h.as(func() error {
+		if !h.user.Allowed(r.Filepath) {
+			return os.ErrPermission
+		}
+
+		switch r.Method {
+		case "Setstat":
+			// Permissions and times are managed by File Manager,
+			// but clients set them after uploads, so they are
+			// silently ignored.
+			return nil
+		case "Mkdir":
+			if !h.user.AllowNew {
+				return os.ErrPermission
+			}
+
+			return h.mkdir(r.Filepath)
+		case "Rename", "PosixRename":
+			return h.rename(r.Filepath, r.Target)
+		case "Remove", "Rmdir":
+			return h.remove(r.Filepath, r.Method == "Rmdir")
+		}
+
+		// Links could point outside of the scope.
+		return sftp.ErrSSHFxOpUnsupported
+	})
+}
+
+func (h *handler) mkdir(name string) error {
+	if err := h.m.Runner("before_mkdir", name, "", h.user); err != nil {
+		return hookError(err)
+	}
+
+	if err := h.user.FileSystem.Mkdir(name, 0776); err != nil {
+		return err
+	}
+
+	if err := h.m.Runner("after_mkdir", name, "", h.user); err != nil {
+		log.Print(err)
+	}
+
+	return nil
+}
+
+func (h *handler) rename(src, dst string) error {
+	if src == "/" || dst == "/" || !h.user.AllowEdit || !h.user.Allowed(dst) {
+		return os.ErrPermission
+	}
+
+	if err := h.m.Runner("before_rename", src, dst, h.user); err != nil {
+		return hookError(err)
+	}
+
+	if err := h.user.FileSystem.Rename(src, dst); err != nil {
+		return err
+	}
+
+	if err := h.m.Unindex(filepath.Join(h.user.Scope, src)); err != nil {
+		log.Print(err)
+	}
+
+	if err := h.m.Reindex(filepath.Join(h.user.Scope, dst)); err != nil {
+		log.Print(err)
+	}
+
+	if err := h.m.Runner("after_rename", src, dst, h.user); err != nil {
+		log.Print(err)
+	}
+
+	return nil
+}
+
+func (h *handler) remove(name string, dir bool) error {
+	// Prevent the removal of the root directory.
+	if name == "/" || !h.user.AllowEdit {
+		return os.ErrPermission
+	}
+
+	info, err := h.user.FileSystem.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() != dir {
+		return sftp.ErrSSHFxFailure
+	}
+
+	// Unlike the API, SFTP only removes empty directories.
+	if dir {
+		files, err := h.user.FileSystem.ReadDir(name)
+		if err != nil {
+			return err
+		}
+
+		if len(files) > 0 {
+			return sftp.ErrSSHFxFailure
+		}
+	}
+
+	if err := h.m.Runner("before_delete", name, "", h.user); err != nil {
+		return hookError(err)
+	}
+
+	freed := h.m.TrackRemove(h.user, name)
+	if err := h.user.FileSystem.RemoveAll(name); err != nil {
+		return err
+	}
+	freed()
+
+	if err := h.m.Unindex(filepath.Join(h.user.Scope, name)); err != nil {
+		log.Print(err)
+	}
+
+	if err := h.m.Runner("after_delete", name, "", h.user); err != nil {
+		log.Print(err)
+	}
+
+	return nil
+}
+
+func (h *handler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	var list lister
+
+	err := h.as(func() error {
+		if !h.user.Allowed(r.Filepath) {
+			return os.ErrPermission
+		}
+
+		switch r.Method {
+		case "List":
+			files, err := h.user.FileSystem.ReadDir(r.Filepath)
+			if err != nil {
+				return err
+			}
+
+			for _, file := range files {
+				if h.user.Allowed(path.Join(r.Filepath, file.Name())) {
+					list = append(list, file)
+				}
+			}
+
+			return nil
+		case "Stat", "Lstat":
+			info, err := h.user.FileSystem.Stat(r.Filepath)
+			if err != nil {
+				return err
+			}
+
+			list = lister{info}
+			return nil
+		}
+
+		return sftp.ErrSSHFxOpUnsupported
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// lister is a list of files for the SFTP server.
+type lister []os.FileInfo
+
+func (l lister) ListAt(files []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(files, l[offset:])
+	if n < len(files) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
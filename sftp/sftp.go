@@ -0,0 +1,199 @@
+// Package sftp implements an SFTP server which gives the users of a
+// File Manager instance access to their scope.
+package sftp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/pkg/sftp"
+	fm "github.com/rjchee/dcac_filemanager"
+	"golang.org/x/crypto/ssh"
+)
+
+var errAuthFailed = errors.New("authentication failed")
+
+// Server is an SFTP server. Users log in with their password or with
+// one of their public keys and only see their own scope.
+type Server struct {
+	FileManager *fm.FileManager
+	config      *ssh.ServerConfig
+}
+
+// New creates a new SFTP server for a File Manager instance.
+func New(m *fm.FileManager, hostKey ssh.Signer) *Server {
+	s := &Server{FileManager: m}
+
+	s.config = &ssh.ServerConfig{
+		PasswordCallback:  s.checkPassword,
+		PublicKeyCallback: s.checkPublicKey,
+	}
+	s.config.AddHostKey(hostKey)
+
+	return s
+}
+
+// LoadHostKey reads the host key of the server from a file, generating
+// a new one if it doesn't exist yet.
+func LoadHostKey(path string) (ssh.Signer, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		data, err = generateHostKey(path)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(data)
+}
+
+func generateHostKey(path string) ([]byte, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return data, ioutil.WriteFile(path, data, 0600)
+}
+
+// Serve accepts the connections on a listener until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// permissions remembers the authenticated user on the connection.
+func permissions(u *fm.User) *ssh.Permissions {
+	return &ssh.Permissions{
+		Extensions: map[string]string{"user-id": strconv.Itoa(u.ID)},
+	}
+}
+
+// checkPassword checks the password of a user. The users with a second
+// factor must log in with a public key instead.
+func (s *Server) checkPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	u, err := s.FileManager.AuthenticateFrom(meta.User(), string(password), meta.RemoteAddr().String())
+	if err != nil || u.ServiceAccount || !s.FileManager.PasswordOnly(u) {
+		return nil, errAuthFailed
+	}
+
+	if err := s.FileManager.LoginSucceeded(meta.User()); err != nil {
+		log.Print(err)
+	}
+
+	return permissions(u), nil
+}
+
+func (s *Server) checkPublicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	u, err := s.FileManager.Store.Users.GetByUsername(meta.User(), s.FileManager.NewFS)
+	if err != nil || u.Disabled {
+		return nil, errAuthFailed
+	}
+
+	for _, k := range u.PublicKeys {
+		pk, err := fm.ParsePublicKey(k)
+		if err == nil && bytes.Equal(pk.Marshal(), key.Marshal()) {
+			return permissions(u), nil
+		}
+	}
+
+	return nil, errAuthFailed
+}
+
+func (s *Server) handleConn(nConn net.Conn) {
+	defer nConn.Close()
+
+	conn, chans, reqs, err := ssh.NewServerConn(nConn, s.config)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	go ssh.DiscardRequests(reqs)
+
+	id, _ := strconv.Atoi(conn.Permissions.Extensions["user-id"])
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+
+		go s.handleSession(id, channel, requests)
+	}
+}
+
+// handleSession serves the sftp subsystem on a session. Shells and
+// commands are refused.
+func (s *Server) handleSession(id int, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		// The payload of a subsystem request is its name, as an
+		// SSH string.
+		ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+		req.Reply(ok, nil)
+		if !ok {
+			continue
+		}
+
+		// The user is loaded again so changes to it, its removal or
+		// its deactivation, apply to new sessions.
+		u, err := s.FileManager.Store.Users.Get(id, s.FileManager.NewFS)
+		if err != nil {
+			fmt.Fprintln(channel.Stderr(), "user not found")
+			return
+		}
+
+		if u.Disabled {
+			fmt.Fprintln(channel.Stderr(), "user disabled")
+			return
+		}
+
+		go ssh.DiscardRequests(requests)
+
+		h := &handler{m: s.FileManager, user: u}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet:  h,
+			FilePut:  h,
+			FileCmd:  h,
+			FileList: h,
+		})
+
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Print(err)
+		}
+
+		server.Close()
+		return
+	}
+}
@@ -0,0 +1,226 @@
+package filemanager
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ShareCookie is the prefix of the cookies which remember that the
+// password of a share link was given.
+const ShareCookie = "share_"
+
+// ParseIPRanges parses a list of addresses and CIDR ranges, like
+// "10.0.0.0/8" or "192.168.1.10".
+func ParseIPRanges(ranges []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+
+	for _, r := range ranges {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		if !strings.Contains(r, "/") {
+			ip := net.ParseIP(r)
+			if ip == nil {
+				return nil, ErrInvalidOption
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(r)
+		if err != nil {
+			return nil, ErrInvalidOption
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
+
+// Allows tells if the link can be opened from a remote address. Every
+// address is allowed when there is no allowlist.
+func (s *ShareLink) Allows(addr string) bool {
+	if len(s.AllowedIPs) == 0 {
+		return true
+	}
+
+	nets, err := ParseIPRanges(s.AllowedIPs)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(loginIP(addr))
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPassword tells if the link is protected by a password.
+func (s *ShareLink) HasPassword() bool {
+	return s.PasswordHash != ""
+}
+
+// SetPassword protects the link with a password, or removes the
+// protection if it is empty.
+func (s *ShareLink) SetPassword(password string) error {
+	if password == "" {
+		s.PasswordHash = ""
+		return nil
+	}
+
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	s.PasswordHash = hash
+	return nil
+}
+
+// Unrestricted tells if the link is a plain one, which anyone can open
+// and download from as often as they want.
+func (s *ShareLink) Unrestricted() bool {
+	return !s.HasPassword() && s.MaxDownloads == 0 && len(s.AllowedIPs) == 0 &&
+		!s.ViewOnly && !s.Upload
+}
+
+// Exhausted tells if the link has no downloads left.
+func (s *ShareLink) Exhausted() bool {
+	return s.MaxDownloads > 0 && s.Downloads >= s.MaxDownloads
+}
+
+// ShareToken is the value of the cookie given once the password of a
+// link was typed. It changes with the password.
+func (m *FileManager) ShareToken(s *ShareLink) string {
+	mac := hmac.New(sha256.New, m.SigningKey())
+	mac.Write([]byte(s.Hash + ":" + s.PasswordHash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckShareToken checks the value of the cookie of a link.
+func (m *FileManager) CheckShareToken(s *ShareLink, token string) bool {
+	return hmac.Equal([]byte(m.ShareToken(s)), []byte(token))
+}
+
+// ShareOwner returns the user who created a link and the path of the
+// shared file in its scope. It returns ErrNotExist when the link is no
+// longer valid: its user was deleted, or the file left its scope. The
+// links created before their users were recorded aren't valid either.
+func (m *FileManager) ShareOwner(s *ShareLink) (*User, string, error) {
+	if s.UserID == 0 {
+		return nil, "", ErrNotExist
+	}
+
+	u, err := m.Store.Users.Get(s.UserID, m.NewFS)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The links point to files on the disk.
+	if !u.LocalScope() {
+		return nil, "", ErrNotExist
+	}
+
+	rel, err := filepath.Rel(filepath.Clean(u.Scope), filepath.Clean(s.Path))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, "", ErrNotExist
+	}
+
+	return u, path.Clean("/" + filepath.ToSlash(rel)), nil
+}
+
+// DeleteUserShares deletes the links created by a user.
+func (m *FileManager) DeleteUserShares(id int) error {
+	links, err := m.Store.Share.GetByUser(id)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range links {
+		if err := m.Store.Share.Delete(l.Hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckUserShares deletes the links of a user which left its scope.
+func (m *FileManager) CheckUserShares(u *User) error {
+	links, err := m.Store.Share.GetByUser(u.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range links {
+		if _, _, err := m.ShareOwner(l); err != ErrNotExist {
+			continue
+		}
+
+		log.Printf("share link %s of %s is no longer valid\n", l.Hash, u.Username)
+		if err := m.Store.Share.Delete(l.Hash); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Contains tells if a path of the user's scope is the shared file or is in
+// the shared directory, once the symbolic links are followed, so they
+// can't lead out of it.
+func (s *ShareLink) Contains(u *User, vpath string) bool {
+	root, err := filepath.EvalSymlinks(s.Path)
+	if err != nil {
+		return false
+	}
+
+	target, err := filepath.EvalSymlinks(filepath.Join(u.Scope, vpath))
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(root, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// UploadName returns the name an upload through a link is saved with. It
+// is prefixed with the time and a random string, so the uploads of the
+// visitors don't collide.
+func UploadName(name string) (string, error) {
+	name = strings.TrimSpace(path.Base(strings.Replace(name, "\\", "/", -1)))
+	if name == "" || name == "." || name == ".." || name == "/" {
+		return "", ErrInvalidOption
+	}
+
+	b, err := GenerateRandomBytes(3)
+	if err != nil {
+		return "", err
+	}
+
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(b) + "-" + name, nil
+}
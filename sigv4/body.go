@@ -0,0 +1,144 @@
+package sigv4
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// maxChunkSize limits the size of the chunks of a streaming payload,
+// which are kept in memory until their signature is checked.
+const maxChunkSize = 16 << 20
+
+var emptyHash = hex.EncodeToString(sha256.New().Sum(nil))
+
+// Body returns the body of a signed request. Reading it fails with
+// ErrContentHash at the end if the content doesn't match the signed
+// hash, and streaming payloads are decoded while their chunks are
+// verified, so the data must not be trusted until it is all read.
+func (s *Signature) Body(body io.ReadCloser) io.ReadCloser {
+	switch s.PayloadHash {
+	case UnsignedPayload:
+		return body
+	case StreamingPayload:
+		return &chunkedReader{
+			sig:      s,
+			body:     body,
+			r:        bufio.NewReader(body),
+			previous: s.signature,
+		}
+	}
+
+	return &hashedReader{
+		body:     body,
+		hash:     sha256.New(),
+		expected: strings.ToLower(s.PayloadHash),
+	}
+}
+
+// hashedReader checks the hash of the content at the end.
+type hashedReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (h *hashedReader) Read(p []byte) (int, error) {
+	n, err := h.body.Read(p)
+	h.hash.Write(p[:n])
+
+	if err == io.EOF && hex.EncodeToString(h.hash.Sum(nil)) != h.expected {
+		return n, ErrContentHash
+	}
+
+	return n, err
+}
+
+func (h *hashedReader) Close() error {
+	return h.body.Close()
+}
+
+// chunkedReader decodes a payload sent as signed chunks:
+//
+//	<hex size>;chunk-signature=<signature>\r\n<data>\r\n
+//
+// where each signature chains the previous one and the last chunk is
+// empty.
+type chunkedReader struct {
+	sig      *Signature
+	body     io.ReadCloser
+	r        *bufio.Reader
+	previous string
+	chunk    []byte
+	done     bool
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+
+		if err := c.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// next reads and verifies the next chunk.
+func (c *chunkedReader) next() error {
+	header, err := c.r.ReadString('\n')
+	if err != nil {
+		return ErrMalformedPayload
+	}
+
+	header = strings.TrimSuffix(header, "\r\n")
+	i := strings.Index(header, ";chunk-signature=")
+	if i == -1 {
+		return ErrMalformedPayload
+	}
+
+	size, err := strconv.ParseInt(header[:i], 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return ErrMalformedPayload
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(c.r, data); err != nil || !bytes.HasSuffix(data, []byte("\r\n")) {
+		return ErrMalformedPayload
+	}
+	data = data[:size]
+
+	hash := sha256.Sum256(data)
+	expected := c.sig.sign(strings.Join([]string{
+		Algorithm + "-PAYLOAD",
+		c.sig.Time.Format(timeFormat),
+		c.sig.scope(),
+		c.previous,
+		emptyHash,
+		hex.EncodeToString(hash[:]),
+	}, "\n"))
+
+	signature := header[i+len(";chunk-signature="):]
+	if expected != signature {
+		return ErrChunkSignature
+	}
+
+	c.previous = signature
+	c.chunk = data
+	c.done = size == 0
+	return nil
+}
+
+func (c *chunkedReader) Close() error {
+	return c.body.Close()
+}
@@ -0,0 +1,426 @@
+// Package sigv4 signs and verifies HTTP requests with AWS Signature
+// Version 4, as used by S3 and the other AWS compatible APIs.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Algorithm is the only signing algorithm supported.
+	Algorithm = "AWS4-HMAC-SHA256"
+
+	// UnsignedPayload is the payload hash of requests whose body is not
+	// signed.
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// StreamingPayload is the payload hash of requests whose body is
+	// sent in signed chunks.
+	StreamingPayload = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+
+	// MaxSkew is how far the time of a request may be from the time of
+	// the server.
+	MaxSkew = 15 * time.Minute
+
+	// MaxExpires is the longest validity of a presigned request.
+	MaxExpires = 7 * 24 * time.Hour
+
+	timeFormat = "20060102T150405Z"
+	dateFormat = "20060102"
+)
+
+var (
+	ErrMissingAuth      = errors.New("sigv4: the request is not signed")
+	ErrMalformed        = errors.New("sigv4: malformed authorization")
+	ErrUnknownKey       = errors.New("sigv4: unknown access key")
+	ErrSignature        = errors.New("sigv4: the signature does not match")
+	ErrUnsignedHeader   = errors.New("sigv4: a header of the request is not signed")
+	ErrExpired          = errors.New("sigv4: the request expired")
+	ErrContentHash      = errors.New("sigv4: the content hash does not match")
+	ErrChunkSignature   = errors.New("sigv4: the chunk signature does not match")
+	ErrMalformedPayload = errors.New("sigv4: malformed chunked payload")
+)
+
+// SecretFunc returns the secret of an access key. It returns an error
+// when the key doesn't exist.
+type SecretFunc func(accessKey string) (string, error)
+
+// Credential identifies the key and the scope of a signature.
+type Credential struct {
+	AccessKey string
+	Date      string
+	Region    string
+	Service   string
+}
+
+func (c Credential) scope() string {
+	return c.Date + "/" + c.Region + "/" + c.Service + "/aws4_request"
+}
+
+// Signature is a verified request signature.
+type Signature struct {
+	Credential
+	Time time.Time
+	// PayloadHash is the hash of the body, UnsignedPayload or
+	// StreamingPayload.
+	PayloadHash string
+
+	signature string
+	key       []byte
+}
+
+// Verify checks the signature of a request, either in the Authorization
+// header or in the query of a presigned URL. The canonical URI is the
+// path as the client sent it.
+func Verify(r *http.Request, secret SecretFunc, now time.Time) (*Signature, error) {
+	var (
+		sig           *Signature
+		signedHeaders []string
+		err           error
+		presigned     bool
+		query         = r.URL.Query()
+	)
+
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		sig, signedHeaders, err = parseHeader(r, auth)
+	} else if query.Get("X-Amz-Algorithm") != "" {
+		presigned = true
+		sig, signedHeaders, err = parseQuery(query, now)
+		query.Del("X-Amz-Signature")
+	} else {
+		return nil, ErrMissingAuth
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if sig.Time.Format(dateFormat) != sig.Date {
+		return nil, ErrMalformed
+	}
+
+	// Like S3, the x-amz-* headers must all be signed, so none can be
+	// added to a signed request.
+	for name := range r.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") && !contains(signedHeaders, name) {
+			return nil, ErrUnsignedHeader
+		}
+	}
+
+	// Presigned requests are checked against their expiration.
+	if !presigned {
+		if d := now.Sub(sig.Time); d > MaxSkew || d < -MaxSkew {
+			return nil, ErrExpired
+		}
+	}
+
+	key, err := secret(sig.AccessKey)
+	if err != nil {
+		return nil, ErrUnknownKey
+	}
+
+	sig.key = signingKey(key, sig.Credential)
+
+	canonical := canonicalRequest(r, query, signedHeaders, sig.PayloadHash)
+	expected := sig.sign(stringToSign(sig.Time, sig.Credential, canonical))
+	if !hmac.Equal([]byte(expected), []byte(sig.signature)) {
+		return nil, ErrSignature
+	}
+
+	return sig, nil
+}
+
+// parseHeader parses an Authorization header like:
+//
+//	AWS4-HMAC-SHA256 Credential=KEY/20060102/region/s3/aws4_request,
+//	SignedHeaders=host;x-amz-date, Signature=abcdef...
+func parseHeader(r *http.Request, auth string) (*Signature, []string, error) {
+	if !strings.HasPrefix(auth, Algorithm+" ") {
+		return nil, nil, ErrMalformed
+	}
+
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimPrefix(auth, Algorithm+" "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, nil, ErrMalformed
+		}
+		fields[kv[0]] = kv[1]
+	}
+
+	cred, err := parseCredential(fields["Credential"])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t, err := requestTime(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		return nil, nil, ErrMalformed
+	}
+
+	signedHeaders := strings.Split(fields["SignedHeaders"], ";")
+	if fields["Signature"] == "" || !contains(signedHeaders, "host") {
+		return nil, nil, ErrMalformed
+	}
+
+	return &Signature{
+		Credential:  cred,
+		Time:        t,
+		PayloadHash: payload,
+		signature:   fields["Signature"],
+	}, signedHeaders, nil
+}
+
+// parseQuery parses the signature of a presigned URL.
+func parseQuery(query url.Values, now time.Time) (*Signature, []string, error) {
+	if query.Get("X-Amz-Algorithm") != Algorithm {
+		return nil, nil, ErrMalformed
+	}
+
+	cred, err := parseCredential(query.Get("X-Amz-Credential"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	t, err := time.Parse(timeFormat, query.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, nil, ErrMalformed
+	}
+
+	expires, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > MaxExpires {
+		return nil, nil, ErrMalformed
+	}
+
+	if now.Before(t.Add(-MaxSkew)) || now.After(t.Add(time.Duration(expires)*time.Second)) {
+		return nil, nil, ErrExpired
+	}
+
+	signedHeaders := strings.Split(query.Get("X-Amz-SignedHeaders"), ";")
+	if query.Get("X-Amz-Signature") == "" || !contains(signedHeaders, "host") {
+		return nil, nil, ErrMalformed
+	}
+
+	payload := query.Get("X-Amz-Content-Sha256")
+	if payload == "" {
+		payload = UnsignedPayload
+	}
+
+	return &Signature{
+		Credential:  cred,
+		Time:        t,
+		PayloadHash: payload,
+		signature:   query.Get("X-Amz-Signature"),
+	}, signedHeaders, nil
+}
+
+func parseCredential(value string) (Credential, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" || parts[0] == "" {
+		return Credential{}, ErrMalformed
+	}
+
+	return Credential{
+		AccessKey: parts[0],
+		Date:      parts[1],
+		Region:    parts[2],
+		Service:   parts[3],
+	}, nil
+}
+
+func requestTime(r *http.Request) (time.Time, error) {
+	if v := r.Header.Get("X-Amz-Date"); v != "" {
+		t, err := time.Parse(timeFormat, v)
+		if err != nil {
+			return time.Time{}, ErrMalformed
+		}
+		return t, nil
+	}
+
+	t, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return time.Time{}, ErrMalformed
+	}
+
+	return t.UTC(), nil
+}
+
+// Sign signs a request with the Authorization header. The body must be
+// described by payloadHash, which may be UnsignedPayload.
+func Sign(r *http.Request, accessKey, secret, region, service, payloadHash string, t time.Time) {
+	t = t.UTC()
+	cred := Credential{
+		AccessKey: accessKey,
+		Date:      t.Format(dateFormat),
+		Region:    region,
+		Service:   service,
+	}
+
+	r.Header.Set("X-Amz-Date", t.Format(timeFormat))
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	r.URL.RawPath = escapePath(r.URL.Path)
+
+	signedHeaders := []string{"host"}
+	for name := range r.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") || name == "content-type" || name == "content-md5" {
+			signedHeaders = append(signedHeaders, name)
+		}
+	}
+	sort.Strings(signedHeaders)
+
+	sig := &Signature{key: signingKey(secret, cred)}
+	canonical := canonicalRequest(r, r.URL.Query(), signedHeaders, payloadHash)
+	signature := sig.sign(stringToSign(t, cred, canonical))
+
+	r.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		Algorithm, accessKey, cred.scope(), strings.Join(signedHeaders, ";"), signature))
+}
+
+func canonicalRequest(r *http.Request, query url.Values, signedHeaders []string, payloadHash string) string {
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		headers.WriteString(name)
+		headers.WriteByte(':')
+		headers.WriteString(headerValue(r, name))
+		headers.WriteByte('\n')
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		canonicalURI(r),
+		canonicalQuery(query),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// canonicalURI returns the path as it was sent, which is already
+// encoded by the client.
+func canonicalURI(r *http.Request) string {
+	uri := r.RequestURI
+	if uri == "" {
+		return r.URL.EscapedPath()
+	}
+
+	if i := strings.IndexByte(uri, '?'); i != -1 {
+		uri = uri[:i]
+	}
+
+	// Requests to proxies have an absolute URI.
+	if !strings.HasPrefix(uri, "/") {
+		if u, err := url.Parse(uri); err == nil {
+			return u.EscapedPath()
+		}
+	}
+
+	if uri == "" {
+		return "/"
+	}
+
+	return uri
+}
+
+func canonicalQuery(query url.Values) string {
+	var params []string
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, escape(key)+"="+escape(value))
+		}
+	}
+
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+func headerValue(r *http.Request, name string) string {
+	switch name {
+	case "host":
+		return r.Host
+	case "content-length":
+		if r.Header.Get("Content-Length") == "" && r.ContentLength >= 0 {
+			return strconv.FormatInt(r.ContentLength, 10)
+		}
+	}
+
+	var values []string
+	for _, v := range r.Header[http.CanonicalHeaderKey(name)] {
+		values = append(values, strings.Join(strings.Fields(v), " "))
+	}
+
+	return strings.Join(values, ",")
+}
+
+func stringToSign(t time.Time, cred Credential, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	return strings.Join([]string{
+		Algorithm,
+		t.Format(timeFormat),
+		cred.scope(),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+}
+
+func signingKey(secret string, cred Credential) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), cred.Date)
+	key = hmacSHA256(key, cred.Region)
+	key = hmacSHA256(key, cred.Service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func (s *Signature) sign(data string) string {
+	return hex.EncodeToString(hmacSHA256(s.key, data))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// escape encodes a string like AWS does: every byte but the unreserved
+// characters is percent encoded.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,238 @@
+package filemanager
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// throttleMu serializes the updates of the login attempts.
+var throttleMu sync.Mutex
+
+// Throttle slows down the guessing of the passwords. After a few
+// failures, each login of a username or from an address must wait for a
+// delay which doubles with each new failure, until the username or the
+// address is locked out.
+type Throttle struct {
+	// FreeAttempts is the number of failures before the delays start.
+	FreeAttempts int
+
+	// BaseDelay is the first delay, which doubles up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// LockoutAttempts is the number of failures which lock a username out
+	// for LockoutDuration, which is also how long the failures are
+	// remembered.
+	LockoutAttempts int
+	LockoutDuration time.Duration
+
+	// IPFactor multiplies the number of failures allowed from an address,
+	// which may be shared by many users.
+	IPFactor int
+}
+
+// DefaultThrottle is the Throttle used when the FileManager has none.
+var DefaultThrottle = Throttle{
+	FreeAttempts:    3,
+	BaseDelay:       time.Second,
+	MaxDelay:        5 * time.Minute,
+	LockoutAttempts: 10,
+	LockoutDuration: 15 * time.Minute,
+	IPFactor:        5,
+}
+
+// LoginAttempts are the recent failed logins of a username or from an
+// address.
+type LoginAttempts struct {
+	// Key is "user:<username>" or "ip:<address>".
+	Key         string    `json:"key" storm:"id"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+
+	// LockedUntil is when the next login may be tried. Locked tells if it
+	// is a lockout rather than a delay.
+	LockedUntil time.Time `json:"lockedUntil"`
+	Locked      bool      `json:"locked"`
+}
+
+// ThrottledError is returned when a login is tried too soon after the
+// last failures.
+type ThrottledError struct {
+	Until time.Time
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("too many failed logins, retry after %s", e.Until.Format(time.RFC3339))
+}
+
+// LoginUserKey is the key of the login attempts of a username.
+func LoginUserKey(username string) string {
+	return "user:" + username
+}
+
+// LoginIPKey is the key of the login attempts from a remote address.
+func LoginIPKey(addr string) string {
+	return "ip:" + loginIP(addr)
+}
+
+// loginIP strips the port from a remote address.
+func loginIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return addr
+}
+
+func (m *FileManager) throttle() Throttle {
+	if m.Throttle != nil {
+		return *m.Throttle
+	}
+
+	return DefaultThrottle
+}
+
+// loginKeys returns the keys of the attempts of a login, and how many
+// failures each of them allows before a lockout.
+func (m *FileManager) loginKeys(username, addr string) map[string]int {
+	t := m.throttle()
+	keys := map[string]int{LoginUserKey(username): 1}
+	if addr != "" {
+		keys[LoginIPKey(addr)] = t.IPFactor
+	}
+
+	return keys
+}
+
+// CheckLogin returns a *ThrottledError if the username or the address
+// must still wait before logging in.
+func (m *FileManager) CheckLogin(username, addr string) error {
+	if m.Store.LoginAttempts == nil {
+		return nil
+	}
+
+	for key := range m.loginKeys(username, addr) {
+		a, err := m.Store.LoginAttempts.Get(key)
+		if err == ErrNotExist {
+			continue
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if a.LockedUntil.After(time.Now()) {
+			return &ThrottledError{Until: a.LockedUntil}
+		}
+	}
+
+	return nil
+}
+
+// LoginFailed counts a failed login of the username from the address.
+func (m *FileManager) LoginFailed(username, addr string) error {
+	if m.Store.LoginAttempts == nil {
+		return nil
+	}
+
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+
+	t := m.throttle()
+	now := time.Now()
+
+	for key, factor := range m.loginKeys(username, addr) {
+		a, err := m.Store.LoginAttempts.Get(key)
+		if err == ErrNotExist || (err == nil && now.Sub(a.LastFailure) > t.LockoutDuration) {
+			a, err = &LoginAttempts{Key: key}, nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		a.Failures++
+		a.LastFailure = now
+
+		free := t.FreeAttempts * factor
+		if a.Failures >= t.LockoutAttempts*factor {
+			a.LockedUntil = now.Add(t.LockoutDuration)
+			a.Locked = true
+			log.Printf("login of %s locked out until %s\n", key, a.LockedUntil.Format(time.RFC3339))
+		} else if a.Failures > free {
+			delay := float64(t.BaseDelay) * math.Pow(2, float64(a.Failures-free-1))
+			a.LockedUntil = now.Add(time.Duration(math.Min(delay, float64(t.MaxDelay))))
+		}
+
+		if err := m.Store.LoginAttempts.Save(a); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// LoginSucceeded forgets the failures of a username. The ones of the
+// address are kept, so an attacker can't clear them with its own
+// account.
+func (m *FileManager) LoginSucceeded(username string) error {
+	return m.Unlock(LoginUserKey(username))
+}
+
+// Unlock forgets the failures of a username or of an address.
+func (m *FileManager) Unlock(key string) error {
+	if m.Store.LoginAttempts == nil {
+		return nil
+	}
+
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+
+	err := m.Store.LoginAttempts.Delete(key)
+	if err == ErrNotExist {
+		return nil
+	}
+
+	return err
+}
+
+// AuthenticateFrom authenticates a user like Authenticate, unless the
+// username or the address must wait, and counts the failures. The caller
+// calls LoginSucceeded once the user is fully authenticated, after its
+// second factor.
+func (m *FileManager) AuthenticateFrom(username, password, addr string) (*User, error) {
+	if err := m.CheckLogin(username, addr); err != nil {
+		return nil, err
+	}
+
+	u, err := m.Authenticate(username, password)
+	if err == ErrInvalidCredentials {
+		if err := m.LoginFailed(username, addr); err != nil {
+			log.Print(err)
+		}
+	}
+
+	return u, err
+}
+
+// LoginAttemptsCleaner removes the failures which are forgotten.
+func (m FileManager) LoginAttemptsCleaner() {
+	attempts, err := m.Store.LoginAttempts.Gets()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	t := m.throttle()
+	for _, a := range attempts {
+		if time.Since(a.LastFailure) > t.LockoutDuration && a.LockedUntil.Before(time.Now()) {
+			if err := m.Unlock(a.Key); err != nil {
+				log.Print(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package filemanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	// Register the decoders for the image formats we can thumbnail.
+	_ "image/gif"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"github.com/rjchee/dcac_filemanager/dcac"
+)
+
+// ThumbnailSizes maps the size names accepted by the thumbnail API to
+// the maximum width and height, in pixels, of the generated image.
+var ThumbnailSizes = map[string]int{
+	"small":  256,
+	"medium": 512,
+	"large":  1080,
+}
+
+// Thumbnail formats.
+const (
+	ThumbnailJPEG = "jpeg"
+	ThumbnailWebP = "webp"
+)
+
+// thumbnailMaxAge is how long a cached thumbnail may go unused before
+// ThumbnailCleaner removes it.
+const thumbnailMaxAge = 30 * 24 * time.Hour
+
+var (
+	ErrNoThumbnail = errors.New("thumbnails are not supported for this file type")
+)
+
+// ThumbnailDir is the directory where the thumbnail cache is kept.
+func (m FileManager) ThumbnailDir() string {
+	return filepath.Join(m.DCACDir, "thumbnails")
+}
+
+// Thumbnail returns the path of a cached thumbnail of the file i, creating
+// it if needed. The cache is content addressed by the file path, its
+// modification time and the requested size and format, so a thumbnail is
+// regenerated as soon as its source changes. WebP thumbnails need ffmpeg
+// and fall back to JPEG without it. The type of i must have been obtained
+// with GetFileType beforehand.
+func (m FileManager) Thumbnail(i *File, size, format string) (string, error) {
+	dimension, ok := ThumbnailSizes[size]
+	if !ok {
+		return "", ErrInvalidOption
+	}
+
+	if format != ThumbnailJPEG && format != ThumbnailWebP {
+		return "", ErrInvalidOption
+	}
+
+	ffmpeg, ffmpegErr := exec.LookPath("ffmpeg")
+	if format == ThumbnailWebP && ffmpegErr != nil {
+		format = ThumbnailJPEG
+	}
+
+	if i.Type != "image" && (i.Type != "video" || ffmpegErr != nil) {
+		return "", ErrNoThumbnail
+	}
+
+	// The converters need the file on the local disk.
+	if _, ok := i.fs.(LocalFileSystem); i.fs != nil && !ok {
+		return "", ErrNoThumbnail
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s", i.Path, i.ModTime.UnixNano(), dimension, format)
+	key := hex.EncodeToString(h.Sum(nil))
+
+	dir := filepath.Join(m.ThumbnailDir(), key[:2])
+	path := filepath.Join(dir, key+"."+format)
+
+	// Cache hit. Touch the thumbnail so the cleaner knows it is in use.
+	if _, err := os.Stat(path); err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return path, nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first so concurrent requests never
+	// see a half written thumbnail.
+	tmp, err := ioutil.TempFile(dir, key)
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if i.Type == "image" && format == ThumbnailJPEG {
+		err = resizeImage(i.Path, tmp.Name(), dimension)
+	} else {
+		err = ffmpegThumbnail(ffmpeg, i, tmp.Name(), dimension, format)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	// The thumbnail must not be readable by anyone who can't read
+	// the original file.
+	if acls, err := dcac.GetFileACLs(i.Path); err == nil {
+		if err := dcac.SetFileRdACL(tmp.Name(), acls.Read); err != nil {
+			log.Printf("error setting read ACL for thumbnail of %s: %s\n", i.Path, err)
+		}
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+// resizeImage scales the image at src so that it fits in a dimension by
+// dimension square and saves it as a JPEG at dst. Images that are already
+// small enough are not upscaled.
+func resizeImage(src, dst string, dimension int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	img, _, err := image.Decode(in)
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > dimension || height > dimension {
+		if width > height {
+			width, height = dimension, height*dimension/width
+		} else {
+			width, height = width*dimension/height, dimension
+		}
+	}
+
+	if width < 1 {
+		width = 1
+	}
+
+	if height < 1 {
+		height = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, bounds, draw.Src, nil)
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return jpeg.Encode(out, thumb, &jpeg.Options{Quality: 85})
+}
+
+// ffmpegThumbnail uses ffmpeg to extract the poster frame of a video, or
+// to scale an image when a format other than JPEG was requested.
+func ffmpegThumbnail(ffmpeg string, i *File, dst string, dimension int, format string) error {
+	d := strconv.Itoa(dimension)
+
+	run := func(seek string) error {
+		args := []string{"-loglevel", "error", "-y"}
+		if seek != "" {
+			args = append(args, "-ss", seek)
+		}
+
+		args = append(args,
+			"-i", i.Path,
+			"-frames:v", "1",
+			"-vf", "scale='min("+d+",iw)':'min("+d+",ih)':force_original_aspect_ratio=decrease",
+		)
+
+		if format == ThumbnailWebP {
+			args = append(args, "-f", "webp", "-c:v", "libwebp")
+		} else {
+			args = append(args, "-f", "image2", "-c:v", "mjpeg")
+		}
+
+		out, err := exec.Command(ffmpeg, append(args, dst)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("ffmpeg: %s: %s", err, out)
+		}
+
+		return nil
+	}
+
+	if i.Type != "video" {
+		return run("")
+	}
+
+	// Skip the first second of videos, which is often black, unless
+	// the video is too short to have a frame there.
+	if err := run("1"); err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(dst); err == nil && info.Size() == 0 {
+		return run("0")
+	}
+
+	return nil
+}
+
+// ThumbnailCleaner removes the thumbnails that haven't been used for a
+// while, including the ones whose source has changed or disappeared.
+// This function is set to run periodically.
+func (m FileManager) ThumbnailCleaner() {
+	limit := time.Now().Add(-thumbnailMaxAge)
+
+	filepath.Walk(m.ThumbnailDir(), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+
+		if info.ModTime().Before(limit) {
+			if err := os.Remove(path); err != nil {
+				log.Print(err)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,116 @@
+package filemanager
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// APITokenPrefix starts the API tokens, which tells them apart from the
+// JWTs of the web interface.
+const APITokenPrefix = "fm_"
+
+// APIToken is a long-lived token scripts authenticate with instead of a
+// password. Only the hash of its secret is stored.
+type APIToken struct {
+	ID     string `json:"id" storm:"id"`
+	Name   string `json:"name"`
+	Hash   string `json:"hash"`
+	UserID int    `json:"userID" storm:"index"`
+
+	// ReadOnly tokens can't change any file.
+	ReadOnly bool `json:"readOnly"`
+
+	// Prefix restricts the token to the files under a path of the scope
+	// of the user, when it isn't empty.
+	Prefix string `json:"prefix"`
+
+	// Expires is when the token stops working. The zero time means
+	// never.
+	Expires time.Time `json:"expires"`
+	Created time.Time `json:"created"`
+}
+
+// NewAPIToken generates a new API token for a user. The token is only
+// returned here: it can't be recovered from the stored hash.
+func NewAPIToken(userID int) (*APIToken, string, error) {
+	id, err := GenerateRandomBytes(8)
+	if err != nil {
+		return nil, "", err
+	}
+
+	secret, err := GenerateRandomBytes(32)
+	if err != nil {
+		return nil, "", err
+	}
+
+	t := &APIToken{
+		ID:      hex.EncodeToString(id),
+		Hash:    hashSecret(hex.EncodeToString(secret)),
+		UserID:  userID,
+		Created: time.Now(),
+	}
+
+	return t, APITokenPrefix + t.ID + "_" + hex.EncodeToString(secret), nil
+}
+
+// ParseAPIToken splits an API token into its ID and its secret.
+func ParseAPIToken(token string) (string, string, bool) {
+	if !strings.HasPrefix(token, APITokenPrefix) {
+		return "", "", false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(token, APITokenPrefix), "_")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
+
+// hashSecret hashes the secret of a token. The secrets are random, so
+// they don't need a slow hash like the passwords.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// Check checks the secret of the token and that it hasn't expired.
+func (t APIToken) Check(secret string) bool {
+	if t.Expired() {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(t.Hash)) == 1
+}
+
+// Expired checks if the token has expired.
+func (t APIToken) Expired() bool {
+	return !t.Expires.IsZero() && time.Now().After(t.Expires)
+}
+
+// Allows checks if the token gives access to a path.
+func (t APIToken) Allows(url string) bool {
+	if t.Prefix == "" || t.Prefix == "/" {
+		return true
+	}
+
+	prefix := strings.TrimSuffix(t.Prefix, "/")
+	return url == prefix || strings.HasPrefix(url, prefix+"/")
+}
+
+// WithToken restricts the user to what a token gives access to. Tokens
+// never give the rights of an admin.
+func (u *User) WithToken(t *APIToken) {
+	u.Token = t
+	u.Admin = false
+
+	if t.ReadOnly {
+		u.AllowNew = false
+		u.AllowEdit = false
+		u.AllowCommands = false
+		u.AllowPublish = false
+	}
+}
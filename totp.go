@@ -0,0 +1,198 @@
+package filemanager
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpDigits = 6
+	totpPeriod = 30
+
+	// totpSkew is the number of periods a code is still accepted before
+	// and after its own, for the clocks which drift.
+	totpSkew = 1
+
+	recoveryCodesCount = 10
+)
+
+// TwoFactor is the TOTP second factor of a user.
+type TwoFactor struct {
+	// Enabled tells if the second factor is asked at login. The secret
+	// may be set before, while the user is enrolling.
+	Enabled bool   `json:"enabled"`
+	Secret  string `json:"secret"`
+
+	// LastStep is the period of the last code used, which can't be
+	// used twice.
+	LastStep int64 `json:"lastStep"`
+
+	// RecoveryCodes are the hashes of the one-time codes the user can
+	// log in with when it loses its device.
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// NewTOTPSecret generates a new base32 encoded TOTP secret.
+func NewTOTPSecret() (string, error) {
+	secret, err := GenerateRandomBytes(20)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// TOTPURI returns the provisioning URI of a TOTP secret, which the
+// authenticator apps read from a QR code.
+func TOTPURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+
+	return u.String()
+}
+
+// totpCode computes the code of a period, as in RFC 6238.
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000)
+}
+
+// checkTOTP checks a TOTP code at a time. The codes of the periods
+// before the last one used are refused, so a code can't be replayed.
+func (t *TwoFactor) checkTOTP(code string, now time.Time) bool {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(t.Secret))
+	if err != nil || len(code) != totpDigits {
+		return false
+	}
+
+	step := now.Unix() / totpPeriod
+	for i := step - totpSkew; i <= step+totpSkew; i++ {
+		if i <= t.LastStep {
+			continue
+		}
+
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, i)), []byte(code)) == 1 {
+			t.LastStep = i
+			return true
+		}
+	}
+
+	return false
+}
+
+// useRecoveryCode checks a recovery code and removes it if it's valid.
+func (t *TwoFactor) useRecoveryCode(code string) bool {
+	hash := hashSecret(normalizeRecoveryCode(code))
+
+	for i, h := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+}
+
+// NewRecoveryCodes replaces the recovery codes of the second factor and
+// returns the new ones. Only their hashes are kept.
+func (t *TwoFactor) NewRecoveryCodes() ([]string, error) {
+	codes := []string{}
+	hashes := []string{}
+
+	for i := 0; i < recoveryCodesCount; i++ {
+		b, err := GenerateRandomBytes(5)
+		if err != nil {
+			return nil, err
+		}
+
+		code := hex.EncodeToString(b)
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashSecret(code))
+	}
+
+	t.RecoveryCodes = hashes
+	return codes, nil
+}
+
+// VerifyTOTP checks a TOTP code against the secret of the second factor,
+// even if it isn't enabled yet, and saves its use.
+func (m *FileManager) VerifyTOTP(u *User, code string) (bool, error) {
+	if !u.TwoFactor.checkTOTP(strings.TrimSpace(code), time.Now()) {
+		return false, nil
+	}
+
+	return true, m.Store.Users.Update(u, "TwoFactor")
+}
+
+// CheckTwoFactor checks the code of the second factor of a user, which is
+// either a TOTP code or one of its recovery codes.
+func (m *FileManager) CheckTwoFactor(u *User, code string) (bool, error) {
+	if !u.TwoFactor.Enabled {
+		return false, nil
+	}
+
+	ok, err := m.VerifyTOTP(u, code)
+	if ok || err != nil {
+		return ok, err
+	}
+
+	if !u.TwoFactor.useRecoveryCode(code) {
+		return false, nil
+	}
+
+	return true, m.Store.Users.Update(u, "TwoFactor")
+}
+
+// TwoFactorRequired tells if the policy requires a second factor from the
+// user. The users from OIDC log in with their identity provider, which is
+// in charge of it.
+func (m *FileManager) TwoFactorRequired(u *User) bool {
+	return m.Require2FA && (u.Admin || u.AllowCommands) &&
+		!u.ServiceAccount && u.Source != "oidc"
+}
+
+// NeedsEnrollment tells if the user must enroll a second factor before
+// anything else.
+func (m *FileManager) NeedsEnrollment(u *User) bool {
+	return m.TwoFactorRequired(u) && !u.TwoFactor.Enabled
+}
+
+// PasswordOnly tells if the user can log in with a password alone, as
+// WebDAV and SFTP clients do. The users who must change their password
+// can't either.
+func (m *FileManager) PasswordOnly(u *User) bool {
+	return !u.TwoFactor.Enabled && !m.TwoFactorRequired(u) && !u.MustChangePassword
+}
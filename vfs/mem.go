@@ -0,0 +1,409 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// memories are the named in-memory file systems.
+var memories = struct {
+	sync.Mutex
+	systems map[string]*Mem
+}{systems: map[string]*Mem{}}
+
+// Memory returns the in-memory file system with the given name, creating
+// it the first time, so the users with the same scope share it.
+func Memory(name string) *Mem {
+	memories.Lock()
+	defer memories.Unlock()
+
+	m, ok := memories.systems[name]
+	if !ok {
+		m = NewMem()
+		memories.systems[name] = m
+	}
+
+	return m
+}
+
+// Mem is a FileSystem which keeps the files in memory. It is meant for
+// tests and demos: the files are lost when the process exits.
+type Mem struct {
+	mu    sync.RWMutex
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// NewMem creates an empty in-memory file system.
+func NewMem() *Mem {
+	return &Mem{nodes: map[string]*memNode{
+		"/": {mode: os.ModeDir | 0777, modTime: time.Now()},
+	}}
+}
+
+func (m *Mem) info(name string, n *memNode) os.FileInfo {
+	return fileInfo{
+		name:    path.Base(name),
+		size:    int64(len(n.data)),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+// children returns the names of the nodes under a directory, at any
+// depth.
+func (m *Mem) children(name string) []string {
+	prefix := strings.TrimSuffix(name, "/") + "/"
+
+	var names []string
+	for n := range m.nodes {
+		if n != "/" && strings.HasPrefix(n, prefix) {
+			names = append(names, n)
+		}
+	}
+
+	return names
+}
+
+// checkParent checks the parent of a new node is a directory.
+func (m *Mem) checkParent(op, name string) error {
+	parent, ok := m.nodes[path.Dir(name)]
+	if !ok {
+		return pathError(op, name, os.ErrNotExist)
+	}
+
+	if !parent.mode.IsDir() {
+		return pathError(op, name, syscall.ENOTDIR)
+	}
+
+	return nil
+}
+
+// Mkdir creates a directory.
+func (m *Mem) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = clean(name)
+	if _, ok := m.nodes[name]; ok {
+		return pathError("mkdir", name, os.ErrExist)
+	}
+
+	if err := m.checkParent("mkdir", name); err != nil {
+		return err
+	}
+
+	m.nodes[name] = &memNode{mode: os.ModeDir | perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+// OpenFile opens a file or a directory.
+func (m *Mem) OpenFile(name string, flag int, perm os.FileMode) (fm.Handle, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = clean(name)
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	n, ok := m.nodes[name]
+	switch {
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, os.ErrNotExist)
+	case !ok:
+		if err := m.checkParent("open", name); err != nil {
+			return nil, err
+		}
+
+		n = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		m.nodes[name] = n
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, pathError("open", name, os.ErrExist)
+	case n.mode.IsDir() && writable:
+		return nil, pathError("open", name, syscall.EISDIR)
+	}
+
+	if n.mode.IsDir() {
+		h := &memDir{m: m, name: name}
+		h.list = func() ([]os.FileInfo, error) { return m.ReadDir(name) }
+		return h, nil
+	}
+
+	if writable && flag&os.O_TRUNC != 0 {
+		n.data = nil
+		n.modTime = time.Now()
+	}
+
+	return &memFile{m: m, name: name, node: n, flag: flag}, nil
+}
+
+// ReadDir returns the files of a directory.
+func (m *Mem) ReadDir(name string) ([]os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	name = clean(name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, pathError("readdir", name, os.ErrNotExist)
+	}
+
+	if !n.mode.IsDir() {
+		return nil, pathError("readdir", name, syscall.ENOTDIR)
+	}
+
+	infos := []os.FileInfo{}
+	for _, child := range m.children(name) {
+		if path.Dir(child) == name {
+			infos = append(infos, m.info(child, m.nodes[child]))
+		}
+	}
+
+	sortInfos(infos)
+	return infos, nil
+}
+
+// RemoveAll removes a file or a directory and its contents. Removing the
+// root directory only removes its contents.
+func (m *Mem) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = clean(name)
+	for _, child := range m.children(name) {
+		delete(m.nodes, child)
+	}
+
+	if name != "/" {
+		delete(m.nodes, name)
+	}
+
+	return nil
+}
+
+// Rename renames a file or a directory, replacing the destination unless
+// it is a directory which isn't empty.
+func (m *Mem) Rename(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldName, newName = clean(oldName), clean(newName)
+	if _, ok := m.nodes[oldName]; !ok {
+		return pathError("rename", oldName, os.ErrNotExist)
+	}
+
+	if oldName == newName {
+		return nil
+	}
+
+	if oldName == "/" || newName == "/" || strings.HasPrefix(newName, oldName+"/") {
+		return pathError("rename", newName, syscall.EINVAL)
+	}
+
+	if err := m.checkParent("rename", newName); err != nil {
+		return err
+	}
+
+	if len(m.children(newName)) > 0 {
+		return pathError("rename", newName, syscall.ENOTEMPTY)
+	}
+
+	delete(m.nodes, newName)
+	for _, child := range m.children(oldName) {
+		m.nodes[newName+strings.TrimPrefix(child, oldName)] = m.nodes[child]
+		delete(m.nodes, child)
+	}
+
+	m.nodes[newName] = m.nodes[oldName]
+	delete(m.nodes, oldName)
+	return nil
+}
+
+// Stat returns the information of a file or a directory.
+func (m *Mem) Stat(name string) (os.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	name = clean(name)
+	n, ok := m.nodes[name]
+	if !ok {
+		return nil, pathError("stat", name, os.ErrNotExist)
+	}
+
+	return m.info(name, n), nil
+}
+
+// Copy copies a file or a directory, replacing the files which already
+// exist at the destination.
+func (m *Mem) Copy(src, dst string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	src, dst = clean(src), clean(dst)
+	n, ok := m.nodes[src]
+	if !ok {
+		return pathError("copy", src, os.ErrNotExist)
+	}
+
+	if src == dst || strings.HasPrefix(dst, src+"/") {
+		return pathError("copy", dst, syscall.EINVAL)
+	}
+
+	if err := m.checkParent("copy", dst); err != nil {
+		return err
+	}
+
+	names := append([]string{src}, m.children(src)...)
+	if !n.mode.IsDir() {
+		names = names[:1]
+	}
+
+	for _, name := range names {
+		n := m.nodes[name]
+		m.nodes[dst+strings.TrimPrefix(name, src)] = &memNode{
+			data:    append([]byte(nil), n.data...),
+			mode:    n.mode,
+			modTime: time.Now(),
+		}
+	}
+
+	return nil
+}
+
+// memFile is an open file of a Mem.
+type memFile struct {
+	notDir
+	m      *Mem
+	name   string
+	node   *memNode
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if f.flag&os.O_WRONLY != 0 {
+		return 0, pathError("read", f.name, syscall.EBADF)
+	}
+
+	f.m.mu.RLock()
+	defer f.m.mu.RUnlock()
+
+	if f.pos >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.node.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	if f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return 0, pathError("write", f.name, syscall.EBADF)
+	}
+
+	f.m.mu.Lock()
+	defer f.m.mu.Unlock()
+
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.node.data))
+	}
+
+	if end := f.pos + int64(len(p)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+
+	copy(f.node.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+
+	f.m.mu.RLock()
+	size := int64(len(f.node.data))
+	f.m.mu.RUnlock()
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += size
+	}
+
+	if offset < 0 {
+		return 0, pathError("seek", f.name, syscall.EINVAL)
+	}
+
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.m.mu.RLock()
+	defer f.m.mu.RUnlock()
+
+	return f.m.info(f.name, f.node), nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+
+	f.closed = true
+	return nil
+}
+
+// memDir is an open directory of a Mem.
+type memDir struct {
+	dirReader
+	m    *Mem
+	name string
+}
+
+func (d *memDir) Read(p []byte) (int, error) {
+	return 0, pathError("read", d.name, syscall.EISDIR)
+}
+
+func (d *memDir) Write(p []byte) (int, error) {
+	return 0, pathError("write", d.name, syscall.EISDIR)
+}
+
+func (d *memDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (d *memDir) Stat() (os.FileInfo, error) {
+	return d.m.Stat(d.name)
+}
+
+func (d *memDir) Close() error {
+	return nil
+}
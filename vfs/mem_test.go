@@ -0,0 +1,40 @@
+package vfs
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMem(t *testing.T) {
+	testFileSystem(t, NewMem())
+}
+
+func TestMemHandles(t *testing.T) {
+	m := NewMem()
+	writeFile(t, m, "/f", os.O_CREATE|os.O_WRONLY, "data")
+
+	f, err := m.OpenFile("/f", os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Read(make([]byte, 1)); err == nil {
+		t.Error("a file opened for writing was read")
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != os.ErrClosed {
+		t.Errorf("second close: %v", err)
+	}
+
+	if _, err := m.OpenFile("/missing/f", os.O_CREATE|os.O_WRONLY, 0666); !os.IsNotExist(err) {
+		t.Errorf("creation without a parent: %v", err)
+	}
+
+	if Memory("shared") != Memory("shared") {
+		t.Error("the named file systems aren't shared")
+	}
+}
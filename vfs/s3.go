@@ -0,0 +1,719 @@
+package vfs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	fm "github.com/rjchee/dcac_filemanager"
+	"github.com/rjchee/dcac_filemanager/sigv4"
+)
+
+// S3 is a FileSystem on a bucket of an S3 compatible object store, like
+// MinIO. The folders are the common prefixes of the keys, and the empty
+// ones are kept as empty objects whose key ends with a slash, like the
+// S3 consoles create them.
+type S3 struct {
+	// Endpoint is the URL of the store, like http://localhost:9000.
+	// Buckets are addressed in the path.
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to the keys, to keep the files in a folder of
+	// the bucket. It is empty or ends with a slash.
+	Prefix    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+// NewS3 creates a file system on a bucket from an URL like:
+//
+//	s3://host:9000/bucket/prefix?region=us-east-1&insecure=true
+//
+// The store is reached over HTTPS unless insecure is set. The keys are
+// read from the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY variables of
+// the environment of the server, so they aren't kept in the scopes the
+// users and the hooks see, unless the URL has them as its user info.
+func NewS3(u *url.URL) (*S3, error) {
+	parts := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if u.Host == "" || parts[0] == "" {
+		return nil, fmt.Errorf("vfs: the S3 URL %q needs a host and a bucket", u.Redacted())
+	}
+
+	s := &S3{
+		Endpoint: "https://" + u.Host,
+		Bucket:   parts[0],
+		Region:   u.Query().Get("region"),
+		Client:   http.DefaultClient,
+	}
+
+	if insecure, _ := strconv.ParseBool(u.Query().Get("insecure")); insecure {
+		s.Endpoint = "http://" + u.Host
+	}
+
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+
+	if len(parts) == 2 && strings.Trim(parts[1], "/") != "" {
+		s.Prefix = strings.Trim(parts[1], "/") + "/"
+	}
+
+	s.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	s.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+
+	if u.User != nil {
+		s.AccessKey = u.User.Username()
+		s.SecretKey, _ = u.User.Password()
+	}
+
+	return s, nil
+}
+
+// s3Error is an error returned by the store.
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// key returns the key of a file.
+func (s *S3) key(name string) string {
+	return s.Prefix + strings.TrimPrefix(clean(name), "/")
+}
+
+// dirKey returns the prefix of the keys of the files in a folder.
+func (s *S3) dirKey(name string) string {
+	if clean(name) == "/" {
+		return s.Prefix
+	}
+
+	return s.key(name) + "/"
+}
+
+// request sends a signed request about a key. Errors responses are
+// returned as errors, the missing keys as os.ErrNotExist and the denied
+// requests as os.ErrPermission.
+func (s *S3) request(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Path = "/" + s.Bucket + "/" + key
+	u.RawQuery = query.Encode()
+
+	r, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, values := range header {
+		r.Header[name] = values
+	}
+
+	if body != nil {
+		r.ContentLength = size
+	}
+
+	sigv4.Sign(r, s.AccessKey, s.SecretKey, s.Region, "s3", sigv4.UnsignedPayload, time.Now())
+
+	resp, err := s.Client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 300 || resp.StatusCode == http.StatusNotModified {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, os.ErrNotExist
+	case http.StatusForbidden:
+		return nil, os.ErrPermission
+	}
+
+	e := &s3Error{Status: resp.StatusCode}
+	xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(e)
+	return nil, e
+}
+
+// do sends a request whose response has no interesting body.
+func (s *S3) do(method, key string, header http.Header, body io.Reader, size int64) error {
+	resp, err := s.request(method, key, nil, header, body, size)
+	if err != nil {
+		return err
+	}
+
+	io.Copy(ioutil.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// list lists the keys with a prefix. With a delimiter, the keys which
+// contain it after the prefix are returned as common prefixes. A
+// positive max stops the listing early.
+func (s *S3) list(prefix, delimiter string, max int) ([]s3Object, []string, error) {
+	var (
+		objects  []s3Object
+		prefixes []string
+		token    string
+	)
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if max > 0 {
+			query.Set("max-keys", strconv.Itoa(max))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.request(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var result struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []s3Object
+			CommonPrefixes        []struct {
+				Prefix string
+			}
+		}
+
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		objects = append(objects, result.Contents...)
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+
+		if !result.IsTruncated || max > 0 || result.NextContinuationToken == "" {
+			return objects, prefixes, nil
+		}
+
+		token = result.NextContinuationToken
+	}
+}
+
+func dirInfo(name string, modTime time.Time) os.FileInfo {
+	return fileInfo{name: path.Base(clean(name)), mode: os.ModeDir | 0777, modTime: modTime}
+}
+
+// Stat returns the information of a file or a folder.
+func (s *S3) Stat(name string) (os.FileInfo, error) {
+	if clean(name) == "/" {
+		return dirInfo(name, time.Time{}), nil
+	}
+
+	resp, err := s.request(http.MethodHead, s.key(name), nil, nil, nil, 0)
+	if err == nil {
+		resp.Body.Close()
+
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return fileInfo{
+			name:    path.Base(clean(name)),
+			size:    resp.ContentLength,
+			mode:    0666,
+			modTime: modTime,
+		}, nil
+	}
+
+	if !os.IsNotExist(err) {
+		return nil, pathError("stat", name, err)
+	}
+
+	objects, prefixes, err := s.list(s.dirKey(name), "/", 1)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return nil, pathError("stat", name, os.ErrNotExist)
+	}
+
+	var modTime time.Time
+	if len(objects) > 0 && objects[0].Key == s.dirKey(name) {
+		modTime = objects[0].LastModified
+	}
+
+	return dirInfo(name, modTime), nil
+}
+
+// ReadDir returns the files of a folder.
+func (s *S3) ReadDir(name string) ([]os.FileInfo, error) {
+	prefix := s.dirKey(name)
+
+	objects, prefixes, err := s.list(prefix, "/", 0)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+
+	infos := []os.FileInfo{}
+	marker := false
+
+	for _, p := range prefixes {
+		infos = append(infos, dirInfo(strings.TrimPrefix(p, prefix), time.Time{}))
+	}
+
+	for _, o := range objects {
+		if o.Key == prefix {
+			marker = true
+			continue
+		}
+
+		infos = append(infos, fileInfo{
+			name:    strings.TrimPrefix(o.Key, prefix),
+			size:    o.Size,
+			mode:    0666,
+			modTime: o.LastModified,
+		})
+	}
+
+	// An empty listing is also the one of a folder which doesn't exist,
+	// or of a file.
+	if len(infos) == 0 && !marker && clean(name) != "/" {
+		info, err := s.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			return nil, pathError("readdir", name, syscall.ENOTDIR)
+		}
+	}
+
+	sortInfos(infos)
+	return infos, nil
+}
+
+// checkParent checks the parent of a new file is a folder.
+func (s *S3) checkParent(op, name string) error {
+	parent := path.Dir(clean(name))
+	if parent == "/" {
+		return nil
+	}
+
+	info, err := s.Stat(parent)
+	if err != nil {
+		return pathError(op, name, os.ErrNotExist)
+	}
+
+	if !info.IsDir() {
+		return pathError(op, name, syscall.ENOTDIR)
+	}
+
+	return nil
+}
+
+// Mkdir creates a folder, as an empty object.
+func (s *S3) Mkdir(name string, perm os.FileMode) error {
+	if _, err := s.Stat(name); err == nil {
+		return pathError("mkdir", name, os.ErrExist)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := s.checkParent("mkdir", name); err != nil {
+		return err
+	}
+
+	if err := s.do(http.MethodPut, s.dirKey(name), nil, http.NoBody, 0); err != nil {
+		return pathError("mkdir", name, err)
+	}
+
+	return nil
+}
+
+// OpenFile opens a file or a folder. Files opened for writing are kept
+// in a temporary file and uploaded when they are closed.
+func (s *S3) OpenFile(name string, flag int, perm os.FileMode) (fm.Handle, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+
+	info, err := s.Stat(name)
+	exists := err == nil
+
+	switch {
+	case err != nil && !os.IsNotExist(err):
+		return nil, err
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, os.ErrNotExist)
+	case exists && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, pathError("open", name, os.ErrExist)
+	case exists && info.IsDir() && writable:
+		return nil, pathError("open", name, syscall.EISDIR)
+	}
+
+	if exists && info.IsDir() {
+		d := &s3Dir{info: info}
+		d.list = func() ([]os.FileInfo, error) { return s.ReadDir(name) }
+		return d, nil
+	}
+
+	if !writable {
+		return &s3Reader{s: s, key: s.key(name), info: info}, nil
+	}
+
+	if !exists {
+		if err := s.checkParent("open", name); err != nil {
+			return nil, err
+		}
+	}
+
+	tmp, err := ioutil.TempFile("", "fm-s3-")
+	if err != nil {
+		return nil, err
+	}
+
+	w := &s3Writer{
+		file:  tmp,
+		s:     s,
+		key:   s.key(name),
+		name:  path.Base(clean(name)),
+		flag:  flag,
+		dirty: !exists || flag&os.O_TRUNC != 0,
+	}
+
+	// The content is kept when the file isn't truncated.
+	if !w.dirty {
+		if err := w.download(); err != nil {
+			w.discard()
+			return nil, pathError("open", name, err)
+		}
+	}
+
+	return w, nil
+}
+
+// keys returns the keys of a file, or of a folder and all its contents.
+func (s *S3) keys(name string) ([]string, error) {
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{s.key(name)}, nil
+	}
+
+	objects, _, err := s.list(s.dirKey(name), "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = o.Key
+	}
+
+	return keys, nil
+}
+
+func (s *S3) remove(keys []string) error {
+	for _, key := range keys {
+		err := s.do(http.MethodDelete, key, nil, nil, 0)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copy copies the objects of a file or a folder to another name.
+func (s *S3) copy(src, dst string) ([]string, error) {
+	keys, err := s.keys(src)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkParent("copy", dst); err != nil {
+		return nil, err
+	}
+
+	from, to := s.key(src), s.key(dst)
+	for _, key := range keys {
+		source := (&url.URL{Path: "/" + s.Bucket + "/" + key}).EscapedPath()
+		header := http.Header{"X-Amz-Copy-Source": {source}}
+
+		if err := s.do(http.MethodPut, to+strings.TrimPrefix(key, from), header, http.NoBody, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// RemoveAll removes a file or a folder and its contents. Removing the
+// root folder only removes its contents.
+func (s *S3) RemoveAll(name string) error {
+	keys, err := s.keys(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err == nil {
+		err = s.remove(keys)
+	}
+
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+
+	return nil
+}
+
+// Rename renames a file or a folder by copying its objects and removing
+// the old ones.
+func (s *S3) Rename(oldName, newName string) error {
+	if clean(oldName) == "/" || clean(newName) == "/" || strings.HasPrefix(clean(newName), clean(oldName)+"/") {
+		return pathError("rename", newName, syscall.EINVAL)
+	}
+
+	if clean(oldName) == clean(newName) {
+		return nil
+	}
+
+	keys, err := s.copy(oldName, newName)
+	if err == nil {
+		err = s.remove(keys)
+	}
+
+	if err != nil {
+		return pathError("rename", oldName, err)
+	}
+
+	return nil
+}
+
+// Copy copies a file or a folder.
+func (s *S3) Copy(src, dst string) error {
+	if clean(dst) == "/" || clean(src) == clean(dst) || strings.HasPrefix(clean(dst), clean(src)+"/") {
+		return pathError("copy", dst, syscall.EINVAL)
+	}
+
+	if _, err := s.copy(src, dst); err != nil {
+		return pathError("copy", src, err)
+	}
+
+	return nil
+}
+
+// s3Reader reads an object with ranged requests, so seeking doesn't
+// download the whole object.
+type s3Reader struct {
+	notDir
+	s    *S3
+	key  string
+	info os.FileInfo
+	pos  int64
+	body io.ReadCloser
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.info.Size() {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", r.pos)}}
+		resp, err := r.s.request(http.MethodGet, r.key, nil, header, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+
+		r.body = resp.Body
+	}
+
+	n, err := r.body.Read(p)
+	r.pos += int64(n)
+
+	if err == io.EOF {
+		r.body.Close()
+		r.body = nil
+
+		if r.pos < r.info.Size() {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+
+	return n, err
+}
+
+func (r *s3Reader) Write(p []byte) (int, error) {
+	return 0, syscall.EBADF
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.info.Size()
+	}
+
+	if offset < 0 {
+		return 0, syscall.EINVAL
+	}
+
+	if offset != r.pos && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Stat() (os.FileInfo, error) {
+	return r.info, nil
+}
+
+func (r *s3Reader) Close() error {
+	if r.body != nil {
+		return r.body.Close()
+	}
+
+	return nil
+}
+
+// s3Writer is an object being written, in a temporary file. The file
+// isn't embedded, so all the writes go through Write.
+type s3Writer struct {
+	file  *os.File
+	s     *S3
+	key   string
+	name  string
+	flag  int
+	dirty bool
+}
+
+func (w *s3Writer) download() error {
+	resp, err := w.s.request(http.MethodGet, w.key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(w.file, resp.Body); err != nil {
+		return err
+	}
+
+	if w.flag&os.O_APPEND == 0 {
+		_, err = w.file.Seek(0, io.SeekStart)
+	}
+
+	return err
+}
+
+func (w *s3Writer) discard() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+func (w *s3Writer) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, syscall.ENOTDIR
+}
+
+func (w *s3Writer) Read(p []byte) (int, error) {
+	if w.flag&os.O_WRONLY != 0 {
+		return 0, syscall.EBADF
+	}
+
+	return w.file.Read(p)
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	w.dirty = true
+	return w.file.Write(p)
+}
+
+func (w *s3Writer) Seek(offset int64, whence int) (int64, error) {
+	return w.file.Seek(offset, whence)
+}
+
+func (w *s3Writer) Stat() (os.FileInfo, error) {
+	info, err := w.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return fileInfo{name: w.name, size: info.Size(), mode: 0666, modTime: info.ModTime()}, nil
+}
+
+// Close uploads the object if it changed.
+func (w *s3Writer) Close() error {
+	defer w.discard()
+
+	if !w.dirty {
+		return nil
+	}
+
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return w.s.do(http.MethodPut, w.key, nil, ioutil.NopCloser(w.file), info.Size())
+}
+
+// s3Dir is an open folder.
+type s3Dir struct {
+	dirReader
+	info os.FileInfo
+}
+
+func (d *s3Dir) Read(p []byte) (int, error) {
+	return 0, syscall.EISDIR
+}
+
+func (d *s3Dir) Write(p []byte) (int, error) {
+	return 0, syscall.EISDIR
+}
+
+func (d *s3Dir) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (d *s3Dir) Stat() (os.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *s3Dir) Close() error {
+	return nil
+}
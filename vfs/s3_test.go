@@ -0,0 +1,242 @@
+package vfs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// fakeS3 is a bucket of an S3 compatible store, with the requests the S3
+// file system makes.
+type fakeS3 struct {
+	mu      sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+type fakeListing struct {
+	XMLName        xml.Name `xml:"ListBucketResult"`
+	IsTruncated    bool
+	Contents       []fakeObject
+	CommonPrefixes []fakePrefix
+}
+
+type fakeObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+type fakePrefix struct {
+	Prefix string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if !strings.HasPrefix(r.URL.Path, "/"+f.bucket+"/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(r.URL.Path, "/"+f.bucket+"/")
+	data, ok := f.objects[key]
+
+	switch {
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		f.list(w, r)
+	case r.Method == http.MethodHead || r.Method == http.MethodGet:
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" {
+			start, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+			data = data[start:]
+			status = http.StatusPartialContent
+		}
+
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodPut:
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			source, _ = url.PathUnescape(source)
+			src, ok := f.objects[strings.TrimPrefix(source, "/"+f.bucket+"/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+
+			f.objects[key] = append([]byte(nil), src...)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		f.objects[key] = body
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	max, _ := strconv.Atoi(q.Get("max-keys"))
+
+	keys := []string{}
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var result fakeListing
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if max > 0 && len(result.Contents)+len(result.CommonPrefixes) == max {
+			result.IsTruncated = true
+			break
+		}
+
+		rest := strings.TrimPrefix(key, prefix)
+		if i := strings.Index(rest, delimiter); delimiter != "" && i >= 0 {
+			p := prefix + rest[:i+len(delimiter)]
+			if !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, fakePrefix{p})
+			}
+			continue
+		}
+
+		result.Contents = append(result.Contents, fakeObject{key, int64(len(f.objects[key])), time.Now()})
+	}
+
+	xml.NewEncoder(w).Encode(result)
+}
+
+func newTestS3(t *testing.T) (*S3, *fakeS3) {
+	fake := &fakeS3{bucket: "bucket", objects: map[string][]byte{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL)
+	s, err := NewS3(&url.URL{
+		Scheme:   "s3",
+		User:     url.UserPassword("key", "secret"),
+		Host:     u.Host,
+		Path:     "/bucket/files",
+		RawQuery: "insecure=true",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Client = srv.Client()
+	return s, fake
+}
+
+func TestNewS3(t *testing.T) {
+	u, _ := url.Parse("s3://key:secret@host:9000/bucket/some/prefix/?region=eu-west-1")
+	s, err := NewS3(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := fmt.Sprintf("%s %s %s %s %s %s", s.Endpoint, s.Bucket, s.Prefix, s.Region, s.AccessKey, s.SecretKey)
+	if want := "https://host:9000 bucket some/prefix/ eu-west-1 key secret"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The scopes the users and the hooks see have no keys.
+	if got := fm.HideScope(u.String()); got != "s3://host:9000/bucket/some/prefix/?region=eu-west-1" {
+		t.Errorf("hidden scope: %q", got)
+	}
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "env-key")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "env-secret")
+
+	u, _ = url.Parse("s3://host:9000/bucket")
+	if s, err = NewS3(u); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.AccessKey != "env-key" || s.SecretKey != "env-secret" {
+		t.Errorf("the keys of the environment weren't used: %q %q", s.AccessKey, s.SecretKey)
+	}
+
+	u, _ = url.Parse("s3://host:9000/")
+	if _, err := NewS3(u); err == nil {
+		t.Error("an URL without a bucket was accepted")
+	}
+}
+
+func TestS3(t *testing.T) {
+	s, fake := newTestS3(t)
+	testFileSystem(t, s)
+
+	// Everything was kept under the prefix.
+	for key := range fake.objects {
+		t.Errorf("key %q left in the bucket", key)
+	}
+}
+
+func TestS3Keys(t *testing.T) {
+	s, fake := newTestS3(t)
+
+	if err := s.Mkdir("/dir", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, s, "/dir/f", os.O_CREATE|os.O_WRONLY, "data")
+
+	for _, key := range []string{"files/dir/", "files/dir/f"} {
+		if _, ok := fake.objects[key]; !ok {
+			t.Errorf("key %q is missing", key)
+		}
+	}
+
+	// The requests which aren't signed are denied, as os.ErrPermission.
+	s.AccessKey, s.SecretKey = "", ""
+	s.Client = &http.Client{Transport: unsigned{s.Client.Transport}}
+	if _, err := s.Stat("/dir/f"); err == nil {
+		t.Error("an unsigned request was accepted")
+	}
+}
+
+// unsigned removes the signature of the requests.
+type unsigned struct {
+	http.RoundTripper
+}
+
+func (u unsigned) RoundTrip(r *http.Request) (*http.Response, error) {
+	r.Header.Del("Authorization")
+	return u.RoundTripper.RoundTrip(r)
+}
@@ -0,0 +1,153 @@
+// Package vfs builds the file systems of the users from their scope,
+// which is either a directory of the local disk or the URL of another
+// backend:
+//
+//	/srv/files                                    a local directory
+//	mem://name                                    an in-memory file system
+//	s3://host:9000/bucket/prefix                  a bucket of an S3 compatible store
+//
+// The DCAC attributes and ACLs only apply to the local disk. The access
+// to the other backends is checked by File Manager with the rules of the
+// users.
+package vfs
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// New builds the file system of a scope, so it can be used as the NewFS
+// of a File Manager. The operations of the file system of an invalid
+// scope all fail.
+func New(scope string) fm.FileSystem {
+	if !strings.Contains(scope, "://") {
+		return fm.Dir(scope)
+	}
+
+	fs, err := Parse(scope)
+	if err != nil {
+		log.Print(err)
+		return broken{err}
+	}
+
+	return fs
+}
+
+// Parse parses the URL of a file system.
+func Parse(scope string) (fm.FileSystem, error) {
+	u, err := url.Parse(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return fm.Dir(u.Path), nil
+	case "mem":
+		return Memory(u.Host + u.Path), nil
+	case "s3":
+		return NewS3(u)
+	}
+
+	return nil, fmt.Errorf("vfs: unknown file system %q", u.Scheme)
+}
+
+// clean returns the absolute form of a path of a file system.
+func clean(name string) string {
+	return path.Clean("/" + name)
+}
+
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// fileInfo describes the files of the backends.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (f fileInfo) Name() string       { return f.name }
+func (f fileInfo) Size() int64        { return f.size }
+func (f fileInfo) Mode() os.FileMode  { return f.mode }
+func (f fileInfo) ModTime() time.Time { return f.modTime }
+func (f fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f fileInfo) Sys() interface{}   { return nil }
+
+func sortInfos(infos []os.FileInfo) {
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+}
+
+// dirReader returns the entries of a directory in pages, like
+// os.File.Readdir.
+type dirReader struct {
+	list    func() ([]os.FileInfo, error)
+	entries []os.FileInfo
+	read    bool
+}
+
+func (d *dirReader) Readdir(count int) ([]os.FileInfo, error) {
+	if !d.read {
+		entries, err := d.list()
+		if err != nil {
+			return nil, err
+		}
+
+		d.entries, d.read = entries, true
+	}
+
+	if count <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if count > len(d.entries) {
+		count = len(d.entries)
+	}
+
+	entries := d.entries[:count]
+	d.entries = d.entries[count:]
+	return entries, nil
+}
+
+// notDir is embedded in the handles of files, which can't be listed.
+type notDir struct{}
+
+func (notDir) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, syscall.ENOTDIR
+}
+
+// broken is the file system of an invalid scope.
+type broken struct {
+	err error
+}
+
+func (b broken) Mkdir(name string, perm os.FileMode) error  { return b.err }
+func (b broken) ReadDir(name string) ([]os.FileInfo, error) { return nil, b.err }
+func (b broken) RemoveAll(name string) error                { return b.err }
+func (b broken) Rename(oldName, newName string) error       { return b.err }
+func (b broken) Stat(name string) (os.FileInfo, error)      { return nil, b.err }
+func (b broken) Copy(src, dst string) error                 { return b.err }
+
+func (b broken) OpenFile(name string, flag int, perm os.FileMode) (fm.Handle, error) {
+	return nil, b.err
+}
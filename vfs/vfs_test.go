@@ -0,0 +1,236 @@
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+func TestParse(t *testing.T) {
+	fs, err := Parse("mem://parse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fs != Memory("parse") {
+		t.Error("mem:// doesn't return the named in-memory file system")
+	}
+
+	if fs, err := Parse("file:///srv/files"); err != nil || fs != fm.Dir("/srv/files") {
+		t.Errorf("file:// returned %v, %v", fs, err)
+	}
+
+	if _, err := Parse("ftp://host/dir"); err == nil {
+		t.Error("an unknown scheme was accepted")
+	}
+
+	if _, err := New("s3://host").Stat("/"); err == nil {
+		t.Error("the file system of an invalid scope works")
+	}
+}
+
+func writeFile(t *testing.T, fs fm.FileSystem, name string, flag int, data string) {
+	t.Helper()
+
+	f, err := fs.OpenFile(name, flag, 0666)
+	if err != nil {
+		t.Fatalf("open %s: %s", name, err)
+	}
+
+	if _, err := io.WriteString(f, data); err != nil {
+		t.Fatalf("write %s: %s", name, err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("close %s: %s", name, err)
+	}
+}
+
+func readFile(t *testing.T, fs fm.FileSystem, name string, offset int64) string {
+	t.Helper()
+
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatalf("open %s: %s", name, err)
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		t.Fatalf("seek %s: %s", name, err)
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("read %s: %s", name, err)
+	}
+
+	return string(data)
+}
+
+func names(infos []os.FileInfo) []string {
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+
+	return names
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// testFileSystem checks the behaviour every FileSystem must have, on an
+// empty one.
+func testFileSystem(t *testing.T, fs fm.FileSystem) {
+	if err := fs.Mkdir("/a", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir("/a", 0755); !os.IsExist(err) {
+		t.Errorf("mkdir of an existing directory: %v", err)
+	}
+
+	if err := fs.Mkdir("/x/y", 0755); !os.IsNotExist(err) {
+		t.Errorf("mkdir without a parent: %v", err)
+	}
+
+	writeFile(t, fs, "/a/f.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, "hello world")
+
+	info, err := fs.Stat("/a/f.txt")
+	if err != nil || info.IsDir() || info.Size() != 11 || info.Name() != "f.txt" {
+		t.Fatalf("stat of a file: %v, %v", info, err)
+	}
+
+	if info, err := fs.Stat("/a"); err != nil || !info.IsDir() {
+		t.Errorf("stat of a directory: %v, %v", info, err)
+	}
+
+	if _, err := fs.Stat("/missing"); !os.IsNotExist(err) {
+		t.Errorf("stat of a missing file: %v", err)
+	}
+
+	if got := readFile(t, fs, "/a/f.txt", 6); got != "world" {
+		t.Errorf("read after a seek: %q", got)
+	}
+
+	if _, err := fs.OpenFile("/a/f.txt", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666); !os.IsExist(err) {
+		t.Errorf("exclusive creation of an existing file: %v", err)
+	}
+
+	if _, err := fs.OpenFile("/a", os.O_WRONLY, 0); err == nil {
+		t.Error("a directory was opened for writing")
+	}
+
+	writeFile(t, fs, "/a/f.txt", os.O_WRONLY|os.O_APPEND, "!")
+	if got := readFile(t, fs, "/a/f.txt", 0); got != "hello world!" {
+		t.Errorf("read after an append: %q", got)
+	}
+
+	if err := fs.Mkdir("/e", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if infos, err := fs.ReadDir("/e"); err != nil || len(infos) != 0 {
+		t.Errorf("listing of an empty directory: %v, %v", names(infos), err)
+	}
+
+	if infos, err := fs.ReadDir("/"); err != nil || !equal(names(infos), []string{"a", "e"}) {
+		t.Errorf("listing of the root: %v, %v", names(infos), err)
+	}
+
+	if _, err := fs.ReadDir("/a/f.txt"); err == nil {
+		t.Error("a file was listed")
+	}
+
+	writeFile(t, fs, "/a/g.txt", os.O_CREATE|os.O_WRONLY, "g")
+
+	dir, err := fs.OpenFile("/a", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var pages []string
+	for {
+		infos, err := dir.Readdir(1)
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil || len(infos) != 1 {
+			t.Fatalf("page of a listing: %v, %v", names(infos), err)
+		}
+
+		pages = append(pages, infos[0].Name())
+	}
+	dir.Close()
+
+	if !equal(pages, []string{"f.txt", "g.txt"}) {
+		t.Errorf("pages of a listing: %v", pages)
+	}
+
+	if err := fs.Copy("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, fs, "/b/f.txt", 0); got != "hello world!" {
+		t.Errorf("read of a copy: %q", got)
+	}
+
+	if err := fs.Copy("/a", "/a/c"); err == nil {
+		t.Error("a directory was copied into itself")
+	}
+
+	if err := fs.Rename("/b/f.txt", "/b/h.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("/b/f.txt"); !os.IsNotExist(err) {
+		t.Errorf("stat of a renamed file: %v", err)
+	}
+
+	if err := fs.Rename("/b", "/e/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if infos, err := fs.ReadDir("/e/b"); err != nil || !equal(names(infos), []string{"g.txt", "h.txt"}) {
+		t.Errorf("listing of a moved directory: %v, %v", names(infos), err)
+	}
+
+	if err := fs.Rename("/a", "/a/c"); err == nil {
+		t.Error("a directory was moved into itself")
+	}
+
+	if err := fs.RemoveAll("/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("/a/f.txt"); !os.IsNotExist(err) {
+		t.Errorf("stat of a removed file: %v", err)
+	}
+
+	if err := fs.RemoveAll("/a"); err != nil {
+		t.Errorf("removal of a missing file: %v", err)
+	}
+
+	if err := fs.RemoveAll("/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if infos, err := fs.ReadDir("/"); err != nil || len(infos) != 0 {
+		t.Errorf("listing of an emptied root: %v, %v", names(infos), err)
+	}
+}
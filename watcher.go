@@ -0,0 +1,383 @@
+package filemanager
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch event operations.
+const (
+	WatchCreate = "create"
+	WatchModify = "modify"
+	WatchDelete = "delete"
+	WatchRename = "rename"
+	// WatchResync tells a subscriber that some events were lost and it
+	// should reload the whole directory.
+	WatchResync = "resync"
+)
+
+// watchCoalesceDelay is how long the watcher waits for a burst of
+// changes to settle before notifying the subscribers.
+const watchCoalesceDelay = 250 * time.Millisecond
+
+// WatchEvent is a change to a file inside a watched directory.
+type WatchEvent struct {
+	Op string `json:"op"`
+	// Path is the absolute path of the file.
+	Path string `json:"path"`
+	// OldPath is the previous path of a renamed file.
+	OldPath string `json:"oldPath,omitempty"`
+}
+
+// Watcher watches directories for changes on behalf of subscribers.
+// The changes are coalesced, so a file written many times in a row is
+// only reported once.
+type Watcher struct {
+	fsw *fsnotify.Watcher
+
+	mu      sync.Mutex
+	subs    map[string]map[*WatchSubscription]struct{}
+	pending map[string][]fsnotify.Event
+	timer   *time.Timer
+
+	// gone are the watched directories which were removed, and parents
+	// the directories watched to notice when they are created again.
+	gone    map[string]struct{}
+	parents map[string]int
+}
+
+// WatchSubscription receives the changes to a directory.
+type WatchSubscription struct {
+	// Dir is the absolute path of the watched directory.
+	Dir string
+	// Events receives the changes. It is closed when the subscription
+	// or the watcher are closed.
+	Events chan []WatchEvent
+
+	w        *Watcher
+	overflow bool
+}
+
+// NewWatcher creates a new Watcher.
+func NewWatcher() (*Watcher, error) {
+	fsw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Watcher{
+		fsw:     fsw,
+		subs:    map[string]map[*WatchSubscription]struct{}{},
+		pending: map[string][]fsnotify.Event{},
+		gone:    map[string]struct{}{},
+		parents: map[string]int{},
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Subscribe starts watching a directory. The directory is opened by
+// the calling thread, so it must be readable with its attributes.
+func (w *Watcher) Subscribe(dir string) (*WatchSubscription, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.subs[dir]; !ok {
+		if err := w.fsw.Add(dir); err != nil {
+			return nil, err
+		}
+
+		w.subs[dir] = map[*WatchSubscription]struct{}{}
+	}
+
+	s := &WatchSubscription{
+		Dir:    dir,
+		Events: make(chan []WatchEvent, 16),
+		w:      w,
+	}
+
+	w.subs[dir][s] = struct{}{}
+	return s, nil
+}
+
+// Close stops the subscription. The directory stops being watched when
+// it has no subscribers left.
+func (s *WatchSubscription) Close() {
+	w := s.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	subs := w.subs[s.Dir]
+	if _, ok := subs[s]; !ok {
+		return
+	}
+
+	delete(subs, s)
+	close(s.Events)
+
+	if len(subs) == 0 {
+		delete(w.subs, s.Dir)
+		delete(w.pending, s.Dir)
+
+		if _, ok := w.gone[s.Dir]; ok {
+			delete(w.gone, s.Dir)
+			w.unwatchParent(s.Dir)
+		} else if w.parents[s.Dir] == 0 {
+			w.fsw.Remove(s.Dir)
+		}
+	}
+}
+
+// Close stops watching every directory and closes the subscriptions.
+func (w *Watcher) Close() error {
+	w.mu.Lock()
+	for _, subs := range w.subs {
+		for s := range subs {
+			close(s.Events)
+		}
+	}
+
+	w.subs = map[string]map[*WatchSubscription]struct{}{}
+	w.pending = map[string][]fsnotify.Event{}
+	w.gone = map[string]struct{}{}
+	w.parents = map[string]int{}
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.mu.Unlock()
+
+	return w.fsw.Close()
+}
+
+func (w *Watcher) run() {
+	for {
+		select {
+		case e, ok := <-w.fsw.Events:
+			if !ok {
+				return
+			}
+
+			w.queue(e)
+		case err, ok := <-w.fsw.Errors:
+			if !ok {
+				return
+			}
+
+			log.Print(err)
+		}
+	}
+}
+
+// queue adds an event to the directories it concerns and schedules the
+// notification of their subscribers.
+func (w *Watcher) queue(e fsnotify.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	dirs := []string{filepath.Dir(e.Name)}
+
+	// A watched directory which is removed or moved away is reported
+	// to its own subscribers too, and so is its return, once it is
+	// watched again.
+	if e.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		dirs = append(dirs, e.Name)
+		if _, ok := w.subs[e.Name]; ok {
+			w.waitFor(e.Name)
+		}
+	}
+
+	if e.Op&fsnotify.Create != 0 {
+		if _, ok := w.gone[e.Name]; ok && w.rewatch(e.Name) {
+			dirs = append(dirs, e.Name)
+		}
+	}
+
+	for _, dir := range dirs {
+		if _, ok := w.subs[dir]; !ok {
+			continue
+		}
+
+		w.pending[dir] = append(w.pending[dir], e)
+		if w.timer == nil {
+			w.timer = time.AfterFunc(watchCoalesceDelay, w.flush)
+		}
+	}
+}
+
+// waitFor watches the parent of a watched directory which was removed,
+// to watch it again when it is created again.
+func (w *Watcher) waitFor(dir string) {
+	if _, ok := w.gone[dir]; ok {
+		return
+	}
+
+	parent := filepath.Dir(dir)
+	if w.parents[parent] == 0 && w.subs[parent] == nil {
+		if err := w.fsw.Add(parent); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+
+	w.gone[dir] = struct{}{}
+	w.parents[parent]++
+}
+
+// rewatch watches a directory which was created again.
+func (w *Watcher) rewatch(dir string) bool {
+	delete(w.gone, dir)
+	w.unwatchParent(dir)
+
+	// The old watch may not be forgotten yet.
+	w.fsw.Remove(dir)
+	if err := w.fsw.Add(dir); err != nil {
+		log.Print(err)
+		return false
+	}
+
+	return true
+}
+
+func (w *Watcher) unwatchParent(dir string) {
+	parent := filepath.Dir(dir)
+	w.parents[parent]--
+	if w.parents[parent] > 0 {
+		return
+	}
+
+	delete(w.parents, parent)
+	if w.subs[parent] == nil {
+		w.fsw.Remove(parent)
+	}
+}
+
+// flush sends the pending events to the subscribers.
+func (w *Watcher) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	pending := w.pending
+	w.pending = map[string][]fsnotify.Event{}
+	w.timer = nil
+
+	for dir, events := range pending {
+		batch := coalesceWatchEvents(events)
+		if len(batch) == 0 {
+			continue
+		}
+
+		for s := range w.subs[dir] {
+			// Slow subscribers must not block the others. They are
+			// told to reload once they catch up.
+			send := batch
+			if s.overflow {
+				send = []WatchEvent{{Op: WatchResync, Path: dir}}
+			}
+
+			select {
+			case s.Events <- send:
+				s.overflow = false
+			default:
+				s.overflow = true
+			}
+		}
+	}
+}
+
+// coalesceWatchEvents turns the raw events of a directory into at most
+// one change for each file. A rename is reported as such when the file
+// shows up right away under its new name in the same directory.
+func coalesceWatchEvents(events []fsnotify.Event) []WatchEvent {
+	var (
+		order   []string
+		ops     = map[string]string{}
+		renamed = map[string]string{}
+
+		// The file moved away by the previous event, what had
+		// happened to it before, and its original name.
+		moved, movedOp, movedFrom string
+	)
+
+	set := func(name, op string) {
+		if _, ok := ops[name]; !ok {
+			order = append(order, name)
+		}
+		ops[name] = op
+	}
+
+	for _, e := range events {
+		prev := ops[e.Name]
+		last := moved
+		moved = ""
+
+		switch {
+		case e.Op&fsnotify.Create != 0:
+			switch {
+			case last != "" && last != e.Name:
+				set(last, "")
+				switch movedOp {
+				case WatchCreate:
+					set(e.Name, WatchCreate)
+				case WatchRename:
+					set(movedFrom, "")
+					set(e.Name, WatchRename)
+					renamed[e.Name] = movedFrom
+				default:
+					set(e.Name, WatchRename)
+					renamed[e.Name] = last
+				}
+			case prev == WatchDelete:
+				set(e.Name, WatchModify)
+			default:
+				set(e.Name, WatchCreate)
+			}
+		case e.Op&(fsnotify.Remove|fsnotify.Rename) != 0:
+			switch prev {
+			case WatchCreate:
+				set(e.Name, "")
+			case WatchRename:
+				// The file is gone from its original name too.
+				set(e.Name, "")
+				set(renamed[e.Name], WatchDelete)
+			default:
+				set(e.Name, WatchDelete)
+			}
+
+			if e.Op&fsnotify.Rename != 0 {
+				moved, movedOp, movedFrom = e.Name, prev, renamed[e.Name]
+			}
+		case e.Op&(fsnotify.Write|fsnotify.Chmod) != 0:
+			if prev == "" {
+				set(e.Name, WatchModify)
+			}
+		}
+	}
+
+	var result []WatchEvent
+	for _, name := range order {
+		op := ops[name]
+		if op == "" {
+			continue
+		}
+
+		event := WatchEvent{Op: op, Path: name}
+		if op == WatchRename {
+			event.OldPath = renamed[name]
+		}
+
+		result = append(result, event)
+	}
+
+	return result
+}
@@ -0,0 +1,309 @@
+package filemanager
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The headers sent with the webhooks.
+const (
+	WebhookEventHeader     = "X-Filemanager-Event"
+	WebhookDeliveryHeader  = "X-Filemanager-Delivery"
+	WebhookSignatureHeader = "X-Filemanager-Signature"
+)
+
+// The states of a delivery.
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+var (
+	// WebhookMaxAttempts is the number of times a delivery is tried
+	// before it fails.
+	WebhookMaxAttempts = 8
+
+	// WebhookBackoff is the wait before the first retry. It doubles with
+	// every attempt, up to WebhookMaxBackoff.
+	WebhookBackoff    = 30 * time.Second
+	WebhookMaxBackoff = 6 * time.Hour
+
+	// webhookRetention is how long the finished deliveries are kept.
+	webhookRetention = 30 * 24 * time.Hour
+
+	// webhookClient is used when FileManager.WebhookClient is nil.
+	webhookClient = &http.Client{Timeout: 15 * time.Second}
+
+	// webhookMu makes sure a delivery isn't sent twice at once.
+	webhookMu sync.Mutex
+)
+
+// Webhook is a URL an event is sent to, as a JSON POST.
+type Webhook struct {
+	URL string `json:"url"`
+
+	// Secret signs the payloads, if set. The signature is the HMAC-SHA256
+	// of the body, in hex, prefixed with "sha256=".
+	Secret string `json:"secret"`
+}
+
+// Check checks the URL of the webhook.
+func (w *Webhook) Check() error {
+	u, err := url.Parse(w.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ErrInvalidOption
+	}
+
+	return nil
+}
+
+// WebhookDelivery is a payload queued for, or sent to, a webhook. It is
+// signed when it is queued, so the secrets aren't stored with it.
+type WebhookDelivery struct {
+	ID          int             `json:"id" storm:"id,increment"`
+	Event       string          `json:"event"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Signature   string          `json:"signature"`
+	Status      string          `json:"status" storm:"index"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+	StatusCode  int             `json:"statusCode"`
+	Error       string          `json:"error"`
+	Created     time.Time       `json:"created"`
+	Updated     time.Time       `json:"updated"`
+}
+
+// SignWebhook signs a payload with the secret of a webhook.
+func SignWebhook(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// queueWebhooks queues the data of an event for its webhooks.
+func (m FileManager) queueWebhooks(data *EventData) error {
+	hooks := m.Webhooks[data.Event]
+	if len(hooks) == 0 || m.Store.Webhooks == nil {
+		return nil
+	}
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	for _, h := range hooks {
+		d := &WebhookDelivery{
+			Event:       data.Event,
+			URL:         h.URL,
+			Payload:     body,
+			Status:      DeliveryPending,
+			NextAttempt: data.Time,
+			Created:     data.Time,
+			Updated:     data.Time,
+		}
+
+		if h.Secret != "" {
+			d.Signature = SignWebhook(h.Secret, body)
+		}
+
+		if err := m.Store.Webhooks.Save(d); err != nil {
+			return err
+		}
+	}
+
+	m.wakeWebhooks()
+	return nil
+}
+
+// wakeWebhooks tells the sender there are new deliveries.
+func (m FileManager) wakeWebhooks() {
+	select {
+	case m.webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+func (m FileManager) webhookClient() *http.Client {
+	if m.WebhookClient == nil {
+		return webhookClient
+	}
+
+	return m.WebhookClient
+}
+
+// DeliverWebhooks sends the deliveries which are due. It runs in the
+// background after Setup, but may be called to flush the queue.
+func (m FileManager) DeliverWebhooks() {
+	if m.Store.Webhooks == nil {
+		return
+	}
+
+	webhookMu.Lock()
+	defer webhookMu.Unlock()
+
+	pending, err := m.Store.Webhooks.GetPending()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	due := map[string][]*WebhookDelivery{}
+	for _, d := range pending {
+		if d.NextAttempt.After(time.Now()) {
+			continue
+		}
+
+		due[d.URL] = append(due[d.URL], d)
+	}
+
+	// The receivers are sent their deliveries at the same time, so one
+	// which is slow or down only holds up its own.
+	var wg sync.WaitGroup
+	for _, deliveries := range due {
+		wg.Add(1)
+		go func(deliveries []*WebhookDelivery) {
+			defer wg.Done()
+			m.deliverWebhooks(deliveries)
+		}(deliveries)
+	}
+
+	wg.Wait()
+}
+
+// deliverWebhooks sends the deliveries of a receiver in order. Once one
+// fails, the others wait for the next pass without losing an attempt.
+func (m FileManager) deliverWebhooks(deliveries []*WebhookDelivery) {
+	for _, d := range deliveries {
+		m.deliverWebhook(d)
+		if err := m.Store.Webhooks.Save(d); err != nil {
+			log.Print(err)
+		}
+
+		if d.Status != DeliveryDelivered {
+			return
+		}
+	}
+}
+
+// deliverWebhook tries to send a delivery once and records the result.
+func (m FileManager) deliverWebhook(d *WebhookDelivery) {
+	d.Attempts++
+	d.Updated = time.Now()
+
+	err := m.postWebhook(d)
+	if err == nil {
+		d.Status = DeliveryDelivered
+		d.Error = ""
+		return
+	}
+
+	d.Error = err.Error()
+	if d.Attempts >= WebhookMaxAttempts {
+		log.Printf("webhook %d to %s failed: %s\n", d.ID, d.URL, err)
+		d.Status = DeliveryFailed
+		return
+	}
+
+	backoff := WebhookBackoff << uint(d.Attempts-1)
+	if backoff > WebhookMaxBackoff || backoff <= 0 {
+		backoff = WebhookMaxBackoff
+	}
+
+	d.NextAttempt = d.Updated.Add(backoff)
+}
+
+func (m FileManager) postWebhook(d *WebhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "File Manager/"+Version)
+	req.Header.Set(WebhookEventHeader, d.Event)
+	req.Header.Set(WebhookDeliveryHeader, strconv.Itoa(d.ID))
+	if d.Signature != "" {
+		req.Header.Set(WebhookSignatureHeader, d.Signature)
+	}
+
+	resp, err := m.webhookClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The connection is reused once the body is read.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	d.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the receiver answered %s", resp.Status)
+	}
+
+	return nil
+}
+
+// RedeliverWebhook queues a delivery again, with all of its attempts.
+func (m FileManager) RedeliverWebhook(d *WebhookDelivery) error {
+	d.Status = DeliveryPending
+	d.Attempts = 0
+	d.NextAttempt = time.Now()
+	d.Updated = d.NextAttempt
+
+	if err := m.Store.Webhooks.Save(d); err != nil {
+		return err
+	}
+
+	m.wakeWebhooks()
+	return nil
+}
+
+// webhookSender sends the deliveries as they are queued, and the retries
+// when they are due.
+func (m FileManager) webhookSender() {
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.webhookWake:
+		}
+
+		m.DeliverWebhooks()
+	}
+}
+
+// WebhookCleaner deletes the old deliveries which are finished.
+func (m FileManager) WebhookCleaner() {
+	deliveries, err := m.Store.Webhooks.Gets()
+	if err != nil {
+		log.Print(err)
+		return
+	}
+
+	for _, d := range deliveries {
+		if d.Status == DeliveryPending || time.Since(d.Updated) < webhookRetention {
+			continue
+		}
+
+		if err := m.Store.Webhooks.Delete(d.ID); err != nil {
+			log.Print(err)
+		}
+	}
+}
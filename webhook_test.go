@@ -0,0 +1,327 @@
+package filemanager_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	fm "github.com/rjchee/dcac_filemanager"
+)
+
+// memWebhooks is a webhooks store in memory.
+type memWebhooks struct {
+	mu         sync.Mutex
+	deliveries map[int]fm.WebhookDelivery
+	next       int
+}
+
+func (s *memWebhooks) Get(id int) (*fm.WebhookDelivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	d, ok := s.deliveries[id]
+	if !ok {
+		return nil, fm.ErrNotExist
+	}
+
+	return &d, nil
+}
+
+func (s *memWebhooks) gets(status string) []*fm.WebhookDelivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deliveries := []*fm.WebhookDelivery{}
+	for _, d := range s.deliveries {
+		if status == "" || d.Status == status {
+			d := d
+			deliveries = append(deliveries, &d)
+		}
+	}
+
+	sort.Slice(deliveries, func(i, j int) bool { return deliveries[i].ID < deliveries[j].ID })
+	return deliveries
+}
+
+func (s *memWebhooks) Gets() ([]*fm.WebhookDelivery, error) {
+	return s.gets(""), nil
+}
+
+func (s *memWebhooks) GetPending() ([]*fm.WebhookDelivery, error) {
+	return s.gets(fm.DeliveryPending), nil
+}
+
+func (s *memWebhooks) Save(d *fm.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d.ID == 0 {
+		s.next++
+		d.ID = s.next
+	}
+
+	s.deliveries[d.ID] = *d
+	return nil
+}
+
+func (s *memWebhooks) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.deliveries, id)
+	return nil
+}
+
+// receiver is a webhook receiver which answers with its status.
+type receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	r := &receiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		r.mu.Lock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, body)
+		status := r.status
+		r.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.status = status
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.requests)
+}
+
+func newWebhookManager(webhooks ...*fm.Webhook) *fm.FileManager {
+	return &fm.FileManager{
+		Store:         &fm.Store{Webhooks: &memWebhooks{deliveries: map[int]fm.WebhookDelivery{}}},
+		Webhooks:      map[string][]*fm.Webhook{"after_upload": webhooks},
+		WebhookClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func upload(t *testing.T, m *fm.FileManager, path string) {
+	t.Helper()
+
+	if err := m.Runner("after_upload", path, "", &fm.User{ID: 1, Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func delivery(t *testing.T, m *fm.FileManager, id int) *fm.WebhookDelivery {
+	t.Helper()
+
+	d, err := m.Store.Webhooks.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return d
+}
+
+// retryNow makes a delivery due again, without waiting for its backoff.
+func retryNow(t *testing.T, m *fm.FileManager, id int) {
+	d := delivery(t, m, id)
+	d.NextAttempt = time.Now()
+
+	if err := m.Store.Webhooks.Save(d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	signed, unsigned := newReceiver(t, http.StatusOK), newReceiver(t, http.StatusNoContent)
+	m := newWebhookManager(
+		&fm.Webhook{URL: signed.URL, Secret: "secret"},
+		&fm.Webhook{URL: unsigned.URL},
+	)
+
+	upload(t, m, "/a.txt")
+	m.DeliverWebhooks()
+
+	if signed.count() != 1 || unsigned.count() != 1 {
+		t.Fatalf("sent %d and %d webhooks, want 1 each", signed.count(), unsigned.count())
+	}
+
+	req, body := signed.requests[0], signed.bodies[0]
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(body)
+
+	if got, want := req.Header.Get(fm.WebhookSignatureHeader), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature: got %q, want %q", got, want)
+	}
+
+	if got := req.Header.Get(fm.WebhookEventHeader); got != "after_upload" {
+		t.Errorf("event: %q", got)
+	}
+
+	if got := unsigned.requests[0].Header.Get(fm.WebhookSignatureHeader); got != "" {
+		t.Errorf("the webhook without a secret was signed: %q", got)
+	}
+
+	for i, r := range []*receiver{signed, unsigned} {
+		id := i + 1
+		if got := r.requests[0].Header.Get(fm.WebhookDeliveryHeader); got != strconv.Itoa(id) {
+			t.Errorf("delivery header: got %q, want %d", got, id)
+		}
+
+		d := delivery(t, m, id)
+		if d.Status != fm.DeliveryDelivered || d.Attempts != 1 || d.StatusCode != r.status {
+			t.Errorf("delivery %d: %+v", id, d)
+		}
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	defer func(backoff, max time.Duration) {
+		fm.WebhookBackoff, fm.WebhookMaxBackoff = backoff, max
+	}(fm.WebhookBackoff, fm.WebhookMaxBackoff)
+
+	fm.WebhookBackoff, fm.WebhookMaxBackoff = time.Minute, 3*time.Minute
+
+	r := newReceiver(t, http.StatusInternalServerError)
+	m := newWebhookManager(&fm.Webhook{URL: r.URL})
+
+	upload(t, m, "/a.txt")
+
+	for attempt, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if attempt > 0 {
+			// It isn't sent again before its backoff.
+			m.DeliverWebhooks()
+			if r.count() != attempt {
+				t.Fatalf("sent %d times before the backoff, want %d", r.count(), attempt)
+			}
+
+			retryNow(t, m, 1)
+		}
+
+		m.DeliverWebhooks()
+
+		d := delivery(t, m, 1)
+		if d.Status != fm.DeliveryPending || d.Attempts != attempt+1 || d.StatusCode != http.StatusInternalServerError || d.Error == "" {
+			t.Fatalf("attempt %d: %+v", attempt+1, d)
+		}
+
+		if got := d.NextAttempt.Sub(d.Updated); got != backoff {
+			t.Errorf("attempt %d: backoff of %s, want %s", attempt+1, got, backoff)
+		}
+	}
+}
+
+func TestWebhookFailed(t *testing.T) {
+	defer func(attempts int) { fm.WebhookMaxAttempts = attempts }(fm.WebhookMaxAttempts)
+	fm.WebhookMaxAttempts = 3
+
+	r := newReceiver(t, http.StatusBadGateway)
+	m := newWebhookManager(&fm.Webhook{URL: r.URL})
+
+	upload(t, m, "/a.txt")
+
+	for i := 0; i < fm.WebhookMaxAttempts; i++ {
+		retryNow(t, m, 1)
+		m.DeliverWebhooks()
+	}
+
+	d := delivery(t, m, 1)
+	if d.Status != fm.DeliveryFailed || d.Attempts != 3 {
+		t.Fatalf("delivery after %d attempts: %+v", fm.WebhookMaxAttempts, d)
+	}
+
+	// The failed deliveries aren't tried anymore.
+	retryNow(t, m, 1)
+	m.DeliverWebhooks()
+	if r.count() != 3 {
+		t.Fatalf("a failed delivery was sent again")
+	}
+
+	r.setStatus(http.StatusOK)
+	if err := m.RedeliverWebhook(delivery(t, m, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := delivery(t, m, 1); d.Status != fm.DeliveryPending || d.Attempts != 0 {
+		t.Fatalf("redelivery: %+v", d)
+	}
+
+	m.DeliverWebhooks()
+
+	d = delivery(t, m, 1)
+	if d.Status != fm.DeliveryDelivered || d.Attempts != 1 || d.Error != "" {
+		t.Errorf("redelivered: %+v", d)
+	}
+
+	if r.count() != 4 {
+		t.Errorf("sent %d times, want 4", r.count())
+	}
+}
+
+func TestWebhookSlowReceiver(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	t.Cleanup(func() { close(release) })
+
+	fast := newReceiver(t, http.StatusOK)
+	m := newWebhookManager(&fm.Webhook{URL: slow.URL}, &fm.Webhook{URL: fast.URL})
+	m.WebhookClient.Timeout = 200 * time.Millisecond
+
+	for _, name := range []string{"/a.txt", "/b.txt", "/c.txt"} {
+		upload(t, m, name)
+	}
+
+	start := time.Now()
+	m.DeliverWebhooks()
+
+	// Sending them one after the other would wait for three timeouts.
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("the pass took %s", elapsed)
+	}
+
+	if fast.count() != 3 {
+		t.Errorf("the other receiver got %d webhooks, want 3", fast.count())
+	}
+
+	deliveries, _ := m.Store.Webhooks.Gets()
+	attempts := 0
+	for _, d := range deliveries {
+		if d.URL == slow.URL {
+			attempts += d.Attempts
+		}
+	}
+
+	if attempts != 1 {
+		t.Errorf("the slow receiver was tried %d times in the pass, want 1", attempts)
+	}
+}